@@ -72,6 +72,7 @@ type ConsoleModel struct {
 	promptTextStyle lipgloss.Style
 	err             error
 	commandCallback func(string)
+	keybindings     Keybindings
 }
 
 func NewConsoleModel(callback func(string)) ConsoleModel {
@@ -99,6 +100,7 @@ func NewConsoleModel(callback func(string)) ConsoleModel {
 		promptTextStyle: lipgloss.NewStyle().Foreground(lipgloss.Color("12")),
 		err:             nil,
 		commandCallback: callback,
+		keybindings:     DefaultKeybindings(),
 	}
 }
 
@@ -111,6 +113,12 @@ func (this *ConsoleModel) SetStyles(promptOutStyle, promptTextStyle lipgloss.Sty
 	this.promptTextStyle = promptTextStyle
 }
 
+// Set the keys used for console actions, e.g. submitting a prompt, these
+// should have been checked with Validate()
+func (this *ConsoleModel) SetKeybindings(keybindings Keybindings) {
+	this.keybindings = keybindings
+}
+
 func consoleChildSizes(width, height int) (int, int, int, int) {
 	taWidth := width
 	taHeight := 3
@@ -147,8 +155,10 @@ func (this ConsoleModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case tea.KeyCtrlC, tea.KeyEsc:
 			fmt.Println(this.textarea.Value())
 			return this, tea.Quit
+		}
 
-		case tea.KeyEnter:
+		if this.keybindings.Matches(KeyActionAskQuestion, msg.String()) {
+			passMsgOn = false
 			cmd := this.textarea.Value()
 			newLine := fmt.Sprintf("\n\n%s %s\n", this.promptOutStyle.Render(">"), this.promptTextStyle.Render(cmd))
 
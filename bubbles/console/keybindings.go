@@ -0,0 +1,191 @@
+package console
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// An action that can be bound to keys in the console or shell
+type KeyAction string
+
+const (
+	// Fill in the autosuggestion shown in the shell
+	KeyActionAcceptSuggestion KeyAction = "accept_suggestion"
+	// Clear the autosuggestion shown in the shell without filling it in
+	KeyActionRejectSuggestion KeyAction = "reject_suggestion"
+	// Submit the prompt typed in the console
+	KeyActionAskQuestion KeyAction = "ask_question"
+	// Explain and fix the last command if it failed, at an empty shell prompt
+	KeyActionFixCommand KeyAction = "fix_command"
+)
+
+var keyActions = []KeyAction{
+	KeyActionAcceptSuggestion,
+	KeyActionRejectSuggestion,
+	KeyActionAskQuestion,
+	KeyActionFixCommand,
+}
+
+// Keybindings maps each action to the keys that trigger it, keys are named
+// the way Bubble Tea names them, e.g. "tab", "enter", "ctrl+g", or a single
+// character. An action with no keys is disabled.
+type Keybindings map[KeyAction][]string
+
+// The bindings used unless configured otherwise. Rejecting a suggestion has
+// no key by default, suggestions are cleared by typing something else.
+func DefaultKeybindings() Keybindings {
+	return Keybindings{
+		KeyActionAcceptSuggestion: {"tab"},
+		KeyActionRejectSuggestion: {},
+		KeyActionAskQuestion:      {"enter"},
+		KeyActionFixCommand:       {"ctrl+g"},
+	}
+}
+
+// Keys that can't be bound because they're needed to interrupt or quit.
+// Escape also starts the sequences for arrow and other special keys.
+var reservedKeys = []string{"ctrl+c", "esc"}
+
+// Terminal input for the keys that can be bound other than single
+// characters, which are sent as themselves
+var namedKeySequences = map[string]string{
+	"tab":       "\t",
+	"enter":     "\r",
+	"esc":       "\x1b",
+	"space":     " ",
+	"backspace": "\x7f",
+	"up":        "\x1b[A",
+	"down":      "\x1b[B",
+	"right":     "\x1b[C",
+	"left":      "\x1b[D",
+}
+
+// KeySequence returns the bytes a terminal sends for a key name, e.g.
+// "\x07" for "ctrl+g", and false if the name isn't recognized
+func KeySequence(name string) ([]byte, bool) {
+	if seq, ok := namedKeySequences[name]; ok {
+		return []byte(seq), true
+	}
+
+	if strings.HasPrefix(name, "ctrl+") && len(name) == len("ctrl+")+1 {
+		c := name[len(name)-1]
+		if c >= 'a' && c <= 'z' {
+			return []byte{c - 'a' + 1}, true
+		}
+	}
+
+	if strings.HasPrefix(name, "alt+") && len(name) == len("alt+")+1 {
+		return []byte{0x1b, name[len(name)-1]}, true
+	}
+
+	if len(name) == 1 && name[0] > ' ' && name[0] < 0x7f {
+		return []byte(name), true
+	}
+
+	return nil, false
+}
+
+// ParseKeybindings applies overrides to the default bindings. Each override
+// maps an action name to a comma-separated list of keys, or to "none" to
+// disable the action. Unknown actions or keys, reserved keys, and keys bound
+// to more than one action are errors.
+func ParseKeybindings(overrides map[string]string) (Keybindings, error) {
+	bindings := DefaultKeybindings()
+
+	for name, value := range overrides {
+		action := KeyAction(strings.TrimSpace(name))
+		if _, ok := bindings[action]; !ok {
+			return nil, fmt.Errorf("Unknown key action %q, expected one of %s", name, actionNames())
+		}
+
+		keys := []string{}
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value != "none" {
+			for _, key := range strings.Split(value, ",") {
+				keys = append(keys, strings.TrimSpace(key))
+			}
+		}
+		bindings[action] = keys
+	}
+
+	err := bindings.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+// Validate checks that every key is recognized, not reserved, and bound to
+// at most one action. Keys are compared by what the terminal sends, so
+// e.g. "ctrl+i" conflicts with "tab".
+func (this Keybindings) Validate() error {
+	actions := make([]string, 0, len(this))
+	for action := range this {
+		actions = append(actions, string(action))
+	}
+	sort.Strings(actions)
+
+	type binding struct {
+		key    string
+		action KeyAction
+	}
+	bound := map[string]binding{}
+
+	for _, name := range actions {
+		action := KeyAction(name)
+		for _, key := range this[action] {
+			for _, reserved := range reservedKeys {
+				if key == reserved {
+					return fmt.Errorf("Key %s is reserved and can't be bound to %s", key, action)
+				}
+			}
+
+			seq, ok := KeySequence(key)
+			if !ok {
+				return fmt.Errorf("Unknown key %q bound to %s", key, action)
+			}
+
+			if other, ok := bound[string(seq)]; ok && other.action != action {
+				if other.key != key {
+					return fmt.Errorf("Keys %s and %s are the same to the terminal, they can't be bound to both %s and %s",
+						other.key, key, other.action, action)
+				}
+				return fmt.Errorf("Key %s is bound to both %s and %s", key, other.action, action)
+			}
+			bound[string(seq)] = binding{key, action}
+		}
+	}
+
+	return nil
+}
+
+// True if the key, named as in Bubble Tea, is bound to the action
+func (this Keybindings) Matches(action KeyAction, key string) bool {
+	for _, bound := range this[action] {
+		if bound == key {
+			return true
+		}
+	}
+	return false
+}
+
+// If data starts with a key bound to the action then return the length of
+// that key's sequence, otherwise 0. Used to match raw terminal input.
+func (this Keybindings) MatchPrefix(action KeyAction, data []byte) int {
+	for _, key := range this[action] {
+		seq, ok := KeySequence(key)
+		if ok && len(data) >= len(seq) && string(data[:len(seq)]) == string(seq) {
+			return len(seq)
+		}
+	}
+	return 0
+}
+
+func actionNames() string {
+	names := make([]string, len(keyActions))
+	for i, action := range keyActions {
+		names[i] = string(action)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,78 @@
+package console
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultKeybindings(t *testing.T) {
+	bindings, err := ParseKeybindings(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultKeybindings(), bindings)
+
+	assert.True(t, bindings.Matches(KeyActionAskQuestion, "enter"))
+	assert.Equal(t, 1, bindings.MatchPrefix(KeyActionAcceptSuggestion, []byte("\tls")))
+	assert.Equal(t, 1, bindings.MatchPrefix(KeyActionFixCommand, []byte{0x07}))
+	assert.Equal(t, 0, bindings.MatchPrefix(KeyActionRejectSuggestion, []byte("\x1b")))
+}
+
+func TestParseKeybindings(t *testing.T) {
+	bindings, err := ParseKeybindings(map[string]string{
+		"fix_command":       "Ctrl+X",
+		"reject_suggestion": "alt+r, ctrl+]",
+		"accept_suggestion": "tab,right",
+		"ask_question":      "none",
+	})
+
+	// ctrl+] isn't a key we know
+	assert.ErrorContains(t, err, `Unknown key "ctrl+]" bound to reject_suggestion`)
+	assert.Nil(t, bindings)
+
+	bindings, err = ParseKeybindings(map[string]string{
+		"fix_command":       "Ctrl+X",
+		"reject_suggestion": "alt+r, ctrl+y",
+		"accept_suggestion": "tab,right",
+		"ask_question":      "none",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ctrl+x"}, bindings[KeyActionFixCommand])
+	assert.Equal(t, []string{"alt+r", "ctrl+y"}, bindings[KeyActionRejectSuggestion])
+	assert.Empty(t, bindings[KeyActionAskQuestion])
+
+	assert.Equal(t, 1, bindings.MatchPrefix(KeyActionFixCommand, []byte{0x18}))
+	assert.Equal(t, 0, bindings.MatchPrefix(KeyActionFixCommand, []byte{0x07}))
+	assert.Equal(t, 2, bindings.MatchPrefix(KeyActionRejectSuggestion, []byte("\x1br")))
+	assert.Equal(t, 3, bindings.MatchPrefix(KeyActionAcceptSuggestion, []byte("\x1b[C")))
+	assert.False(t, bindings.Matches(KeyActionAskQuestion, "enter"))
+
+	_, err = ParseKeybindings(map[string]string{"launch_rockets": "ctrl+r"})
+	assert.ErrorContains(t, err, `Unknown key action "launch_rockets"`)
+}
+
+func TestKeybindingConflicts(t *testing.T) {
+	// the default fix key is already taken
+	_, err := ParseKeybindings(map[string]string{"accept_suggestion": "ctrl+g"})
+	assert.ErrorContains(t, err, "Key ctrl+g is bound to both accept_suggestion and fix_command")
+
+	// moving the other binding out of the way resolves it
+	_, err = ParseKeybindings(map[string]string{
+		"accept_suggestion": "ctrl+g",
+		"fix_command":       "ctrl+x",
+	})
+	assert.NoError(t, err)
+
+	// ctrl+i is what the terminal sends for tab
+	_, err = ParseKeybindings(map[string]string{"reject_suggestion": "ctrl+i"})
+	assert.ErrorContains(t, err, "Keys tab and ctrl+i are the same to the terminal")
+
+	// binding a key twice to the same action is fine
+	_, err = ParseKeybindings(map[string]string{"accept_suggestion": "tab,ctrl+i"})
+	assert.NoError(t, err)
+
+	// keys needed to interrupt and quit can't be bound
+	_, err = ParseKeybindings(map[string]string{"fix_command": "ctrl+c"})
+	assert.ErrorContains(t, err, "Key ctrl+c is reserved")
+	_, err = ParseKeybindings(map[string]string{"reject_suggestion": "esc"})
+	assert.ErrorContains(t, err, "Key esc is reserved")
+}
@@ -44,3 +44,46 @@ func TestPrettyHexExamples(t *testing.T) {
 		prettyHex(hexBytes, 80)
 	}
 }
+
+func TestApplyANSIMode(t *testing.T) {
+	// colored ls output followed by a compiler error with redundant codes and
+	// a progress line using cursor movement
+	sample := "\x1b[32mfoo.txt\x1b[0m  bar.txt\n" +
+		"\x1b[0m\x1b[1m\x1b[31merror\x1b[0m\x1b[0m: \x1b[31mbad\x1b[31m thing\x1b[m\n" +
+		"\x1b[2K\x1b[1Gprogress\x1b[?25l 50%\x1b[31m\x1b[0m done"
+
+	assert.Equal(t,
+		"foo.txt  bar.txt\nerror: bad thing\nprogress 50% done",
+		ApplyANSIMode(sample, ANSIStrip))
+
+	assert.Equal(t, sample, ApplyANSIMode(sample, ANSIPreserve))
+
+	assert.Equal(t,
+		"\x1b[32mfoo.txt\x1b[0m  bar.txt\n"+
+			"\x1b[1;31merror\x1b[0m: \x1b[31mbad thing\x1b[0m\n"+
+			"progress 50% done",
+		ApplyANSIMode(sample, ANSINormalize))
+
+	// normalizing is idempotent
+	normalized := ApplyANSIMode(sample, ANSINormalize)
+	assert.Equal(t, normalized, ApplyANSIMode(normalized, ANSINormalize))
+
+	// a reset with empty parameters, as zsh prints
+	assert.Equal(t, "\x1b[32mok\x1b[0m", ApplyANSIMode("\x1b[;m\x1b[32mok\x1b[;m\x1b[m", ANSINormalize))
+}
+
+func TestSanitizeTTYStringMode(t *testing.T) {
+	data := "a\x07b \x1b[31mred\x1b[0m\r\n"
+
+	assert.Equal(t, "ab red\n", sanitizeTTYStringMode(data, ANSIStrip))
+	// control characters are removed but escape sequences kept
+	assert.Equal(t, "ab \x1b[31mred\x1b[0m\n", sanitizeTTYStringMode(data, ANSIPreserve))
+	assert.Equal(t, "ab \x1b[31mred\x1b[0m\n", sanitizeTTYStringMode(data, ANSINormalize))
+
+	mode, err := ParseANSIMode("Normalize")
+	assert.NoError(t, err)
+	assert.Equal(t, ANSINormalize, mode)
+	assert.Equal(t, "normalize", mode.String())
+	_, err = ParseANSIMode("rainbow")
+	assert.Error(t, err)
+}
@@ -6,21 +6,24 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/creack/pty"
+	"github.com/joho/godotenv"
 	"github.com/mitchellh/go-homedir"
 	"golang.org/x/term"
 
+	"github.com/bakks/butterfish/bubbles/console"
 	"github.com/bakks/butterfish/embedding"
 	"github.com/bakks/butterfish/prompt"
 	"github.com/bakks/butterfish/util"
@@ -40,25 +43,143 @@ type ButterfishConfig struct {
 	// 2 = very verbose output
 	Verbose int
 
+	// Minimum level of log messages to write: debug, info, warn, or error.
+	// If empty then verbose mode logs at debug and otherwise info.
+	LogLevel string
+
 	// build variables
 	BuildInfo string
 
 	// OpenAI private token, should start with "sk-".
 	// Found at https://platform.openai.com/account/api-keys
-	OpenAIToken  string
-	BaseURL      string
-	TokenTimeout time.Duration // how long to wait for a token before timing out
+	// If not set then we look in the environment and then CredentialsPath,
+	// see ResolveOpenAIToken.
+	OpenAIToken     string
+	CredentialsPath string
+	EnvFile         string        // per-project .env file loaded before the LLM client is created if set, see LoadEnvFile
+	BaseURL         string        // OpenAI-compatible API, e.g. a proxy or local server
+	TokenTimeout    time.Duration // how long to wait for a token before timing out
+	RequestTimeout  time.Duration // deadline for a whole LLM request, 0 for none
+
+	// If no token is found then a first-run setup prompt asks for a provider
+	// and token, reading from SetupIn and writing to SetupOut, see
+	// PromptLLMSetup. They default to stdin and stdout, and if SetupIn isn't
+	// set and stdin isn't a terminal then there's no prompt.
+	SetupIn  io.Reader
+	SetupOut io.Writer
+
+	// Where gencmd reads whether to run or copy the command it generated,
+	// defaults to stdin. If it isn't set and stdin or stdout isn't a
+	// terminal, e.g. the description was piped in or the output is piped
+	// elsewhere, the command is only printed.
+	ConfirmIn io.Reader
+
+	// Limits on calls to the OpenAI API, requests block until there's
+	// capacity, 0 means unlimited
+	RequestsPerMinute int
+	TokensPerMinute   int
+
+	// Limits on each embeddings request, larger inputs are split into
+	// batches with up to EmbeddingBatchWorkers requested at once. 0 uses
+	// the API's limits and one batch at a time, see GPT.Embeddings.
+	EmbeddingBatchSize    int
+	EmbeddingBatchTokens  int
+	EmbeddingBatchWorkers int
+
+	// If set then this is called after each successful LLM request with the
+	// model, feature, tokens used, and latency, e.g. to track spending
+	UsageCallback func(UsageEvent)
+
+	// If AzureEndpoint is set then requests go to that Azure OpenAI resource
+	// rather than BaseURL, routed to deployments rather than models. See
+	// azureDeploymentMapper for the AzureDeployment format, AzureAPIVersion
+	// defaults to DefaultAzureAPIVersion.
+	AzureEndpoint   string
+	AzureDeployment string
+	AzureAPIVersion string
 
 	// LLM API communication client that implements the LLM interface
 	LLMClient LLM
 
-	// Color scheme to use for the shell, see GruvboxDark below
+	// Base URL of an OpenAI-compatible API that calls fall back to when the
+	// primary API is unavailable, e.g. a local model, empty for none. The
+	// OpenAI token isn't sent to it unless it's OpenAI's API. Any
+	// FallbackLLMClients are tried after it.
+	FallbackBaseURL    string
+	FallbackLLMClients []LLM
+
+	// Wrapped around the LLM client, including any fallbacks, to add
+	// behavior like logging or caching to every call, see Chain
+	LLMMiddlewares []LLMMiddleware
+
+	// If ResponseCacheEntries is more than 0 then responses to identical
+	// completion requests are reused for up to ResponseCacheTTL (0 means
+	// forever) rather than calling the LLM again, see CompletionCache. If
+	// ResponseCachePath is set then the cache is kept there between runs.
+	ResponseCacheEntries int
+	ResponseCacheTTL     time.Duration
+	ResponseCachePath    string
+
+	// Model used for requests that don't set one, features can override this
+	// per request, e.g. a cheap model for autosuggest
+	DefaultModel string
+
+	// Sampling defaults from the environment, if set with SamplingEnv.Apply,
+	// used to fill in command flags that aren't given explicitly
+	SamplingEnv *SamplingEnv
+	// Defaults from the project's .butterfish.yaml, if set with
+	// ProjectConfig.Apply, used after SamplingEnv to fill in command flags
+	ProjectConfig *ProjectConfig
+
+	// Model used to calculate embeddings for the index. The index records it
+	// and embeds files again rather than mixing vectors from two models.
+	EmbeddingModel string
+
+	// Optional function returning the tokenizer for a model, used to trim
+	// history and snippets to the model's context window. Set this for
+	// backends that don't use OpenAI's encodings. If nil then tiktoken is used.
+	TokenizerForModel func(model string) (Tokenizer, error)
+
+	// Color scheme to use for the shell, see GruvboxDark below. Defaults to
+	// DetectColorScheme(), set this and Styles to override.
 	ColorScheme *ColorScheme
+	// Optional YAML or JSON file to load the color scheme from, replaces
+	// ColorScheme and Styles when the Butterfish context is created
+	ColorSchemePath string
 
 	// A list of context-specific styles drawn from the colorscheme
 	// These are what should actually be used during rendering
 	Styles *styles
 
+	// If true then output is printed without colors or other ANSI codes, e.g.
+	// when piping to a file. Defaults to true if stdout isn't a terminal. Use
+	// SetPlainOutput and SetColorScheme to keep Styles in sync.
+	PlainOutput bool
+
+	// If set then text printed with a style, e.g. by StylePrintf, is sent here
+	// as the style's name and the unstyled text rather than written to Out
+	// with ANSI codes, e.g. to render output in a GUI
+	OutputSink OutputSink
+
+	// If set then the raw text of answers streamed by commands, e.g. prompt
+	// and question, is copied here as it's displayed, before any styling,
+	// e.g. to log answers to a file
+	StreamTee io.Writer
+
+	// Answers streamed by commands are displayed at most this many
+	// characters per second so that a very fast stream doesn't flood the
+	// terminal, see util.ThrottledWriter. 0 means no limit.
+	StreamCharsPerSecond int
+
+	// How command results are printed, OutputFormatText for styled text or
+	// OutputFormatJSON for a single JSON object that scripts can parse.
+	// Currently used by indexquestion.
+	OutputFormat string
+
+	// Keys bound to actions in the shell and console, e.g. accepting an
+	// autosuggestion, see console.ParseKeybindings
+	Keybindings console.Keybindings
+
 	// Path of yaml file from which to load LLM prompts
 	// Defaults to ~/.config/butterfish/prompts.yaml
 	PromptLibraryPath string
@@ -67,6 +188,23 @@ type ButterfishConfig struct {
 	// calling the LLM
 	PromptLibrary PromptLibrary
 
+	// If set then prompts are fetched from this URL, serving a library in the
+	// same yaml format, and the library at PromptLibraryPath is only used for
+	// prompts the URL doesn't serve or when it can't be fetched. Fetched
+	// prompts are rechecked after PromptLibraryTTL.
+	PromptLibraryURL string
+	PromptLibraryTTL time.Duration
+
+	// If true then the prompt library file is watched and reloaded when it
+	// changes, so edited prompts are used without restarting
+	PromptLibraryWatch bool
+
+	// Text added before and after every user prompt from the prompt library,
+	// after its fields are filled in, e.g. standing instructions for the LLM.
+	// System messages and function output aren't wrapped.
+	GlobalPromptPrefix string
+	GlobalPromptSuffix string
+
 	// Shell mode configuration
 	ShellMode               bool
 	ShellPluginMode         bool
@@ -76,6 +214,14 @@ type ButterfishConfig struct {
 	ShellLeavePromptAlone   bool   // don't try to edit the shell prompt
 	ShellAutosuggestEnabled bool   // whether to use autosuggest
 	ShellAutosuggestModel   string // used when we're autocompleting a command
+	// Sampling for shell prompts (questions), goal mode, and autosuggest. A
+	// TopP of 0 leaves the API default.
+	ShellPromptTemperature      float32
+	ShellPromptTopP             float32
+	GoalModeTemperature         float32
+	GoalModeTopP                float32
+	ShellAutosuggestTemperature float32
+	ShellAutosuggestTopP        float32
 	// how long to wait between when the user stos typing and we ask for an
 	// autosuggest
 	ShellAutosuggestTimeout time.Duration
@@ -85,23 +231,161 @@ type ButterfishConfig struct {
 	ShellMaxHistoryBlockTokens int
 	// Maximum tokens for the response, reserved when calculating history and passed as max_tokens during inference
 	ShellMaxResponseTokens int
-
-	// Model, temp, and max tokens to use when executing the `gencmd` command
+	// Deadline for each autosuggest request, kept short since a late
+	// suggestion is useless
+	ShellAutosuggestRequestTimeout time.Duration
+	// Limits on the history included in autosuggest prompts, the oldest
+	// entries are evicted once either is exceeded, 0 means unbounded
+	ShellAutosuggestHistoryEntries int
+	ShellAutosuggestHistoryBytes   int
+	// If set, shell commands are appended to this file and recent ones are
+	// loaded into autosuggest history at startup, empty disables persistence
+	ShellHistoryPath string
+	// The history file is rotated once it reaches this size
+	ShellHistoryMaxBytes int64
+	// Lines of shell output where more than this fraction of the characters
+	// aren't printable are treated as binary data, e.g. from cat on an
+	// image, and left out of the history sent to the LLM. They're still
+	// shown in the terminal. 0 disables the check.
+	ShellBinaryThreshold float64
+	// If set, the wrapped shell marks where prompts, commands, and their
+	// output start and end so that only command output goes into history as
+	// output, see ShellIntegrationParser. Supported for bash and zsh.
+	ShellIntegration bool
+
+	// If set, record a transcript of the shell session (input, output, and
+	// LLM responses) to timestamped files in this directory
+	ShellRecordPath string
+	// How control codes are handled in the text transcript, the raw
+	// transcript always has them as they are
+	ShellRecordANSIMode ANSIMode
+
+	// In goal mode, print the commands the model proposes rather than running
+	// them, the model is told each command succeeded
+	GoalModeDryRun bool
+	// In goal mode, ask the user before running each command the model
+	// proposes, they can run it, skip it, or edit it first
+	GoalModeConfirm bool
+	// Maximum number of model responses goal mode acts on before giving up on
+	// the goal, 0 means no limit
+	GoalModeMaxSteps int
+	// Command output given back to the model in goal mode is truncated to
+	// this many bytes, 0 means no limit
+	GoalModeMaxOutputBytes int
+	// If set, goal mode saves its progress to a session file in this
+	// directory so that it can be resumed, empty disables sessions
+	GoalModeSessionPath string
+	// Name of a saved goal mode session to resume when the shell starts
+	GoalModeResume string
+	// Regex patterns matched against commands goal mode proposes. Commands
+	// matching a deny pattern are refused, and if allow patterns are set then
+	// commands must match one of them. Defaults to DefaultGoalModeDenyPatterns.
+	GoalModeAllowPatterns []string
+	GoalModeDenyPatterns  []string
+
+	// Patterns watched for in the wrapped shell's output, e.g. "command not
+	// found", and the action taken when a line matches. Each watcher fires
+	// at most once per WatcherDebounce.
+	Watchers        []Watcher
+	WatcherDebounce time.Duration
+
+	// Model, sampling, and max tokens to use when executing the `gencmd` command
 	GencmdModel       string
 	GencmdTemperature float32
+	GencmdTopP        float32
 	GencmdMaxTokens   int
 
-	// Model, temp, and max tokens to use when executing the `exec` command
+	// Model, sampling, and max tokens to use when executing the `exec` command
 	ExeccheckModel       string
 	ExeccheckTemperature float32
+	ExeccheckTopP        float32
 	ExeccheckMaxTokens   int
 
-	// Model, temp, and max tokens to use when executing the `summarize` command
+	// Output of the failed command given to the model when asking for a fix,
+	// by the `exec` command and in shell mode, is truncated to this many
+	// bytes by cutting out the middle, 0 means no limit
+	FixCommandMaxOutputBytes int
+
+	// Regex patterns for secrets, e.g. API keys, replaced with [REDACTED] in
+	// terminal history and command output before they're sent to the model.
+	// Defaults to DefaultRedactPatterns, empty disables redaction.
+	RedactPatterns []string
+
+	// How long answers to indexquestion and command fixes should be, adjusts
+	// their system message and max tokens
+	AnswerVerbosity Verbosity
+
+	// Model, sampling, and max tokens to use when executing the `summarize` command
 	SummarizeModel       string
 	SummarizeTemperature float32
+	SummarizeTopP        float32
 	SummarizeMaxTokens   int
+
+	// Number of index snippets given to the LLM by the `indexquestion`
+	// command, and the cosine similarity they must score to be included.
+	// Raising the threshold trades recall for precision and fewer tokens.
+	// With no maximum (0) the best matches are packed in until the model's
+	// context window is full.
+	QuestionMaxSnippets   int
+	QuestionMinSimilarity float64
+	// Tokens of the context window held back for the answer when packing
+	// snippets, the answer's max tokens are held back if that's more
+	QuestionReserveTokens int
+
+	// Whether the embedding index reads and writes its cache files, e.g. read
+	// only for an index on a shared filesystem
+	IndexCacheMode embedding.CacheMode
+
+	// Search the embedding index in shards of this many directories, merging
+	// the best of each, with up to IndexShardWorkers at once. 0 searches it
+	// as one. With IndexLazyLoad cache files are only read when a search
+	// reaches them, bounding memory for very large corpora.
+	IndexShardSize    int
+	IndexShardWorkers int
+	IndexLazyLoad     bool
+
+	// Search the embedding index approximately with an HNSW graph once it
+	// holds at least IndexANNThreshold vectors, 0 always searches exactly.
+	// IndexANNEfSearch trades speed for recall, 0 uses the default.
+	IndexANNThreshold int
+	IndexANNEfSearch  int
+
+	// If set, embeddings are also kept in a content-addressed store in this
+	// directory shared by every index, so identical files in different
+	// projects are only embedded once, see embedding.SharedEmbeddingCache
+	IndexSharedCachePath string
+
+	// Name of the embedding index namespace, so that separate projects
+	// don't share embeddings. Empty is the default namespace, and
+	// IndexNamespaceAuto names it after the current directory.
+	IndexNamespace string
+
+	// While indexing, save the files embedded so far after this long without
+	// another file finishing or once this many are waiting, so that they
+	// aren't lost if the process is killed. 0 disables either.
+	IndexAutoSaveInterval  time.Duration
+	IndexAutoSaveThreshold int
+
+	// If set then only files with these extensions, e.g. ".go", are indexed,
+	// and questions are only answered from files in IndexLanguages, e.g.
+	// "go", see embedding.DetectLanguage
+	IndexExtensions []string
+	IndexLanguages  []string
+
+	// Directories skipped when indexing or summarizing a directory, in
+	// addition to embedding.DefaultIgnoreDirs
+	IndexIgnoreDirs []string
+
+	// Features set to false here are turned off, their entry points do
+	// nothing rather than calling the LLM. See ToggleableFeatures for the
+	// names, features that aren't listed stay enabled.
+	Features map[string]bool
 }
 
+// Name the index namespace after the current directory, see
+// embedding.NamespaceForPath
+const IndexNamespaceAuto = "auto"
+
 func (this *ButterfishConfig) ParseShell() string {
 	fields := strings.Split(this.ShellBinary, "/")
 	lastField := fields[len(fields)-1]
@@ -118,6 +402,16 @@ type PromptLibrary interface {
 	// have a corresponding variable, an error is returned.
 	GetPrompt(name string, args ...string) (string, error)
 
+	// Get a prompt by name, filling in variables by name from the fields map,
+	// e.g. GetPromptFields("greeting", map[string]string{"name": "Peter"}).
+	// Missing or unknown fields are an error.
+	GetPromptFields(name string, fields map[string]string) (string, error)
+
+	// The same as GetPrompt and GetPromptFields, but the result is wrapped in
+	// the given prefix and suffix instead of the library's global ones
+	GetPromptWrapped(name, prefix, suffix string, args ...string) (string, error)
+	GetPromptFieldsWrapped(name, prefix, suffix string, fields map[string]string) (string, error)
+
 	GetUninterpolatedPrompt(name string) (string, error)
 	InterpolatePrompt(prompt string, args ...string) (string, error)
 }
@@ -128,6 +422,123 @@ type LLM interface {
 	CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error)
 	Completion(request *util.CompletionRequest) (*util.CompletionResponse, error)
 	Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error)
+	// List the models this backend serves, e.g. to present a model picker or
+	// find a model's context window
+	Models(ctx context.Context) ([]ModelInfo, error)
+}
+
+// Implemented by LLMs that can generate several candidate completions in
+// one request, see CompletionN
+type MultiCompletionLLM interface {
+	CompletionN(request *util.CompletionRequest) ([]string, error)
+}
+
+// Generate request.N candidate completions, e.g. alternative autosuggestions
+// to cycle through. LLMs that implement MultiCompletionLLM are asked once,
+// others are called N times. Empty and duplicate candidates are removed, so
+// fewer than N may be returned.
+func CompletionN(llm LLM, request *util.CompletionRequest) ([]string, error) {
+	if multi, ok := llm.(MultiCompletionLLM); ok {
+		return multi.CompletionN(request)
+	}
+
+	n := request.N
+	if n < 1 {
+		n = 1
+	}
+
+	completions := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		response, err := llm.Completion(request)
+		if err != nil {
+			return nil, err
+		}
+		completions = append(completions, response.Completion)
+	}
+
+	return dedupCompletions(completions), nil
+}
+
+// Tokens used by a request, see util.CompletionResponse
+type CompletionUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+	// Set if the counts were estimated rather than reported by the API, e.g.
+	// for streamed responses
+	Estimated bool
+}
+
+func (this CompletionUsage) TotalTokens() int {
+	return this.PromptTokens + this.CompletionTokens
+}
+
+// A completion along with why the model stopped and the tokens it used, see
+// CompletionDetailed
+type CompletionResult struct {
+	Text string
+	// e.g. util.FinishReasonStop or util.FinishReasonLength, empty if the
+	// backend didn't say
+	FinishReason string
+	Usage        CompletionUsage
+}
+
+// True if the model was cut off by the token limit rather than finishing,
+// so Text may be incomplete
+func (this *CompletionResult) Truncated() bool {
+	return this.FinishReason == util.FinishReasonLength
+}
+
+// Complete a request like llm.Completion, returning the text with its finish
+// reason and usage, e.g. so that a feature can tell whether the answer was
+// cut off by max tokens. Works with any LLM and middleware since the details
+// are carried on util.CompletionResponse.
+func CompletionDetailed(llm LLM, request *util.CompletionRequest) (*CompletionResult, error) {
+	response, err := llm.Completion(request)
+	if err != nil {
+		return nil, err
+	}
+	return newCompletionResult(response), nil
+}
+
+// Like CompletionDetailed, but the text is streamed to writer as it arrives
+func CompletionStreamDetailed(llm LLM, request *util.CompletionRequest, writer io.Writer) (*CompletionResult, error) {
+	response, err := llm.CompletionStream(request, writer)
+	if err != nil {
+		return nil, err
+	}
+	return newCompletionResult(response), nil
+}
+
+func newCompletionResult(response *util.CompletionResponse) *CompletionResult {
+	return &CompletionResult{
+		Text:         response.Completion,
+		FinishReason: response.FinishReason,
+		Usage: CompletionUsage{
+			PromptTokens:     response.PromptTokens,
+			CompletionTokens: response.CompletionTokens,
+			Estimated:        response.UsageEstimated,
+		},
+	}
+}
+
+// Remove empty and repeated completions, keeping the first of each in order
+func dedupCompletions(completions []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, completion := range completions {
+		if completion == "" || seen[completion] {
+			continue
+		}
+		seen[completion] = true
+		unique = append(unique, completion)
+	}
+	return unique
+}
+
+// A structured destination for styled output. WriteStyled is called with the
+// name of a style, e.g. StyleError, and the text to show in that style.
+type OutputSink interface {
+	WriteStyled(style, text string)
 }
 
 type ButterfishCtx struct {
@@ -150,6 +561,26 @@ type ButterfishCtx struct {
 	CommandRegister string
 	// embedding index for searching local files
 	VectorIndex embedding.FileEmbeddingIndex
+	// filter applied to commands before goal mode runs them
+	CommandFilter *CommandFilter
+	// removes secrets from context sent to the model
+	Redactor *Redactor
+	// leveled logger, writes to the standard logger output
+	Log *util.Logger
+
+	// restores the terminal put in raw mode by RunShell if a goroutine
+	// panics, nil otherwise
+	terminal *terminalGuard
+
+	// models reported by modelsClient, cached by listModels
+	models       []ModelInfo
+	modelsClient LLM
+	modelsMutex  sync.Mutex
+
+	// resources released by Close, e.g. a shell's transcript recorder
+	closers    []io.Closer
+	closeMutex sync.Mutex
+	closed     bool
 }
 
 type ColorScheme struct {
@@ -195,13 +626,30 @@ var GruvboxLight = ColorScheme{
 
 const BestCompletionModel = "gpt-3.5-turbo"
 
+// Reports whether stdout is a terminal, a variable so tests can override it
+// Values for ButterfishConfig.OutputFormat
+const (
+	OutputFormatText = "text"
+	OutputFormatJSON = "json"
+)
+
+var stdoutIsTerminal = func() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
 func MakeButterfishConfig() *ButterfishConfig {
-	colorScheme := &GruvboxDark
+	colorScheme := DetectColorScheme()
+	plainOutput := !stdoutIsTerminal()
 
 	return &ButterfishConfig{
 		Verbose:              0,
 		ColorScheme:          colorScheme,
-		Styles:               ColorSchemeToStyles(colorScheme),
+		Styles:               stylesFor(colorScheme, plainOutput),
+		PlainOutput:          plainOutput,
+		OutputFormat:         OutputFormatText,
+		DefaultModel:         BestCompletionModel,
+		EmbeddingModel:       string(GPTEmbeddingsModel),
+		CredentialsPath:      DefaultCredentialsPath,
 		GencmdModel:          BestCompletionModel,
 		GencmdTemperature:    0.6,
 		GencmdMaxTokens:      512,
@@ -211,6 +659,35 @@ func MakeButterfishConfig() *ButterfishConfig {
 		SummarizeModel:       BestCompletionModel,
 		SummarizeTemperature: 0.7,
 		SummarizeMaxTokens:   1024,
+		RequestTimeout:       2 * time.Minute,
+		Keybindings:          console.DefaultKeybindings(),
+
+		// by default every snippet found is passed along
+		QuestionMaxSnippets:   0,
+		QuestionMinSimilarity: -1,
+
+		IndexAutoSaveInterval:  embedding.DefaultAutoSaveInterval,
+		IndexAutoSaveThreshold: embedding.DefaultAutoSaveThreshold,
+
+		// commands should be predictable, questions can be more creative
+		ShellPromptTemperature:         0.7,
+		GoalModeTemperature:            0.6,
+		ShellAutosuggestTemperature:    0.2,
+		ShellAutosuggestRequestTimeout: 5 * time.Second,
+		ShellAutosuggestHistoryEntries: 64,
+		ShellAutosuggestHistoryBytes:   4096,
+		ShellHistoryMaxBytes:           1024 * 1024,
+		ShellBinaryThreshold:           0.3,
+		ShellRecordANSIMode:            ANSIPreserve,
+
+		GoalModeMaxSteps:       30,
+		GoalModeMaxOutputBytes: 4096,
+		GoalModeDenyPatterns:   append([]string{}, DefaultGoalModeDenyPatterns...),
+
+		WatcherDebounce: DefaultWatcherDebounce,
+
+		FixCommandMaxOutputBytes: 4096,
+		RedactPatterns:           append([]string{}, DefaultRedactPatterns...),
 	}
 }
 
@@ -247,6 +724,58 @@ func filterNonPrintable(s string) string {
 	}, s)
 }
 
+// Replaces binary data in shell history, see filterBinaryOutput
+const binaryOutputNote = "[binary output omitted]\n"
+
+// Replace lines of output that look like binary data, those where more than
+// threshold of the characters aren't printable once ANSI codes are removed,
+// with binaryOutputNote. A run of binary lines gets one note. inBinary is
+// whether earlier output ended in binary, so that a burst split across reads
+// isn't noted twice, and the returned bool is the same for this output. A
+// threshold of 0 or less returns data unchanged.
+func filterBinaryOutput(data string, threshold float64, inBinary bool) (string, bool) {
+	if threshold <= 0 {
+		return data, false
+	}
+
+	var builder strings.Builder
+	for _, line := range strings.SplitAfter(data, "\n") {
+		if line == "" {
+			continue
+		}
+		if !looksBinary(line, threshold) {
+			builder.WriteString(line)
+			inBinary = false
+			continue
+		}
+		if !inBinary {
+			builder.WriteString(binaryOutputNote)
+		}
+		inBinary = true
+	}
+
+	return builder.String(), inBinary
+}
+
+// True if more than threshold of the characters in line, with ANSI codes
+// removed, are invalid UTF-8 or neither printable nor whitespace
+func looksBinary(line string, threshold float64) bool {
+	text := stripANSI(line)
+	total := 0
+	nonPrintable := 0
+
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		text = text[size:]
+		total++
+		if (r == utf8.RuneError && size <= 1) || (!unicode.IsPrint(r) && !unicode.IsSpace(r)) {
+			nonPrintable++
+		}
+	}
+
+	return total > 0 && float64(nonPrintable)/float64(total) > threshold
+}
+
 func sanitizeTTYData(data []byte) []byte {
 	return []byte(filterNonPrintable(stripANSI(string(data))))
 }
@@ -255,7 +784,139 @@ func sanitizeTTYString(data string) string {
 	return filterNonPrintable(stripANSI(data))
 }
 
-func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.File, func() error, error) {
+// How ANSI control codes are handled when sanitizing terminal output
+type ANSIMode int
+
+const (
+	// Remove all control codes, used for prompt context
+	ANSIStrip ANSIMode = iota
+	// Keep control codes as they are
+	ANSIPreserve
+	// Keep only color and style (SGR) codes, dropping cursor movement and
+	// the like, and collapse redundant color codes
+	ANSINormalize
+)
+
+var ansiModeNames = []string{"strip", "preserve", "normalize"}
+
+func (this ANSIMode) String() string {
+	if int(this) < len(ansiModeNames) {
+		return ansiModeNames[this]
+	}
+	return fmt.Sprintf("ANSIMode(%d)", int(this))
+}
+
+func ParseANSIMode(name string) (ANSIMode, error) {
+	for i, modeName := range ansiModeNames {
+		if strings.EqualFold(name, modeName) {
+			return ANSIMode(i), nil
+		}
+	}
+	return ANSIStrip, fmt.Errorf("Unknown ANSI mode %q, expected strip, preserve, or normalize", name)
+}
+
+// Matches a Select Graphic Rendition sequence, i.e. colors and text style
+var sgrRegexp = regexp.MustCompile("^\x1b\\[([0-9;]*)m$")
+
+// Apply mode to the control codes in str, text between them is left alone
+func ApplyANSIMode(str string, mode ANSIMode) string {
+	switch mode {
+	case ANSIStrip:
+		return stripANSI(str)
+	case ANSINormalize:
+		return normalizeANSI(str)
+	default:
+		return str
+	}
+}
+
+// Drop control codes other than SGR and collapse each run of adjacent SGR
+// codes into one, skipping codes made redundant by a reset in the same run,
+// codes that repeat the last one written, and resets when no style is set
+func normalizeANSI(str string) string {
+	var builder strings.Builder
+	run := []string{}
+	lastWritten := ""
+	styled := false
+
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+
+		params := []string{}
+		for _, param := range run {
+			if strings.Trim(param, "0;") == "" {
+				// a reset, e.g. ESC[m or ESC[0m, undoes everything before it
+				params = []string{"0"}
+			} else if len(params) == 0 || params[len(params)-1] != param {
+				params = append(params, param)
+			}
+		}
+		run = run[:0]
+		if len(params) > 1 && params[0] == "0" && !styled {
+			// nothing to reset
+			params = params[1:]
+		}
+
+		isReset := len(params) == 1 && params[0] == "0"
+		seq := "\x1b[" + strings.Join(params, ";") + "m"
+		if (isReset && !styled) || seq == lastWritten {
+			return
+		}
+
+		builder.WriteString(seq)
+		lastWritten = seq
+		styled = !isReset
+	}
+
+	last := 0
+	for _, loc := range ansiRegexp.FindAllStringIndex(str, -1) {
+		if loc[0] > last {
+			flush()
+			builder.WriteString(str[last:loc[0]])
+		}
+		last = loc[1]
+
+		match := sgrRegexp.FindStringSubmatch(str[loc[0]:loc[1]])
+		if match != nil {
+			run = append(run, match[1])
+		}
+	}
+
+	if last < len(str) {
+		flush()
+		builder.WriteString(str[last:])
+	}
+	flush()
+
+	return builder.String()
+}
+
+// Sanitize terminal output, handling control codes according to mode and
+// removing other non-printable characters
+func sanitizeTTYStringMode(data string, mode ANSIMode) string {
+	if mode == ANSIStrip {
+		return sanitizeTTYString(data)
+	}
+
+	data = ApplyANSIMode(data, mode)
+
+	var builder strings.Builder
+	last := 0
+	for _, loc := range ansiRegexp.FindAllStringIndex(data, -1) {
+		builder.WriteString(filterNonPrintable(data[last:loc[0]]))
+		builder.WriteString(data[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	builder.WriteString(filterNonPrintable(data[last:]))
+
+	return builder.String()
+}
+
+// Start command in a pty and put stdin in raw mode. The returned guard
+// restores stdin and closes the pty, including if the resize handler panics.
+func ptyCommand(ctx context.Context, logger *util.Logger, envVars []string, command []string) (*os.File, *terminalGuard, error) {
 	// Create arbitrary command.
 	var cmd *exec.Cmd
 
@@ -276,62 +937,161 @@ func ptyCommand(ctx context.Context, envVars []string, command []string) (*os.Fi
 		return nil, nil, err
 	}
 
-	// Handle pty size.
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGWINCH)
-	go func() {
-		for range ch {
-			if err := pty.InheritSize(os.Stdin, ptmx); err != nil {
-				log.Printf("error resizing pty: %s", err)
-			}
-		}
-	}()
-	ch <- syscall.SIGWINCH // Initial resize.
-
 	// Set stdin in raw mode.
 	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
 	if err != nil {
 		ptmx.Close()
-		signal.Stop(ch)
-		close(ch)
 		return nil, nil, err
 	}
 
-	cleanup := func() error {
-		err := ptmx.Close()
-		if err != nil {
-			return err
-		}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+
+	guard := newTerminalGuard(func() error {
+		// restore the terminal first, it matters most if anything fails
+		restoreErr := term.Restore(int(os.Stdin.Fd()), oldState)
+		closeErr := ptmx.Close()
 
 		signal.Stop(ch)
 		close(ch)
 
-		return term.Restore(int(os.Stdin.Fd()), oldState)
-	}
+		if restoreErr != nil {
+			return restoreErr
+		}
+		return closeErr
+	})
 
-	return ptmx, cleanup, nil
+	// Handle pty size.
+	go func() {
+		defer guard.RecoverPanic()
+		for range ch {
+			if err := pty.InheritSize(os.Stdin, ptmx); err != nil {
+				logger.Warnf("Error resizing pty: %s", err)
+			}
+		}
+	}()
+	ch <- syscall.SIGWINCH // Initial resize.
+
+	return ptmx, guard, nil
 }
 
 func (this *ButterfishCtx) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
 	return this.LLMClient.Embeddings(ctx, content, this.Config.Verbose > 0)
 }
 
-// A local printf that writes to the butterfishctx out using a lipgloss style
-func (this *ButterfishCtx) StylePrintf(style lipgloss.Style, format string, a ...any) {
-	str := util.MultilineLipglossRender(style, fmt.Sprintf(format, a...))
+// A local printf that writes to the butterfishctx out using the named style,
+// e.g. StyleError, or without styling if PlainOutput is set. If an
+// OutputSink is configured then the unstyled text goes to it instead.
+func (this *ButterfishCtx) StylePrintf(style string, format string, a ...any) {
+	if this.Config.OutputSink != nil {
+		this.Config.OutputSink.WriteStyled(style, fmt.Sprintf(format, a...))
+		return
+	}
+
+	str := this.StyleSprintf(this.Config.Styles.Get(style), format, a...)
 	this.Out.Write([]byte(str))
 }
 
+// A writer for streamed output in the named style, it's styled and written
+// to Out, or sent to the OutputSink if one is configured
+func (this *ButterfishCtx) styleWriter(style string) io.Writer {
+	if this.Config.OutputSink != nil {
+		return &sinkWriter{Sink: this.Config.OutputSink, Style: style}
+	}
+	return util.NewStyledWriter(this.Out, this.Config.Styles.Get(style))
+}
+
+// Adapts an OutputSink to io.Writer, each write is sent in one style
+type sinkWriter struct {
+	Sink  OutputSink
+	Style string
+}
+
+func (this *sinkWriter) Write(p []byte) (int, error) {
+	this.Sink.WriteStyled(this.Style, string(p))
+	return len(p), nil
+}
+
 func (this *ButterfishCtx) StyleSprintf(style lipgloss.Style, format string, a ...any) string {
-	return util.MultilineLipglossRender(style, fmt.Sprintf(format, a...))
+	str := fmt.Sprintf(format, a...)
+	if this.Config.PlainOutput {
+		return str
+	}
+	return util.MultilineLipglossRender(style, str)
 }
 
 func (this *ButterfishCtx) Printf(format string, a ...any) {
-	this.StylePrintf(this.Config.Styles.Foreground, format, a...)
+	this.StylePrintf(StyleForeground, format, a...)
 }
 
 func (this *ButterfishCtx) ErrorPrintf(format string, a ...any) {
-	this.StylePrintf(this.Config.Styles.Error, format, a...)
+	this.StylePrintf(StyleError, format, a...)
+}
+
+// Return the tokenizer for a model, from the config if one is set otherwise
+// the model's tiktoken encoding
+func (this *ButterfishCtx) tokenizerForModel(model string) (Tokenizer, error) {
+	if this.Config.TokenizerForModel != nil {
+		return this.Config.TokenizerForModel(model)
+	}
+	return NewTiktokenTokenizer(model)
+}
+
+// The context window of a model in tokens, as reported by the LLM client's
+// Models(), falling back to our table of known models if the client doesn't
+// report one. The client's models are listed once and cached.
+func (this *ButterfishCtx) contextWindowForModel(model string) int {
+	if this.LLMClient != nil {
+		for _, info := range this.listModels() {
+			if info.Name == model && info.ContextWindow > 0 {
+				return info.ContextWindow
+			}
+		}
+	}
+
+	return NumTokensForModel(model)
+}
+
+// The models reported by the LLM client, listed once per client. Nothing is
+// cached if listing fails, so it's tried again next time.
+func (this *ButterfishCtx) listModels() []ModelInfo {
+	this.modelsMutex.Lock()
+	defer this.modelsMutex.Unlock()
+
+	if this.models != nil && this.modelsClient == this.LLMClient {
+		return this.models
+	}
+
+	models, err := this.LLMClient.Models(this.Ctx)
+	if err != nil {
+		this.Log.Warnf("Error listing models, using default context window: %s", err)
+		return nil
+	}
+
+	if models == nil {
+		models = []ModelInfo{}
+	}
+	this.models = models
+	this.modelsClient = this.LLMClient
+	return models
+}
+
+// Identifies where embeddings come from in shared embedding cache keys, the
+// provider and its endpoint, or the type of a custom LLM client
+func (this *ButterfishCtx) embedderName() string {
+	config := this.Config
+	if config.LLMClient != nil {
+		return fmt.Sprintf("%T", config.LLMClient)
+	}
+	if config.AzureEndpoint != "" {
+		return fmt.Sprintf("azure %s %s", strings.TrimRight(config.AzureEndpoint, "/"), config.AzureDeployment)
+	}
+
+	baseURL := config.BaseURL
+	if baseURL == "" {
+		baseURL = OpenAIBaseURL
+	}
+	return "openai " + strings.TrimRight(baseURL, "/")
 }
 
 // Ensure we have a vector index object, idempotent
@@ -342,6 +1102,39 @@ func (this *ButterfishCtx) initVectorIndex(pathsToLoad []string) error {
 
 	out := util.NewStyledWriter(this.Out, this.Config.Styles.Foreground)
 	index := embedding.NewDiskCachedEmbeddingIndex(this, out)
+	index.EmbeddingModel = this.Config.EmbeddingModel
+	index.CacheMode = this.Config.IndexCacheMode
+	index.ShardSize = this.Config.IndexShardSize
+	index.ShardWorkers = this.Config.IndexShardWorkers
+	index.LazyLoad = this.Config.IndexLazyLoad
+	index.ANNThreshold = this.Config.IndexANNThreshold
+	index.ANNEfSearch = this.Config.IndexANNEfSearch
+	if this.Config.IndexSharedCachePath != "" {
+		path, err := homedir.Expand(this.Config.IndexSharedCachePath)
+		if err != nil {
+			return err
+		}
+		index.SharedCache = embedding.NewSharedEmbeddingCache(index.Fs, path)
+	}
+	index.EmbedderName = this.embedderName()
+	index.Extensions = this.Config.IndexExtensions
+	index.SearchLanguages = this.Config.IndexLanguages
+	index.IgnoreDirs = append(index.IgnoreDirs, this.Config.IndexIgnoreDirs...)
+	index.AutoSaveInterval = this.Config.IndexAutoSaveInterval
+	index.AutoSaveThreshold = this.Config.IndexAutoSaveThreshold
+
+	namespace := this.Config.IndexNamespace
+	if namespace == IndexNamespaceAuto {
+		var err error
+		namespace, err = embedding.NamespaceForPath(".")
+		if err != nil {
+			return err
+		}
+	}
+	err := index.SetNamespace(namespace)
+	if err != nil {
+		return err
+	}
 
 	if this.Config.Verbose > 0 {
 		index.SetOutput(this.Out)
@@ -356,7 +1149,7 @@ func (this *ButterfishCtx) initVectorIndex(pathsToLoad []string) error {
 			pathsToLoad = []string{"."}
 		}
 
-		err := this.VectorIndex.LoadPaths(this.Ctx, pathsToLoad)
+		err := this.VectorIndex.LoadPaths(this.Ctx, pathsToLoad, nil)
 		if err != nil {
 			return err
 		}
@@ -367,12 +1160,25 @@ func (this *ButterfishCtx) initVectorIndex(pathsToLoad []string) error {
 
 func (this *ButterfishCtx) printError(err error, prefix ...string) {
 	if len(prefix) > 0 {
-		fmt.Fprintf(this.Out, "%s error: %s\n", prefix[0], err.Error())
+		this.ErrorPrintf("%s error: %s\n", prefix[0], err.Error())
 	} else {
-		fmt.Fprintf(this.Out, "Error: %s\n", err.Error())
+		this.ErrorPrintf("Error: %s\n", err.Error())
 	}
 }
 
+// Names of the styles in styles, passed to StylePrintf and an OutputSink
+const (
+	StyleQuestion   = "question"
+	StyleAnswer     = "answer"
+	StyleGo         = "go"
+	StyleSummarize  = "summarize"
+	StyleHighlight  = "highlight"
+	StylePrompt     = "prompt"
+	StyleError      = "error"
+	StyleForeground = "foreground"
+	StyleGrey       = "grey"
+)
+
 type styles struct {
 	Question   lipgloss.Style
 	Answer     lipgloss.Style
@@ -397,6 +1203,53 @@ func (this *styles) PrintTestColors() {
 	fmt.Println(this.Grey.Render("Grey"))
 }
 
+// Get a style by name, e.g. StyleError, unknown names get the foreground
+// style
+func (this *styles) Get(name string) lipgloss.Style {
+	switch name {
+	case StyleQuestion:
+		return this.Question
+	case StyleAnswer:
+		return this.Answer
+	case StyleGo:
+		return this.Go
+	case StyleSummarize:
+		return this.Summarize
+	case StyleHighlight:
+		return this.Highlight
+	case StylePrompt:
+		return this.Prompt
+	case StyleError:
+		return this.Error
+	case StyleGrey:
+		return this.Grey
+	}
+	return this.Foreground
+}
+
+// Styles that render text unchanged, used for plain output
+func PlainStyles() *styles {
+	plain := lipgloss.NewStyle()
+	return &styles{
+		Question:   plain,
+		Answer:     plain,
+		Go:         plain,
+		Highlight:  plain,
+		Summarize:  plain,
+		Prompt:     plain,
+		Error:      plain,
+		Foreground: plain,
+		Grey:       plain,
+	}
+}
+
+func stylesFor(colorScheme *ColorScheme, plain bool) *styles {
+	if plain {
+		return PlainStyles()
+	}
+	return ColorSchemeToStyles(colorScheme)
+}
+
 func ColorSchemeToStyles(colorScheme *ColorScheme) *styles {
 	return &styles{
 		Question:   lipgloss.NewStyle().Foreground(lipgloss.Color(colorScheme.Color5)),
@@ -413,8 +1266,8 @@ func ColorSchemeToStyles(colorScheme *ColorScheme) *styles {
 
 // Let's initialize our prompts. If we have a prompt library file, we'll load it.
 // Either way, we'll then add the default prompts to the library, replacing
-// loaded prompts only if OkToReplace is set on them. Then we save the library
-// at the same path.
+// loaded prompts only if OkToReplace is set on them. Then we validate the
+// library and, if it's valid, save it at the same path.
 func NewDiskPromptLibrary(path string, verbose bool, writer io.Writer) (*prompt.DiskPromptLibrary, error) {
 	promptLibrary := prompt.NewPromptLibrary(path, verbose, writer)
 	loaded := false
@@ -427,7 +1280,16 @@ func NewDiskPromptLibrary(path string, verbose bool, writer io.Writer) (*prompt.
 		loaded = true
 	}
 	promptLibrary.ReplacePrompts(prompt.DefaultPrompts)
-	promptLibrary.Save()
+
+	err := promptLibrary.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = promptLibrary.Save()
+	if err != nil {
+		return nil, err
+	}
 
 	if !loaded {
 		fmt.Fprintf(writer, "Wrote prompt library at %s\n", path)
@@ -436,19 +1298,224 @@ func NewDiskPromptLibrary(path string, verbose bool, writer io.Writer) (*prompt.
 	return promptLibrary, nil
 }
 
+const DefaultCredentialsPath = "~/.config/butterfish/butterfish.env"
+
+// Environment variables checked for an OpenAI token, in order
+var openAITokenEnvVars = []string{"OPENAI_API_KEY", "OPENAI_TOKEN"}
+
+// Environment variables checked for an Azure OpenAI key, in order
+var azureTokenEnvVars = []string{"AZURE_OPENAI_API_KEY"}
+
+// Find an OpenAI token, checking in order: the token set explicitly in
+// config, the OPENAI_API_KEY (or legacy OPENAI_TOKEN) environment variable,
+// and a dotenv-style credentials file. Returns the token and a label for
+// where it was found. If no token is found the error lists everywhere we
+// looked.
+func ResolveOpenAIToken(configToken string, getenv func(string) string, credentialsPath string) (string, string, error) {
+	if configToken != "" {
+		return configToken, "config", nil
+	}
+
+	token, source, searched, err := findToken(openAITokenEnvVars, getenv, credentialsPath)
+	if err != nil || token != "" {
+		return token, source, err
+	}
+
+	searched = append([]string{"config"}, searched...)
+	return "", "", fmt.Errorf("No OpenAI token found, looked in: %s", strings.Join(searched, ", "))
+}
+
+// Find an Azure OpenAI key, checking the AZURE_OPENAI_API_KEY environment
+// variable and then the credentials file before falling back to an OpenAI
+// token as found by ResolveOpenAIToken. Azure keys are kept apart so that
+// saving one doesn't replace an OpenAI token.
+func ResolveAzureToken(configToken string, getenv func(string) string, credentialsPath string) (string, string, error) {
+	token, source, searched, err := findToken(azureTokenEnvVars, getenv, credentialsPath)
+	if err != nil || token != "" {
+		return token, source, err
+	}
+
+	token, source, err = ResolveOpenAIToken(configToken, getenv, credentialsPath)
+	if err != nil {
+		return "", "", fmt.Errorf("No Azure OpenAI key found, looked in: %s, and for an OpenAI token: %s",
+			strings.Join(searched, ", "), err)
+	}
+	return token, source, nil
+}
+
+// Look for a token in envVars in the environment and then the credentials
+// file. Returns the token and where it was found, or an empty token and
+// the places searched.
+func findToken(envVars []string, getenv func(string) string, credentialsPath string) (string, string, []string, error) {
+	searched := []string{}
+
+	for _, envVar := range envVars {
+		token := getenv(envVar)
+		if token != "" {
+			return token, "$" + envVar, nil, nil
+		}
+		searched = append(searched, "$"+envVar)
+	}
+
+	if credentialsPath != "" {
+		path, err := homedir.Expand(credentialsPath)
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		// a missing file just means there's nothing to find here
+		values, err := godotenv.Read(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", "", nil, fmt.Errorf("Unable to read credentials file %s: %s", path, err)
+		}
+
+		for _, envVar := range envVars {
+			token := values[envVar]
+			if token != "" {
+				return token, path, nil, nil
+			}
+		}
+		searched = append(searched, path)
+	}
+
+	return "", "", searched, nil
+}
+
+// Returns true if requests to baseURL don't need a token, i.e. it's a local
+// server or proxy rather than OpenAI itself. Local servers usually ignore the
+// token so we don't insist on one.
+func TokenOptional(baseURL string) bool {
+	return baseURL != "" && strings.TrimRight(baseURL, "/") != OpenAIBaseURL
+}
+
+// Create the LLM client, falling back to FallbackBaseURL and then
+// FallbackLLMClients when the primary is unavailable, wrapped in
+// LLMMiddlewares
 func initLLM(config *ButterfishConfig) (LLM, error) {
-	if config.OpenAIToken == "" && config.LLMClient != nil {
-		return nil, errors.New("Must provide either an OpenAI Token or an LLM client.")
-	} else if config.OpenAIToken != "" && config.LLMClient != nil {
+	llm, err := initFallbackLLM(config)
+	if err != nil {
+		return nil, err
+	}
+	return Chain(llm, config.LLMMiddlewares...), nil
+}
+
+// Create the response cache and load it from ResponseCachePath, or return
+// nil if it's disabled
+func initResponseCache(config *ButterfishConfig) (*CompletionCache, error) {
+	if config.ResponseCacheEntries <= 0 {
+		return nil, nil
+	}
+
+	cache := NewCompletionCache(config.ResponseCacheEntries, config.ResponseCacheTTL)
+	cache.Path = config.ResponseCachePath
+	err := cache.Load()
+	if err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+func initFallbackLLM(config *ButterfishConfig) (LLM, error) {
+	llm, err := initPrimaryLLM(config)
+	if err != nil {
+		return nil, err
+	}
+
+	fallbacks := config.FallbackLLMClients
+	if config.FallbackBaseURL != "" {
+		// the OpenAI token is only sent to OpenAI
+		token := ""
+		if !TokenOptional(config.FallbackBaseURL) {
+			token, _, _ = ResolveOpenAIToken(config.OpenAIToken, os.Getenv, config.CredentialsPath)
+		}
+		gpt := NewGPT(token, config.FallbackBaseURL, config.DefaultModel)
+		gpt.UsageCallback = config.UsageCallback
+		fallbacks = append([]LLM{gpt}, fallbacks...)
+	}
+	if len(fallbacks) == 0 {
+		return llm, nil
+	}
+
+	return NewFallbackLLM(append([]LLM{llm}, fallbacks...)...), nil
+}
+
+func initPrimaryLLM(config *ButterfishConfig) (LLM, error) {
+	if config.OpenAIToken != "" && config.LLMClient != nil {
 		return nil, errors.New("Must provide either an OpenAI Token or an LLM client, not both.")
-	} else if config.OpenAIToken != "" {
-		gpt := NewGPT(config.OpenAIToken, config.BaseURL)
-		return gpt, nil
-	} else {
+	}
+
+	if config.LLMClient != nil {
 		return config.LLMClient, nil
 	}
+
+	resolveToken := ResolveOpenAIToken
+	if config.AzureEndpoint != "" {
+		resolveToken = ResolveAzureToken
+	}
+
+	token, source, err := resolveToken(config.OpenAIToken, os.Getenv, config.CredentialsPath)
+	if err != nil && (config.AzureEndpoint != "" || !TokenOptional(config.BaseURL)) {
+		// ask for a provider if there's someone to ask
+		setup, setupErr := runLLMSetup(config)
+		if setupErr != nil {
+			return nil, setupErr
+		}
+		if setup == nil {
+			return nil, err
+		}
+		token, source, err = setup.Token, "setup", nil
+		if token == "" {
+			err = errors.New("No token given during setup")
+		}
+	}
+
+	if err != nil {
+		util.DefaultLogger().Infof("No OpenAI token found, sending requests to %s without one", config.BaseURL)
+	} else {
+		util.DefaultLogger().Infof("Using OpenAI token from %s", source)
+	}
+
+	var gpt *GPT
+	if config.AzureEndpoint != "" {
+		gpt = NewAzureGPT(token, config.AzureEndpoint, config.AzureDeployment,
+			config.AzureAPIVersion, config.DefaultModel)
+	} else {
+		gpt = NewGPT(token, config.BaseURL, config.DefaultModel)
+	}
+	if config.EmbeddingModel != "" {
+		gpt.EmbeddingModel = config.EmbeddingModel
+	}
+	gpt.EmbeddingBatchSize = config.EmbeddingBatchSize
+	gpt.EmbeddingBatchTokens = config.EmbeddingBatchTokens
+	gpt.EmbeddingBatchWorkers = config.EmbeddingBatchWorkers
+	if config.RequestsPerMinute > 0 || config.TokensPerMinute > 0 {
+		gpt.RateLimiter = NewRateLimiter(config.RequestsPerMinute, config.TokensPerMinute)
+	}
+	gpt.UsageCallback = config.UsageCallback
+	return gpt, nil
 }
 
+func initLogger(config *ButterfishConfig) (*util.Logger, error) {
+	level := util.LogLevelInfo
+	if config.Verbose > 0 {
+		level = util.LogLevelDebug
+	}
+
+	if config.LogLevel != "" {
+		var err error
+		level, err = util.ParseLogLevel(config.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return util.NewLogger(level, nil), nil
+}
+
+// How often the prompt library file is checked for changes when
+// PromptLibraryWatch is set
+const promptLibraryWatchInterval = time.Second
+
 func initPromptLibrary(config *ButterfishConfig) (PromptLibrary, error) {
 	verboseWriter := util.NewStyledWriter(os.Stdout, config.Styles.Grey)
 
@@ -461,20 +1528,166 @@ func initPromptLibrary(config *ButterfishConfig) (PromptLibrary, error) {
 		return nil, err
 	}
 
-	return NewDiskPromptLibrary(promptPath, config.Verbose > 0, verboseWriter)
+	library, err := NewDiskPromptLibrary(promptPath, config.Verbose > 0, verboseWriter)
+	if err != nil {
+		return nil, err
+	}
+	library.GlobalPromptPrefix = config.GlobalPromptPrefix
+	library.GlobalPromptSuffix = config.GlobalPromptSuffix
+
+	if config.PromptLibraryURL != "" {
+		httpLibrary := prompt.NewHTTPPromptLibrary(config.PromptLibraryURL, library)
+		httpLibrary.Verbose = config.Verbose > 0
+		if config.PromptLibraryTTL > 0 {
+			httpLibrary.TTL = config.PromptLibraryTTL
+		}
+		return httpLibrary, nil
+	}
+
+	return library, nil
+}
+
+// Load the color scheme file if one is configured. The shell's own colors
+// are switched to light if the scheme is GruvboxLight, whether it was picked
+// or loaded from a file.
+func initColorScheme(config *ButterfishConfig) error {
+	if config.ColorSchemePath != "" {
+		path, err := homedir.Expand(config.ColorSchemePath)
+		if err != nil {
+			return err
+		}
+
+		colorScheme, err := LoadColorScheme(path)
+		if err != nil {
+			return err
+		}
+
+		config.SetColorScheme(colorScheme)
+	}
+
+	if config.ColorScheme != nil && sameColorScheme(config.ColorScheme, &GruvboxLight) {
+		config.ShellColorDark = false
+	}
+	return nil
+}
+
+// Set the color scheme and the styles drawn from it
+func (this *ButterfishConfig) SetColorScheme(colorScheme *ColorScheme) {
+	this.ColorScheme = colorScheme
+	this.Styles = stylesFor(colorScheme, this.PlainOutput)
+}
+
+// Turn plain output on or off, updating the styles to match
+func (this *ButterfishConfig) SetPlainOutput(plain bool) {
+	this.PlainOutput = plain
+	this.Styles = stylesFor(this.ColorScheme, plain)
+}
+
+// ConfigureConsole applies the configured styles and keybindings to a
+// console model, it's meant to be passed as the configCallback to
+// console.NewConsoleProgram
+func (this *ButterfishCtx) ConfigureConsole(model console.ConsoleModel) console.ConsoleModel {
+	model.SetStyles(this.Config.Styles.Prompt, this.Config.Styles.Question)
+	if this.Config.Keybindings != nil {
+		model.SetKeybindings(this.Config.Keybindings)
+	}
+	return model
+}
+
+// Register a resource to be released when the ButterfishCtx is closed
+func (this *ButterfishCtx) addCloser(closer io.Closer) {
+	this.closeMutex.Lock()
+	defer this.closeMutex.Unlock()
+	this.closers = append(this.closers, closer)
+}
+
+// Close releases the resources held by the ButterfishCtx so it can be used
+// within a longer-lived process. It cancels Ctx, which stops the shell
+// multiplexer and any in-flight LLM requests, then flushes and closes the
+// transcript recorder if a shell opened one, and finally saves any parts of
+// the vector index that were embedded but not yet written to disk. The pty
+// is owned by RunShell, which closes it when the shell exits. Calling Close
+// more than once is safe, later calls do nothing.
+func (this *ButterfishCtx) Close() error {
+	this.closeMutex.Lock()
+	if this.closed {
+		this.closeMutex.Unlock()
+		return nil
+	}
+	this.closed = true
+	closers := this.closers
+	this.closers = nil
+	this.closeMutex.Unlock()
+
+	if this.Cancel != nil {
+		this.Cancel()
+	}
+
+	var err error
+	for i := len(closers) - 1; i >= 0; i-- {
+		closeErr := closers[i].Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	if index, ok := this.VectorIndex.(*embedding.DiskCachedEmbeddingIndex); ok {
+		saveErr := index.SaveDirty()
+		if saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+
+	return err
 }
 
 func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCtx, error) {
+	logger, err := initLogger(config)
+	if err != nil {
+		return nil, err
+	}
+	// code without a ButterfishCtx to hand, e.g. the LLM client and prompt
+	// library, logs at the same level
+	util.SetDefaultLogger(logger)
+
+	_, err = LoadEnvFile(config.EnvFile, os.LookupEnv, os.Setenv)
+	if err != nil {
+		return nil, err
+	}
+
 	llmClient, err := initLLM(config)
 	if err != nil {
 		return nil, err
 	}
 
+	responseCache, err := initResponseCache(config)
+	if err != nil {
+		return nil, err
+	}
+	if responseCache != nil {
+		llmClient = Chain(llmClient, responseCache.Middleware())
+	}
+
 	promptLibrary, err := initPromptLibrary(config)
 	if err != nil {
 		return nil, err
 	}
 
+	err = initColorScheme(config)
+	if err != nil {
+		return nil, err
+	}
+
+	commandFilter, err := NewCommandFilter(config.GoalModeAllowPatterns, config.GoalModeDenyPatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	redactor, err := NewRedactor(config.RedactPatterns)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 
 	butterfishCtx := &ButterfishCtx{
@@ -485,6 +1698,21 @@ func NewButterfish(ctx context.Context, config *ButterfishConfig) (*ButterfishCt
 		Config:        config,
 		LLMClient:     llmClient,
 		Out:           os.Stdout,
+		CommandFilter: commandFilter,
+		Redactor:      redactor,
+		Log:           logger,
+	}
+
+	if config.PromptLibraryWatch {
+		if library, ok := promptLibrary.(*prompt.DiskPromptLibrary); ok {
+			library.Watch(ctx, promptLibraryWatchInterval)
+		} else if library, ok := promptLibrary.(*prompt.HTTPPromptLibrary); ok {
+			library.Fallback.Watch(ctx, promptLibraryWatchInterval)
+		}
+	}
+
+	if responseCache != nil {
+		butterfishCtx.addCloser(responseCache)
 	}
 
 	return butterfishCtx, nil
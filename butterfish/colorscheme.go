@@ -0,0 +1,204 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Environment variable that forces a color scheme, "dark" or "light", useful
+// in CI or in terminals that don't report their background
+const ColorSchemeEnvVar = "BUTTERFISH_COLOR_SCHEME"
+
+// Pick GruvboxDark or GruvboxLight based on the terminal background. The
+// BUTTERFISH_COLOR_SCHEME env var wins if set, otherwise we look at
+// COLORFGBG, which many terminals (rxvt, Konsole, iTerm2) set to "fg;bg".
+// Falls back to dark if the background can't be determined.
+func DetectColorScheme() *ColorScheme {
+	return detectColorScheme(os.Getenv(ColorSchemeEnvVar), os.Getenv("COLORFGBG"))
+}
+
+func detectColorScheme(override, colorfgbg string) *ColorScheme {
+	scheme, err := SelectColorScheme(override)
+	if err == nil && scheme != nil {
+		return scheme
+	}
+
+	dark, ok := parseCOLORFGBG(colorfgbg)
+	if ok && !dark {
+		return &GruvboxLight
+	}
+	return &GruvboxDark
+}
+
+// Check that BUTTERFISH_COLOR_SCHEME is unset or a valid scheme name.
+// DetectColorScheme ignores invalid values since it can't return an error,
+// so callers that can report one should check first.
+func CheckColorSchemeEnv() error {
+	return checkColorSchemeEnv(os.Getenv(ColorSchemeEnvVar))
+}
+
+func checkColorSchemeEnv(value string) error {
+	_, err := SelectColorScheme(value)
+	if err != nil {
+		return fmt.Errorf("Invalid %s: %w", ColorSchemeEnvVar, err)
+	}
+	return nil
+}
+
+// Return the color scheme for an explicit override of "dark" or "light".
+// An empty override or "auto" returns nil, meaning the caller should detect
+// the scheme.
+func SelectColorScheme(override string) (*ColorScheme, error) {
+	switch strings.ToLower(strings.TrimSpace(override)) {
+	case "", "auto":
+		return nil, nil
+	case "dark":
+		return &GruvboxDark, nil
+	case "light":
+		return &GruvboxLight, nil
+	}
+
+	return nil, fmt.Errorf("Unknown color scheme %q, expected auto, dark, or light", override)
+}
+
+// Parse a COLORFGBG value like "15;0" or "0;default;15", the last field is
+// the background as an ANSI color index. Indexes 7 (white) and 9-15 (bright
+// colors) are light backgrounds, everything else is dark. Returns ok=false if
+// the background isn't a color index.
+func parseCOLORFGBG(value string) (dark bool, ok bool) {
+	fields := strings.Split(value, ";")
+	if len(fields) < 2 {
+		return false, false
+	}
+
+	bg, err := strconv.Atoi(strings.TrimSpace(fields[len(fields)-1]))
+	if err != nil || bg < 0 || bg > 15 {
+		return false, false
+	}
+
+	light := bg == 7 || bg >= 9
+	return !light, true
+}
+
+var hexColorRegex = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+type colorSchemeField struct {
+	Name     string
+	Value    *string
+	Optional bool
+}
+
+// Pointers to each ColorScheme field by name, used when loading a scheme from
+// a file so we can match keys case-insensitively and name bad fields
+func colorSchemeFields(scheme *ColorScheme) []colorSchemeField {
+	return []colorSchemeField{
+		{"Foreground", &scheme.Foreground, false},
+		{"Background", &scheme.Background, true},
+		{"Error", &scheme.Error, false},
+		{"Color1", &scheme.Color1, false},
+		{"Color2", &scheme.Color2, false},
+		{"Color3", &scheme.Color3, false},
+		{"Color4", &scheme.Color4, false},
+		{"Color5", &scheme.Color5, false},
+		{"Color6", &scheme.Color6, false},
+		{"Grey", &scheme.Grey, false},
+	}
+}
+
+// Whether two schemes have the same colors, hex digits are compared
+// case-insensitively since files may use either case
+func sameColorScheme(a, b *ColorScheme) bool {
+	aFields := colorSchemeFields(a)
+	bFields := colorSchemeFields(b)
+	for i := range aFields {
+		if !strings.EqualFold(*aFields[i].Value, *bFields[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Load a color scheme from a YAML or JSON file, for example:
+//
+//	Foreground: "#839496"
+//	Background: "#002b36"
+//	Error: "#dc322f"
+//	Color1: "#859900"
+//	...
+//	Grey: "#586e75"
+//
+// Keys are matched case-insensitively. Every field except Background is
+// required and all colors must be hex, e.g. #fff or #ffffff.
+func LoadColorScheme(path string) (*ColorScheme, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &values)
+	} else {
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing color scheme %s: %w", path, err)
+	}
+
+	scheme, err := parseColorScheme(values)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid color scheme %s: %w", path, err)
+	}
+
+	return scheme, nil
+}
+
+func parseColorScheme(values map[string]string) (*ColorScheme, error) {
+	scheme := &ColorScheme{}
+	fields := colorSchemeFields(scheme)
+	problems := []string{}
+
+	for key, value := range values {
+		found := false
+		for _, field := range fields {
+			if strings.EqualFold(key, field.Name) {
+				*field.Value = strings.TrimSpace(value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("unknown field %s", key))
+		}
+	}
+
+	for _, field := range fields {
+		value := *field.Value
+		if value == "" {
+			if !field.Optional {
+				problems = append(problems, fmt.Sprintf("missing field %s", field.Name))
+			}
+			continue
+		}
+		if !hexColorRegex.MatchString(value) {
+			problems = append(problems,
+				fmt.Sprintf("field %s has invalid hex color %q", field.Name, value))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, errors.New(strings.Join(problems, ", "))
+	}
+
+	return scheme, nil
+}
@@ -0,0 +1,125 @@
+package butterfish
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Commands that goal mode refuses to run by default, these are destructive
+// enough that we never want a model running them unattended. rm with
+// recursive and force flags is always refused whatever the deny list is, it's
+// checked by isForcedRecursiveRemove since its flags can be written too many
+// ways for a pattern.
+var DefaultGoalModeDenyPatterns = []string{
+	`(^|[;&|]\s*|\bsudo\s+)dd\s`,
+	`\bmkfs(\.\w+)?\b`,
+}
+
+// CommandFilter decides whether goal mode may run a proposed command. A
+// command is refused if it matches any deny pattern, or if allow patterns
+// are set and it matches none of them.
+type CommandFilter struct {
+	Allow []*regexp.Regexp
+	Deny  []*regexp.Regexp
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid command filter pattern %q: %s", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func NewCommandFilter(allow, deny []string) (*CommandFilter, error) {
+	allowRegexes, err := compilePatterns(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	denyRegexes, err := compilePatterns(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CommandFilter{
+		Allow: allowRegexes,
+		Deny:  denyRegexes,
+	}, nil
+}
+
+// Check returns an error describing why a command is refused, or nil if it
+// may be run. A nil filter allows everything.
+func (this *CommandFilter) Check(cmd string) error {
+	if this == nil {
+		return nil
+	}
+
+	if isForcedRecursiveRemove(cmd) {
+		return fmt.Errorf("command runs rm with recursive and force flags")
+	}
+
+	for _, re := range this.Deny {
+		if re.MatchString(cmd) {
+			return fmt.Errorf("command matches deny rule %s", re.String())
+		}
+	}
+
+	if len(this.Allow) == 0 {
+		return nil
+	}
+
+	for _, re := range this.Allow {
+		if re.MatchString(cmd) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("command does not match any allow rule")
+}
+
+// Whether any command in cmd, which may be a list or pipeline, runs rm with
+// both a recursive flag (-r, -R, --recursive) and a force flag (-f,
+// --force), however the flags are combined or ordered
+func isForcedRecursiveRemove(cmd string) bool {
+	segments := strings.FieldsFunc(cmd, func(r rune) bool {
+		return strings.ContainsRune(";&|\n()`", r)
+	})
+
+	for _, segment := range segments {
+		args := strings.Fields(segment)
+		for i, arg := range args {
+			if filepath.Base(strings.Trim(arg, `"'`)) != "rm" {
+				continue
+			}
+
+			recursive, force := false, false
+			for _, flag := range args[i+1:] {
+				flag = strings.Trim(flag, `"'`)
+				if flag == "--" {
+					break
+				}
+				switch {
+				case flag == "--recursive":
+					recursive = true
+				case flag == "--force":
+					force = true
+				case strings.HasPrefix(flag, "-") && !strings.HasPrefix(flag, "--"):
+					recursive = recursive || strings.ContainsAny(flag, "rR")
+					force = force || strings.Contains(flag, "f")
+				}
+			}
+			if recursive && force {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -1,25 +1,32 @@
 package butterfish
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"regexp"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/mattn/go-runewidth"
 	"github.com/mitchellh/go-homedir"
 	"github.com/sashabaranov/go-openai/jsonschema"
 	"github.com/sergi/go-diff/diffmatchpatch"
 	"github.com/spf13/afero"
 	"golang.org/x/term"
 
+	"github.com/bakks/butterfish/embedding"
 	"github.com/bakks/butterfish/prompt"
 	"github.com/bakks/butterfish/util"
 )
@@ -41,7 +48,7 @@ func (this *ButterfishCtx) Command(cmd string) error {
 
 func (this *ButterfishCtx) ParseCommand(cmd string) (*kong.Context, *CliCommandConfig, error) {
 	options := &CliCommandConfig{}
-	parser, err := kong.New(options)
+	parser, err := kong.New(options, kong.Resolvers(this.Config.FlagResolver()))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -62,7 +69,7 @@ type CliCommandConfig struct {
 		Functions     string   `short:"f" default:"" help:"Path to json file with functions to use for prompt."`
 		NoColor       bool     `default:"false" help:"Disable color output."`
 		NoBackticks   bool     `default:"false" help:"Strip out backticks around codeblocks."`
-	} `cmd:"" help:"Run an LLM prompt without wrapping, stream results back. This is a straight-through call to the LLM from the command line with a given prompt. This accepts piped input, if there is both piped input and a prompt then they will be concatenated together (prompt first). It is recommended that you wrap the prompt with quotes. The default GPT model is gpt-4-turbo."`
+	} `cmd:"" help:"Run an LLM prompt without wrapping, stream results back. This is a straight-through call to the LLM from the command line with a given prompt. This accepts piped input, if there is both piped input and a prompt then they will be concatenated together (prompt first). It is recommended that you wrap the prompt with quotes. The default GPT model is gpt-4-turbo. In Console Mode, 'prompt edit <name>' opens the named prompt from the prompt library in your editor instead, and 'prompt lint' lists likely problems in the library."`
 
 	Promptedit struct {
 		File        string  `short:"f" default:"~/.config/butterfish/prompt.txt" help:"Cached prompt file to use." optional:""`
@@ -84,10 +91,19 @@ type CliCommandConfig struct {
 	} `cmd:"" help:"Edit a file by using a line range editing tool."`
 
 	Summarize struct {
-		Files     []string `arg:"" help:"File paths to summarize." optional:""`
-		ChunkSize int      `short:"c" default:"3600" help:"Number of bytes to summarize at a time if the file must be split up."`
-		MaxChunks int      `short:"C" default:"8" help:"Maximum number of chunks to summarize from a specific file."`
-	} `cmd:"" help:"Semantically summarize a list of files (or piped input). We read in the file, if it is short then we hand it directly to the LLM and ask for a summary. If it is longer then we break it into chunks and ask for a list of facts from each chunk (max 8 chunks), then concatenate facts and ask GPT for an overall summary."`
+		Files     []string `arg:"" help:"File paths to summarize, or pipe the content in." optional:""`
+		ChunkSize int      `short:"c" default:"3600" help:"Number of bytes to read from the file at a time."`
+		MaxChunks int      `short:"C" default:"-1" help:"Maximum number of chunks to read from a specific file, -1 reads the whole file."`
+	} `cmd:"" help:"Semantically summarize a list of files (or piped input). We read in the file, if it fits in the model's context window then we hand it directly to the LLM and ask for a summary. If it is longer then we break it into window-sized pieces and summarize each, then summarize groups of those summaries, repeating until they fit in a single prompt for the overall summary."`
+
+	Summarizedir struct {
+		Path        string `arg:"" help:"Directory to summarize, defaults to the current directory." optional:""`
+		ChunkSize   int    `short:"c" default:"3600" help:"Number of bytes to read from a file at a time."`
+		MaxChunks   int    `short:"C" default:"8" help:"Maximum number of chunks to read from a specific file."`
+		MaxFileSize int64  `default:"1048576" help:"Skip files larger than this many bytes, e.g. generated code and lockfiles. 0 means no limit."`
+		NoGitignore bool   `default:"false" help:"Summarize files even if they're matched by a .gitignore file."`
+		Workers     int    `short:"w" default:"4" help:"Number of files to summarize concurrently."`
+	} `cmd:"" help:"Recursively summarize a directory. Each file is summarized (skipping the same files as index), then each directory is summarized from the summaries of its files and subdirectories, and the results are printed as a tree."`
 
 	Gencmd struct {
 		Prompt []string `arg:"" help:"Prompt describing the desired shell command."`
@@ -99,16 +115,32 @@ type CliCommandConfig struct {
 	} `cmd:"" help:"Execute a command and try to debug problems. The command can either passed in or in the command register (if you have run gencmd in Console Mode)."`
 
 	Index struct {
-		Paths     []string `arg:"" help:"Paths to index." optional:""`
-		Force     bool     `short:"f" default:"false" help:"Force re-indexing of files rather than skipping cached embeddings."`
-		ChunkSize int      `short:"c" default:"512" help:"Number of bytes to embed at a time when the file is split up."`
-		MaxChunks int      `short:"C" default:"256" help:"Maximum number of chunks to embed from a specific file."`
-	} `cmd:"" help:"Recursively index the current directory using embeddings. This will read each file, split it into chunks, embed the chunks, and write a .butterfish_index file to each directory caching the embeddings. If you re-run this it will skip over previously embedded files unless you force a re-index. This implements an exponential backoff if you hit OpenAI API rate limits."`
+		Paths       []string `arg:"" help:"Paths to index." optional:""`
+		Force       bool     `short:"f" default:"false" help:"Force re-indexing of files rather than skipping cached embeddings."`
+		ChunkSize   int      `short:"c" default:"512" help:"Number of bytes to embed at a time when the file is split up."`
+		MaxChunks   int      `short:"C" default:"256" help:"Maximum number of chunks to embed from a specific file."`
+		MaxFileSize int64    `default:"1048576" help:"Skip files larger than this many bytes, e.g. generated code and lockfiles. 0 means no limit."`
+		NoGitignore bool     `default:"false" help:"Index files even if they're matched by a .gitignore file."`
+		Quantize    bool     `short:"q" default:"false" help:"Store new embeddings as 8-bit integers rather than 32-bit floats, using about a quarter of the memory and disk at a small cost in search accuracy."`
+		Workers     int      `short:"w" default:"4" help:"Number of files to embed concurrently."`
+		BatchSize   int      `short:"b" default:"32" help:"Number of chunks to send in each embedding API call."`
+		Dedup       float64  `default:"0" help:"Collapse new chunks whose cosine similarity to an indexed chunk is at least this, e.g. 0.98, so boilerplate like license headers isn't indexed and returned many times. Collapsed chunks are listed with the chunk they duplicate. 0 disables."`
+	} `cmd:"" help:"Recursively index the current directory using embeddings. This will read each file, split it into chunks, embed the chunks, and write a .butterfish_index file to each directory caching the embeddings. If you re-run this it will skip over previously embedded files unless you force a re-index, so an interrupted index picks up where it stopped. This implements an exponential backoff if you hit OpenAI API rate limits."`
 
 	Clearindex struct {
 		Paths []string `arg:"" help:"Paths to clear from the index." optional:""`
 	} `cmd:"" help:"Clear paths from the index, both from the in-memory index (if in Console Mode) and to delete .butterfish_index files. Defaults to loading from the current directory but allows you to pass in paths to load."`
 
+	Verifyindex struct {
+		Paths []string `arg:"" help:"Paths to verify." optional:""`
+	} `cmd:"" help:"Check the .butterfish_index files in paths for problems: files that can't be decoded, were built with a different embedding model, or hold vectors that are missing or have the wrong dimensions, and with a shared embedding cache, chunks whose shared entries are missing or unusable. Defaults to the current directory."`
+
+	Rebuildindex struct {
+		Paths     []string `arg:"" help:"Paths to rebuild." optional:""`
+		ChunkSize int      `short:"c" default:"512" help:"Number of bytes to embed at a time when the file is split up."`
+		MaxChunks int      `short:"C" default:"256" help:"Maximum number of chunks to embed from a specific file."`
+	} `cmd:"" help:"Clear the index for paths and embed the files that were indexed there again, e.g. to repair problems found by verifyindex. Files in cache files that can't be decoded are found by scanning their directory. Every chunk is embedded again, replacing its shared embedding cache entry. Defaults to the current directory."`
+
 	Loadindex struct {
 		Paths []string `arg:"" help:"Paths to load into the index." optional:""`
 	} `cmd:"" help:"Load paths into the index. This is specifically for Console Mode when you want to load a set of cached indexes into memory. Defaults to loading from the current directory but allows you to pass in paths to load."`
@@ -117,16 +149,29 @@ type CliCommandConfig struct {
 		Paths []string `arg:"" help:"Paths to show from the index." optional:""`
 	} `cmd:"" help:"Show which files are present in the loaded index. You can pass in a path but it defaults to the current directory."`
 
+	Indexstats struct {
+		Paths []string `arg:"" help:"Paths to load into the index before computing stats." optional:""`
+	} `cmd:"" help:"Show stats about the loaded index: the number of files, chunks, and vectors, the embedding model, approximate memory size, and the oldest and newest file modification times. Defaults to the current directory."`
+
 	Indexsearch struct {
 		Query   string `arg:"" help:"Query to search for."`
 		Results int    `short:"r" default:"5" help:"Number of results to return."`
 	} `cmd:"" help:"Search embedding index and return relevant file snippets. This uses the embedding API to embed the search string, then does a brute-force cosine similarity against every indexed chunk of text, returning those chunks and their scores."`
 
+	Indexscores struct {
+		Query   string `arg:"" help:"Query to search for."`
+		Results int    `short:"r" default:"10" help:"Number of results to show."`
+	} `cmd:"" help:"Show the snippets a query retrieves from the embedding index, best match first, with their cosine similarity scores and a preview of each. The LLM isn't asked anything, so this shows whether a bad indexquestion answer came from retrieval or generation."`
+
 	Indexquestion struct {
-		Question    string  `arg:"" help:"Question to ask."`
-		Model       string  `short:"m" default:"gpt-4-turbo" help:"GPT model to use for the prompt."`
-		NumTokens   int     `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
-		Temperature float32 `short:"T" default:"0.7" help:"Temperature to use for the prompt."`
+		Question      string  `arg:"" help:"Question to ask, or pipe the question in." optional:""`
+		Model         string  `short:"m" default:"gpt-4-turbo" help:"GPT model to use for the prompt."`
+		NumTokens     int     `short:"n" default:"1024" help:"Maximum number of tokens to generate."`
+		Temperature   float32 `short:"T" default:"0.7" help:"Temperature to use for the prompt."`
+		NoSources     bool    `default:"false" help:"Don't list the files and byte ranges the answer was based on."`
+		MaxSnippets   int     `short:"s" default:"0" help:"Maximum number of snippets from the index to pass to the LLM, 0 means as many as fit in the model's context window."`
+		ReserveTokens int     `default:"0" help:"Tokens of the model's context window to keep free for the answer when adding snippets, never less than --num-tokens."`
+		MinSimilarity float64 `default:"-1" help:"Minimum cosine similarity for a snippet to be passed to the LLM, between -1 and 1. If no snippets pass then we don't ask for an answer."`
 	} `cmd:"" help:"Ask a question using the embeddings index. This fetches text snippets from the index and passes them to the LLM to generate an answer, thus you need to run the index command first."`
 }
 
@@ -148,6 +193,22 @@ func (this *ButterfishCtx) getPipedStdinReader() io.Reader {
 	return nil
 }
 
+// Like getPipedStdinReader but also nil if the piped input is empty, e.g. a
+// script run with stdin closed. This waits for the first byte of input.
+func (this *ButterfishCtx) getNonEmptyPipedStdinReader() io.Reader {
+	piped := this.getPipedStdinReader()
+	if piped == nil {
+		return nil
+	}
+
+	reader := bufio.NewReader(piped)
+	_, err := reader.Peek(1)
+	if err != nil {
+		return nil
+	}
+	return reader
+}
+
 // Given a parsed input split into a slice, join the string together
 // and remove any leading/trailing quotes
 func (this *ButterfishCtx) cleanInput(input []string) string {
@@ -171,6 +232,120 @@ func (this *ButterfishCtx) cleanInput(input []string) string {
 	return joined
 }
 
+// Open path in an editor and wait for it to exit. The editor defaults to the
+// EDITOR env var, then to vi.
+func (this *ButterfishCtx) runEditor(editor, path string) error {
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if this.Config.Verbose > 0 {
+			this.StylePrintf(StyleGrey, "Defaulting to %s for editor, you can set this with --editor or the EDITOR env var\n", editor)
+		}
+	}
+
+	if this.Config.Verbose > 0 {
+		this.StylePrintf(StyleGrey, "%s %s\n", editor, path)
+	}
+
+	cmd := exec.Command(editor, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+
+	return cmd.Run()
+}
+
+// Open a prompt from the prompt library in an editor, then check the edited
+// prompt's fields and save the library. The edited prompt has OkToReplace
+// cleared so that it isn't overwritten by the defaults.
+func (this *ButterfishCtx) editLibraryPrompt(name string) error {
+	if remote, ok := this.PromptLibrary.(*prompt.HTTPPromptLibrary); ok {
+		return fmt.Errorf("Editing prompts isn't supported for remote prompt libraries, the prompts are served from %s", remote.URL)
+	}
+
+	library, ok := this.PromptLibrary.(*prompt.DiskPromptLibrary)
+	if !ok {
+		return errors.New("The prompt library can't be edited")
+	}
+
+	text, err := library.GetUninterpolatedPrompt(name)
+	if err != nil {
+		return fmt.Errorf("No prompt named %s, prompts are: %s",
+			name, strings.Join(library.PromptNames(), ", "))
+	}
+
+	file, err := os.CreateTemp("", "butterfish-prompt-*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(text)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = this.runEditor("", file.Name())
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(file.Name())
+	if err != nil {
+		return err
+	}
+	// editors usually add a newline at the end of the file
+	edited := strings.TrimSuffix(string(content), "\n")
+
+	if edited == text {
+		this.StylePrintf(StyleGrey, "Prompt %s unchanged\n", name)
+		return nil
+	}
+
+	err = library.SetPrompt(name, edited)
+	if err != nil {
+		return err
+	}
+
+	err = library.Save()
+	if err != nil {
+		return err
+	}
+
+	this.StylePrintf(StyleGrey, "Saved prompt %s to %s\n", name, library.Path)
+	return nil
+}
+
+// Implemented by the disk and remote prompt libraries
+type lintablePromptLibrary interface {
+	Lint() []prompt.LintIssue
+	PromptNames() []string
+}
+
+// Print the problems Lint finds in the prompt library, one per line
+func (this *ButterfishCtx) lintLibraryPrompts() error {
+	library, ok := this.PromptLibrary.(lintablePromptLibrary)
+	if !ok {
+		return errors.New("The prompt library can't be linted")
+	}
+
+	issues := library.Lint()
+	if len(issues) == 0 {
+		this.StylePrintf(StyleGrey, "No problems found in %d prompts\n", len(library.PromptNames()))
+		return nil
+	}
+
+	for _, issue := range issues {
+		this.StylePrintf(StyleHighlight, "%s", issue.Prompt)
+		this.StylePrintf(StyleError, ": %s\n", issue.Message)
+	}
+	return nil
+}
+
 // Manage a buffer of lines, we want to be able to replace a range of lines
 type LineBuffer struct {
 	Lines []string
@@ -272,6 +447,13 @@ func (this *ButterfishCtx) ExecCommand(
 		// least one of them. If we have both then we concatenate them with prompt
 		// first.
 		promptArr := options.Prompt.Prompt
+		if this.InConsoleMode && len(promptArr) == 2 && promptArr[0] == "edit" {
+			return this.editLibraryPrompt(promptArr[1])
+		}
+		if this.InConsoleMode && len(promptArr) == 1 && promptArr[0] == "lint" {
+			return this.lintLibraryPrompts()
+		}
+
 		prompt := ""
 		if promptArr != nil && len(promptArr) > 0 {
 			prompt = strings.Join(promptArr, " ")
@@ -314,28 +496,7 @@ func (this *ButterfishCtx) ExecCommand(
 			return err
 		}
 
-		// get EDITOR env var if not specified
-		if editor == "" {
-			editor = os.Getenv("EDITOR")
-		}
-		if editor == "" {
-			editor = "vi"
-			if this.Config.Verbose > 0 {
-				this.StylePrintf(this.Config.Styles.Grey, "Defaulting to %s for editor, you can set this with --editor or the EDITOR env var\n", editor)
-			}
-		}
-
-		if this.Config.Verbose > 0 {
-			this.StylePrintf(this.Config.Styles.Grey, "%s %s\n", editor, targetFile)
-		}
-
-		cmd := exec.Command(editor, targetFile)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Env = os.Environ()
-
-		err = cmd.Run()
+		err = this.runEditor(editor, targetFile)
 		if err != nil {
 			return err
 		}
@@ -346,7 +507,7 @@ func (this *ButterfishCtx) ExecCommand(
 		}
 
 		if this.Config.Verbose > 0 {
-			this.StylePrintf(this.Config.Styles.Question, "%s\n", string(content))
+			this.StylePrintf(StyleQuestion, "%s\n", string(content))
 		}
 
 		commandConfig := &promptCommand{
@@ -394,24 +555,33 @@ func (this *ButterfishCtx) ExecCommand(
 
 		return nil
 
-	case "summarize":
-		chunks, err := util.GetChunks(
-			os.Stdin,
-			options.Summarize.ChunkSize,
-			options.Summarize.MaxChunks)
+	case "summarize", "summarize <files>":
+		files := options.Summarize.Files
 
-		if err != nil {
-			return err
+		// only read stdin when no files are given, otherwise we'd block on a
+		// stdin that's never closed
+		var piped io.Reader
+		if len(files) == 0 {
+			piped = this.getNonEmptyPipedStdinReader()
 		}
 
-		if len(chunks) == 0 {
-			return errors.New("No input to summarize")
-		}
+		if piped != nil {
+			chunks, err := util.GetChunks(
+				piped,
+				options.Summarize.ChunkSize,
+				options.Summarize.MaxChunks)
 
-		return this.SummarizeChunks(chunks)
+			if err != nil {
+				return err
+			}
+
+			if len(chunks) == 0 {
+				return errors.New("No input to summarize")
+			}
+
+			return this.SummarizeChunks(chunks)
+		}
 
-	case "summarize <files>":
-		files := options.Summarize.Files
 		if len(files) == 0 {
 			return errors.New("Please provide file paths or piped data to summarize")
 		}
@@ -421,12 +591,26 @@ func (this *ButterfishCtx) ExecCommand(
 			options.Summarize.MaxChunks)
 		return err
 
+	case "summarizedir", "summarizedir <path>":
+		path := options.Summarizedir.Path
+		if path == "" {
+			path = "."
+		}
+
+		return this.SummarizeDirectory(path,
+			options.Summarizedir.ChunkSize,
+			options.Summarizedir.MaxChunks,
+			options.Summarizedir.Workers,
+			options.Summarizedir.MaxFileSize,
+			!options.Summarizedir.NoGitignore)
+
 	case "gencmd <prompt>":
 		input := this.cleanInput(options.Gencmd.Prompt)
 		if input == "" {
 			return errors.New("Please provide a description to generate a command")
 		}
 
+		// the command is shown as it's generated
 		cmd, err := this.gencmdCommand(input)
 		if err != nil {
 			return err
@@ -436,14 +620,10 @@ func (this *ButterfishCtx) ExecCommand(
 		cmd = strings.TrimSpace(cmd)
 
 		if !options.Gencmd.Force {
-			this.StylePrintf(this.Config.Styles.Highlight, "%s\n", cmd)
-		} else {
-			_, err := this.execCommand(cmd)
-			if err != nil {
-				return err
-			}
+			return this.gencmdConfirm(cmd)
 		}
-		return nil
+		_, err = this.execCommand(cmd)
+		return err
 
 	case "exec", "exec <command>":
 		input := this.cleanInput(options.Exec.Command)
@@ -468,6 +648,46 @@ func (this *ButterfishCtx) ExecCommand(
 		this.VectorIndex.ClearPaths(this.Ctx, paths)
 		return nil
 
+	case "verifyindex", "verifyindex <paths>":
+		paths := options.Verifyindex.Paths
+		if len(paths) == 0 {
+			paths = []string{"."}
+		}
+		this.initVectorIndex(paths)
+
+		problems, err := this.VectorIndex.VerifyCache(this.Ctx, paths)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			this.StylePrintf(StyleError, "%s\n", problem)
+		}
+		if len(problems) == 0 {
+			this.Printf("No problems found\n")
+		} else {
+			this.Printf("Found %d problems, run rebuildindex to repair them\n", len(problems))
+		}
+		return nil
+
+	case "rebuildindex", "rebuildindex <paths>":
+		paths := options.Rebuildindex.Paths
+		if len(paths) == 0 {
+			paths = []string{"."}
+		}
+
+		this.Printf("Rebuilding index for %s\n", strings.Join(paths, ", "))
+		this.initVectorIndex(paths)
+
+		err := this.VectorIndex.RebuildCache(this.Ctx, paths,
+			options.Rebuildindex.ChunkSize,
+			options.Rebuildindex.MaxChunks)
+		if err != nil {
+			return err
+		}
+
+		this.Printf("Done, %d files now loaded in the index\n", len(this.VectorIndex.IndexedFiles()))
+		return nil
+
 	case "showindex", "showindex <paths>":
 		paths := options.Showindex.Paths
 		this.initVectorIndex(paths)
@@ -479,6 +699,16 @@ func (this *ButterfishCtx) ExecCommand(
 
 		return nil
 
+	case "indexstats", "indexstats <paths>":
+		paths := options.Indexstats.Paths
+		err := this.initVectorIndex(paths)
+		if err != nil {
+			return err
+		}
+
+		this.printIndexStats(this.VectorIndex.Stats())
+		return nil
+
 	case "loadindex", "loadindex <paths>":
 		paths := options.Loadindex.Paths
 		if len(paths) == 0 {
@@ -488,7 +718,7 @@ func (this *ButterfishCtx) ExecCommand(
 		this.Printf("Loading indexes (not generating new embeddings) for %s\n", strings.Join(paths, ", "))
 		this.initVectorIndex(paths)
 
-		err := this.VectorIndex.LoadPaths(this.Ctx, paths)
+		err := this.VectorIndex.LoadPaths(this.Ctx, paths, nil)
 		if err != nil {
 			return err
 		}
@@ -499,22 +729,44 @@ func (this *ButterfishCtx) ExecCommand(
 		if len(paths) == 0 {
 			paths = []string{"."}
 		}
+		if options.Index.Dedup < 0 || options.Index.Dedup > 1 {
+			return fmt.Errorf("--dedup must be between 0 and 1, got %g", options.Index.Dedup)
+		}
 
 		this.Printf("Indexing %s\n", strings.Join(paths, ", "))
 		this.initVectorIndex(paths)
 
-		err := this.VectorIndex.LoadPaths(this.Ctx, paths)
+		if index, ok := this.VectorIndex.(*embedding.DiskCachedEmbeddingIndex); ok {
+			index.MaxFileSize = options.Index.MaxFileSize
+			index.UseGitignore = !options.Index.NoGitignore
+			index.Quantize = options.Index.Quantize
+			index.Workers = options.Index.Workers
+			index.ChunksPerCall = options.Index.BatchSize
+			index.DedupThreshold = options.Index.Dedup
+		}
+
+		// an interrupt stops indexing rather than exiting, files embedded by
+		// then are saved and skipped when indexing again
+		ctx, stop := signal.NotifyContext(this.Ctx, os.Interrupt)
+		defer stop()
+
+		err := this.VectorIndex.LoadPaths(ctx, paths, nil)
 		if err != nil {
 			return err
 		}
 		force := options.Index.Force
 
 		err = this.VectorIndex.IndexPaths(
-			this.Ctx,
+			ctx,
 			paths,
 			force,
 			options.Index.ChunkSize,
 			options.Index.MaxChunks)
+		if err != nil && ctx.Err() != nil && this.Ctx.Err() == nil {
+			this.Printf("Indexing interrupted, %d files are indexed and will be skipped next time\n",
+				len(this.VectorIndex.IndexedFiles()))
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -537,58 +789,114 @@ func (this *ButterfishCtx) ExecCommand(
 		}
 
 		for _, result := range results {
-			this.StylePrintf(this.Config.Styles.Highlight, "%s : %0.4f\n", result.FilePath, result.Score)
+			this.StylePrintf(StyleHighlight, "%s : %0.4f\n", resultLocation(result), result.Score)
+			for _, alias := range result.Aliases {
+				this.StylePrintf(StyleGrey, "  also in %s:%d-%d\n", alias.FilePath, alias.Start, alias.End)
+			}
 			this.Printf("%s\n", result.Content)
 		}
 
-	case "indexquestion <question>":
+	case "indexscores <query>":
 		this.initVectorIndex(nil)
-		input := options.Indexquestion.Question
 
+		input := options.Indexscores.Query
+		if input == "" {
+			return errors.New("Please provide search parameters")
+		}
+
+		return this.indexScores(input, options.Indexscores.Results)
+
+	case "indexquestion", "indexquestion <question>":
+		input := options.Indexquestion.Question
+		// piped input is only read when no question is given
+		if input == "" {
+			input = strings.TrimSpace(this.getPipedStdin())
+		}
 		if input == "" {
 			return errors.New("Please provide a question")
 		}
+
+		this.initVectorIndex(nil)
 		if this.VectorIndex == nil {
 			return errors.New("No vector index loaded")
 		}
 
-		results, err := this.VectorIndex.Search(this.Ctx, input, 3)
-		if err != nil {
-			return err
-		}
-		samples := []string{}
+		this.Config.QuestionMaxSnippets = options.Indexquestion.MaxSnippets
+		this.Config.QuestionMinSimilarity = options.Indexquestion.MinSimilarity
+		this.Config.QuestionReserveTokens = options.Indexquestion.ReserveTokens
 
-		for _, result := range results {
-			samples = append(samples, result.Content)
-		}
+		return this.indexQuestion(input,
+			options.Indexquestion.Model,
+			options.Indexquestion.NumTokens,
+			options.Indexquestion.Temperature,
+			!options.Indexquestion.NoSources)
 
-		exerpts := strings.Join(samples, "\n---\n")
+	default:
+		return errors.New("Unrecognized command: " + parsed.Command())
 
-		prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptQuestion,
-			"snippets", exerpts,
-			"question", input)
-		if err != nil {
-			return err
-		}
+	}
 
-		req := &util.CompletionRequest{
-			Ctx:           this.Ctx,
-			Prompt:        prompt,
-			Model:         options.Indexquestion.Model,
-			MaxTokens:     options.Indexquestion.NumTokens,
-			Temperature:   options.Indexquestion.Temperature,
-			SystemMessage: "N/A",
+	return nil
+}
+
+// Print index stats as aligned label/value rows
+func (this *ButterfishCtx) printIndexStats(stats embedding.IndexStats) {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "n/a"
 		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	}
 
-		_, err = this.LLMClient.CompletionStream(req, this.Out)
-		return err
+	model := stats.EmbeddingModel
+	if model == "" {
+		model = "unknown"
+	}
 
-	default:
-		return errors.New("Unrecognized command: " + parsed.Command())
+	namespace := stats.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
 
+	rows := [][2]string{
+		{"Namespace", namespace},
+		{"Directories", fmt.Sprintf("%d", stats.Directories)},
+		{"Files", fmt.Sprintf("%d", stats.Files)},
+		{"Chunks", fmt.Sprintf("%d", stats.Chunks)},
+		{"Vectors", fmt.Sprintf("%d x %d dimensions", stats.Vectors, stats.Dimensions)},
+		{"Quantized vectors", fmt.Sprintf("%d", stats.QuantizedVectors)},
+		{"Duplicate chunks", fmt.Sprintf("%d", stats.AliasChunks)},
+		{"Embedding model", model},
+		{"Approx. memory", formatByteSize(stats.ApproxBytes)},
+		{"Oldest file", formatTime(stats.OldestModTime)},
+		{"Newest file", formatTime(stats.NewestModTime)},
+		{"Stale files", fmt.Sprintf("%d", stats.StaleFiles)},
+		{"Missing files", fmt.Sprintf("%d", stats.MissingFiles)},
 	}
 
-	return nil
+	for _, row := range rows {
+		this.StylePrintf(StyleHighlight, "%-17s", row[0]+":")
+		this.Printf("%s\n", row[1])
+	}
+
+	if stats.StaleFiles > 0 || stats.MissingFiles > 0 {
+		this.StylePrintf(StyleGrey, "Some files changed since they were indexed, run `index` to update them.\n")
+	}
+}
+
+// Format a byte count with a binary unit, e.g. 1.5 KB
+func formatByteSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
 }
 
 func styleToEscape(color lipgloss.TerminalColor) string {
@@ -634,7 +942,7 @@ func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse,
 	sysMsg := cmd.SysMsg
 	if sysMsg == "" {
 		var err error
-		sysMsg, err = this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+		sysMsg, err = this.systemMessage()
 		if err != nil {
 			return nil, err
 		}
@@ -659,19 +967,40 @@ func (this *ButterfishCtx) Prompt(cmd *promptCommand) (*util.CompletionResponse,
 
 	req := &util.CompletionRequest{
 		Ctx:           this.Ctx,
+		Timeout:       this.Config.RequestTimeout,
 		Prompt:        cmd.Prompt,
 		Model:         cmd.Model,
 		MaxTokens:     cmd.NumTokens,
 		Temperature:   cmd.Temperature,
 		SystemMessage: sysMsg,
 		Verbose:       cmd.Verbose > 0,
+		Feature:       FeaturePrompt,
 		Functions:     functions,
 		Tools:         cmd.Tools,
 		HistoryBlocks: cmd.History,
 		TokenTimeout:  this.Config.TokenTimeout,
 	}
 
-	return this.LLMClient.CompletionStream(req, writer)
+	stream := this.teeStream(writer)
+	response, err := this.LLMClient.CompletionStream(req, stream)
+	if err != nil {
+		return nil, err
+	}
+	return response, stream.Flush()
+}
+
+// Wrap the writer a streamed answer is displayed with so that its raw text
+// is also copied to Config.StreamTee, if set, and it's displayed no faster
+// than Config.StreamCharsPerSecond. Call Flush when the stream is done.
+func (this *ButterfishCtx) teeStream(writer io.Writer) *util.TeeWriter {
+	tee := this.Config.StreamTee
+	if tee == nil {
+		tee = io.Discard
+	}
+	if this.Config.StreamCharsPerSecond > 0 {
+		writer = util.NewThrottledWriter(this.Ctx, writer, this.Config.StreamCharsPerSecond)
+	}
+	return util.NewTeeWriter(writer, tee)
 }
 
 var EditSysMsg = `You're helping an expert programmer edit a file of code. You can either respond with questions and clarifications, or you can use the edit() tool, which replaces a range from the file with new code. In some cases you may want to call edit() multiple times, I will apply the edits and give you the updated file after every call. Use the most recent file for your edits. If there are no more edits, just say "DONE!"`
@@ -704,16 +1033,20 @@ var EditTools = []util.ToolDefinition{
 	},
 }
 
-func (this *ButterfishCtx) EditLineBuffer(lineBuffer *LineBuffer, prompt string, options *CliCommandConfig) error {
-	// add prompt to history, this is what the user is asking for
+func (this *ButterfishCtx) EditLineBuffer(lineBuffer *LineBuffer, instruction string, options *CliCommandConfig) error {
+	// the user's instruction and the file, wrapped in the library's edit
+	// prompt, start the history
+	editPrompt, err := this.PromptLibrary.GetPrompt(prompt.PromptEdit,
+		"instruction", instruction,
+		"content", lineBuffer.PrefixLineNumbers())
+	if err != nil {
+		return err
+	}
+
 	history := []util.HistoryBlock{
 		{
 			Type:    historyTypePrompt,
-			Content: prompt,
-		},
-		{
-			Type:    historyTypePrompt,
-			Content: lineBuffer.PrefixLineNumbers(),
+			Content: editPrompt,
 		},
 	}
 
@@ -793,6 +1126,340 @@ func (this *ButterfishCtx) diffStrings(a, b string) string {
 	return strBuilder.String()
 }
 
+// The most snippets we search for when Config.QuestionMaxSnippets is 0, the
+// context window decides how many of them are used
+const questionSearchLimit = 64
+
+// Answer a question using snippets from the vector index. We search for up to
+// Config.QuestionMaxSnippets snippets, or questionSearchLimit if it's 0, and
+// drop those scoring below Config.QuestionMinSimilarity, if none are left we
+// say so rather than asking the LLM to answer without context. The best of
+// the rest are packed into the prompt while they fit, see questionPrompt.
+func (this *ButterfishCtx) indexQuestion(question, model string, numTokens int, temperature float32, showSources bool) error {
+	if !this.featureEnabled(FeatureQuestion) {
+		return nil
+	}
+
+	limit := this.Config.QuestionMaxSnippets
+	if limit <= 0 {
+		limit = questionSearchLimit
+	}
+
+	results, err := this.VectorIndex.Search(this.Ctx, question, limit)
+	if err != nil {
+		return err
+	}
+
+	results = filterBySimilarity(results, this.Config.QuestionMinSimilarity)
+	if len(results) == 0 {
+		message := noRelevantContextMessage(this.Config.QuestionMinSimilarity)
+		if this.Config.OutputFormat == OutputFormatJSON {
+			return this.writeQuestionAnswer(&QuestionAnswer{
+				Question: question,
+				Model:    model,
+				Sources:  []QuestionSource{},
+				Error:    message,
+			})
+		}
+		this.StylePrintf(StyleError, "%s\n", message)
+		return nil
+	}
+
+	sysMsg, err := this.systemMessage()
+	if err != nil {
+		return err
+	}
+	sysMsg, numTokens = this.Config.AnswerVerbosity.Apply(sysMsg, numTokens)
+
+	prompt, sources, err := this.questionPrompt(question, results, model, sysMsg, numTokens)
+	if err != nil {
+		return err
+	}
+
+	req := &util.CompletionRequest{
+		Ctx:           this.Ctx,
+		Timeout:       this.Config.RequestTimeout,
+		Prompt:        prompt,
+		Model:         model,
+		MaxTokens:     numTokens,
+		Temperature:   temperature,
+		SystemMessage: sysMsg,
+		Feature:       FeatureQuestion,
+	}
+
+	if this.Config.OutputFormat == OutputFormatJSON {
+		response, err := this.LLMClient.Completion(req)
+		if err != nil {
+			return err
+		}
+
+		return this.writeQuestionAnswer(&QuestionAnswer{
+			Question: question,
+			Answer:   response.Completion,
+			Model:    model,
+			Sources:  questionSources(sources),
+		})
+	}
+
+	// wrap the answer to the terminal width, if we can't get the width
+	// (e.g. output is piped) then the width is 0 and text passes through. An
+	// OutputSink gets the answer unwrapped.
+	var out io.Writer
+	if this.Config.OutputSink != nil {
+		out = this.styleWriter(StyleAnswer)
+	} else {
+		termWidth, _, _ := term.GetSize(int(os.Stdout.Fd()))
+		out = util.NewWordWrapWriter(this.Out, termWidth)
+	}
+	writer := this.teeStream(out)
+
+	_, err = this.LLMClient.CompletionStream(req, writer)
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	if showSources {
+		this.StylePrintf(StyleGrey, "%s", formatSources(sources, previewWidth(sourcePreviewIndent)))
+	}
+	return nil
+}
+
+// The result of indexquestion when OutputFormat is OutputFormatJSON. Error
+// is set instead of Answer when we didn't ask the LLM, e.g. because no
+// snippets were relevant.
+type QuestionAnswer struct {
+	Question string           `json:"question"`
+	Answer   string           `json:"answer"`
+	Model    string           `json:"model"`
+	Sources  []QuestionSource `json:"sources"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// A snippet an answer was based on, Start and End are byte offsets in the
+// file
+type QuestionSource struct {
+	Path    string  `json:"path"`
+	Start   uint64  `json:"start"`
+	End     uint64  `json:"end"`
+	Heading string  `json:"heading,omitempty"`
+	Score   float64 `json:"score"`
+}
+
+func questionSources(results []*embedding.VectorSearchResult) []QuestionSource {
+	sources := make([]QuestionSource, len(results))
+	for i, result := range results {
+		sources[i] = QuestionSource{
+			Path:    result.FilePath,
+			Start:   result.Start,
+			End:     result.End,
+			Heading: result.Heading,
+			Score:   result.Score,
+		}
+	}
+	return sources
+}
+
+// Write answer to Out as a single line of JSON, unstyled
+func (this *ButterfishCtx) writeQuestionAnswer(answer *QuestionAnswer) error {
+	data, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(this.Out, "%s\n", data)
+	return err
+}
+
+// Drop search results scoring below minSimilarity, results are sorted by
+// score so we keep a prefix
+func filterBySimilarity(results []*embedding.VectorSearchResult, minSimilarity float64) []*embedding.VectorSearchResult {
+	for i, result := range results {
+		if result.Score < minSimilarity {
+			return results[:i]
+		}
+	}
+	return results
+}
+
+func noRelevantContextMessage(minSimilarity float64) string {
+	return fmt.Sprintf("No relevant context found in the index (no snippets with similarity of at least %.2f), so not answering. Try indexing more files or lowering --min-similarity.", minSimilarity)
+}
+
+// Build the indexquestion prompt from search results, which are ordered best
+// match first. Snippets are added in that order while they fit in the model's
+// context window after the question, the prompt template, the system
+// message, and the tokens reserved for the answer (the larger of
+// Config.QuestionReserveTokens and numTokens). Returns the prompt and the
+// results whose content was included, so the answer can cite them, or an
+// error if there's no room for any snippets.
+func (this *ButterfishCtx) questionPrompt(
+	question string,
+	results []*embedding.VectorSearchResult,
+	model string,
+	sysMsg string,
+	numTokens int,
+) (string, []*embedding.VectorSearchResult, error) {
+	const separator = "\n---\n"
+
+	samples := []string{}
+	for _, result := range results {
+		sample := result.Content
+		if result.Heading != "" {
+			sample = fmt.Sprintf("Section: %s\n%s", result.Heading, sample)
+		}
+		samples = append(samples, sample)
+	}
+
+	exerpts := strings.Join(samples, separator)
+	used := results
+
+	if tokenizer, err := this.tokenizerForModel(model); err == nil {
+		template, err := this.PromptLibrary.GetPromptFields(prompt.PromptQuestion,
+			map[string]string{
+				"snippets": "",
+				"question": question,
+			})
+		if err != nil {
+			return "", nil, err
+		}
+
+		// the answer can use up to numTokens whatever the reservation
+		reserve := numTokens
+		if this.Config.QuestionReserveTokens > reserve {
+			reserve = this.Config.QuestionReserveTokens
+		}
+
+		budget := this.contextWindowForModel(model) - reserve -
+			len(tokenizer.Encode(template)) - len(tokenizer.Encode(sysMsg))
+		if budget <= 0 {
+			return "", nil, fmt.Errorf("The context window of %s has no room for snippets after the question and the %d tokens reserved for the answer, try fewer max tokens or reserved tokens", model, reserve)
+		}
+		var numUsed int
+		exerpts, numUsed = joinWithinTokens(tokenizer, samples, separator, budget)
+		used = results[:numUsed]
+	}
+
+	promptStr, err := this.PromptLibrary.GetPromptFields(prompt.PromptQuestion,
+		map[string]string{
+			"snippets": exerpts,
+			"question": question,
+		})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return promptStr, used, nil
+}
+
+// List the files and byte ranges an answer was based on, each followed by a
+// preview of the snippet truncated to previewWidth columns, empty if there
+// weren't any
+func formatSources(results []*embedding.VectorSearchResult, previewWidth int) string {
+	if len(results) == 0 {
+		return ""
+	}
+
+	var builder strings.Builder
+	builder.WriteString("\nSources:\n")
+	for i, result := range results {
+		fmt.Fprintf(&builder, "  [%d] %s:%d-%d", i+1, result.FilePath, result.Start, result.End)
+		if result.Heading != "" {
+			fmt.Fprintf(&builder, " (%s)", result.Heading)
+		}
+		builder.WriteString("\n")
+		if preview := snippetPreview(result.Content, previewWidth); preview != "" {
+			fmt.Fprintf(&builder, "%*s%s\n", sourcePreviewIndent, "", preview)
+		}
+	}
+	return builder.String()
+}
+
+// The number of columns of each snippet shown by indexscores and under
+// question sources when we can't get the terminal width
+const snippetPreviewLength = 72
+
+// Snippet previews under question sources line up with the source paths
+const sourcePreviewIndent = 6
+
+// The width of snippet previews indented by indent columns, so that they
+// fit on one line of the terminal. If we can't get the terminal width, e.g.
+// because output is piped, then it's snippetPreviewLength.
+func previewWidth(indent int) int {
+	termWidth, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || termWidth <= indent {
+		return snippetPreviewLength
+	}
+	return termWidth - indent
+}
+
+// Print the top search results for a query with their scores and a preview
+// of each snippet, without calling the LLM
+func (this *ButterfishCtx) indexScores(query string, numResults int) error {
+	results, err := this.VectorIndex.Search(this.Ctx, query, numResults)
+	if err != nil {
+		return err
+	}
+
+	if len(results) == 0 {
+		this.StylePrintf(StyleGrey, "No results, the index is empty\n")
+		return nil
+	}
+
+	width := previewWidth(4)
+	for i, result := range results {
+		this.StylePrintf(StyleHighlight, "%2d. %0.4f  %s:%d-%d\n", i+1, result.Score,
+			resultLocation(result), result.Start, result.End)
+		this.StylePrintf(StyleGrey, "    %s\n", snippetPreview(result.Content, width))
+	}
+	return nil
+}
+
+// Collapse a snippet's whitespace onto one line and truncate it to width
+// columns, see truncateToWidth
+func snippetPreview(content string, width int) string {
+	return truncateToWidth(strings.Join(strings.Fields(content), " "), width)
+}
+
+// Truncate s to at most width terminal columns, ending it with an ellipsis
+// if it doesn't fit. We cut between runes so multibyte characters stay
+// whole, and wide characters like CJK count as two columns. Nothing is left
+// if width is 0 or less.
+func truncateToWidth(s string, width int) string {
+	if runewidth.StringWidth(s) <= width {
+		return s
+	}
+
+	ellipsis := "..."
+	if width < len(ellipsis) {
+		ellipsis = ""
+	}
+
+	var builder strings.Builder
+	used := 0
+	for _, r := range s {
+		runeWidth := runewidth.RuneWidth(r)
+		if used+runeWidth > width-len(ellipsis) {
+			break
+		}
+		builder.WriteRune(r)
+		used += runeWidth
+	}
+	return builder.String() + ellipsis
+}
+
+// The file a search result came from, followed by its section for
+// structured documents, e.g. "README.md > Install"
+func resultLocation(result *embedding.VectorSearchResult) string {
+	if result.Heading == "" {
+		return result.FilePath
+	}
+	return result.FilePath + " > " + result.Heading
+}
+
 // Given a description of functionality, we call GPT to generate a shell
 // command
 func (this *ButterfishCtx) gencmdCommand(description string) (string, error) {
@@ -801,27 +1468,79 @@ func (this *ButterfishCtx) gencmdCommand(description string) (string, error) {
 		return "", err
 	}
 
-	sysMsg, err := this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+	sysMsg, err := this.systemMessage()
 	if err != nil {
 		return "", err
 	}
 	req := &util.CompletionRequest{
 		Ctx:           this.Ctx,
+		Timeout:       this.Config.RequestTimeout,
 		Prompt:        promptStr,
 		Model:         this.Config.GencmdModel,
 		MaxTokens:     this.Config.GencmdMaxTokens,
 		Temperature:   this.Config.GencmdTemperature,
+		TopP:          this.Config.GencmdTopP,
+		Stop:          []string{"\n"}, // we only want a single command
 		SystemMessage: sysMsg,
+		Feature:       FeatureGencmd,
 		TokenTimeout:  this.Config.TokenTimeout,
 	}
 
-	resp, err := this.LLMClient.Completion(req)
+	writer := this.teeStream(this.styleWriter(StyleGo))
+	result, err := CompletionStreamDetailed(this.LLMClient, req, writer)
+	if err != nil {
+		return "", err
+	}
+	err = writer.Flush()
 	if err != nil {
 		return "", err
 	}
+	this.Printf("\n")
+
+	// running half a command could do anything, so don't offer it
+	if result.Truncated() {
+		return "", fmt.Errorf("The generated command was cut off at %d tokens and may be incomplete, set %s to allow a longer response", req.MaxTokens, MaxTokensEnvVar)
+	}
+
+	this.updateCommandRegister(result.Text)
+	return result.Text, nil
+}
+
+// Ask whether to run or copy a command from gencmd. Answers are read from
+// ConfirmIn, or stdin if both stdin and stdout are terminals, otherwise
+// there's no prompt so piped output stays clean. In Console Mode the command
+// is in the register for exec instead.
+func (this *ButterfishCtx) gencmdConfirm(cmd string) error {
+	in := this.Config.ConfirmIn
+	if in == nil {
+		if this.InConsoleMode || !stdinIsTerminal() || !stdoutIsTerminal() {
+			return nil
+		}
+		in = os.Stdin
+	}
+
+	this.StylePrintf(StyleQuestion, "Run this command? [y]es, [c]opy, [N]o: ")
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		_, err := this.execCommand(cmd)
+		return err
+	case "c", "copy":
+		copyToClipboard(this.Out, cmd)
+		this.StylePrintf(StyleGrey, "Copied to clipboard\n")
+	}
+	return nil
+}
 
-	this.updateCommandRegister(resp.Completion)
-	return resp.Completion, nil
+// Copy text to the clipboard with the OSC 52 escape sequence, which the
+// terminal handles so it also works over ssh. Terminals that don't support
+// it ignore it.
+func copyToClipboard(out io.Writer, text string) {
+	fmt.Fprintf(out, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
 }
 
 // We're parsing the results from an LLM requesting a command fix, we expect
@@ -864,25 +1583,40 @@ func (this *ButterfishCtx) execAndCheck(ctx context.Context, cmd string) error {
 			return nil
 		}
 
+		if !this.featureEnabled(FeatureFixCommand) {
+			return nil
+		}
+
 		this.ErrorPrintf("Command failed with status %d, requesting fix...\n", result.Status)
 
-		prompt, err := this.PromptLibrary.GetPrompt("fix_command",
-			"command", cmd,
-			"status", fmt.Sprintf("%d", result.Status),
-			"output", string(result.LastOutput))
+		prompt, err := this.PromptLibrary.GetPromptFields(prompt.PromptFixCommand,
+			map[string]string{
+				"command": cmd,
+				"status":  fmt.Sprintf("%d", result.Status),
+				"output": truncateMiddle(this.Redactor.Redact(string(result.LastOutput)),
+					this.Config.FixCommandMaxOutputBytes),
+			})
 		if err != nil {
 			return err
 		}
+		sysMsg, err := this.systemMessage()
+		if err != nil {
+			return err
+		}
+		sysMsg, maxTokens := this.Config.AnswerVerbosity.Apply(sysMsg, this.Config.ExeccheckMaxTokens)
 
-		styleWriter := util.NewStyledWriter(this.Out, this.Config.Styles.Highlight)
+		styleWriter := this.teeStream(this.styleWriter(StyleHighlight))
 
 		req := &util.CompletionRequest{
 			Ctx:           this.Ctx,
+			Timeout:       this.Config.RequestTimeout,
 			Prompt:        prompt,
 			Model:         this.Config.ExeccheckModel,
-			MaxTokens:     this.Config.ExeccheckMaxTokens,
+			MaxTokens:     maxTokens,
 			Temperature:   this.Config.ExeccheckTemperature,
-			SystemMessage: "N/A",
+			TopP:          this.Config.ExeccheckTopP,
+			SystemMessage: sysMsg,
+			Feature:       FeatureExeccheck,
 			TokenTimeout:  this.Config.TokenTimeout,
 		}
 
@@ -890,13 +1624,17 @@ func (this *ButterfishCtx) execAndCheck(ctx context.Context, cmd string) error {
 		if err != nil {
 			return err
 		}
+		err = styleWriter.Flush()
+		if err != nil {
+			return err
+		}
 
 		cmd, err = fixCommandParse(response.Completion)
 		if err != nil {
 			return err
 		}
 
-		this.StylePrintf(this.Config.Styles.Question, "Run this command? [y/N]: ")
+		this.StylePrintf(StyleQuestion, "Run this command? [y/N]: ")
 
 		var input string
 		_, err = fmt.Scanln(&input)
@@ -954,7 +1692,7 @@ func (this *ButterfishCtx) execCommand(cmd string) (*executeResult, error) {
 	}
 
 	if this.Config.Verbose > 0 {
-		this.StylePrintf(this.Config.Styles.Question, "exec> %s\n", cmd)
+		this.StylePrintf(StyleQuestion, "exec> %s\n", cmd)
 	}
 	return executeCommand(this.Ctx, cmd, this.Out)
 }
@@ -984,7 +1722,7 @@ func (this *ButterfishCtx) SummarizePaths(paths []string, chunkSize, maxChunks i
 // of both your inputs and outputs. As a rough rule of thumb, 1 token is
 // approximately 4 characters or 0.75 words for English text.
 func (this *ButterfishCtx) SummarizePath(path string, chunkSize, maxChunks int) error {
-	this.StylePrintf(this.Config.Styles.Question, "Summarizing %s\n", path)
+	this.StylePrintf(StyleQuestion, "Summarizing %s\n", path)
 
 	fs := afero.NewOsFs()
 	chunks, err := util.GetFileChunks(this.Ctx, fs, path, chunkSize, maxChunks)
@@ -1004,63 +1742,187 @@ func (this *ButterfishCtx) updateCommandRegister(cmd string) {
 	cmd = strings.TrimSpace(cmd)
 	this.CommandRegister = cmd
 	this.Printf("Command register updated to:\n")
-	this.StylePrintf(this.Config.Styles.Answer, "%s\n", cmd)
+	this.StylePrintf(StyleAnswer, "%s\n", cmd)
 	this.Printf("Run exec or execremote to execute\n")
 }
 
 func (this *ButterfishCtx) SummarizeChunks(chunks [][]byte) error {
-	writer := util.NewStyledWriter(this.Out, this.Config.Styles.Foreground)
-	req := &util.CompletionRequest{
+	_, err := this.Summarize(chunks)
+	return err
+}
+
+// Summarize a document read in chunks, streaming the summary to Out in the
+// summarize style as it arrives so long documents show progress, and return
+// the full summary
+func (this *ButterfishCtx) Summarize(chunks [][]byte) (string, error) {
+	writer := this.teeStream(this.styleWriter(StyleSummarize))
+	summary, err := this.summarize(chunks, writer)
+	if err != nil {
+		return "", err
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return "", err
+	}
+	this.Printf("\n")
+	return summary, nil
+}
+
+// Summarize a document read in chunks and return the summary. If writer is
+// set the summary is streamed to it, otherwise it's requested in one piece,
+// e.g. when summarizing files concurrently. The summaries of pieces of a
+// long document are never streamed, see summarizeChunksPrompt.
+func (this *ButterfishCtx) summarize(chunks [][]byte, writer io.Writer) (string, error) {
+	req, err := this.summarizeRequest()
+	if err != nil {
+		return "", err
+	}
+
+	req.Prompt, err = this.summarizeChunksPrompt(req, chunks)
+	if err != nil {
+		return "", err
+	}
+
+	var resp *util.CompletionResponse
+	if writer != nil {
+		resp, err = this.LLMClient.CompletionStream(req, writer)
+	} else {
+		resp, err = this.LLMClient.Completion(req)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(resp.Completion), nil
+}
+
+// The system message for one-off requests from commands, the shell and goal
+// mode have their own
+func (this *ButterfishCtx) systemMessage() (string, error) {
+	return this.PromptLibrary.GetPrompt(prompt.PromptSystemMessage)
+}
+
+// Request settings shared by the summarize commands, the caller sets Prompt
+func (this *ButterfishCtx) summarizeRequest() (*util.CompletionRequest, error) {
+	sysMsg, err := this.systemMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	return &util.CompletionRequest{
 		Ctx:           this.Ctx,
+		Timeout:       this.Config.RequestTimeout,
 		Model:         this.Config.SummarizeModel,
 		MaxTokens:     this.Config.SummarizeMaxTokens,
 		Temperature:   this.Config.SummarizeTemperature,
-		SystemMessage: "N/A",
+		TopP:          this.Config.SummarizeTopP,
+		SystemMessage: sysMsg,
+		Feature:       FeatureSummarize,
+	}, nil
+}
+
+// Build the prompt for the final summary of a document. If the document fits
+// in the model's context window we summarize it directly. Otherwise we split
+// it into window-sized pieces and summarize each, then summarize groups of
+// those summaries as lists of facts, repeating until the summaries fit in a
+// single prompt. Each round reduces the number of summaries so this ends
+// with at most one summary per group.
+func (this *ButterfishCtx) summarizeChunksPrompt(req *util.CompletionRequest, chunks [][]byte) (string, error) {
+	content := string(bytes.Join(chunks, nil))
+
+	tokenizer, err := this.tokenizerForModel(req.Model)
+	if err != nil {
+		// we can't tell what fits without a tokenizer, summarize directly
+		this.Log.Warnf("Error getting tokenizer for %s, summarizing without a token budget: %s", req.Model, err)
+		return this.PromptLibrary.GetPrompt(prompt.PromptSummarize, "content", content)
 	}
 
-	if len(chunks) == 1 {
+	budget, err := this.summarizeBudget(tokenizer, req, prompt.PromptSummarize)
+	if err != nil {
+		return "", err
+	}
+	if len(tokenizer.Encode(content)) <= budget {
 		// the entire document fits within the token limit, summarize directly
-		prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptSummarize,
-			"content", string(chunks[0]))
+		return this.PromptLibrary.GetPrompt(prompt.PromptSummarize,
+			"content", content)
+	}
+
+	summaries, err := this.summarizePieces(req, prompt.PromptSummarize,
+		splitToTokens(tokenizer, content, budget))
+	if err != nil {
+		return "", err
+	}
+
+	budget, err = this.summarizeBudget(tokenizer, req, prompt.PromptSummarizeListOfFacts)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		groups := groupWithinTokens(tokenizer, summaries, "\n", budget)
+		if len(groups) <= 1 {
+			facts := strings.Join(groups, "\n")
+			return this.PromptLibrary.GetPrompt(prompt.PromptSummarizeListOfFacts,
+				"content", facts)
+		}
+		if len(groups) >= len(summaries) {
+			return "", fmt.Errorf("Unable to summarize, summaries from %s are too long to combine in its context window", req.Model)
+		}
+
+		summaries, err = this.summarizePieces(req, prompt.PromptSummarizeListOfFacts, groups)
 		if err != nil {
-			return err
+			return "", err
 		}
-		req.Prompt = prompt
+	}
+}
 
-		_, err = this.LLMClient.CompletionStream(req, writer)
+// Tokens left spare when fitting content into a summarize prompt, since
+// tokens can merge differently where the content meets the prompt text
+const summarizeSpareTokens = 8
+
+// The number of tokens of content that fit in a summarize prompt, leaving
+// room in the model's context window for the prompt itself and the response
+func (this *ButterfishCtx) summarizeBudget(tokenizer Tokenizer, req *util.CompletionRequest, promptName string) (int, error) {
+	template, err := this.PromptLibrary.GetPrompt(promptName, "content", "")
+	if err != nil {
+		return 0, err
 	}
 
-	// the document doesn't fit within the token limit, we'll iterate over it
-	// and summarize each chunk as facts, then ask for a summary of facts
-	facts := strings.Builder{}
+	budget := this.contextWindowForModel(req.Model) - req.MaxTokens -
+		len(tokenizer.Encode(template)) - summarizeSpareTokens
+	if budget <= 0 {
+		return 0, fmt.Errorf("The context window of %s is too small to summarize with, try fewer max tokens", req.Model)
+	}
+	return budget, nil
+}
 
-	for _, chunk := range chunks {
-		if len(chunk) < 16 { // if we have a tiny chunk, skip it
-			break
+// Summarize each piece of content with the named prompt, returning the
+// non-empty summaries in order
+func (this *ButterfishCtx) summarizePieces(req *util.CompletionRequest, promptName string, pieces []string) ([]string, error) {
+	summaries := []string{}
+
+	for _, piece := range pieces {
+		if strings.TrimSpace(piece) == "" {
+			continue
 		}
 
-		prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptSummarizeFacts,
-			"content", string(chunk))
+		prompt, err := this.PromptLibrary.GetPrompt(promptName, "content", piece)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		req.Prompt = prompt
-		resp, err := this.LLMClient.Completion(req)
+		pieceReq := *req
+		pieceReq.Prompt = prompt
+		resp, err := this.LLMClient.Completion(&pieceReq)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		facts.WriteString(resp.Completion)
-		facts.WriteString("\n")
-	}
 
-	mergedFacts := facts.String()
-	prompt, err := this.PromptLibrary.GetPrompt(prompt.PromptSummarizeListOfFacts,
-		"content", mergedFacts)
-	if err != nil {
-		return err
+		summary := strings.TrimSpace(resp.Completion)
+		if summary != "" {
+			summaries = append(summaries, summary)
+		}
 	}
 
-	req.Prompt = prompt
-	_, err = this.LLMClient.CompletionStream(req, writer)
-	return err
+	return summaries, nil
 }
@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"log"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/mattn/go-runewidth"
+
+	"github.com/bakks/butterfish/util"
 )
 
 // See https://platform.openai.com/docs/models/overview
@@ -27,6 +31,8 @@ var MODEL_TO_NUM_TOKENS = map[string]int{
 	"gpt-4-turbo":                 128000,
 	"gpt-4-turbo-preview":         128000,
 	"gpt-4-turbo-2024-04-09":      128000,
+	"gpt-4o":                      128000,
+	"gpt-4o-mini":                 128000,
 	"gpt-3.5-turbo":               16384,
 	"gpt-3.5-turbo-0301":          4096,
 	"gpt-3.5-turbo-0613":          4096,
@@ -102,27 +108,107 @@ func NumTokensForModel(model string) int {
 
 	// couldn't find model
 	if foundModel == "" {
-		log.Printf("WARNING: Unknown model %s, using default context window size of 2048 tokens", model)
+		util.DefaultLogger().Warnf("Unknown model %s, using default context window size of 2048 tokens", model)
 		return 2048
 	}
 
 	// found simpler model
 	if foundModel != model {
-		log.Printf("WARNING: Unknown model %s, using model %s settings instead with context window size of %d tokens", model, foundModel, numTokens)
+		util.DefaultLogger().Warnf("Unknown model %s, using model %s settings instead with context window size of %d tokens", model, foundModel, numTokens)
 		return numTokens
 	}
 
-	log.Printf("Found model %s context window size of %d tokens", model, numTokens)
+	util.DefaultLogger().Debugf("Found model %s context window size of %d tokens", model, numTokens)
 
 	// normal
 	return numTokens
 }
 
+// Returns true if the model, or a simpler version of its name, is in our
+// table of models
+func IsKnownModel(model string) bool {
+	foundModel, _ := findModelValue(model, MODEL_TO_NUM_TOKENS)
+	return foundModel != ""
+}
+
+// Returns the sorted names of models we know the context window size of
+func KnownModels() []string {
+	models := make([]string, 0, len(MODEL_TO_NUM_TOKENS))
+	for model := range MODEL_TO_NUM_TOKENS {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
+
+// Capabilities of a model served by an LLM backend
+type ModelInfo struct {
+	Name string
+	// Context window size in tokens, 0 if unknown
+	ContextWindow int
+	// Whether the model can be used with CompletionStream
+	Streaming bool
+	// Whether the model calculates embeddings rather than completions
+	Embeddings bool
+	// Whether the model is an edit model, e.g. text-davinci-edit-001
+	Edits bool
+}
+
+// Names of the features that make LLM requests, reported in UsageEvents
+const (
+	FeaturePrompt      = "prompt"
+	FeatureSummarize   = "summarize"
+	FeatureGencmd      = "gencmd"
+	FeatureExeccheck   = "execcheck"
+	FeatureFixCommand  = "fix_command"
+	FeatureQuestion    = "indexquestion"
+	FeatureShellPrompt = "shell_prompt"
+	FeatureGoalMode    = "goal_mode"
+	FeatureAutosuggest = "autosuggest"
+	FeatureEmbeddings  = "embeddings"
+	FeatureUnknown     = "unknown"
+)
+
+// Token usage of a single LLM request, passed to
+// ButterfishConfig.UsageCallback. Streamed responses don't report usage so
+// their token counts are estimated from the text sent and received.
+type UsageEvent struct {
+	Model            string
+	Feature          string
+	PromptTokens     int
+	CompletionTokens int
+	Estimated        bool
+	Latency          time.Duration
+}
+
+// Describe a model based on its name, using our table of context window sizes
+// and naming conventions for embedding and edit models. Custom LLM clients can
+// use this to build a static list for Models().
+func DescribeModel(name string) ModelInfo {
+	info := ModelInfo{Name: name}
+
+	foundModel, numTokens := findModelValue(name, MODEL_TO_NUM_TOKENS)
+	if foundModel != "" {
+		info.ContextWindow = numTokens
+	}
+
+	switch {
+	case strings.Contains(name, "embedding"):
+		info.Embeddings = true
+	case strings.Contains(name, "-edit-"):
+		info.Edits = true
+	case strings.HasPrefix(name, "gpt-") || foundModel != "":
+		info.Streaming = true
+	}
+
+	return info
+}
+
 func NumTokensPerMessageForModel(model string) int {
 	foundModel, numTokens := findModelValue(model, MODEL_TO_TOKENS_PER_MESSAGE)
 
 	if foundModel == "" {
-		log.Printf("WARNING: Unknown model %s, using default num tokens per message 5", model)
+		util.DefaultLogger().Warnf("Unknown model %s, using default num tokens per message 5", model)
 		return 5
 	}
 
@@ -147,9 +233,47 @@ func NewByteMsg(data []byte) *byteMsg {
 	}
 }
 
+// Return the index where an incomplete UTF-8 sequence starts at the end of
+// data, or len(data) if data ends on a rune boundary. Invalid bytes are not
+// held back since no later byte can complete them.
+func incompleteRuneStart(data []byte) int {
+	// a rune is at most 4 bytes so we only look at the last 3
+	for i := len(data) - 1; i >= 0 && i >= len(data)-3; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
+
+// Reads from a PTY can split a multi-byte rune, this holds back the
+// incomplete bytes at the end of one read and joins them to the next
+type runeCarry struct {
+	pending []byte
+}
+
+// Return data prefixed with bytes held back from the last call, minus any
+// incomplete rune at the end
+func (this *runeCarry) Join(data []byte) []byte {
+	if len(this.pending) > 0 {
+		data = append(this.pending, data...)
+		this.pending = nil
+	}
+
+	split := incompleteRuneStart(data)
+	if split < len(data) {
+		this.pending = append([]byte{}, data[split:]...)
+	}
+	return data[:split]
+}
+
 // Given an io.Reader we write byte chunks to a channel
-func readerToChannel(input io.Reader, c chan<- *byteMsg) {
+func readerToChannel(input io.Reader, c chan<- *byteMsg, logger *util.Logger) {
 	buf := make([]byte, 1024*16)
+	carry := &runeCarry{}
 
 	// Loop indefinitely
 	for {
@@ -159,16 +283,26 @@ func readerToChannel(input io.Reader, c chan<- *byteMsg) {
 		// Check for error
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("Error reading from file: %s\n", err)
+				logger.Errorf("Error reading from file: %s", err)
 			}
 			break
 		}
 
-		if n >= 2 && buf[0] == '\x1b' && buf[1] == '[' && !ansiCsiPattern.Match(buf[:n]) {
-			log.Printf("Got incomplete escape sequence: %x, this may not be handled correctly and could indicate something weird going on with the child shell", buf)
+		data := carry.Join(buf[:n])
+		if len(data) == 0 {
+			continue
+		}
+
+		if len(data) >= 2 && data[0] == '\x1b' && data[1] == '[' && !ansiCsiPattern.Match(data) {
+			logger.Warnf("Got incomplete escape sequence: %x, this may not be handled correctly and could indicate something weird going on with the child shell", data)
 		}
 
-		c <- NewByteMsg(buf[:n])
+		c <- NewByteMsg(data)
+	}
+
+	// flush anything held back, it will never be completed
+	if len(carry.pending) > 0 {
+		c <- NewByteMsg(carry.pending)
 	}
 
 	// Close the channel
@@ -201,8 +335,9 @@ func parseCursorPos(data []byte) (int, int, bool) {
 
 // Given an io.Reader we write byte chunks to a channel
 // This is a modified version with a separate channel for cursor position
-func readerToChannelWithPosition(input io.Reader, c chan<- *byteMsg, pos chan<- *cursorPosition) {
+func readerToChannelWithPosition(input io.Reader, c chan<- *byteMsg, pos chan<- *cursorPosition, logger *util.Logger) {
 	buf := make([]byte, 1024*16)
+	carry := &runeCarry{}
 
 	// Loop indefinitely
 	for {
@@ -212,32 +347,35 @@ func readerToChannelWithPosition(input io.Reader, c chan<- *byteMsg, pos chan<-
 		// Check for error
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("Error reading from file: %s\n", err)
+				logger.Errorf("Error reading from file: %s", err)
 			}
 			break
 		}
 
+		data := carry.Join(buf[:n])
+		if len(data) == 0 {
+			continue
+		}
+
 		// if we find a cursor position, extract it from data and write it to the pos chan
-		row, col, found := parseCursorPos(buf[:n])
+		row, col, found := parseCursorPos(data)
 		if found {
 			pos <- &cursorPosition{
 				Row:    row,
 				Column: col,
 			}
 
-			cleaned := cursorPosRegex.ReplaceAll(buf[:n], []byte{})
-			copy(buf, cleaned)
-			n = len(cleaned)
-			if n == 0 {
+			data = cursorPosRegex.ReplaceAll(data, []byte{})
+			if len(data) == 0 {
 				continue
 			}
 		}
 
-		if n >= 2 && buf[0] == '\x1b' && buf[1] == '[' && !ansiCsiPattern.Match(buf[:n]) {
-			log.Printf("Got incomplete escape sequence: %x, this may not be handled correctly and could indicate something weird going on with the child shell", buf)
+		if len(data) >= 2 && data[0] == '\x1b' && data[1] == '[' && !ansiCsiPattern.Match(data) {
+			logger.Warnf("Got incomplete escape sequence: %x, this may not be handled correctly and could indicate something weird going on with the child shell", data)
 		}
 
-		c <- NewByteMsg(buf[:n])
+		c <- NewByteMsg(data)
 	}
 
 	// Close the channel
@@ -287,7 +425,7 @@ func PrintLoggingBox(box LoggingBox) {
 	buf.WriteString("\n")
 	printLoggingBox(box, buf, 0, []string{})
 	buf.WriteString("\033[0m")
-	log.Println(buf.String())
+	util.DefaultLogger().Debugf("%s", buf.String())
 }
 
 // wrap a string based on a rune array, don't worry about spacing or word wrapping
@@ -407,7 +545,7 @@ func GetSystemInfo() string {
 	cmd := exec.Command("uname", "-a")
 	out, err := cmd.Output()
 	if err != nil {
-		log.Println("Error running uname -a: ", err)
+		util.DefaultLogger().Warnf("Error running uname -a: %s", err)
 		return ""
 	}
 	sysInfo = string(out)
@@ -0,0 +1,294 @@
+package butterfish
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/mitchellh/go-homedir"
+)
+
+// Completion responses kept for identical requests, so that re-running the
+// same request, e.g. summarizing the same file while developing, doesn't
+// call the LLM again. Requests are the same if everything sent to the model
+// matches: the model, prompt, system message, temperature, and the rest of
+// the sampling parameters, history, functions, and number of completions.
+// Responses older than TTL aren't used, and once there are MaxEntries the
+// least recently used response is dropped. If Path is set then Load reads
+// the cache from that file and Close writes it back, so that it lasts
+// between runs.
+type CompletionCache struct {
+	MaxEntries int
+	// 0 means responses don't expire
+	TTL  time.Duration
+	Path string
+
+	mutex   sync.Mutex
+	entries map[string]*completionCacheEntry
+	// keys from least to most recently used
+	order []string
+	// replaced in tests
+	now func() time.Time
+}
+
+type completionCacheEntry struct {
+	Key      string
+	Stored   time.Time
+	Response *util.CompletionResponse
+}
+
+func NewCompletionCache(maxEntries int, ttl time.Duration) *CompletionCache {
+	return &CompletionCache{
+		MaxEntries: maxEntries,
+		TTL:        ttl,
+		entries:    map[string]*completionCacheEntry{},
+		now:        time.Now,
+	}
+}
+
+// Answer identical completion requests from a new cache rather than calling
+// the LLM again, see CompletionCache
+func CachingMiddleware(maxEntries int, ttl time.Duration) LLMMiddleware {
+	return NewCompletionCache(maxEntries, ttl).Middleware()
+}
+
+// A middleware answering completion requests from this cache. Embeddings
+// and model lists aren't cached.
+func (this *CompletionCache) Middleware() LLMMiddleware {
+	return func(llm LLM) LLM {
+		return &cachingLLM{LLM: llm, cache: this}
+	}
+}
+
+// The parts of a request that affect the response
+type completionCacheKey struct {
+	Prompt        string
+	Model         string
+	MaxTokens     int
+	Temperature   float32
+	TopP          float32
+	Stop          []string
+	HistoryBlocks []util.HistoryBlock
+	SystemMessage string
+	Functions     []util.FunctionDefinition
+	Tools         []util.ToolDefinition
+	N             int
+}
+
+func cacheKey(request *util.CompletionRequest) (string, error) {
+	// 0 and 1 both ask for one completion
+	n := request.N
+	if n < 1 {
+		n = 1
+	}
+
+	encoded, err := json.Marshal(completionCacheKey{
+		Prompt:        request.Prompt,
+		Model:         request.Model,
+		MaxTokens:     request.MaxTokens,
+		Temperature:   request.Temperature,
+		TopP:          request.TopP,
+		Stop:          request.Stop,
+		HistoryBlocks: request.HistoryBlocks,
+		SystemMessage: request.SystemMessage,
+		Functions:     request.Functions,
+		Tools:         request.Tools,
+		N:             n,
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(encoded)), nil
+}
+
+func (this *CompletionCache) expired(entry *completionCacheEntry) bool {
+	return this.TTL > 0 && this.now().Sub(entry.Stored) >= this.TTL
+}
+
+// Return a copy of the cached response for key and mark it as recently
+// used, or nil if there isn't one or it has expired
+func (this *CompletionCache) Get(key string) *util.CompletionResponse {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entry, ok := this.entries[key]
+	if !ok {
+		return nil
+	}
+	if this.expired(entry) {
+		this.remove(key)
+		return nil
+	}
+
+	this.remove(key)
+	this.add(entry)
+	copied := *entry.Response
+	return &copied
+}
+
+func (this *CompletionCache) Put(key string, response *util.CompletionResponse) {
+	if this.MaxEntries <= 0 || response == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	copied := *response
+	this.remove(key)
+	this.add(&completionCacheEntry{Key: key, Stored: this.now(), Response: &copied})
+}
+
+// The number of responses cached, including any that have expired but
+// haven't been looked up since
+func (this *CompletionCache) Len() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.order)
+}
+
+// Add an entry as the most recently used, dropping the least recently used
+// if we're over MaxEntries. Called with mutex held.
+func (this *CompletionCache) add(entry *completionCacheEntry) {
+	this.entries[entry.Key] = entry
+	this.order = append(this.order, entry.Key)
+
+	for len(this.order) > this.MaxEntries {
+		delete(this.entries, this.order[0])
+		this.order = this.order[1:]
+	}
+}
+
+// Called with mutex held
+func (this *CompletionCache) remove(key string) {
+	if _, ok := this.entries[key]; !ok {
+		return
+	}
+	delete(this.entries, key)
+	for i, existing := range this.order {
+		if existing == key {
+			this.order = append(this.order[:i], this.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Read cached responses from Path, a missing file leaves the cache empty.
+// Expired responses are skipped.
+func (this *CompletionCache) Load() error {
+	if this.Path == "" {
+		return nil
+	}
+	path, err := homedir.Expand(this.Path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []*completionCacheEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return fmt.Errorf("Unable to read response cache %s: %s", path, err)
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, entry := range entries {
+		if entry.Response == nil || this.expired(entry) {
+			continue
+		}
+		this.remove(entry.Key)
+		this.add(entry)
+	}
+	return nil
+}
+
+// Write the cache to Path, least recently used first, if Path is set
+func (this *CompletionCache) Close() error {
+	if this.Path == "" {
+		return nil
+	}
+	path, err := homedir.Expand(this.Path)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	entries := make([]*completionCacheEntry, 0, len(this.order))
+	for _, key := range this.order {
+		if entry := this.entries[key]; !this.expired(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	this.mutex.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+type cachingLLM struct {
+	LLM
+	cache *CompletionCache
+}
+
+// Cached responses are replayed to the writer as if they were streamed
+func (this *cachingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	key, err := cacheKey(request)
+	if err != nil {
+		return this.LLM.CompletionStream(request, writer)
+	}
+
+	if response := this.cache.Get(key); response != nil {
+		_, err = writer.Write([]byte(response.Completion))
+		return response, err
+	}
+
+	response, err := this.LLM.CompletionStream(request, writer)
+	if err == nil {
+		this.cache.Put(key, response)
+	}
+	return response, err
+}
+
+func (this *cachingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	key, err := cacheKey(request)
+	if err != nil {
+		return this.LLM.Completion(request)
+	}
+
+	if response := this.cache.Get(key); response != nil {
+		return response, nil
+	}
+
+	response, err := this.LLM.Completion(request)
+	if err == nil {
+		this.cache.Put(key, response)
+	}
+	return response, err
+}
+
+// Candidates aren't cached, asking for several is asking for variety
+func (this *cachingLLM) CompletionN(request *util.CompletionRequest) ([]string, error) {
+	return CompletionN(this.LLM, request)
+}
@@ -0,0 +1,59 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/joho/godotenv"
+	"github.com/mitchellh/go-homedir"
+)
+
+// Variables taken from a .env file. Others in the file are ignored since a
+// project's .env often holds unrelated secrets that shouldn't end up in the
+// environment of the wrapped shell.
+var envFileVars = append(append(append([]string{}, openAITokenEnvVars...), azureTokenEnvVars...),
+	ModelEnvVar, TemperatureEnvVar, MaxTokensEnvVar, ColorSchemeEnvVar)
+
+// Load the variables butterfish recognizes from a dotenv file at path into
+// the environment with setenv. Variables that are already set, according to
+// lookupEnv, take precedence over the file and are left alone. Quotes,
+// comments, and export prefixes are handled as by godotenv. A missing file
+// isn't an error. Returns the names of the variables that were set.
+func LoadEnvFile(path string, lookupEnv func(string) (string, bool), setenv func(string, string) error) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := godotenv.Read(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read env file %s: %s", path, err)
+	}
+
+	loaded := []string{}
+	for _, name := range envFileVars {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		if _, set := lookupEnv(name); set {
+			continue
+		}
+
+		err = setenv(name, value)
+		if err != nil {
+			return loaded, err
+		}
+		loaded = append(loaded, name)
+	}
+
+	return loaded, nil
+}
@@ -0,0 +1,179 @@
+package butterfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bakks/butterfish/util"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// An LLM that sends each call to the first of LLMs that can serve it. When a
+// call fails because a backend is unavailable, e.g. it's down or rate
+// limiting us, the call is tried again with the next one. Other errors,
+// like an invalid request, would fail the same way everywhere so they're
+// returned immediately.
+type FallbackLLM struct {
+	LLMs []LLM
+}
+
+func NewFallbackLLM(llms ...LLM) *FallbackLLM {
+	return &FallbackLLM{
+		LLMs: llms,
+	}
+}
+
+// Returned when every LLM in a FallbackLLM was unavailable, Errors holds
+// each one's error in order
+type FallbackError struct {
+	Errors []error
+}
+
+func (this *FallbackError) Error() string {
+	messages := make([]string, len(this.Errors))
+	for i, err := range this.Errors {
+		messages[i] = fmt.Sprintf("%d: %s", i+1, err)
+	}
+	return fmt.Sprintf("All %d LLMs failed, %s", len(this.Errors), strings.Join(messages, "; "))
+}
+
+func (this *FallbackError) Unwrap() []error {
+	return this.Errors
+}
+
+// True if err means the backend couldn't serve the call right now, i.e. a
+// rate limit, a server error, a timeout, or a network failure, so another
+// backend might
+func isUnavailable(err error) bool {
+	var netErr net.Error
+	if errors.Is(err, ErrRateLimited) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &netErr) {
+		return true
+	}
+
+	var apiErr *openai.APIError
+	var requestErr *openai.RequestError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode >= http.StatusInternalServerError
+	}
+	if errors.As(err, &requestErr) {
+		return requestErr.HTTPStatusCode >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// Call fn with each LLM in turn until one succeeds or fails with an error
+// that isn't about availability. If the caller's context is done we stop
+// rather than trying the rest.
+func (this *FallbackLLM) try(ctx context.Context, fn func(llm LLM) error) error {
+	if len(this.LLMs) == 0 {
+		return errors.New("No LLMs to send the request to")
+	}
+
+	var errs []error
+	for i, llm := range this.LLMs {
+		err := fn(llm)
+		if err == nil {
+			return nil
+		}
+		if !isUnavailable(err) || (ctx != nil && ctx.Err() != nil) {
+			return err
+		}
+
+		errs = append(errs, err)
+		if i < len(this.LLMs)-1 {
+			util.DefaultLogger().Warnf("LLM %d unavailable, falling back to the next: %s", i+1, err)
+		}
+	}
+
+	return &FallbackError{Errors: errs}
+}
+
+// Counts bytes written through it, so we know whether a failed stream had
+// already shown output
+type countingWriter struct {
+	Writer  io.Writer
+	Written int
+}
+
+func (this *countingWriter) Write(p []byte) (int, error) {
+	n, err := this.Writer.Write(p)
+	this.Written += n
+	return n, err
+}
+
+// Stream from the first available LLM. If a stream fails after some of it
+// was written we can't take that output back, so the error is returned
+// rather than starting again with the next LLM.
+func (this *FallbackLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	var response *util.CompletionResponse
+	var streamErr error
+	counter := &countingWriter{Writer: writer}
+
+	err := this.try(request.Ctx, func(llm LLM) error {
+		var err error
+		response, err = llm.CompletionStream(request, counter)
+		if err != nil && counter.Written > 0 {
+			// stop here, but with the stream's error
+			streamErr = err
+			return nil
+		}
+		return err
+	})
+
+	if streamErr != nil {
+		return response, streamErr
+	}
+	return response, err
+}
+
+func (this *FallbackLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	var response *util.CompletionResponse
+
+	err := this.try(request.Ctx, func(llm LLM) error {
+		var err error
+		response, err = llm.Completion(request)
+		return err
+	})
+
+	return response, err
+}
+
+func (this *FallbackLLM) CompletionN(request *util.CompletionRequest) ([]string, error) {
+	var completions []string
+
+	err := this.try(request.Ctx, func(llm LLM) error {
+		var err error
+		completions, err = CompletionN(llm, request)
+		return err
+	})
+
+	return completions, err
+}
+
+// Embeddings always come from the first LLM, vectors from different models
+// can't be compared so falling back would corrupt the index
+func (this *FallbackLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	if len(this.LLMs) == 0 {
+		return nil, errors.New("No LLMs to send the request to")
+	}
+	return this.LLMs[0].Embeddings(ctx, input, verbose)
+}
+
+func (this *FallbackLLM) Models(ctx context.Context) ([]ModelInfo, error) {
+	var models []ModelInfo
+
+	err := this.try(ctx, func(llm LLM) error {
+		var err error
+		models, err = llm.Models(ctx)
+		return err
+	})
+
+	return models, err
+}
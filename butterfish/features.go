@@ -0,0 +1,52 @@
+package butterfish
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Features that can be turned off with ButterfishConfig.Features
+var ToggleableFeatures = []string{
+	FeatureAutosuggest,
+	FeatureGoalMode,
+	FeatureFixCommand,
+	FeatureQuestion,
+}
+
+// Whether a feature is enabled. Features are on unless Features sets them
+// to false, so a config without Features has everything enabled.
+func (this *ButterfishConfig) FeatureEnabled(name string) bool {
+	enabled, ok := this.Features[name]
+	return !ok || enabled
+}
+
+// Turn a list of feature names, e.g. from a flag, into a Features map with
+// those features disabled. Names must be in ToggleableFeatures.
+func ParseDisabledFeatures(names []string) (map[string]bool, error) {
+	features := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, feature := range ToggleableFeatures {
+			known = known || feature == name
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown feature %q, expected one of %s",
+				name, strings.Join(ToggleableFeatures, ", "))
+		}
+		features[name] = false
+	}
+	return features, nil
+}
+
+// Check a feature before using it, logging at debug level if it's disabled
+func (this *ButterfishCtx) featureEnabled(name string) bool {
+	if this.Config.FeatureEnabled(name) {
+		return true
+	}
+	this.Log.Debugf("Skipping %s, the feature is disabled", name)
+	return false
+}
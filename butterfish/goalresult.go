@@ -0,0 +1,94 @@
+package butterfish
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+// The outcome of a command goal mode ran, given back to the model with the
+// goal mode command result prompt so that success and failure always look
+// the same. Commands run in a terminal so stdout and stderr are combined.
+type GoalModeCommandResult struct {
+	Command  string
+	ExitCode int
+	Output   string
+	Duration time.Duration
+}
+
+// Render the result for the model, output longer than maxOutputBytes is
+// truncated, 0 means no limit
+func (this *GoalModeCommandResult) Format(library PromptLibrary, maxOutputBytes int) (string, error) {
+	result := "success"
+	if this.ExitCode != 0 {
+		result = "failure"
+	}
+
+	output := truncateMiddle(this.Output, maxOutputBytes)
+	if output == "" {
+		output = "(no output)"
+	}
+
+	return library.GetPromptFields(prompt.GoalModeCommandResult,
+		map[string]string{
+			"command":  this.Command,
+			"status":   fmt.Sprintf("%d", this.ExitCode),
+			"result":   result,
+			"duration": formatCommandDuration(this.Duration),
+			"output":   output,
+		})
+}
+
+// Identifies the result when checking whether goal mode is repeating itself,
+// the duration is left out since it varies between identical runs
+func (this *GoalModeCommandResult) repeatKey() string {
+	return fmt.Sprintf("%d\n%s", this.ExitCode, this.Output)
+}
+
+func formatCommandDuration(duration time.Duration) string {
+	if duration < time.Second {
+		return duration.Round(time.Millisecond).String()
+	}
+	return duration.Round(100 * time.Millisecond).String()
+}
+
+// Shorten str to about maxBytes by cutting out the middle, the start of
+// command output usually shows what happened and the end how it finished.
+// A note in place of the cut says how much was removed. A maxBytes of 0
+// means no limit.
+func truncateMiddle(str string, maxBytes int) string {
+	if maxBytes <= 0 || len(str) <= maxBytes {
+		return str
+	}
+
+	// cut on rune boundaries so we don't split a character
+	head := maxBytes / 2
+	for head > 0 && !utf8.RuneStart(str[head]) {
+		head--
+	}
+	tail := len(str) - (maxBytes - head)
+	for tail < len(str) && !utf8.RuneStart(str[tail]) {
+		tail++
+	}
+
+	return str[:head] + truncatedOutputNote(tail-head) + str[tail:]
+}
+
+// Marks where bytes were cut from the middle of output
+func truncatedOutputNote(bytes int) string {
+	return fmt.Sprintf("\n[... %d bytes of output truncated ...]\n", bytes)
+}
+
+// The output of a goal mode command from the raw child output collected
+// while it ran, with control codes and the shell's echo of the command
+// removed
+func goalModeCommandOutput(command, buffer string) string {
+	shellBuffer := NewShellBuffer()
+	shellBuffer.Write(buffer)
+	output := strings.TrimSpace(sanitizeTTYString(shellBuffer.String()))
+	output = strings.TrimPrefix(output, command)
+	return strings.TrimSpace(output)
+}
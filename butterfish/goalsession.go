@@ -0,0 +1,167 @@
+package butterfish
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Status of a saved goal mode session
+const (
+	GoalModeSessionRunning     = "running"
+	GoalModeSessionSuccess     = "success"
+	GoalModeSessionFailure     = "failure"
+	GoalModeSessionAborted     = "aborted"
+	GoalModeSessionInterrupted = "interrupted"
+)
+
+// A command goal mode ran and its result, i.e. the command's output and the
+// response sent to the model
+type GoalModeStep struct {
+	Command string
+	Result  string
+}
+
+// GoalModeSession is goal mode's progress saved to disk so that it can be
+// resumed after goal mode exits, e.g. when the user hits Ctrl-C. It holds the
+// goal, the commands run and their results, and the shell history since goal
+// mode started, which is the context the model is given.
+type GoalModeSession struct {
+	Name     string
+	Goal     string
+	Unsafe   bool
+	Status   string
+	Steps    int
+	Started  time.Time
+	Updated  time.Time
+	Commands []GoalModeStep
+	History  []util.HistoryBlock
+
+	// index in the shell history where this session's blocks start
+	historyStart int
+}
+
+func NewGoalModeSession(goal string, unsafe bool) *GoalModeSession {
+	now := time.Now()
+	return &GoalModeSession{
+		Name:    "goal-" + now.Format("20060102-150405"),
+		Goal:    goal,
+		Unsafe:  unsafe,
+		Status:  GoalModeSessionRunning,
+		Started: now,
+		Updated: now,
+	}
+}
+
+func goalModeSessionPath(dir, name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, filepath.Separator) {
+		return "", fmt.Errorf("Invalid goal mode session name: %q", name)
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// Save the session to dir as <name>.json with secrets removed by redactor,
+// which may be nil. The file is written to a temporary file first and then
+// renamed so that an interrupted save doesn't leave a corrupt session.
+func (this *GoalModeSession) Save(dir string, redactor *Redactor) error {
+	path, err := goalModeSessionPath(dir, this.Name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(this.redacted(redactor), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tempPath := path + ".tmp"
+	err = os.WriteFile(tempPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// A copy of the session with secrets removed from the goal, commands, and
+// history
+func (this *GoalModeSession) redacted(redactor *Redactor) *GoalModeSession {
+	session := *this
+	session.Goal = redactor.Redact(this.Goal)
+
+	session.Commands = make([]GoalModeStep, len(this.Commands))
+	for i, step := range this.Commands {
+		session.Commands[i] = GoalModeStep{
+			Command: redactor.Redact(step.Command),
+			Result:  redactor.Redact(step.Result),
+		}
+	}
+
+	session.History = make([]util.HistoryBlock, len(this.History))
+	for i, block := range this.History {
+		block.Content = redactor.Redact(block.Content)
+		block.FunctionParams = redactor.Redact(block.FunctionParams)
+		session.History[i] = block
+	}
+	return &session
+}
+
+// Load the session with the given name from dir
+func LoadGoalModeSession(dir, name string) (*GoalModeSession, error) {
+	path, err := goalModeSessionPath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("No goal mode session named %s in %s", name, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session := &GoalModeSession{}
+	err = json.Unmarshal(data, session)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading goal mode session %s: %w", path, err)
+	}
+	return session, nil
+}
+
+// List the sessions saved in dir, most recently updated first. A missing
+// directory has no sessions. Files that can't be read as sessions are
+// skipped and an error for each is returned in skipped, so one corrupt file
+// doesn't hide the rest.
+func ListGoalModeSessions(dir string) (sessions []*GoalModeSession, skipped []error, err error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sessions = []*GoalModeSession{}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		session, err := LoadGoalModeSession(dir, name)
+		if err != nil {
+			skipped = append(skipped, err)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].Updated.After(sessions[j].Updated)
+	})
+	return sessions, skipped, nil
+}
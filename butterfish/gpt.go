@@ -7,9 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bakks/butterfish/util"
@@ -39,18 +40,191 @@ func IsLegacyModel(model string) bool {
 
 type GPT struct {
 	client *openai.Client
+
+	// Model used when a request doesn't specify one
+	DefaultModel string
+	// Model used to calculate embeddings
+	EmbeddingModel string
+	// If true then requests for models that aren't in our table or the API's
+	// model list are rejected, this is only set when talking to OpenAI
+	// directly since compatible endpoints can serve arbitrary models
+	ValidateModels bool
+	// How long the result of Models() is cached
+	ModelsCacheTTL time.Duration
+	// Optional limiter that every completion and embedding call waits on,
+	// share one instance between clients to limit them together
+	RateLimiter *RateLimiter
+	// Optional callback reporting the tokens used by each successful request
+	UsageCallback func(UsageEvent)
+	// Logs warnings, e.g. when the model list can't be fetched, nil logs to
+	// the standard logger
+	Log *util.Logger
+
+	// Embeddings splits its input into batches of at most this many strings
+	// and EmbeddingBatchTokens estimated tokens per request, 0 means
+	// DefaultEmbeddingBatchSize and DefaultEmbeddingBatchTokens. A single
+	// string over the token limit is sent on its own.
+	EmbeddingBatchSize   int
+	EmbeddingBatchTokens int
+	// Number of embedding batches requested at once, defaults to 1
+	EmbeddingBatchWorkers int
+
+	models          []ModelInfo
+	modelsFetchedAt time.Time
+	modelsMutex     sync.Mutex
 }
 
-func NewGPT(token, baseUrl string) *GPT {
+const OpenAIBaseURL = "https://api.openai.com/v1"
+
+func NewGPT(token, baseUrl, defaultModel string) *GPT {
 	config := openai.DefaultConfig(token)
 	if baseUrl != "" {
-		config.BaseURL = baseUrl
+		// paths are appended directly, e.g. /chat/completions
+		config.BaseURL = strings.TrimRight(baseUrl, "/")
+	}
+
+	return newGPTWithConfig(config, defaultModel)
+}
+
+// Azure OpenAI API version used if none is configured
+const DefaultAzureAPIVersion = "2024-02-01"
+
+// NewAzureGPT returns a client for an Azure OpenAI resource at endpoint, e.g.
+// https://my-resource.openai.azure.com. Azure routes requests to a deployment
+// rather than a model, see azureDeploymentMapper for the deployments format.
+func NewAzureGPT(token, endpoint, deployments, apiVersion, defaultModel string) *GPT {
+	config := openai.DefaultAzureConfig(token, endpoint)
+	config.APIVersion = DefaultAzureAPIVersion
+	if apiVersion != "" {
+		config.APIVersion = apiVersion
 	}
+	config.AzureModelMapperFunc = azureDeploymentMapper(deployments)
 
+	return newGPTWithConfig(config, defaultModel)
+}
+
+func newGPTWithConfig(config openai.ClientConfig, defaultModel string) *GPT {
 	client := openai.NewClientWithConfig(config)
 
 	return &GPT{
-		client: client,
+		client:         client,
+		DefaultModel:   defaultModel,
+		EmbeddingModel: string(GPTEmbeddingsModel),
+		ValidateModels: config.BaseURL == OpenAIBaseURL,
+		ModelsCacheTTL: time.Hour,
+	}
+}
+
+// Strips characters Azure doesn't allow in deployment names, e.g. gpt-3.5-turbo
+// is conventionally deployed as gpt-35-turbo
+var azureDeploymentNameReplacer = strings.NewReplacer(".", "", ":", "")
+
+// Return a function mapping model names to Azure deployment names.
+// deployments is either a single deployment used for every request, or
+// comma-separated model=deployment pairs, e.g.
+// "gpt-4o=chat,text-embedding-3-small=embed". Models without a pair, or every
+// model if deployments is empty, use a deployment named after the model.
+func azureDeploymentMapper(deployments string) func(model string) string {
+	deployments = strings.TrimSpace(deployments)
+	if deployments != "" && !strings.Contains(deployments, "=") {
+		return func(model string) string {
+			return deployments
+		}
+	}
+
+	mapping := map[string]string{}
+	for _, pair := range strings.Split(deployments, ",") {
+		model, deployment, ok := strings.Cut(pair, "=")
+		if ok {
+			mapping[strings.TrimSpace(model)] = strings.TrimSpace(deployment)
+		}
+	}
+
+	return func(model string) string {
+		if deployment, ok := mapping[model]; ok {
+			return deployment
+		}
+		return azureDeploymentNameReplacer.Replace(model)
+	}
+}
+
+// List the models available from the API, sorted by name. The list is cached
+// for ModelsCacheTTL since it rarely changes.
+func (this *GPT) Models(ctx context.Context) ([]ModelInfo, error) {
+	this.modelsMutex.Lock()
+	defer this.modelsMutex.Unlock()
+
+	// callers get a copy so sorting or appending doesn't change the cache
+	if this.models != nil && time.Since(this.modelsFetchedAt) < this.ModelsCacheTTL {
+		return append([]ModelInfo{}, this.models...), nil
+	}
+
+	list, err := this.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	models := make([]ModelInfo, 0, len(list.Models))
+	for _, model := range list.Models {
+		models = append(models, DescribeModel(model.ID))
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Name < models[j].Name
+	})
+
+	this.models = models
+	this.modelsFetchedAt = time.Now()
+	return append([]ModelInfo{}, models...), nil
+}
+
+// Return a copy of the request with the model filled in from the default if
+// it isn't set, and check that the model is one we know about
+func (this *GPT) resolveModel(request *util.CompletionRequest) (*util.CompletionRequest, error) {
+	resolved := *request
+	if resolved.Model == "" {
+		resolved.Model = this.DefaultModel
+	}
+
+	if resolved.Model == "" {
+		return nil, errors.New("No model set on the request and no default model configured")
+	}
+
+	if this.ValidateModels && !IsKnownModel(resolved.Model) {
+		err := this.checkModelAvailable(resolved.Ctx, resolved.Model)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &resolved, nil
+}
+
+// Check a model missing from our table against the models the API lists,
+// since new models are released faster than the table is updated. If the
+// list can't be fetched we let the API decide.
+func (this *GPT) checkModelAvailable(ctx context.Context, model string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	models, err := this.Models(ctx)
+	if err != nil {
+		this.Log.Warnf("Unable to list models to check %s, sending the request anyway: %s", model, err)
+		return nil
+	}
+
+	names := make([]string, 0, len(models))
+	for _, info := range models {
+		if info.Name == model {
+			return nil
+		}
+		names = append(names, info.Name)
+	}
+
+	return &LLMError{
+		Kind: ErrModelNotFound,
+		Err: fmt.Errorf("Unknown model %s, valid models are: %s",
+			model, strings.Join(names, ", ")),
 	}
 }
 
@@ -107,8 +281,8 @@ func LogCompletionResponse(resp util.CompletionResponse, id string) {
 }
 
 func LogCompletionRequest(req openai.CompletionRequest) {
-	meta := fmt.Sprintf("model:       %s\ntemperature: %f\nmax_tokens:  %d",
-		req.Model, req.Temperature, req.MaxTokens)
+	meta := fmt.Sprintf("model:       %s\ntemperature: %f\ntop_p:       %f\nmax_tokens:  %d",
+		req.Model, req.Temperature, req.TopP, req.MaxTokens)
 
 	box := LoggingBox{
 		Title:   " Completion Request /v1/completions ",
@@ -141,8 +315,8 @@ func replaceNonAscii(s string) string {
 }
 
 func LogChatCompletionRequest(req openai.ChatCompletionRequest) {
-	meta := fmt.Sprintf("model:       %s\ntemperature: %f\nmax_tokens:  %d",
-		req.Model, req.Temperature, req.MaxTokens)
+	meta := fmt.Sprintf("model:       %s\ntemperature: %f\ntop_p:       %f\nmax_tokens:  %d",
+		req.Model, req.Temperature, req.TopP, req.MaxTokens)
 
 	historyBoxes := []LoggingBox{}
 	for _, message := range req.Messages {
@@ -328,11 +502,94 @@ func ShellHistoryBlocksToGPTChat(systemMsg string, blocks []util.HistoryBlock) [
 	return out
 }
 
+// Returned, wrapped, when a request exceeds its Timeout
+var ErrRequestTimeout = errors.New("LLM request timed out")
+
+// If the request has a Timeout then replace its context with one that has a
+// deadline, the returned cancel function must be called to release it.
+// Request should already be a copy from resolveModel.
+func withRequestTimeout(request *util.CompletionRequest) context.CancelFunc {
+	if request.Timeout <= 0 {
+		return func() {}
+	}
+
+	parent := request.Ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	ctx, cancel := context.WithTimeout(parent, request.Timeout)
+	request.Ctx = ctx
+	return cancel
+}
+
+// If the request failed because its own deadline passed, rather than the
+// caller's context being cancelled, return an error wrapping
+// ErrRequestTimeout
+func requestTimeoutError(request *util.CompletionRequest, err error) error {
+	if err == nil || request.Timeout <= 0 ||
+		!errors.Is(request.Ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+
+	return fmt.Errorf("%w after %s", ErrRequestTimeout, request.Timeout)
+}
+
+// Block until the rate limiter, if any, has capacity for a call
+func (this *GPT) waitForCapacity(ctx context.Context, numTokens int) error {
+	if this.RateLimiter == nil {
+		return nil
+	}
+	return this.RateLimiter.Wait(ctx, numTokens)
+}
+
+// Report a request's token usage to UsageCallback, if set
+func (this *GPT) reportUsage(model, feature string, promptTokens, completionTokens int, estimated bool, latency time.Duration) {
+	if this.UsageCallback == nil {
+		return
+	}
+	if feature == "" {
+		feature = FeatureUnknown
+	}
+
+	this.UsageCallback(UsageEvent{
+		Model:            model,
+		Feature:          feature,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		Estimated:        estimated,
+		Latency:          latency,
+	})
+}
+
+// Report the usage of a completion request, estimating it if the API didn't
+// report any
+func (this *GPT) reportCompletionUsage(request *util.CompletionRequest, response *util.CompletionResponse, start time.Time) {
+	if response.UsageEstimated {
+		response.PromptTokens = estimatePromptTokens(request)
+		response.CompletionTokens = estimateCompletionTokens(response)
+	}
+	this.reportUsage(request.Model, request.Feature, response.PromptTokens,
+		response.CompletionTokens, response.UsageEstimated, time.Since(start))
+}
+
 // We're doing completions through the chat API by default, this routes
 // to the legacy completion API if the model is the legacy model.
 func (this *GPT) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	request, err := this.resolveModel(request)
+	if err != nil {
+		return nil, err
+	}
+	// the timeout covers waiting for the rate limiter too
+	cancel := withRequestTimeout(request)
+	defer cancel()
+	err = this.waitForCapacity(request.Ctx, estimateRequestTokens(request))
+	if err != nil {
+		return nil, requestTimeoutError(request, err)
+	}
+	start := time.Now()
+
 	var result *util.CompletionResponse
-	var err error
 
 	if IsCompletionModel(request.Model) {
 		result, err = this.InstructCompletion(request)
@@ -342,12 +599,40 @@ func (this *GPT) Completion(request *util.CompletionRequest) (*util.CompletionRe
 		result, err = this.FullChatCompletion(request)
 	}
 
+	if err == nil && result != nil {
+		this.reportCompletionUsage(request, result, start)
+	}
+
+	err = classifyLLMError(err)
 	// This error means the user needs to set up a subscription, give advice
-	if err != nil && strings.Contains(err.Error(), ERR_429) {
-		err = fmt.Errorf("%s\n\n%s", err.Error(), ERR_429_HELP)
+	if err != nil && (strings.Contains(err.Error(), ERR_429) || isInsufficientQuota(err)) {
+		err = fmt.Errorf("%w\n\n%s", err, ERR_429_HELP)
 	}
 
-	return result, err
+	return result, requestTimeoutError(request, err)
+}
+
+// Ask for request.N candidate completions in one call, returning them with
+// duplicates removed. Streaming doesn't support several candidates so this
+// is only done with Completion.
+func (this *GPT) CompletionN(request *util.CompletionRequest) ([]string, error) {
+	response, err := this.Completion(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response.Choices) == 0 {
+		return dedupCompletions([]string{response.Completion}), nil
+	}
+	return dedupCompletions(response.Choices), nil
+}
+
+// The number of candidates to ask the API for
+func candidates(request *util.CompletionRequest) int {
+	if request.N < 1 {
+		return 1
+	}
+	return request.N
 }
 
 // If the model is legacy or ends with -instruct then it should use completion
@@ -359,8 +644,20 @@ func IsCompletionModel(modelName string) bool {
 // We're doing completions through the chat API by default, this routes
 // to the legacy completion API if the model is the legacy model.
 func (this *GPT) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	request, err := this.resolveModel(request)
+	if err != nil {
+		return nil, err
+	}
+	// the timeout covers waiting for the rate limiter too
+	cancel := withRequestTimeout(request)
+	defer cancel()
+	err = this.waitForCapacity(request.Ctx, estimateRequestTokens(request))
+	if err != nil {
+		return nil, requestTimeoutError(request, err)
+	}
+	start := time.Now()
+
 	var result *util.CompletionResponse
-	var err error
 
 	if IsCompletionModel(request.Model) {
 		result, err = this.InstructCompletionStream(request, writer)
@@ -370,12 +667,17 @@ func (this *GPT) CompletionStream(request *util.CompletionRequest, writer io.Wri
 		result, err = this.FullChatCompletionStream(request, writer)
 	}
 
+	if err == nil && result != nil {
+		this.reportCompletionUsage(request, result, start)
+	}
+
+	err = classifyLLMError(err)
 	// This error means the user needs to set up a subscription, give advice
-	if err != nil && strings.Contains(err.Error(), ERR_429) {
-		err = fmt.Errorf("%s\n\n%s", err.Error(), ERR_429_HELP)
+	if err != nil && (strings.Contains(err.Error(), ERR_429) || isInsufficientQuota(err)) {
+		err = fmt.Errorf("%w\n\n%s", err, ERR_429_HELP)
 	}
 
-	return result, err
+	return result, requestTimeoutError(request, err)
 }
 
 func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
@@ -384,16 +686,23 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 		Model:       request.Model,
 		MaxTokens:   request.MaxTokens,
 		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		Stop:        request.Stop,
 	}
 
 	strBuilder := strings.Builder{}
+	stopFilter := util.NewStopSequenceFilter(req.Stop)
+	var finishReason string
 
 	callback := func(resp openai.CompletionResponse) {
 		if resp.Choices == nil || len(resp.Choices) == 0 {
 			return
 		}
+		if resp.Choices[0].FinishReason != "" {
+			finishReason = resp.Choices[0].FinishReason
+		}
 
-		text := resp.Choices[0].Text
+		text, _ := stopFilter.Filter(resp.Choices[0].Text)
 		writer.Write([]byte(text))
 		strBuilder.WriteString(text)
 	}
@@ -416,11 +725,25 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 
 		callback(response)
 		id = response.ID
+
+		// the server should have stopped already but we stop locally in case
+		// the backend doesn't support stop sequences
+		if stopFilter.Stopped() {
+			finishReason = util.FinishReasonStop
+			stream.Close()
+			break
+		}
 	}
+
+	pending := stopFilter.Flush()
+	writer.Write([]byte(pending))
+	strBuilder.WriteString(pending)
 	fmt.Fprintf(writer, "\n") // GPT doesn't finish with a newline
 
 	response := util.CompletionResponse{
-		Completion: strBuilder.String(),
+		Completion:     strBuilder.String(),
+		UsageEstimated: true,
+		FinishReason:   finishReason,
 	}
 
 	if request.Verbose {
@@ -431,30 +754,52 @@ func (this *GPT) InstructCompletionStream(request *util.CompletionRequest, write
 }
 
 func (this *GPT) SimpleChatCompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	req, err := chatCompletionRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.doChatStreamCompletion(request.Ctx, req, writer, request.TokenTimeout, request.Verbose)
+}
+
+// Build the chat messages for a request: the system message in the system
+// role, then any history, then the prompt as a user message. Every chat
+// request needs a system message, features get theirs from the prompt
+// library, e.g. prompt.PromptSystemMessage.
+func chatMessages(request *util.CompletionRequest) ([]openai.ChatCompletionMessage, error) {
 	if request.SystemMessage == "" {
-		return nil, errors.New("system message required for full chat completion")
+		return nil, errors.New("System message required for chat completion")
 	}
 
-	req := openai.ChatCompletionRequest{
-		Model: request.Model,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    "system",
-				Content: request.SystemMessage,
-			},
-			{
-				Role:    "user",
-				Content: request.Prompt,
-			},
-		},
+	messages := ShellHistoryBlocksToGPTChat(request.SystemMessage, request.HistoryBlocks)
+	if request.Prompt != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    "user",
+			Content: request.Prompt,
+		})
+	}
+
+	return messages, nil
+}
+
+// Translate a request to an OpenAI chat completion request
+func chatCompletionRequest(request *util.CompletionRequest) (openai.ChatCompletionRequest, error) {
+	messages, err := chatMessages(request)
+	if err != nil {
+		return openai.ChatCompletionRequest{}, err
+	}
+
+	return openai.ChatCompletionRequest{
+		Model:       request.Model,
+		Messages:    messages,
 		MaxTokens:   request.MaxTokens,
 		Temperature: request.Temperature,
-		N:           1,
+		TopP:        request.TopP,
+		Stop:        request.Stop,
+		N:           candidates(request),
 		Functions:   convertToOpenaiFunctions(request.Functions),
 		Tools:       convertToOpenaiTools(request.Tools),
-	}
-
-	return this.doChatStreamCompletion(request.Ctx, req, writer, request.TokenTimeout, request.Verbose)
+	}, nil
 }
 
 func convertToOpenaiFunctions(funcs []util.FunctionDefinition) []openai.FunctionDefinition {
@@ -495,27 +840,9 @@ func convertToOpenaiTools(tools []util.ToolDefinition) []openai.Tool {
 }
 
 func (this *GPT) FullChatCompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
-	gptHistory := ShellHistoryBlocksToGPTChat(request.SystemMessage, request.HistoryBlocks)
-
-	if len(gptHistory) == 0 || gptHistory[0].Role != "system" {
-		return nil, errors.New("System message required for full chat completion")
-	}
-
-	if request.Prompt != "" {
-		gptHistory = append(gptHistory, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: request.Prompt,
-		})
-	}
-
-	req := openai.ChatCompletionRequest{
-		Model:       request.Model,
-		Messages:    gptHistory,
-		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
-		N:           1,
-		Functions:   convertToOpenaiFunctions(request.Functions),
-		Tools:       convertToOpenaiTools(request.Tools),
+	req, err := chatCompletionRequest(request)
+	if err != nil {
+		return nil, err
 	}
 
 	return this.doChatStreamCompletion(
@@ -533,6 +860,8 @@ func (this *GPT) doChatStreamCompletion(
 	var functionName string
 	var functionArgs strings.Builder
 	var toolCalls []*util.ToolCall
+	var finishReason string
+	stopFilter := util.NewStopSequenceFilter(req.Stop)
 
 	// We already have a context that sets an overall timeout, but we also
 	// want to timeout if we don't get a chunk back for a while.
@@ -573,6 +902,9 @@ func (this *GPT) doChatStreamCompletion(
 		if resp.Choices == nil || len(resp.Choices) == 0 {
 			return
 		}
+		if resp.Choices[0].FinishReason != "" {
+			finishReason = string(resp.Choices[0].FinishReason)
+		}
 
 		text := resp.Choices[0].Delta.Content
 		functionCall := resp.Choices[0].Delta.FunctionCall
@@ -584,12 +916,11 @@ func (this *GPT) doChatStreamCompletion(
 		if functionCall != nil {
 			if functionCall.Name != "" {
 				functionName = functionCall.Name
-				printWriter.Write([]byte(functionName))
-				printWriter.Write([]byte("("))
+				util.WriteFunctionCall(printWriter, []byte(functionName+"("))
 			}
 			if functionCall.Arguments != "" {
 				functionArgs.WriteString(functionCall.Arguments)
-				printWriter.Write([]byte(functionCall.Arguments))
+				util.WriteFunctionCall(printWriter, []byte(functionCall.Arguments))
 			}
 		}
 
@@ -615,12 +946,11 @@ func (this *GPT) doChatStreamCompletion(
 				}
 				if name != "" {
 					toolCall.Function.Name += name
-					printWriter.Write([]byte(name))
-					printWriter.Write([]byte("("))
+					util.WriteFunctionCall(printWriter, []byte(name+"("))
 				}
 				if args != "" {
 					toolCall.Function.Parameters += args
-					printWriter.Write([]byte(args))
+					util.WriteFunctionCall(printWriter, []byte(args))
 				}
 			}
 		}
@@ -629,6 +959,7 @@ func (this *GPT) doChatStreamCompletion(
 			return
 		}
 
+		text, _ = stopFilter.Filter(text)
 		printWriter.Write([]byte(text))
 		responseContent.WriteString(text)
 	}
@@ -670,11 +1001,23 @@ func (this *GPT) doChatStreamCompletion(
 
 		callback(response)
 		id = response.ID
+
+		// the server should have stopped already but we stop locally in case
+		// the backend doesn't support stop sequences
+		if stopFilter.Stopped() {
+			finishReason = util.FinishReasonStop
+			stream.Close()
+			break
+		}
 	}
 
+	pending := stopFilter.Flush()
+	printWriter.Write([]byte(pending))
+	responseContent.WriteString(pending)
+
 	// this doesn't yet handle multiple tool calls
 	if functionName != "" || len(toolCalls) > 0 {
-		printWriter.Write([]byte(")"))
+		util.WriteFunctionCall(printWriter, []byte(")"))
 	}
 
 	fmt.Fprintf(printWriter, "\n") // GPT doesn't finish with a newline
@@ -684,6 +1027,8 @@ func (this *GPT) doChatStreamCompletion(
 		FunctionName:       functionName,
 		ToolCalls:          toolCalls,
 		FunctionParameters: functionArgs.String(),
+		UsageEstimated:     true,
+		FinishReason:       finishReason,
 	}
 
 	if verbose {
@@ -698,7 +1043,10 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 		Model:       request.Model,
 		MaxTokens:   request.MaxTokens,
 		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		Stop:        request.Stop,
 		Prompt:      request.Prompt,
+		N:           candidates(request),
 	}
 
 	if request.Verbose {
@@ -719,7 +1067,15 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 	text = strings.TrimSpace(text)
 
 	response := util.CompletionResponse{
-		Completion: text,
+		Completion:       text,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+		FinishReason:     resp.Choices[0].FinishReason,
+	}
+	if len(resp.Choices) > 1 {
+		for _, choice := range resp.Choices {
+			response.Choices = append(response.Choices, strings.TrimSpace(choice.Text))
+		}
 	}
 
 	if request.Verbose {
@@ -729,52 +1085,18 @@ func (this *GPT) InstructCompletion(request *util.CompletionRequest) (*util.Comp
 }
 
 func (this *GPT) FullChatCompletion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
-	gptHistory := ShellHistoryBlocksToGPTChat(request.SystemMessage, request.HistoryBlocks)
-
-	if request.Prompt != "" {
-		gptHistory = append(gptHistory, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: request.Prompt,
-		})
-	}
-
-	if len(gptHistory) == 0 || gptHistory[0].Role != "system" {
-		return nil, errors.New("System message required for full chat completion")
-	}
-
-	req := openai.ChatCompletionRequest{
-		Model:       request.Model,
-		Messages:    gptHistory,
-		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
-		N:           1,
-		Functions:   convertToOpenaiFunctions(request.Functions),
+	req, err := chatCompletionRequest(request)
+	if err != nil {
+		return nil, err
 	}
 
 	return this.doChatCompletion(request.Ctx, req, request.Verbose)
 }
 
 func (this *GPT) SimpleChatCompletion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
-	if request.SystemMessage == "" {
-		return nil, errors.New("system message is required for full chat completion")
-	}
-
-	req := openai.ChatCompletionRequest{
-		Model: request.Model,
-		Messages: []openai.ChatCompletionMessage{
-			{
-				Role:    "system",
-				Content: request.SystemMessage,
-			},
-			{
-				Role:    "user",
-				Content: request.Prompt,
-			},
-		},
-		MaxTokens:   request.MaxTokens,
-		Temperature: request.Temperature,
-		N:           1,
-		Functions:   convertToOpenaiFunctions(request.Functions),
+	req, err := chatCompletionRequest(request)
+	if err != nil {
+		return nil, err
 	}
 
 	return this.doChatCompletion(request.Ctx, req, request.Verbose)
@@ -795,10 +1117,21 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 		return nil, err
 	}
 
+	if len(resp.Choices) == 0 {
+		return nil, errors.New("No completions returned from a chat completion request with 200 response.")
+	}
 	responseText := resp.Choices[0].Message.Content
 
 	response := util.CompletionResponse{
-		Completion: responseText,
+		Completion:       responseText,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+		FinishReason:     string(resp.Choices[0].FinishReason),
+	}
+	if len(resp.Choices) > 1 {
+		for _, choice := range resp.Choices {
+			response.Choices = append(response.Choices, choice.Message.Content)
+		}
 	}
 
 	funcCall := resp.Choices[0].Message.FunctionCall
@@ -807,6 +1140,17 @@ func (this *GPT) doChatCompletion(ctx context.Context, request openai.ChatComple
 		response.FunctionParameters = funcCall.Arguments
 	}
 
+	for _, toolCall := range resp.Choices[0].Message.ToolCalls {
+		response.ToolCalls = append(response.ToolCalls, &util.ToolCall{
+			Id:   toolCall.ID,
+			Type: string(toolCall.Type),
+			Function: util.FunctionCall{
+				Name:       toolCall.Function.Name,
+				Parameters: toolCall.Function.Arguments,
+			},
+		})
+	}
+
 	if verbose {
 		LogCompletionResponse(response, resp.ID)
 	}
@@ -818,16 +1162,16 @@ const GPTEmbeddingsModel = openai.AdaEmbeddingV2
 
 func withExponentialBackoff(f func() error) error {
 	for i := 0; ; i++ {
-		err := f()
+		err := classifyLLMError(f())
 
-		if err != nil && strings.Contains(err.Error(), "429") {
-			// TODO should probably have a better error detection
+		// being out of credits is also a 429 but waiting won't fix it
+		if errors.Is(err, ErrRateLimited) && !isInsufficientQuota(err) {
 			sleepTime := time.Duration(math.Pow(1.6, float64(i+1))) * time.Second
-			log.Printf("Rate limited, sleeping for %s\n", sleepTime)
+			util.DefaultLogger().Warnf("Rate limited, sleeping for %s", sleepTime)
 			time.Sleep(sleepTime)
 
 			if i > 3 {
-				return fmt.Errorf("Getting 429s from OpenAI API, this means you're hitting the rate limit, giving up after %d retries", i)
+				return fmt.Errorf("Getting 429s from OpenAI API, this means you're hitting the rate limit, giving up after %d retries: %w", i, err)
 			}
 			continue
 		}
@@ -835,12 +1179,16 @@ func withExponentialBackoff(f func() error) error {
 	}
 }
 
-func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
-	req := openai.EmbeddingRequest{
-		Input: input,
-		Model: GPTEmbeddingsModel,
-	}
+// Limits on a single embeddings request, the API accepts at most 2048
+// inputs and about 300k tokens per request
+const DefaultEmbeddingBatchSize = 2048
+const DefaultEmbeddingBatchTokens = 300000
 
+// Calculate embeddings for input, returned in the same order. Input is sent
+// in batches under the EmbeddingBatchSize and EmbeddingBatchTokens limits,
+// up to EmbeddingBatchWorkers at once. If any batch fails then the others
+// are cancelled and only the error is returned.
+func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
 	if verbose {
 		summary := fmt.Sprintf("Embedding %d strings: [", len(input))
 		for i, s := range input {
@@ -855,9 +1203,113 @@ func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) (
 		fmt.Printf("%s\n", summary)
 	}
 
+	maxItems := this.EmbeddingBatchSize
+	if maxItems <= 0 {
+		maxItems = DefaultEmbeddingBatchSize
+	}
+	maxTokens := this.EmbeddingBatchTokens
+	if maxTokens <= 0 {
+		maxTokens = DefaultEmbeddingBatchTokens
+	}
+	batches := splitEmbeddingBatches(input, maxItems, maxTokens)
+	if len(batches) == 1 {
+		return this.embeddingBatch(ctx, batches[0])
+	}
+
+	workers := this.EmbeddingBatchWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([][][]float32, len(batches))
+	semaphore := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	var firstErr error
+	errOnce := sync.Once{}
+
+	for i, batch := range batches {
+		semaphore <- struct{}{}
+		if ctx.Err() != nil {
+			<-semaphore
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, batch []string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			embeddings, err := this.embeddingBatch(ctx, batch)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("Embedding batch %d of %d failed: %w", i+1, len(batches), err)
+					cancel()
+				})
+				return
+			}
+			results[i] = embeddings
+		}(i, batch)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	embeddings := make([][]float32, 0, len(input))
+	for _, result := range results {
+		embeddings = append(embeddings, result...)
+	}
+	return embeddings, nil
+}
+
+// Split input into consecutive batches of at most maxItems strings and
+// maxTokens estimated tokens, a string over maxTokens gets a batch of its
+// own. Empty input is one empty batch.
+func splitEmbeddingBatches(input []string, maxItems, maxTokens int) [][]string {
+	batches := [][]string{}
+	start, tokens := 0, 0
+
+	for i, s := range input {
+		// estimated like the rate limiter, about 4 bytes per token
+		itemTokens := len(s) / 4
+		if i > start && (i-start >= maxItems || tokens+itemTokens > maxTokens) {
+			batches = append(batches, input[start:i])
+			start, tokens = i, 0
+		}
+		tokens += itemTokens
+	}
+
+	return append(batches, input[start:])
+}
+
+// Request embeddings for a single batch of input
+func (this *GPT) embeddingBatch(ctx context.Context, input []string) ([][]float32, error) {
+	req := openai.EmbeddingRequest{
+		Input: input,
+		Model: openai.EmbeddingModel(this.EmbeddingModel),
+	}
+
+	numBytes := 0
+	for _, s := range input {
+		numBytes += len(s)
+	}
+	err := this.waitForCapacity(ctx, numBytes/4)
+	if err != nil {
+		return nil, err
+	}
+
 	result := [][]float32{}
+	promptTokens := 0
+	start := time.Now()
 
-	err := withExponentialBackoff(func() error {
+	err = withExponentialBackoff(func() error {
 		resp, err := this.client.CreateEmbeddings(ctx, req)
 		if err != nil {
 			return err
@@ -866,8 +1318,13 @@ func (this *GPT) Embeddings(ctx context.Context, input []string, verbose bool) (
 		for _, embedding := range resp.Data {
 			result = append(result, embedding.Embedding)
 		}
+		promptTokens = resp.Usage.PromptTokens
 		return nil
 	})
 
-	return result, err
+	if err == nil {
+		this.reportUsage(this.EmbeddingModel, FeatureEmbeddings, promptTokens, 0, false, time.Since(start))
+	}
+
+	return result, classifyLLMError(err)
 }
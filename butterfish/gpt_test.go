@@ -0,0 +1,1255 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake OpenAI-compatible server that answers chat completions and records
+// the decoded request bodies
+type fakeOpenAIServer struct {
+	*httptest.Server
+	Requests []map[string]any
+	mutex    sync.Mutex
+}
+
+func newFakeOpenAIServer(t *testing.T, reply string) *fakeOpenAIServer {
+	server := &fakeOpenAIServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]any{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		assert.NoError(t, err)
+
+		server.mutex.Lock()
+		server.Requests = append(server.Requests, body)
+		server.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id": "test", "object": "chat.completion", "model": %q,
+			"choices": [{"index": 0, "finish_reason": "stop",
+			"message": {"role": "assistant", "content": %q}}]}`, body["model"], reply)
+	}))
+	return server
+}
+
+func TestGPTRequestModelOverridesDefault(t *testing.T) {
+	server := newFakeOpenAIServer(t, "hello")
+	defer server.Close()
+
+	gpt := NewGPT("token", server.URL, "default-model")
+
+	request := &util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+	}
+
+	// no model on the request means we use the default
+	response, err := gpt.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", response.Completion)
+	assert.Equal(t, "default-model", server.Requests[0]["model"])
+	assert.Equal(t, "", request.Model)
+
+	// the request model wins over the default
+	request.Model = "request-model"
+	_, err = gpt.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "request-model", server.Requests[1]["model"])
+}
+
+func TestGPTUnknownModel(t *testing.T) {
+	gpt := NewGPT("token", "", "gpt-4-turbo")
+	assert.True(t, gpt.ValidateModels)
+
+	// models missing from our table are checked against the API's list
+	listed := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !listed {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"object": "list", "data": [
+			{"id": "gpt-4.1", "object": "model", "owned_by": "system"},
+			{"id": "o3-mini", "object": "model", "owned_by": "system"}]}`)
+	}))
+	defer server.Close()
+
+	gpt = NewGPT("token", server.URL, "gpt-4-turbo")
+	gpt.ValidateModels = true
+
+	request := &util.CompletionRequest{
+		Ctx:   context.Background(),
+		Model: "gpt-17-ultra",
+	}
+	_, err := gpt.Completion(request)
+	assert.ErrorIs(t, err, ErrModelNotFound)
+	assert.ErrorContains(t, err, "Unknown model gpt-17-ultra")
+	assert.ErrorContains(t, err, "o3-mini")
+
+	// models newer than our table are fine if the API lists them
+	resolved, err := gpt.resolveModel(&util.CompletionRequest{Model: "o3-mini"})
+	assert.NoError(t, err)
+	assert.Equal(t, "o3-mini", resolved.Model)
+
+	// dated variants of known models don't need the list
+	resolved, err = gpt.resolveModel(&util.CompletionRequest{Model: "gpt-4-0613"})
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4-0613", resolved.Model)
+
+	// if the list can't be fetched the API decides
+	listed = false
+	gpt.ModelsCacheTTL = 0
+	_, err = gpt.resolveModel(&util.CompletionRequest{Model: "gpt-17-ultra"})
+	assert.NoError(t, err)
+
+	// we don't know what models a custom endpoint serves
+	gpt = NewGPT("token", "http://localhost:8080/v1", "llama")
+	assert.False(t, gpt.ValidateModels)
+	_, err = gpt.resolveModel(&util.CompletionRequest{Model: "gpt-17-ultra"})
+	assert.NoError(t, err)
+}
+
+func TestGPTModels(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/models", r.URL.Path)
+		requests++
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"object": "list", "data": [
+			{"id": "gpt-4o", "object": "model", "owned_by": "system"},
+			{"id": "text-embedding-3-small", "object": "model", "owned_by": "system"},
+			{"id": "gpt-3.5-turbo-0125", "object": "model", "owned_by": "system"},
+			{"id": "code-davinci-edit-001", "object": "model", "owned_by": "system"},
+			{"id": "dall-e-3", "object": "model", "owned_by": "system"}]}`)
+	}))
+	defer server.Close()
+
+	gpt := NewGPT("token", server.URL, "gpt-4o")
+
+	models, err := gpt.Models(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []ModelInfo{
+		{Name: "code-davinci-edit-001", Edits: true},
+		{Name: "dall-e-3"},
+		{Name: "gpt-3.5-turbo-0125", ContextWindow: 16384, Streaming: true},
+		{Name: "gpt-4o", ContextWindow: 128000, Streaming: true},
+		{Name: "text-embedding-3-small", Embeddings: true},
+	}, models)
+
+	// the second call is served from the cache, changing the first result
+	// doesn't change it
+	models[0].Name = "changed"
+	models, err = gpt.Models(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, "code-davinci-edit-001", models[0].Name)
+
+	gpt.ModelsCacheTTL = 0
+	_, err = gpt.Models(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+}
+
+func TestGPTRequestTimeout(t *testing.T) {
+	// a server that never answers until the client gives up
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	gpt := NewGPT("token", server.URL, "gpt-4")
+
+	request := &util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+		Timeout:       50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	_, err := gpt.Completion(request)
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	_, err = gpt.CompletionStream(request, io.Discard)
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+
+	// the caller's own context being cancelled isn't a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request.Ctx = ctx
+	_, err = gpt.Completion(request)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrRequestTimeout)
+}
+
+func TestGPTFunctionCalling(t *testing.T) {
+	var body map[string]any
+	reply := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = map[string]any{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, reply)
+	}))
+	defer server.Close()
+
+	gpt := NewGPT("token", server.URL, "gpt-4")
+	function := util.FunctionDefinition{
+		Name:        "command",
+		Description: "Run a command",
+	}
+
+	// a legacy function call
+	reply = `{"id": "1", "choices": [{"index": 0, "finish_reason": "function_call",
+		"message": {"role": "assistant", "content": "",
+		"function_call": {"name": "command", "arguments": "{\"cmd\": \"ls\"}"}}}]}`
+
+	response, err := gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "list files",
+		SystemMessage: "system",
+		Functions:     []util.FunctionDefinition{function},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "command", body["functions"].([]any)[0].(map[string]any)["name"])
+	assert.Equal(t, &util.FunctionCall{Name: "command", Parameters: `{"cmd": "ls"}`},
+		response.CalledFunction())
+
+	// a tool call, tools are passed through on non-streaming requests too
+	reply = `{"id": "2", "choices": [{"index": 0, "finish_reason": "tool_calls",
+		"message": {"role": "assistant", "content": "",
+		"tool_calls": [{"id": "call_1", "type": "function",
+		"function": {"name": "command", "arguments": "{\"cmd\": \"pwd\"}"}}]}}]}`
+
+	response, err = gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "where am I",
+		SystemMessage: "system",
+		Tools:         []util.ToolDefinition{{Type: "function", Function: function}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, body["tools"], 1)
+	assert.Equal(t, "", response.FunctionName)
+	assert.Equal(t, "call_1", response.ToolCalls[0].Id)
+	assert.Equal(t, &util.FunctionCall{Name: "command", Parameters: `{"cmd": "pwd"}`},
+		response.CalledFunction())
+
+	// plain text has no function call
+	reply = `{"id": "3", "choices": [{"index": 0, "finish_reason": "stop",
+		"message": {"role": "assistant", "content": "hello"}}]}`
+	response, err = gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, response.CalledFunction())
+}
+
+func TestGPTSamplingParameters(t *testing.T) {
+	server := newFakeOpenAIServer(t, "hello")
+	defer server.Close()
+
+	gpt := NewGPT("token", server.URL, "default-model")
+
+	_, err := gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+		Temperature:   0.25,
+		TopP:          0.5,
+	})
+	assert.NoError(t, err)
+
+	// a TopP of 0 is left out so the API default applies
+	_, err = gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+		Temperature:   0.25,
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, len(server.Requests))
+	assert.Equal(t, 0.25, server.Requests[0]["temperature"])
+	assert.Equal(t, 0.5, server.Requests[0]["top_p"])
+	assert.NotContains(t, server.Requests[1], "top_p")
+}
+
+func TestCompletionN(t *testing.T) {
+	// OpenAI returns all the candidates from one request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]any{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, float64(3), body["n"])
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": "test", "object": "chat.completion", "model": "gpt-4",
+			"choices": [
+			{"index": 0, "finish_reason": "stop", "message": {"role": "assistant", "content": "ls -la"}},
+			{"index": 1, "finish_reason": "stop", "message": {"role": "assistant", "content": "ls -l"}},
+			{"index": 2, "finish_reason": "stop", "message": {"role": "assistant", "content": "ls -la"}}]}`)
+	}))
+	defer server.Close()
+
+	request := &util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "list files",
+		SystemMessage: "system",
+		N:             3,
+	}
+	completions, err := CompletionN(NewGPT("token", server.URL, "gpt-4"), request)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ls -la", "ls -l"}, completions)
+
+	// other LLMs are called N times
+	llm := &fakeLLM{Responses: []*util.CompletionResponse{
+		{Completion: "git status"},
+		{Completion: "git status"},
+		{Completion: ""},
+		{Completion: "git diff"},
+	}}
+	request.N = 4
+	completions, err = CompletionN(llm, request)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"git status", "git diff"}, completions)
+	assert.Equal(t, 4, len(llm.Requests))
+
+	// an N of 0 asks for one
+	llm = &fakeLLM{Responses: []*util.CompletionResponse{{Completion: "pwd"}}}
+	request.N = 0
+	completions, err = CompletionN(llm, request)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pwd"}, completions)
+	assert.Equal(t, 1, len(llm.Requests))
+
+	// and errors stop the loop
+	failing := &failingLLM{Err: errors.New("down")}
+	request.N = 3
+	_, err = CompletionN(failing, request)
+	assert.Error(t, err)
+	assert.Equal(t, 1, failing.Calls)
+
+	// a fallback passes the request on to the first LLM that's available
+	completions, err = CompletionN(NewFallbackLLM(
+		&failingLLM{Err: context.DeadlineExceeded},
+		&fakeLLM{Responses: []*util.CompletionResponse{{Completion: "a"}, {Completion: "b"}}},
+	), &util.CompletionRequest{Ctx: context.Background(), N: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, completions)
+}
+
+// A fake server that streams a chat completion back in the given chunks and
+// ignores any stop sequences, like a backend without server side stops
+func newFakeOpenAIStreamServer(t *testing.T, chunks []string) *fakeOpenAIServer {
+	server := &fakeOpenAIServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]any{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		assert.NoError(t, err)
+
+		server.mutex.Lock()
+		server.Requests = append(server.Requests, body)
+		server.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, `data: {"id": "test", "object": "chat.completion.chunk", "model": %q, `+
+				`"choices": [{"index": 0, "delta": {"content": %q}}]}`, body["model"], chunk)
+			fmt.Fprintf(w, "\n\n")
+		}
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+	}))
+	return server
+}
+
+func TestGPTStopSequences(t *testing.T) {
+	server := newFakeOpenAIServer(t, "ls")
+	defer server.Close()
+
+	gpt := NewGPT("token", server.URL, "default-model")
+
+	_, err := gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+		Stop:          []string{"\n"},
+	})
+	assert.NoError(t, err)
+
+	// no stop sequences are left out of the request
+	_, err = gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []any{"\n"}, server.Requests[0]["stop"])
+	assert.NotContains(t, server.Requests[1], "stop")
+}
+
+// The stream should be cut at the stop sequence even if the server keeps
+// going, including when the stop sequence is split across chunks
+func TestGPTStreamLocalStop(t *testing.T) {
+	server := newFakeOpenAIStreamServer(t, []string{"ls -la", " /tmp\nrm", " -rf /"})
+	defer server.Close()
+
+	gpt := NewGPT("token", server.URL, "default-model")
+
+	var output strings.Builder
+	response, err := gpt.CompletionStream(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+		Stop:          []string{"\n"},
+	}, &output)
+	assert.NoError(t, err)
+	assert.Equal(t, "ls -la /tmp", response.Completion)
+	assert.Equal(t, "ls -la /tmp\n", output.String())
+
+	server = newFakeOpenAIStreamServer(t, []string{"one two ST", "OP three"})
+	defer server.Close()
+
+	gpt = NewGPT("token", server.URL, "default-model")
+
+	output.Reset()
+	response, err = gpt.CompletionStream(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+		Stop:          []string{"STOP"},
+	}, &output)
+	assert.NoError(t, err)
+	assert.Equal(t, "one two ", response.Completion)
+	assert.Equal(t, "one two \n", output.String())
+}
+
+// The system message is sent in the system role ahead of any history, and
+// the prompt is sent alone as the user message
+func TestGPTSystemMessageRole(t *testing.T) {
+	server := newFakeOpenAIServer(t, "hello")
+	defer server.Close()
+	streamServer := newFakeOpenAIStreamServer(t, []string{"hello"})
+	defer streamServer.Close()
+
+	history := []util.HistoryBlock{
+		{Type: historyTypeShellInput, Content: "ls"},
+		{Type: historyTypeLLMOutput, Content: "try ls -la"},
+	}
+
+	_, err := NewGPT("token", server.URL, "default-model").Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "be brief",
+	})
+	assert.NoError(t, err)
+	_, err = NewGPT("token", server.URL, "default-model").Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "be brief",
+		HistoryBlocks: history,
+	})
+	assert.NoError(t, err)
+	_, err = NewGPT("token", streamServer.URL, "default-model").CompletionStream(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "be brief",
+		HistoryBlocks: history,
+	}, io.Discard)
+	assert.NoError(t, err)
+
+	requests := append(server.Requests, streamServer.Requests...)
+	assert.Equal(t, 3, len(requests))
+	for i, request := range requests {
+		messages := request["messages"].([]any)
+		first := messages[0].(map[string]any)
+		last := messages[len(messages)-1].(map[string]any)
+		assert.Equal(t, "system", first["role"], i)
+		assert.Equal(t, "be brief", first["content"], i)
+		assert.Equal(t, "user", last["role"], i)
+		assert.Equal(t, "hi", last["content"], i)
+	}
+	assert.Equal(t, 2, len(requests[0]["messages"].([]any)))
+	assert.Equal(t, 4, len(requests[1]["messages"].([]any)))
+	assert.Equal(t, 4, len(requests[2]["messages"].([]any)))
+
+	// chat requests can't be sent without a system message
+	_, err = NewGPT("token", server.URL, "default-model").Completion(&util.CompletionRequest{
+		Ctx:    context.Background(),
+		Prompt: "hi",
+	})
+	assert.ErrorContains(t, err, "System message required")
+	assert.Equal(t, 2, len(server.Requests))
+}
+
+// A fake server that fails every request with the given status and body
+func newFakeOpenAIErrorServer(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestClassifyLLMError(t *testing.T) {
+	testCases := []struct {
+		status int
+		body   string
+		kind   error
+	}{
+		{401, `{"error": {"message": "Incorrect API key provided", "type": "invalid_request_error", "code": "invalid_api_key"}}`, ErrAuth},
+		{429, `{"error": {"message": "Rate limit reached for requests", "type": "requests", "code": "rate_limit_exceeded"}}`, ErrRateLimited},
+		{429, `{"error": {"message": "You exceeded your current quota", "type": "insufficient_quota", "code": "insufficient_quota"}}`, ErrRateLimited},
+		{400, `{"error": {"message": "This model's maximum context length is 8192 tokens. However, your messages resulted in 9000 tokens.", "type": "invalid_request_error", "code": "context_length_exceeded"}}`, ErrContextLengthExceeded},
+		{404, `{"error": {"message": "The model gpt-5 does not exist", "type": "invalid_request_error", "code": "model_not_found"}}`, ErrModelNotFound},
+		{500, `{"error": {"message": "The server had an error", "type": "server_error", "code": null}}`, nil},
+	}
+
+	for _, testCase := range testCases {
+		server := newFakeOpenAIErrorServer(testCase.status, testCase.body)
+		gpt := NewGPT("token", server.URL, "default-model")
+
+		// go straight to the client so we don't retry rate limits
+		_, err := gpt.client.CreateChatCompletion(context.Background(),
+			openai.ChatCompletionRequest{Model: "gpt-4"})
+		server.Close()
+		assert.Error(t, err)
+
+		err = classifyLLMError(err)
+		var apiErr *openai.APIError
+		assert.ErrorAs(t, err, &apiErr)
+
+		var llmErr *LLMError
+		if testCase.kind == nil {
+			assert.False(t, errors.As(err, &llmErr), testCase.body)
+			continue
+		}
+
+		assert.ErrorIs(t, err, testCase.kind, testCase.body)
+		assert.ErrorAs(t, err, &llmErr)
+		assert.Equal(t, testCase.status, llmErr.StatusCode)
+		assert.NotEmpty(t, LLMErrorHint(err))
+	}
+}
+
+func TestGPTTypedErrors(t *testing.T) {
+	server := newFakeOpenAIErrorServer(401,
+		`{"error": {"message": "Incorrect API key provided", "type": "invalid_request_error", "code": "invalid_api_key"}}`)
+	defer server.Close()
+
+	gpt := NewGPT("token", server.URL, "default-model")
+	_, err := gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+	})
+	assert.ErrorIs(t, err, ErrAuth)
+	assert.NotErrorIs(t, err, ErrRateLimited)
+}
+
+// An LLM that fails every call with Err, after streaming Partial
+type failingLLM struct {
+	Err     error
+	Partial string
+	Calls   int
+}
+
+func (this *failingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	this.Calls++
+	if this.Partial != "" {
+		writer.Write([]byte(this.Partial))
+	}
+	return nil, this.Err
+}
+
+func (this *failingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	this.Calls++
+	return nil, this.Err
+}
+
+func (this *failingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	this.Calls++
+	return nil, this.Err
+}
+
+func (this *failingLLM) Models(ctx context.Context) ([]ModelInfo, error) {
+	this.Calls++
+	return nil, this.Err
+}
+
+func TestFallbackLLM(t *testing.T) {
+	// a primary that's down falls back to the secondary
+	server := newFakeOpenAIErrorServer(503,
+		`{"error": {"message": "The server is overloaded", "type": "server_error", "code": null}}`)
+	defer server.Close()
+	secondary := &fakeLLM{Responses: []*util.CompletionResponse{
+		{Completion: "from secondary"},
+		{Completion: "streamed from secondary"},
+	}}
+	llm := NewFallbackLLM(NewGPT("token", server.URL, "gpt-4"), secondary)
+
+	request := &util.CompletionRequest{Ctx: context.Background(), Prompt: "hi", SystemMessage: "system"}
+	response, err := llm.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "from secondary", response.Completion)
+
+	out := &bytes.Buffer{}
+	request = &util.CompletionRequest{Ctx: context.Background(), Prompt: "hi", SystemMessage: "system"}
+	response, err = llm.CompletionStream(request, out)
+	assert.NoError(t, err)
+	assert.Equal(t, "streamed from secondary", response.Completion)
+	assert.Equal(t, "streamed from secondary", out.String())
+	assert.Equal(t, 2, len(secondary.Requests))
+
+	models, err := llm.Models(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4", models[0].Name)
+
+	// errors that aren't about availability are returned without falling back
+	primary := &failingLLM{Err: &LLMError{Kind: ErrAuth, Err: errors.New("bad key")}}
+	secondary = &fakeLLM{}
+	llm = NewFallbackLLM(primary, secondary)
+	_, err = llm.Completion(&util.CompletionRequest{Ctx: context.Background()})
+	assert.ErrorIs(t, err, ErrAuth)
+	assert.Equal(t, 0, len(secondary.Requests))
+
+	// a stream that already wrote output isn't repeated by the next LLM
+	primary = &failingLLM{Err: context.DeadlineExceeded, Partial: "half an ans"}
+	llm = NewFallbackLLM(primary, secondary)
+	out.Reset()
+	_, err = llm.CompletionStream(&util.CompletionRequest{Ctx: context.Background()}, out)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, "half an ans", out.String())
+	assert.Equal(t, 0, len(secondary.Requests))
+
+	// embeddings only come from the first LLM
+	_, err = llm.Embeddings(context.Background(), []string{"text"}, false)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// when everything is unavailable the error has each failure
+	first := &failingLLM{Err: &LLMError{Kind: ErrRateLimited, Err: errors.New("slow down")}}
+	second := &failingLLM{Err: context.DeadlineExceeded}
+	llm = NewFallbackLLM(first, second)
+	_, err = llm.Completion(&util.CompletionRequest{Ctx: context.Background()})
+	var fallbackErr *FallbackError
+	assert.ErrorAs(t, err, &fallbackErr)
+	assert.Equal(t, 2, len(fallbackErr.Errors))
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, "All 2 LLMs failed, 1: slow down; 2: context deadline exceeded", err.Error())
+	assert.Equal(t, 1, first.Calls)
+	assert.Equal(t, 1, second.Calls)
+
+	// we stop once the caller has given up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	first.Calls, second.Calls = 0, 0
+	_, err = llm.Completion(&util.CompletionRequest{Ctx: ctx})
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Equal(t, 0, second.Calls)
+
+	// the configured client falls back to the fallback URL, then any clients
+	config := MakeButterfishConfig()
+	config.LLMClient = secondary
+	config.FallbackBaseURL = "http://localhost:11434/v1"
+	config.FallbackLLMClients = []LLM{first}
+	client, err := initLLM(config)
+	assert.NoError(t, err)
+	fallback, ok := client.(*FallbackLLM)
+	assert.True(t, ok)
+	assert.Equal(t, 3, len(fallback.LLMs))
+	assert.Equal(t, secondary, fallback.LLMs[0])
+	assert.Equal(t, first, fallback.LLMs[2])
+}
+
+// An Azure-shaped server: requests are routed by deployment in the path,
+// carry an api-version query param, and authenticate with an api-key header
+type fakeAzureServer struct {
+	*httptest.Server
+	Paths       []string
+	APIVersions []string
+	APIKeys     []string
+	mutex       sync.Mutex
+}
+
+func newFakeAzureServer(t *testing.T) *fakeAzureServer {
+	server := &fakeAzureServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		server.Paths = append(server.Paths, r.URL.Path)
+		server.APIVersions = append(server.APIVersions, r.URL.Query().Get("api-version"))
+		server.APIKeys = append(server.APIKeys, r.Header.Get("api-key"))
+		server.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/embeddings") {
+			fmt.Fprint(w, `{"object": "list", "model": "embed",
+				"data": [{"object": "embedding", "index": 0, "embedding": [0.5, 0.25]}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"id": "test", "object": "chat.completion", "model": "chat",
+			"choices": [{"index": 0, "finish_reason": "stop",
+			"message": {"role": "assistant", "content": "hello from azure"}}]}`)
+	}))
+	return server
+}
+
+// A middleware that records when calls pass through it
+func recordingMiddleware(name string, calls *[]string) LLMMiddleware {
+	return func(llm LLM) LLM {
+		return &recordingLLM{LLM: llm, name: name, calls: calls}
+	}
+}
+
+type recordingLLM struct {
+	LLM
+	name  string
+	calls *[]string
+}
+
+func (this *recordingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	*this.calls = append(*this.calls, this.name+" before")
+	response, err := this.LLM.Completion(request)
+	*this.calls = append(*this.calls, this.name+" after")
+	return response, err
+}
+
+func TestChainMiddlewares(t *testing.T) {
+	calls := []string{}
+	base := &fakeLLM{Responses: []*util.CompletionResponse{{Completion: "hello"}}}
+	llm := Chain(base,
+		recordingMiddleware("outer", &calls),
+		recordingMiddleware("inner", &calls))
+
+	response, err := llm.Completion(&util.CompletionRequest{Prompt: "hi"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", response.Completion)
+	assert.Equal(t, []string{"outer before", "inner before", "inner after", "outer after"}, calls)
+	assert.Equal(t, 1, len(base.Requests))
+
+	// calls a middleware doesn't wrap pass straight through
+	calls = []string{}
+	buf := &bytes.Buffer{}
+	_, err = llm.CompletionStream(&util.CompletionRequest{Prompt: "hi"}, buf)
+	assert.NoError(t, err)
+	assert.Empty(t, calls)
+	assert.Equal(t, 2, len(base.Requests))
+
+	assert.Equal(t, base, Chain(base))
+
+	// the config's middlewares wrap the client
+	calls = []string{}
+	config := MakeButterfishConfig()
+	config.LLMClient = base
+	config.LLMMiddlewares = []LLMMiddleware{recordingMiddleware("config", &calls)}
+	llm, err = initLLM(config)
+	assert.NoError(t, err)
+	_, err = llm.Completion(&util.CompletionRequest{Prompt: "hi"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"config before", "config after"}, calls)
+}
+
+func TestCachingMiddleware(t *testing.T) {
+	base := &fakeLLM{Responses: []*util.CompletionResponse{
+		{Completion: "one"}, {Completion: "two"}, {Completion: "three"}, {Completion: "four"},
+	}}
+	calls := []string{}
+	llm := Chain(base, recordingMiddleware("logging", &calls), CachingMiddleware(2, 0))
+
+	request := &util.CompletionRequest{Prompt: "first", Model: "gpt-4", Temperature: 0.5}
+	response, err := llm.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "one", response.Completion)
+
+	// an identical request is answered from the cache, and still passes
+	// through the outer middleware
+	response, err = llm.Completion(&util.CompletionRequest{Prompt: "first", Model: "gpt-4", Temperature: 0.5, Feature: FeaturePrompt})
+	assert.NoError(t, err)
+	assert.Equal(t, "one", response.Completion)
+	assert.Equal(t, 1, len(base.Requests))
+	assert.Equal(t, 4, len(calls))
+
+	// streamed hits are written out
+	buf := &bytes.Buffer{}
+	response, err = llm.CompletionStream(request, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "one", response.Completion)
+	assert.Equal(t, "one", buf.String())
+	assert.Equal(t, 1, len(base.Requests))
+
+	// anything sent to the model makes a different request
+	response, err = llm.Completion(&util.CompletionRequest{Prompt: "first", Model: "gpt-4", Temperature: 0.7})
+	assert.NoError(t, err)
+	assert.Equal(t, "two", response.Completion)
+
+	// the least recently used response is dropped once full, "first" at 0.5
+	// was used more recently than at 0.7
+	_, err = llm.Completion(request)
+	assert.NoError(t, err)
+	response, err = llm.Completion(&util.CompletionRequest{Prompt: "second"})
+	assert.NoError(t, err)
+	assert.Equal(t, "three", response.Completion)
+	response, err = llm.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "one", response.Completion)
+	response, err = llm.Completion(&util.CompletionRequest{Prompt: "first", Model: "gpt-4", Temperature: 0.7})
+	assert.NoError(t, err)
+	assert.Equal(t, "four", response.Completion)
+	assert.Equal(t, 4, len(base.Requests))
+
+	// asking for more completions is a different request, but N of 0 and 1
+	// are the same
+	key, err := cacheKey(request)
+	assert.NoError(t, err)
+	keyN, err := cacheKey(&util.CompletionRequest{Prompt: "first", Model: "gpt-4", Temperature: 0.5, N: 3})
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, keyN)
+	keyN, err = cacheKey(&util.CompletionRequest{Prompt: "first", Model: "gpt-4", Temperature: 0.5, N: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, key, keyN)
+
+	// errors aren't cached
+	failing := &failingLLM{Err: errors.New("boom")}
+	llm = Chain(failing, CachingMiddleware(2, 0))
+	_, err = llm.Completion(request)
+	assert.ErrorContains(t, err, "boom")
+	_, err = llm.Completion(request)
+	assert.ErrorContains(t, err, "boom")
+	assert.Equal(t, 2, failing.Calls)
+}
+
+func TestCompletionCacheTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewCompletionCache(10, time.Hour)
+	cache.now = func() time.Time { return now }
+
+	base := &fakeLLM{Responses: []*util.CompletionResponse{{Completion: "one"}, {Completion: "two"}}}
+	llm := Chain(base, cache.Middleware())
+	request := &util.CompletionRequest{Prompt: "summarize", Model: "gpt-4"}
+
+	response, err := llm.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "one", response.Completion)
+
+	now = now.Add(59 * time.Minute)
+	response, err = llm.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "one", response.Completion)
+	assert.Equal(t, 1, len(base.Requests))
+
+	// expiry counts from when the response was stored, not last used
+	now = now.Add(time.Minute)
+	response, err = llm.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "two", response.Completion)
+	assert.Equal(t, 2, len(base.Requests))
+	assert.Equal(t, 1, cache.Len())
+}
+
+func TestCompletionCacheLoadClose(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := t.TempDir() + "/cache/responses.json"
+
+	cache := NewCompletionCache(10, time.Hour)
+	cache.Path = path
+	cache.now = func() time.Time { return now }
+	assert.NoError(t, cache.Load())
+	assert.Equal(t, 0, cache.Len())
+
+	cache.Put("old", &util.CompletionResponse{Completion: "old"})
+	now = now.Add(30 * time.Minute)
+	cache.Put("new", &util.CompletionResponse{Completion: "new", PromptTokens: 3})
+	assert.NoError(t, cache.Close())
+
+	// a later run picks up the cached responses, skipping any that expired
+	// in between
+	now = now.Add(45 * time.Minute)
+	loaded := NewCompletionCache(10, time.Hour)
+	loaded.Path = path
+	loaded.now = func() time.Time { return now }
+	assert.NoError(t, loaded.Load())
+	assert.Equal(t, 1, loaded.Len())
+	assert.Nil(t, loaded.Get("old"))
+	assert.Equal(t, &util.CompletionResponse{Completion: "new", PromptTokens: 3}, loaded.Get("new"))
+
+	// a corrupt file is an error rather than silently ignored
+	assert.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+	assert.ErrorContains(t, loaded.Load(), "Unable to read response cache")
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := util.NewLogger(util.LogLevelDebug, out)
+	base := &fakeLLM{Responses: []*util.CompletionResponse{{Completion: "hello", PromptTokens: 3, CompletionTokens: 1}}}
+	llm := Chain(base, LoggingMiddleware(logger))
+
+	_, err := llm.Completion(&util.CompletionRequest{Prompt: "hi", Model: "gpt-4", Feature: FeaturePrompt})
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "DEBUG LLM Completion request: model gpt-4, feature prompt, 2 bytes of prompt")
+	assert.Contains(t, out.String(), "3 prompt tokens, 1 completion tokens")
+
+	out.Reset()
+	llm = Chain(&failingLLM{Err: errors.New("boom")}, LoggingMiddleware(logger))
+	_, err = llm.Completion(&util.CompletionRequest{Prompt: "hi"})
+	assert.ErrorContains(t, err, "boom")
+	assert.Contains(t, out.String(), "LLM Completion failed after")
+
+	// nothing is logged above debug level
+	out.Reset()
+	llm = Chain(base, LoggingMiddleware(util.NewLogger(util.LogLevelInfo, out)))
+	_, err = llm.Completion(&util.CompletionRequest{Prompt: "hi"})
+	assert.NoError(t, err)
+	assert.Empty(t, out.String())
+}
+
+func TestAzureDeploymentMapper(t *testing.T) {
+	single := azureDeploymentMapper("my-deployment")
+	assert.Equal(t, "my-deployment", single("gpt-4o"))
+	assert.Equal(t, "my-deployment", single("text-embedding-3-small"))
+
+	mapped := azureDeploymentMapper("gpt-4o=chat, text-embedding-3-small=embed")
+	assert.Equal(t, "chat", mapped("gpt-4o"))
+	assert.Equal(t, "embed", mapped("text-embedding-3-small"))
+	assert.Equal(t, "gpt-35-turbo", mapped("gpt-3.5-turbo"))
+
+	assert.Equal(t, "gpt-35-turbo", azureDeploymentMapper("")("gpt-3.5-turbo"))
+}
+
+func TestAzureGPT(t *testing.T) {
+	server := newFakeAzureServer(t)
+	defer server.Close()
+
+	deployments := "gpt-4o=chat," + string(GPTEmbeddingsModel) + "=embed"
+	gpt := NewAzureGPT("azure-key", server.URL, deployments, "", "gpt-4o")
+	assert.False(t, gpt.ValidateModels)
+
+	response, err := gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello from azure", response.Completion)
+
+	embeddings, err := gpt.Embeddings(context.Background(), []string{"hello"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float32{{0.5, 0.25}}, embeddings)
+
+	assert.Equal(t, []string{
+		"/openai/deployments/chat/chat/completions",
+		"/openai/deployments/embed/embeddings",
+	}, server.Paths)
+	assert.Equal(t, []string{DefaultAzureAPIVersion, DefaultAzureAPIVersion}, server.APIVersions)
+	assert.Equal(t, []string{"azure-key", "azure-key"}, server.APIKeys)
+
+	// an explicit API version is passed through
+	gpt = NewAzureGPT("azure-key", server.URL, "chat", "2023-05-15", "gpt-4o")
+	_, err = gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "2023-05-15", server.APIVersions[2])
+}
+
+// Requests go to the configured base URL, and without a token we don't send
+// an Authorization header at all
+func TestGPTBaseURL(t *testing.T) {
+	var paths []string
+	var auths []string
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		paths = append(paths, r.URL.Path)
+		auths = append(auths, r.Header.Get("Authorization"))
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": "test", "object": "chat.completion", "model": "local",
+			"choices": [{"index": 0, "finish_reason": "stop",
+			"message": {"role": "assistant", "content": "hello"}}]}`)
+	}))
+	defer server.Close()
+
+	request := &util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+		Model:         "local",
+	}
+
+	gpt := NewGPT("", server.URL+"/v1/", "local")
+	assert.False(t, gpt.ValidateModels)
+	response, err := gpt.Completion(request)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", response.Completion)
+
+	gpt = NewGPT("sk-local", server.URL+"/proxy/v1", "local")
+	_, err = gpt.Completion(request)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"/v1/chat/completions", "/proxy/v1/chat/completions"}, paths)
+	assert.Equal(t, []string{"", "Bearer sk-local"}, auths)
+}
+
+// Usage is reported from the API's usage fields for completions and
+// embeddings, and estimated for streamed completions
+func TestGPTUsageCallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/embeddings") {
+			fmt.Fprint(w, `{"object": "list", "model": "embed-model",
+				"data": [{"object": "embedding", "index": 0, "embedding": [0.5, 0.5]}],
+				"usage": {"prompt_tokens": 7, "total_tokens": 7}}`)
+			return
+		}
+		fmt.Fprint(w, `{"id": "test", "object": "chat.completion", "model": "test-model",
+			"choices": [{"index": 0, "finish_reason": "stop",
+			"message": {"role": "assistant", "content": "hello"}}],
+			"usage": {"prompt_tokens": 12, "completion_tokens": 3, "total_tokens": 15}}`)
+	}))
+	defer server.Close()
+	streamServer := newFakeOpenAIStreamServer(t, []string{"hello", " world"})
+	defer streamServer.Close()
+
+	events := []UsageEvent{}
+	callback := func(event UsageEvent) {
+		events = append(events, event)
+	}
+
+	gpt := NewGPT("token", server.URL, "test-model")
+	gpt.EmbeddingModel = "embed-model"
+	gpt.UsageCallback = callback
+
+	response, err := gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+		Feature:       FeatureGencmd,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 12, response.PromptTokens)
+	assert.Equal(t, 3, response.CompletionTokens)
+
+	_, err = gpt.Embeddings(context.Background(), []string{"some text"}, false)
+	assert.NoError(t, err)
+
+	streamGPT := NewGPT("token", streamServer.URL, "test-model")
+	streamGPT.UsageCallback = callback
+	_, err = streamGPT.CompletionStream(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "summarize this text",
+		SystemMessage: "system",
+	}, io.Discard)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, len(events))
+	for _, event := range events {
+		assert.Greater(t, event.Latency, time.Duration(0))
+	}
+
+	assert.Equal(t, "test-model", events[0].Model)
+	assert.Equal(t, FeatureGencmd, events[0].Feature)
+	assert.Equal(t, 12, events[0].PromptTokens)
+	assert.Equal(t, 3, events[0].CompletionTokens)
+	assert.False(t, events[0].Estimated)
+
+	assert.Equal(t, "embed-model", events[1].Model)
+	assert.Equal(t, FeatureEmbeddings, events[1].Feature)
+	assert.Equal(t, 7, events[1].PromptTokens)
+	assert.Equal(t, 0, events[1].CompletionTokens)
+	assert.False(t, events[1].Estimated)
+
+	// "summarize this text" and "system" are 25 bytes, "hello world" is 11
+	assert.Equal(t, "test-model", events[2].Model)
+	assert.Equal(t, FeatureUnknown, events[2].Feature)
+	assert.Equal(t, 6, events[2].PromptTokens)
+	assert.Equal(t, 2, events[2].CompletionTokens)
+	assert.True(t, events[2].Estimated)
+}
+
+// Why the model stopped is passed along from the API, so that a reply cut
+// off by max tokens can be told apart from a finished one
+func TestCompletionDetailedFinishReason(t *testing.T) {
+	finishReason := "length"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id": "test", "object": "chat.completion", "model": "test-model",
+			"choices": [{"index": 0, "finish_reason": %q,
+			"message": {"role": "assistant", "content": "find . -name"}}],
+			"usage": {"prompt_tokens": 12, "completion_tokens": 4, "total_tokens": 16}}`, finishReason)
+	}))
+	defer server.Close()
+
+	gpt := NewGPT("token", server.URL, "test-model")
+	request := &util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "find go files",
+		SystemMessage: "system",
+		MaxTokens:     4,
+	}
+
+	result, err := CompletionDetailed(gpt, request)
+	assert.NoError(t, err)
+	assert.Equal(t, "find . -name", result.Text)
+	assert.Equal(t, util.FinishReasonLength, result.FinishReason)
+	assert.True(t, result.Truncated())
+	assert.Equal(t, CompletionUsage{PromptTokens: 12, CompletionTokens: 4}, result.Usage)
+	assert.Equal(t, 16, result.Usage.TotalTokens())
+
+	finishReason = "stop"
+	result, err = CompletionDetailed(gpt, request)
+	assert.NoError(t, err)
+	assert.Equal(t, util.FinishReasonStop, result.FinishReason)
+	assert.False(t, result.Truncated())
+
+	// through middleware too
+	result, err = CompletionDetailed(Chain(gpt, LoggingMiddleware(util.NewLogger(util.LogLevelInfo, io.Discard))), request)
+	assert.NoError(t, err)
+	assert.Equal(t, util.FinishReasonStop, result.FinishReason)
+}
+
+func TestStreamFinishReason(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, `data: {"id": "test", "object": "chat.completion.chunk", "model": "test-model", `+
+			`"choices": [{"index": 0, "delta": {"content": "a long"}}]}`+"\n\n")
+		fmt.Fprintf(w, `data: {"id": "test", "object": "chat.completion.chunk", "model": "test-model", `+
+			`"choices": [{"index": 0, "delta": {"content": " answer"}, "finish_reason": "length"}]}`+"\n\n")
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	gpt := NewGPT("token", server.URL, "test-model")
+	response, err := gpt.CompletionStream(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+	}, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, "a long answer", response.Completion)
+	assert.Equal(t, util.FinishReasonLength, response.FinishReason)
+
+	// stopping locally at a stop sequence is a stop
+	stopServer := newFakeOpenAIStreamServer(t, []string{"ls -la", " /tmp\nrm", " -rf /"})
+	defer stopServer.Close()
+
+	gpt = NewGPT("token", stopServer.URL, "test-model")
+	response, err = gpt.CompletionStream(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+		Stop:          []string{"\n"},
+	}, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, util.FinishReasonStop, response.FinishReason)
+}
+
+func TestSplitEmbeddingBatches(t *testing.T) {
+	input := []string{"a", "b", "c", "d", "e"}
+	assert.Equal(t, [][]string{input}, splitEmbeddingBatches(input, 10, 100))
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}, splitEmbeddingBatches(input, 2, 100))
+	assert.Equal(t, [][]string{{}}, splitEmbeddingBatches([]string{}, 2, 100))
+
+	// 8 bytes is about 2 tokens, and a string over the limit is sent alone
+	long := strings.Repeat("x", 40)
+	input = []string{"12345678", "12345678", "12345678", long, "12345678"}
+	assert.Equal(t, [][]string{{"12345678", "12345678"}, {"12345678"}, {long}, {"12345678"}},
+		splitEmbeddingBatches(input, 10, 4))
+}
+
+// A fake embeddings endpoint, each input "item N" gets the vector [N].
+// Earlier batches are answered more slowly so that they finish out of order,
+// and a batch containing "fail" is rejected.
+func newFakeEmbeddingsServer(t *testing.T, batches *[][]string, mutex *sync.Mutex) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Input []string `json:"input"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		assert.NoError(t, err)
+
+		mutex.Lock()
+		*batches = append(*batches, body.Input)
+		mutex.Unlock()
+
+		data := []string{}
+		first := 0
+		for i, input := range body.Input {
+			if input == "fail" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": {"message": "bad input", "type": "invalid_request_error"}}`)
+				return
+			}
+			n := 0
+			fmt.Sscanf(input, "item %d", &n)
+			if i == 0 {
+				first = n
+			}
+			data = append(data, fmt.Sprintf(`{"object": "embedding", "index": %d, "embedding": [%d]}`, i, n))
+		}
+		time.Sleep(time.Duration(20-first) * time.Millisecond)
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"object": "list", "model": "embed-model", "data": [%s],
+			"usage": {"prompt_tokens": 1, "total_tokens": 1}}`, strings.Join(data, ","))
+	}))
+}
+
+func TestGPTEmbeddingBatches(t *testing.T) {
+	batches := [][]string{}
+	mutex := sync.Mutex{}
+	server := newFakeEmbeddingsServer(t, &batches, &mutex)
+	defer server.Close()
+
+	input := []string{}
+	expected := [][]float32{}
+	for i := 0; i < 10; i++ {
+		input = append(input, fmt.Sprintf("item %d", i))
+		expected = append(expected, []float32{float32(i)})
+	}
+
+	gpt := NewGPT("token", server.URL, "test-model")
+	gpt.EmbeddingBatchSize = 3
+	gpt.EmbeddingBatchWorkers = 3
+
+	embeddings, err := gpt.Embeddings(context.Background(), input, false)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, embeddings)
+	assert.Equal(t, 4, len(batches))
+	for _, batch := range batches {
+		assert.LessOrEqual(t, len(batch), 3)
+	}
+
+	// a failed batch fails the whole call
+	batches = [][]string{}
+	input[4] = "fail"
+	embeddings, err = gpt.Embeddings(context.Background(), input, false)
+	assert.ErrorContains(t, err, "Embedding batch 2 of 4 failed")
+	assert.ErrorContains(t, err, "bad input")
+	assert.Nil(t, embeddings)
+}
@@ -0,0 +1,153 @@
+package butterfish
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// HistoryFile persists shell commands across sessions so that autosuggest
+// has context from the first command. Entries are sanitized and appended one
+// per line, with newlines and backslashes escaped. Once the file would grow
+// past MaxBytes it's renamed to Path + ".1", replacing any earlier rotation,
+// and a new file is started, so at most about twice MaxBytes is kept.
+type HistoryFile struct {
+	Path     string
+	MaxBytes int64
+	// removes secrets from entries before they're written, may be nil
+	Redactor *Redactor
+
+	mutex sync.Mutex
+}
+
+func NewHistoryFile(path string, maxBytes int64) *HistoryFile {
+	return &HistoryFile{
+		Path:     path,
+		MaxBytes: maxBytes,
+	}
+}
+
+var historyFileEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+
+// Append an entry to the file with secrets redacted, empty entries are
+// dropped
+func (this *HistoryFile) Append(entry string) error {
+	entry = this.Redactor.Redact(strings.TrimSpace(sanitizeTTYString(entry)))
+	if entry == "" {
+		return nil
+	}
+	line := historyFileEscaper.Replace(entry) + "\n"
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	err := os.MkdirAll(filepath.Dir(this.Path), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = this.rotate(int64(len(line)))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(this.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(line)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Rotate the file if adding incoming bytes would take it past MaxBytes,
+// assumes the mutex is held
+func (this *HistoryFile) rotate(incoming int64) error {
+	if this.MaxBytes <= 0 {
+		return nil
+	}
+
+	info, err := os.Stat(this.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 || info.Size()+incoming <= this.MaxBytes {
+		return nil
+	}
+	return os.Rename(this.Path, this.rotatedPath())
+}
+
+func (this *HistoryFile) rotatedPath() string {
+	return this.Path + ".1"
+}
+
+// Load the most recent n entries, oldest first, reading the rotated file
+// too if needed. If n is 0 or less then every entry is returned. Missing
+// files are treated as empty.
+func (this *HistoryFile) Load(n int) ([]string, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entries := []string{}
+	for _, path := range []string{this.rotatedPath(), this.Path} {
+		fileEntries, err := readHistoryFile(path)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fileEntries...)
+	}
+
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
+
+func readHistoryFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []string{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			entries = append(entries, unescapeHistoryLine(line))
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Reverse historyFileEscaper
+func unescapeHistoryLine(line string) string {
+	var builder strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' && i+1 < len(line) {
+			i++
+			if line[i] == 'n' {
+				builder.WriteByte('\n')
+			} else {
+				builder.WriteByte(line[i])
+			}
+			continue
+		}
+		builder.WriteByte(line[i])
+	}
+	return builder.String()
+}
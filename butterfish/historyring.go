@@ -0,0 +1,121 @@
+package butterfish
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// HistoryRing is a bounded history of shell activity used when building
+// autosuggest prompts. It keeps at most MaxEntries entries and MaxBytes bytes
+// of content, evicting the oldest entries first. A limit of 0 means that
+// dimension is unbounded.
+type HistoryRing struct {
+	MaxEntries int
+	MaxBytes   int
+
+	entries []string
+	size    int
+	// whether the newest entry is shell output that more output can join
+	lastIsOutput bool
+	mutex        sync.Mutex
+}
+
+func NewHistoryRing(maxEntries, maxBytes int) *HistoryRing {
+	return &HistoryRing{
+		MaxEntries: maxEntries,
+		MaxBytes:   maxBytes,
+		entries:    []string{},
+	}
+}
+
+// Add an entry to the history. ANSI escape sequences and non-printable
+// characters are stripped before storing, empty entries are dropped. If a
+// single entry is larger than MaxBytes we keep only its tail, starting at a
+// rune boundary so a multi-byte character isn't cut in half.
+func (this *HistoryRing) Add(entry string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.add(strings.TrimSpace(sanitizeTTYString(entry)), false)
+}
+
+// AddOutput adds shell output to the history, keeping its line breaks.
+// Output arrives in chunks, so consecutive chunks are joined into one entry
+// rather than crowding out the rest of the history.
+func (this *HistoryRing) AddOutput(output string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	lines := strings.Split(strings.ReplaceAll(output, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = sanitizeTTYString(line)
+	}
+	output = strings.Join(lines, "\n")
+	if this.lastIsOutput && len(this.entries) > 0 {
+		last := len(this.entries) - 1
+		output = this.entries[last] + output
+		this.size -= len(this.entries[last])
+		this.entries = this.entries[:last]
+	}
+	this.add(output, true)
+}
+
+// Store a sanitized entry, assumes the mutex is held. Output entries keep
+// their surrounding whitespace so the next chunk joins them correctly, it's
+// trimmed in Snapshot.
+func (this *HistoryRing) add(entry string, output bool) {
+	if strings.TrimSpace(entry) == "" {
+		return
+	}
+
+	if this.MaxBytes > 0 && len(entry) > this.MaxBytes {
+		start := len(entry) - this.MaxBytes
+		for start < len(entry) && !utf8.RuneStart(entry[start]) {
+			start++
+		}
+		entry = entry[start:]
+	}
+
+	this.entries = append(this.entries, entry)
+	this.size += len(entry)
+	this.lastIsOutput = output
+	this.evict()
+}
+
+// Drop the oldest entries until we're within both limits, assumes the mutex
+// is held
+func (this *HistoryRing) evict() {
+	for len(this.entries) > 0 &&
+		((this.MaxEntries > 0 && len(this.entries) > this.MaxEntries) ||
+			(this.MaxBytes > 0 && this.size > this.MaxBytes)) {
+		this.size -= len(this.entries[0])
+		this.entries = this.entries[1:]
+	}
+}
+
+// Len returns the number of entries currently held
+func (this *HistoryRing) Len() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.entries)
+}
+
+// Size returns the number of content bytes currently held
+func (this *HistoryRing) Size() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.size
+}
+
+// Snapshot returns the history as a newline-separated string, oldest first,
+// suitable for interpolating into a prompt
+func (this *HistoryRing) Snapshot() string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entries := make([]string, len(this.entries))
+	for i, entry := range this.entries {
+		entries[i] = strings.TrimSpace(entry)
+	}
+	return strings.Join(entries, "\n")
+}
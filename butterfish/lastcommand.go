@@ -0,0 +1,167 @@
+package butterfish
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bakks/butterfish/prompt"
+)
+
+// Only the head and tail of a command's long output are kept, what it was
+// doing is usually at the start and errors at the end. Half of this is kept
+// for each.
+const lastCommandMaxOutputBytes = 8192
+
+// Output held back from being cut down because a secret may run past its
+// end, e.g. a private key still being printed, is cut down anyway once it's
+// this long
+const lastCommandMaxPendingBytes = 4 * lastCommandMaxOutputBytes
+
+// LastCommand captures the most recent command run in the wrapped shell, its
+// output, and its exit status. Output is collected from when the command is
+// submitted until the next shell prompt, which carries the exit status in
+// the PS1 we set, see SetPS1().
+type LastCommand struct {
+	Command string
+	Status  int
+	// Output lines that look like binary data are left out, see
+	// ButterfishConfig.ShellBinaryThreshold
+	BinaryThreshold float64
+	// The pattern of a fix watcher that matched the output, if any, which
+	// lets a command be fixed even if it succeeded, see Watcher
+	Flagged string
+	// Removes secrets from the output before the middle of long output is
+	// dropped, so a secret cut in half can't slip past it
+	Redactor *Redactor
+
+	head []byte
+	tail []byte
+	// bytes of output dropped between head and tail
+	omitted int
+	running bool
+	done    bool
+}
+
+// Start capturing a newly submitted command, discarding the previous one
+func (this *LastCommand) Start(command string) {
+	this.Command = command
+	this.Status = 0
+	this.Flagged = ""
+	this.head = this.head[:0]
+	this.tail = this.tail[:0]
+	this.omitted = 0
+	this.running = true
+	this.done = false
+}
+
+// Add child output to the capture, keeping only the head and tail of long
+// output. Does nothing unless a command is running.
+func (this *LastCommand) Write(data string) {
+	if !this.running {
+		return
+	}
+
+	this.tail = append(this.tail, data...)
+	if len(this.head)+len(this.tail) > lastCommandMaxOutputBytes {
+		this.cutDown()
+	}
+}
+
+// Fill the head from the start of the tail and drop the middle of the
+// output, keeping half of lastCommandMaxOutputBytes for each. Secrets are
+// redacted first, and if one may still be running at the end of the output
+// then nothing is dropped until it's finished or there's too much pending.
+func (this *LastCommand) cutDown() {
+	output := this.Redactor.Redact(string(this.tail))
+	if strings.HasSuffix(output, redactedText) && !strings.HasSuffix(string(this.tail), redactedText) &&
+		len(this.tail) < lastCommandMaxPendingBytes {
+		return
+	}
+
+	maxBytes := lastCommandMaxOutputBytes / 2
+	if room := maxBytes - len(this.head); room > 0 {
+		if room > len(output) {
+			room = len(output)
+		}
+		this.head = append(this.head, output[:room]...)
+		output = output[room:]
+	}
+
+	if len(output) > maxBytes {
+		this.omitted += len(output) - maxBytes
+		output = output[len(output)-maxBytes:]
+	}
+	this.tail = append(this.tail[:0], output...)
+}
+
+// Finish the capture with the exit status parsed from the shell prompt
+func (this *LastCommand) Finish(status int) {
+	if !this.running {
+		return
+	}
+
+	this.Status = status
+	this.running = false
+	this.done = true
+}
+
+// Output of the command with secrets, terminal control codes, and binary
+// data removed. If the middle of long output was dropped a note says how
+// much.
+func (this *LastCommand) Output() string {
+	output := string(this.head)
+	if this.omitted > 0 {
+		output += truncatedOutputNote(this.omitted)
+	}
+	output += this.Redactor.Redact(string(this.tail))
+
+	output, _ = filterBinaryOutput(output, this.BinaryThreshold, false)
+	return strings.TrimSpace(sanitizeTTYString(output))
+}
+
+// True if a command has finished with a non-zero exit status
+func (this *LastCommand) Failed() bool {
+	return this.done && this.Status != 0
+}
+
+// Mark the command's output as matching a fix watcher's pattern
+func (this *LastCommand) Flag(pattern string) {
+	this.Flagged = pattern
+}
+
+// True if a command has finished and can be fixed, either it failed or its
+// output matched a fix watcher
+func (this *LastCommand) Fixable() bool {
+	return this.Failed() || (this.done && this.Flagged != "")
+}
+
+// Record child output for the running command. Output before the first
+// prompt in data belongs to the command, and if there is a prompt then the
+// command has finished with the prompt's status.
+func (this *ShellState) captureCommandOutput(data string, lastStatus, prompts int) {
+	if prompts == 0 {
+		this.LastCommand.Write(data)
+		return
+	}
+
+	if index := strings.Index(data, PROMPT_PREFIX); index != -1 {
+		data = data[:index]
+	}
+	this.LastCommand.Write(data)
+	this.LastCommand.Finish(lastStatus)
+}
+
+// Build the fix command prompt from the captured command
+func (this *ShellState) fixCommandPrompt() (string, error) {
+	if !this.LastCommand.Fixable() {
+		return "", fmt.Errorf("The last command didn't fail, there's nothing to fix")
+	}
+
+	return this.Butterfish.PromptLibrary.GetPromptFields(prompt.PromptFixCommand,
+		map[string]string{
+			"command": this.LastCommand.Command,
+			"status":  fmt.Sprintf("%d", this.LastCommand.Status),
+			"output": truncateMiddle(this.LastCommand.Output(),
+				this.Butterfish.Config.FixCommandMaxOutputBytes),
+		})
+}
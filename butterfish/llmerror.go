@@ -0,0 +1,115 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Kinds of LLM API failure. The GPT client returns these wrapped in an
+// *LLMError, check for them with errors.Is and use errors.As to get the
+// status code or the underlying API error.
+var (
+	ErrAuth                  = errors.New("LLM authentication failed")
+	ErrRateLimited           = errors.New("LLM rate limit exceeded")
+	ErrContextLengthExceeded = errors.New("LLM context length exceeded")
+	ErrModelNotFound         = errors.New("LLM model not found")
+)
+
+// An LLM API failure classified as one of the errors above
+type LLMError struct {
+	Kind       error  // ErrAuth, ErrRateLimited, etc
+	StatusCode int    // HTTP status, 0 if we didn't get a response
+	Code       string // API error code, e.g. insufficient_quota
+	Err        error  // the underlying error
+}
+
+func (this *LLMError) Error() string {
+	return this.Err.Error()
+}
+
+func (this *LLMError) Unwrap() error {
+	return this.Err
+}
+
+func (this *LLMError) Is(target error) bool {
+	return target == this.Kind
+}
+
+// Wrap an error from the OpenAI client in an *LLMError if we recognize it,
+// otherwise return it unchanged
+func classifyLLMError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var llmErr *LLMError
+	if errors.As(err, &llmErr) {
+		return err
+	}
+
+	var statusCode int
+	var code, message string
+
+	var apiErr *openai.APIError
+	var requestErr *openai.RequestError
+	if errors.As(err, &apiErr) {
+		statusCode = apiErr.HTTPStatusCode
+		if apiErr.Code != nil {
+			code = fmt.Sprintf("%v", apiErr.Code)
+		}
+		message = apiErr.Message
+	} else if errors.As(err, &requestErr) {
+		statusCode = requestErr.HTTPStatusCode
+	} else {
+		return err
+	}
+
+	var kind error
+	switch {
+	case code == "context_length_exceeded" ||
+		strings.Contains(message, "maximum context length"):
+		kind = ErrContextLengthExceeded
+	case code == "model_not_found" || statusCode == http.StatusNotFound:
+		kind = ErrModelNotFound
+	case code == "invalid_api_key" || statusCode == http.StatusUnauthorized ||
+		statusCode == http.StatusForbidden:
+		kind = ErrAuth
+	case statusCode == http.StatusTooManyRequests:
+		kind = ErrRateLimited
+	default:
+		return err
+	}
+
+	return &LLMError{
+		Kind:       kind,
+		StatusCode: statusCode,
+		Code:       code,
+		Err:        err,
+	}
+}
+
+// True if the error means the account is out of credits, retrying won't help,
+// the GPT client adds ERR_429_HELP to these
+func isInsufficientQuota(err error) bool {
+	var llmErr *LLMError
+	return errors.As(err, &llmErr) && llmErr.Code == "insufficient_quota"
+}
+
+// Advice to show the user alongside an LLM error, empty if we don't have any
+func LLMErrorHint(err error) string {
+	switch {
+	case errors.Is(err, ErrAuth):
+		return "Check that your OpenAI token is valid, you can issue a new one at https://platform.openai.com/account/api-keys"
+	case errors.Is(err, ErrRateLimited):
+		return "You're sending requests faster than your account allows, wait a moment and try again or limit requests with --requests-per-minute and --tokens-per-minute."
+	case errors.Is(err, ErrContextLengthExceeded):
+		return "The request was too long for the model, try a model with a larger context window or send less history."
+	case errors.Is(err, ErrModelNotFound):
+		return "Check the model name and that your account has access to it."
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package butterfish
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Wraps an LLM to add behavior around its calls, e.g. logging, caching, or
+// metrics, without changing the clients themselves. A middleware usually
+// returns a struct that embeds the LLM it was given, so that calls it
+// doesn't care about pass straight through.
+type LLMMiddleware func(LLM) LLM
+
+// Wrap base with middlewares. The first middleware is the outermost, so it
+// sees each call first and its result last, e.g. with
+// Chain(gpt, LoggingMiddleware(logger), CachingMiddleware(100, time.Hour))
+// cache hits are still logged.
+func Chain(base LLM, middlewares ...LLMMiddleware) LLM {
+	llm := base
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		llm = middlewares[i](llm)
+	}
+	return llm
+}
+
+// Log each completion request at debug level when it's sent, and its
+// latency and token usage or error when it's done
+func LoggingMiddleware(logger *util.Logger) LLMMiddleware {
+	return func(llm LLM) LLM {
+		return &loggingLLM{LLM: llm, logger: logger}
+	}
+}
+
+type loggingLLM struct {
+	LLM
+	logger *util.Logger
+}
+
+func (this *loggingLLM) logRequest(method string, request *util.CompletionRequest) time.Time {
+	this.logger.Debugf("LLM %s request: model %s, feature %s, %d bytes of prompt",
+		method, request.Model, request.Feature, len(request.Prompt))
+	return time.Now()
+}
+
+func (this *loggingLLM) logResponse(method string, start time.Time, response *util.CompletionResponse, err error) {
+	latency := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		this.logger.Debugf("LLM %s failed after %s: %s", method, latency, err)
+		return
+	}
+	this.logger.Debugf("LLM %s done in %s: %d prompt tokens, %d completion tokens",
+		method, latency, response.PromptTokens, response.CompletionTokens)
+}
+
+func (this *loggingLLM) CompletionStream(request *util.CompletionRequest, writer io.Writer) (*util.CompletionResponse, error) {
+	start := this.logRequest("CompletionStream", request)
+	response, err := this.LLM.CompletionStream(request, writer)
+	this.logResponse("CompletionStream", start, response, err)
+	return response, err
+}
+
+func (this *loggingLLM) Completion(request *util.CompletionRequest) (*util.CompletionResponse, error) {
+	start := this.logRequest("Completion", request)
+	response, err := this.LLM.Completion(request)
+	this.logResponse("Completion", start, response, err)
+	return response, err
+}
+
+func (this *loggingLLM) CompletionN(request *util.CompletionRequest) ([]string, error) {
+	start := this.logRequest("CompletionN", request)
+	completions, err := CompletionN(this.LLM, request)
+	if err != nil {
+		this.logger.Debugf("LLM CompletionN failed after %s: %s", time.Since(start).Round(time.Millisecond), err)
+	} else {
+		this.logger.Debugf("LLM CompletionN done in %s: %d candidates", time.Since(start).Round(time.Millisecond), len(completions))
+	}
+	return completions, err
+}
+
+func (this *loggingLLM) Embeddings(ctx context.Context, input []string, verbose bool) ([][]float32, error) {
+	start := time.Now()
+	embeddings, err := this.LLM.Embeddings(ctx, input, verbose)
+	if err != nil {
+		this.logger.Debugf("LLM Embeddings of %d inputs failed after %s: %s", len(input), time.Since(start).Round(time.Millisecond), err)
+	} else {
+		this.logger.Debugf("LLM Embeddings of %d inputs done in %s", len(input), time.Since(start).Round(time.Millisecond))
+	}
+	return embeddings, err
+}
@@ -0,0 +1,165 @@
+package butterfish
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/alecthomas/kong"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Per-project config file, found by searching upward from the current
+// directory so that it can be committed at the root of a repository
+const ProjectConfigFilename = ".butterfish.yaml"
+
+// Per-project defaults read from a .butterfish.yaml file, e.g.
+//
+//	model: gpt-4o
+//	prompt_library: .butterfish/prompts.yaml
+//	ignore_dirs: [vendor, testdata]
+//
+// Flags and environment variables given explicitly take precedence over it.
+type ProjectConfig struct {
+	// File the config was loaded from
+	Path string `yaml:"-"`
+
+	Model          string `yaml:"model"`
+	EmbeddingModel string `yaml:"embedding_model"`
+	// Prompt library to use instead of ~/.config/butterfish/prompts.yaml,
+	// relative to the config file
+	PromptLibrary string `yaml:"prompt_library"`
+	// Directories to skip when indexing, in addition to
+	// embedding.DefaultIgnoreDirs
+	IgnoreDirs []string `yaml:"ignore_dirs"`
+}
+
+// Search dir and then each of its parents for a project config file,
+// returning the path of the closest one or an empty string if there isn't
+// one
+func FindProjectConfig(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		path := filepath.Join(dir, ProjectConfigFilename)
+		info, err := os.Stat(path)
+		if err == nil && !info.IsDir() {
+			return path, nil
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// Read a project config file. Unknown keys are an error so that a typo
+// doesn't go unnoticed.
+func LoadProjectConfig(path string) (*ProjectConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ProjectConfig{}
+	err = yaml.UnmarshalStrict(content, config)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid project config %s: %s", path, err)
+	}
+	config.Path = path
+
+	if config.PromptLibrary != "" && !filepath.IsAbs(config.PromptLibrary) &&
+		config.PromptLibrary[0] != '~' {
+		config.PromptLibrary = filepath.Join(filepath.Dir(path), config.PromptLibrary)
+	}
+
+	return config, nil
+}
+
+// Find and load the project config for dir, returning nil if there isn't
+// one, see FindProjectConfig
+func DiscoverProjectConfig(dir string) (*ProjectConfig, error) {
+	path, err := FindProjectConfig(dir)
+	if err != nil || path == "" {
+		return nil, err
+	}
+	return LoadProjectConfig(path)
+}
+
+// Set the project's defaults in config. Call before SamplingEnv.Apply so
+// that the environment takes precedence. A nil ProjectConfig changes
+// nothing.
+func (this *ProjectConfig) Apply(config *ButterfishConfig) {
+	if this == nil {
+		return
+	}
+	config.ProjectConfig = this
+
+	if this.Model != "" {
+		config.DefaultModel = this.Model
+		config.GencmdModel = this.Model
+		config.ExeccheckModel = this.Model
+		config.SummarizeModel = this.Model
+		config.ShellPromptModel = this.Model
+	}
+	if this.EmbeddingModel != "" {
+		config.EmbeddingModel = this.EmbeddingModel
+	}
+	if this.PromptLibrary != "" {
+		config.PromptLibraryPath = this.PromptLibrary
+	}
+	config.IndexIgnoreDirs = append(config.IndexIgnoreDirs, this.IgnoreDirs...)
+}
+
+// A kong resolver that fills in the model flags from the project config
+// when they aren't given on the command line. A nil ProjectConfig resolves
+// nothing.
+func (this *ProjectConfig) Resolver() kong.Resolver {
+	return kong.ResolverFunc(func(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+		if this == nil {
+			return nil, nil
+		}
+
+		var value string
+		switch flag.Name {
+		case "model":
+			value = this.Model
+		case "embedding-model":
+			value = this.EmbeddingModel
+		}
+
+		if value == "" {
+			return nil, nil
+		}
+		return value, nil
+	})
+}
+
+// Combine kong resolvers so that a flag is resolved by the first of them
+// that has a value for it, e.g. the environment before the project config
+func ChainResolvers(resolvers ...kong.Resolver) kong.Resolver {
+	return kong.ResolverFunc(func(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+		for _, resolver := range resolvers {
+			value, err := resolver.Resolve(context, parent, flag)
+			if err != nil || value != nil {
+				return value, err
+			}
+		}
+		return nil, nil
+	})
+}
+
+// Resolves command flags that aren't given explicitly from the environment,
+// then the project config
+func (this *ButterfishConfig) FlagResolver() kong.Resolver {
+	return ChainResolvers(this.SamplingEnv.Resolver(), this.ProjectConfig.Resolver())
+}
@@ -0,0 +1,143 @@
+package butterfish
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// RateLimiter is a pair of token buckets, one for requests and one for LLM
+// tokens, matching how OpenAI limits accounts. Each bucket holds up to a
+// minute's worth of capacity and refills continuously. A single limiter can
+// be shared by every caller of a client, e.g. autosuggest, prompts, and goal
+// mode, so that together they stay under the limits. Callers block until
+// there's capacity rather than failing. A limit of 0 means that dimension is
+// unlimited.
+type RateLimiter struct {
+	RequestsPerMinute int
+	TokensPerMinute   int
+
+	requests float64
+	tokens   float64
+	last     time.Time
+	mutex    sync.Mutex
+}
+
+// Create a limiter which starts with full buckets
+func NewRateLimiter(requestsPerMinute, tokensPerMinute int) *RateLimiter {
+	return &RateLimiter{
+		RequestsPerMinute: requestsPerMinute,
+		TokensPerMinute:   tokensPerMinute,
+		requests:          float64(requestsPerMinute),
+		tokens:            float64(tokensPerMinute),
+		last:              time.Now(),
+	}
+}
+
+// Block until there's capacity for one request using numTokens tokens, or
+// until ctx is done in which case the context error is returned. A request
+// for more tokens than TokensPerMinute waits for a full bucket rather than
+// forever.
+func (this *RateLimiter) Wait(ctx context.Context, numTokens int) error {
+	for {
+		delay := this.reserve(numTokens)
+		if delay == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Take capacity for a request if it's available and return 0, otherwise
+// return how long until there should be enough
+func (this *RateLimiter) reserve(numTokens int) time.Duration {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.refill(time.Now())
+
+	needTokens := float64(numTokens)
+	if this.TokensPerMinute > 0 {
+		needTokens = math.Min(needTokens, float64(this.TokensPerMinute))
+	}
+
+	var delay time.Duration
+	if this.RequestsPerMinute > 0 && this.requests < 1 {
+		delay = timeToRefill(1-this.requests, this.RequestsPerMinute)
+	}
+	if this.TokensPerMinute > 0 && this.tokens < needTokens {
+		tokenDelay := timeToRefill(needTokens-this.tokens, this.TokensPerMinute)
+		if tokenDelay > delay {
+			delay = tokenDelay
+		}
+	}
+	if delay > 0 {
+		return delay
+	}
+
+	if this.RequestsPerMinute > 0 {
+		this.requests--
+	}
+	if this.TokensPerMinute > 0 {
+		this.tokens -= needTokens
+	}
+	return 0
+}
+
+// Add the capacity accrued since the last refill, assumes the mutex is held
+func (this *RateLimiter) refill(now time.Time) {
+	minutes := now.Sub(this.last).Minutes()
+	this.last = now
+
+	this.requests = math.Min(float64(this.RequestsPerMinute),
+		this.requests+minutes*float64(this.RequestsPerMinute))
+	this.tokens = math.Min(float64(this.TokensPerMinute),
+		this.tokens+minutes*float64(this.TokensPerMinute))
+}
+
+// How long it takes to accrue amount at perMinute, at least a millisecond so
+// that waiters don't spin
+func timeToRefill(amount float64, perMinute int) time.Duration {
+	delay := time.Duration(amount / float64(perMinute) * float64(time.Minute))
+	if delay < time.Millisecond {
+		delay = time.Millisecond
+	}
+	return delay
+}
+
+// Rough number of tokens a request counts against the limit, OpenAI counts
+// the prompt plus the maximum tokens of the answer. We estimate 4 bytes per
+// token rather than running a tokenizer on every request.
+func estimateRequestTokens(request *util.CompletionRequest) int {
+	return estimatePromptTokens(request) + request.MaxTokens
+}
+
+// Rough number of tokens in a request's prompt, system message, and history
+func estimatePromptTokens(request *util.CompletionRequest) int {
+	numBytes := len(request.Prompt) + len(request.SystemMessage)
+	for _, block := range request.HistoryBlocks {
+		numBytes += len(block.Content) + len(block.FunctionParams)
+	}
+	return numBytes / 4
+}
+
+// Rough number of tokens in a response, for streamed responses where the
+// API doesn't report usage
+func estimateCompletionTokens(response *util.CompletionResponse) int {
+	numBytes := len(response.Completion) + len(response.FunctionName) +
+		len(response.FunctionParameters)
+	for _, toolCall := range response.ToolCalls {
+		numBytes += len(toolCall.Function.Name) + len(toolCall.Function.Parameters)
+	}
+	return numBytes / 4
+}
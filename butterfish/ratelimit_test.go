@@ -0,0 +1,107 @@
+package butterfish
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterRequestPacing(t *testing.T) {
+	// 20 requests a second once the initial minute's worth is used up
+	limiter := NewRateLimiter(1200, 0)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 1200; i++ {
+		assert.NoError(t, limiter.Wait(ctx, 0))
+	}
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, limiter.Wait(ctx, 0))
+	}
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 120*time.Millisecond)
+	assert.Less(t, elapsed, time.Second)
+}
+
+func TestRateLimiterTokenPacing(t *testing.T) {
+	// 100 tokens a second
+	limiter := NewRateLimiter(0, 6000)
+	ctx := context.Background()
+
+	assert.NoError(t, limiter.Wait(ctx, 6000))
+
+	start := time.Now()
+	assert.NoError(t, limiter.Wait(ctx, 20))
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 150*time.Millisecond)
+	assert.Less(t, elapsed, time.Second)
+
+	// a request bigger than the whole bucket goes through once it's full
+	limiter = NewRateLimiter(0, 100)
+	start = time.Now()
+	assert.NoError(t, limiter.Wait(ctx, 1000))
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestRateLimiterContextCancel(t *testing.T) {
+	limiter := NewRateLimiter(1, 0)
+	assert.NoError(t, limiter.Wait(context.Background(), 0))
+
+	// the next request would wait a minute
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := limiter.Wait(ctx, 0)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// Calls through the client wait on a shared limiter and give up if the
+// request context ends first
+func TestGPTRateLimited(t *testing.T) {
+	server := newFakeOpenAIServer(t, "hello")
+	defer server.Close()
+
+	limiter := NewRateLimiter(1, 0)
+	gpt := NewGPT("token", server.URL, "default-model")
+	gpt.RateLimiter = limiter
+	other := NewGPT("token", server.URL, "default-model")
+	other.RateLimiter = limiter
+
+	_, err := gpt.Completion(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+	})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = other.Completion(&util.CompletionRequest{
+		Ctx:           ctx,
+		Prompt:        "hi",
+		SystemMessage: "system",
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, len(server.Requests))
+
+	// a request's own timeout covers waiting for capacity
+	start := time.Now()
+	_, err = other.CompletionStream(&util.CompletionRequest{
+		Ctx:           context.Background(),
+		Prompt:        "hi",
+		SystemMessage: "system",
+		Timeout:       50 * time.Millisecond,
+	}, &bytes.Buffer{})
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 1, len(server.Requests))
+}
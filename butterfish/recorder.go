@@ -0,0 +1,180 @@
+package butterfish
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sources of data recorded in a transcript
+const (
+	transcriptParentIn = "in"
+	transcriptChildOut = "out"
+	transcriptLLM      = "llm"
+)
+
+type transcriptEntry struct {
+	Source string
+	Time   time.Time
+	Data   []byte
+}
+
+// TranscriptRecorder records everything that flows through the shell
+// multiplexer to two streams: a sanitized, timestamped text transcript and
+// the raw bytes. Control codes in the text transcript are handled according
+// to its ANSIMode, e.g. to keep colors. Recording never blocks the caller,
+// entries are passed over a buffered channel to a writer goroutine and
+// dropped if the buffer is full.
+type TranscriptRecorder struct {
+	clean   io.Writer
+	raw     io.Writer
+	entries chan *transcriptEntry
+	done    chan struct{}
+	dropped int64
+	closers []io.Closer
+	mode    ANSIMode
+
+	// guards closed so that Record and Close can be called concurrently
+	mutex  sync.RWMutex
+	closed bool
+}
+
+func NewTranscriptRecorder(clean, raw io.Writer, bufferSize int, mode ANSIMode) *TranscriptRecorder {
+	recorder := &TranscriptRecorder{
+		clean:   clean,
+		raw:     raw,
+		entries: make(chan *transcriptEntry, bufferSize),
+		done:    make(chan struct{}),
+		mode:    mode,
+	}
+
+	go recorder.writeLoop()
+	return recorder
+}
+
+// Create a recorder writing to a pair of timestamped files in dir, a .txt
+// file with the sanitized transcript and a .raw file with the raw bytes
+func OpenTranscriptRecorder(dir string, mode ANSIMode) (*TranscriptRecorder, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	name := "transcript-" + time.Now().Format("20060102-150405")
+	clean, err := os.OpenFile(filepath.Join(dir, name+".txt"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := os.OpenFile(filepath.Join(dir, name+".raw"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		clean.Close()
+		return nil, err
+	}
+
+	recorder := NewTranscriptRecorder(clean, raw, 1024, mode)
+	recorder.closers = []io.Closer{clean, raw}
+	return recorder, nil
+}
+
+// Record a chunk of data from the given source. The data is copied so the
+// caller may reuse the buffer. A nil recorder ignores all data.
+func (this *TranscriptRecorder) Record(source string, data []byte) {
+	if this == nil || len(data) == 0 {
+		return
+	}
+
+	entry := &transcriptEntry{
+		Source: source,
+		Time:   time.Now(),
+		Data:   append([]byte{}, data...),
+	}
+
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	if this.closed {
+		return
+	}
+
+	select {
+	case this.entries <- entry:
+	default:
+		atomic.AddInt64(&this.dropped, 1)
+	}
+}
+
+// Number of entries dropped because the writer couldn't keep up
+func (this *TranscriptRecorder) Dropped() int64 {
+	return atomic.LoadInt64(&this.dropped)
+}
+
+func (this *TranscriptRecorder) writeLoop() {
+	defer close(this.done)
+
+	for entry := range this.entries {
+		if this.raw != nil {
+			this.raw.Write(entry.Data)
+		}
+
+		if this.clean != nil {
+			text := collapseCarriageReturns(string(entry.Data))
+			text = sanitizeTTYStringMode(text, this.mode)
+			if text != "" {
+				fmt.Fprintf(this.clean, "[%s] %s: %s\n",
+					entry.Time.Format("15:04:05.000"), entry.Source, text)
+			}
+		}
+	}
+}
+
+// Keep only the last rendering of each line that was redrawn with carriage
+// returns, e.g. by a progress bar, so the text transcript shows the final
+// state rather than every frame run together
+func collapseCarriageReturns(data string) string {
+	lines := strings.Split(data, "\n")
+	for i, line := range lines {
+		frames := strings.Split(line, "\r")
+		for j := len(frames) - 1; j >= 0; j-- {
+			if frames[j] != "" {
+				lines[i] = frames[j]
+				break
+			}
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Flush any pending entries and close the underlying files. Data recorded
+// after Close is ignored and closing again does nothing.
+func (this *TranscriptRecorder) Close() error {
+	if this == nil {
+		return nil
+	}
+
+	this.mutex.Lock()
+	if this.closed {
+		this.mutex.Unlock()
+		return nil
+	}
+	this.closed = true
+	close(this.entries)
+	this.mutex.Unlock()
+
+	<-this.done
+
+	var err error
+	for _, closer := range this.closers {
+		closeErr := closer.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
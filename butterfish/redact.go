@@ -0,0 +1,91 @@
+package butterfish
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Replaces each secret found in context sent to the model
+const redactedText = "[REDACTED]"
+
+// Secrets removed from terminal history and command output before they're
+// sent to the model. If a pattern has capture groups then only the text
+// they match is replaced, so e.g. the name in password=hunter2 is kept and
+// the model still knows a password was set.
+var DefaultRedactPatterns = []string{
+	// AWS access key IDs
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	// AWS secret access keys, which are only recognizable by their name
+	`(?i)aws_secret_access_key["']?\s*[=:]\s*["']?([A-Za-z0-9/+=]{40})`,
+	// Authorization headers and the like, long enough that prose such as
+	// "bearer token" isn't mistaken for one
+	`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{16,}=*)`,
+	// PEM private keys, up to the end of the text if it was cut short
+	`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?(?:-----END [A-Z ]*PRIVATE KEY-----|\z)`,
+	// OpenAI and GitHub tokens
+	`\bsk-[A-Za-z0-9_\-]{20,}`,
+	`\bgh[pousr]_[A-Za-z0-9]{36,}\b`,
+	// passwords and tokens assigned in commands or config
+	`(?i)\b(?:password|passwd|secret|api_?key|access_?token)["']?\s*[=:]\s*["']?([^\s"']+)`,
+}
+
+// Redactor replaces secrets matching its patterns with [REDACTED]
+type Redactor struct {
+	Patterns []*regexp.Regexp
+}
+
+func NewRedactor(patterns []string) (*Redactor, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redact pattern %q: %s", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+
+	return &Redactor{Patterns: compiled}, nil
+}
+
+// Redact returns str with every secret replaced. A nil redactor returns str
+// unchanged.
+func (this *Redactor) Redact(str string) string {
+	if this == nil {
+		return str
+	}
+
+	for _, re := range this.Patterns {
+		if re.NumSubexp() == 0 {
+			str = re.ReplaceAllLiteralString(str, redactedText)
+			continue
+		}
+		str = redactGroups(re, str)
+	}
+	return str
+}
+
+// Replace only the text matched by the capture groups of re
+func redactGroups(re *regexp.Regexp, str string) string {
+	matches := re.FindAllStringSubmatchIndex(str, -1)
+	if matches == nil {
+		return str
+	}
+
+	result := []byte{}
+	last := 0
+	for _, match := range matches {
+		// group offsets are in order and don't overlap, unmatched groups
+		// are -1
+		for i := 2; i < len(match); i += 2 {
+			start, end := match[i], match[i+1]
+			if start < last || start == end {
+				continue
+			}
+			result = append(result, str[last:start]...)
+			result = append(result, redactedText...)
+			last = end
+		}
+	}
+	result = append(result, str[last:]...)
+	return string(result)
+}
@@ -0,0 +1,124 @@
+package butterfish
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/alecthomas/kong"
+)
+
+// Environment variables that set sampling defaults without flags, e.g. for
+// scripts. Flags given explicitly take precedence over them.
+const (
+	ModelEnvVar       = "BUTTERFISH_MODEL"
+	TemperatureEnvVar = "BUTTERFISH_TEMPERATURE"
+	MaxTokensEnvVar   = "BUTTERFISH_MAX_TOKENS"
+)
+
+// Sampling defaults read from ModelEnvVar, TemperatureEnvVar, and
+// MaxTokensEnvVar. Unset variables are left empty.
+type SamplingEnv struct {
+	Model       string
+	Temperature string
+	MaxTokens   string
+}
+
+// Read and validate the sampling environment variables with getenv. An
+// invalid value is an error naming the variable.
+func ReadSamplingEnv(getenv func(string) string) (*SamplingEnv, error) {
+	env := &SamplingEnv{
+		Model:       getenv(ModelEnvVar),
+		Temperature: getenv(TemperatureEnvVar),
+		MaxTokens:   getenv(MaxTokensEnvVar),
+	}
+
+	if env.Temperature != "" {
+		temperature, err := strconv.ParseFloat(env.Temperature, 32)
+		if err != nil || temperature < 0 || temperature > 2 {
+			return nil, fmt.Errorf("Invalid %s %q, it must be a number from 0 to 2", TemperatureEnvVar, env.Temperature)
+		}
+	}
+
+	if env.MaxTokens != "" {
+		maxTokens, err := strconv.Atoi(env.MaxTokens)
+		if err != nil || maxTokens < 1 {
+			return nil, fmt.Errorf("Invalid %s %q, it must be a positive whole number", MaxTokensEnvVar, env.MaxTokens)
+		}
+	}
+
+	return env, nil
+}
+
+// MakeButterfishConfig with its sampling defaults replaced by those in the
+// environment, read with getenv, see ReadSamplingEnv
+func MakeButterfishConfigFromEnv(getenv func(string) string) (*ButterfishConfig, error) {
+	config := MakeButterfishConfig()
+
+	env, err := ReadSamplingEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+	env.Apply(config)
+
+	return config, nil
+}
+
+// Set the models, temperatures, and maximum response tokens in config to
+// the values from the environment. Autosuggest keeps its own model and
+// temperature since it needs a fast completion model.
+func (this *SamplingEnv) Apply(config *ButterfishConfig) {
+	config.SamplingEnv = this
+
+	if this.Model != "" {
+		config.DefaultModel = this.Model
+		config.GencmdModel = this.Model
+		config.ExeccheckModel = this.Model
+		config.SummarizeModel = this.Model
+		config.ShellPromptModel = this.Model
+	}
+
+	if this.Temperature != "" {
+		// already validated by ReadSamplingEnv
+		parsed, _ := strconv.ParseFloat(this.Temperature, 32)
+		temperature := float32(parsed)
+		config.GencmdTemperature = temperature
+		config.ExeccheckTemperature = temperature
+		config.SummarizeTemperature = temperature
+		config.ShellPromptTemperature = temperature
+		config.GoalModeTemperature = temperature
+	}
+
+	if this.MaxTokens != "" {
+		maxTokens, _ := strconv.Atoi(this.MaxTokens)
+		config.GencmdMaxTokens = maxTokens
+		config.ExeccheckMaxTokens = maxTokens
+		config.SummarizeMaxTokens = maxTokens
+		config.ShellMaxResponseTokens = maxTokens
+	}
+}
+
+// A kong resolver that fills in the model, temperature, and token limit
+// flags from the environment when they aren't given on the command line. A
+// nil SamplingEnv resolves nothing.
+func (this *SamplingEnv) Resolver() kong.Resolver {
+	return kong.ResolverFunc(func(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+		if this == nil {
+			return nil, nil
+		}
+
+		var value string
+		switch flag.Name {
+		case "model":
+			value = this.Model
+		case "temperature":
+			value = this.Temperature
+		case "num-tokens", "max-response-tokens":
+			value = this.MaxTokens
+		}
+
+		if value == "" {
+			return nil, nil
+		}
+		return value, nil
+	})
+}
@@ -0,0 +1,232 @@
+package butterfish
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/term"
+)
+
+// LLM providers offered by the first-run setup prompt
+const (
+	ProviderOpenAI = "openai"
+	ProviderAzure  = "azure"
+	ProviderLocal  = "local"
+)
+
+// Answers from the first-run setup prompt, see PromptLLMSetup
+type LLMSetup struct {
+	Provider string
+	// Base URL of a local or OpenAI-compatible server, or the Azure endpoint
+	BaseURL string
+	Token   string
+	// Credentials file the token was saved to, empty if it wasn't saved
+	SavedPath string
+}
+
+// Point config at the provider chosen during setup
+func (this *LLMSetup) Apply(config *ButterfishConfig) {
+	config.OpenAIToken = this.Token
+	switch this.Provider {
+	case ProviderAzure:
+		config.AzureEndpoint = this.BaseURL
+	case ProviderLocal:
+		config.BaseURL = this.BaseURL
+	}
+}
+
+// Reports whether stdin is a terminal, a variable so tests can override it
+var stdinIsTerminal = func() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// If in is a terminal then ask question on out and read the answer without
+// echoing it. Returns false if in isn't a terminal, a variable so tests can
+// override it.
+var readSecret = func(in io.Reader, out io.Writer, question string) (string, bool, error) {
+	file, ok := in.(*os.File)
+	if !ok || !term.IsTerminal(int(file.Fd())) {
+		return "", false, nil
+	}
+
+	fmt.Fprint(out, question)
+	secret, err := term.ReadPassword(int(file.Fd()))
+	// the newline typed after the secret wasn't echoed either
+	fmt.Fprint(out, "\n")
+	return string(secret), true, err
+}
+
+// Ask which LLM provider to use and for its token, reading answers from in
+// and writing questions to out. Keys aren't echoed when in is a terminal. If
+// savePath is set then offer to save the token there as OPENAI_API_KEY, or
+// AZURE_OPENAI_API_KEY for Azure, keeping anything else in the file, so it's
+// found next time, see ResolveOpenAIToken and ResolveAzureToken.
+func PromptLLMSetup(in io.Reader, out io.Writer, savePath string) (*LLMSetup, error) {
+	reader := bufio.NewReader(in)
+	ask := func(question string) (string, error) {
+		fmt.Fprint(out, question)
+		line, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", errors.New("Setup cancelled, no LLM provider configured")
+		}
+		return strings.TrimSpace(line), nil
+	}
+	askSecret := func(question string) (string, error) {
+		secret, ok, err := readSecret(in, out, question)
+		if !ok {
+			return ask(question)
+		}
+		if err != nil {
+			return "", errors.New("Setup cancelled, no LLM provider configured")
+		}
+		return strings.TrimSpace(secret), nil
+	}
+
+	fmt.Fprintf(out, "No LLM provider is configured, which would you like to use?\n")
+	fmt.Fprintf(out, "  1) OpenAI\n")
+	fmt.Fprintf(out, "  2) Azure OpenAI\n")
+	fmt.Fprintf(out, "  3) A local or other OpenAI-compatible server\n")
+
+	setup := &LLMSetup{}
+	for setup.Provider == "" {
+		answer, err := ask("Provider [1]: ")
+		if err != nil {
+			return nil, err
+		}
+		switch answer {
+		case "", "1":
+			setup.Provider = ProviderOpenAI
+		case "2":
+			setup.Provider = ProviderAzure
+		case "3":
+			setup.Provider = ProviderLocal
+		default:
+			fmt.Fprintf(out, "Please enter 1, 2, or 3\n")
+		}
+	}
+
+	var err error
+	switch setup.Provider {
+	case ProviderOpenAI:
+		for !strings.HasPrefix(setup.Token, "sk-") {
+			setup.Token, err = askSecret("OpenAI API key, create one at https://platform.openai.com/account/api-keys (it should start with sk-): ")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case ProviderAzure:
+		for setup.BaseURL == "" {
+			setup.BaseURL, err = ask("Azure OpenAI endpoint, e.g. https://my-resource.openai.azure.com: ")
+			if err != nil {
+				return nil, err
+			}
+		}
+		for setup.Token == "" {
+			setup.Token, err = askSecret("Azure OpenAI API key: ")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case ProviderLocal:
+		for setup.BaseURL == "" {
+			setup.BaseURL, err = ask("Base URL, e.g. http://localhost:8080/v1: ")
+			if err != nil {
+				return nil, err
+			}
+		}
+		setup.Token, err = askSecret("API key, leave empty if the server doesn't need one: ")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if savePath != "" && setup.Token != "" {
+		answer, err := ask(fmt.Sprintf("Save the key to %s? [Y/n]: ", savePath))
+		if err != nil {
+			return nil, err
+		}
+		if answer == "" || strings.HasPrefix(strings.ToLower(answer), "y") {
+			name := openAITokenEnvVars[0]
+			if setup.Provider == ProviderAzure {
+				name = azureTokenEnvVars[0]
+			}
+			setup.SavedPath, err = saveCredential(savePath, name, setup.Token)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(out, "Key saved, you can edit it at any time at %s\n", setup.SavedPath)
+		}
+	}
+
+	switch setup.Provider {
+	case ProviderAzure:
+		fmt.Fprintf(out, "Pass --azure-endpoint %s to use this endpoint next time\n", setup.BaseURL)
+	case ProviderLocal:
+		fmt.Fprintf(out, "Pass --base-url %s to use this server next time\n", setup.BaseURL)
+	}
+	fmt.Fprintf(out, "\n")
+
+	return setup, nil
+}
+
+// Set name to value in the dotenv file at path, creating it if needed.
+// Returns the expanded path.
+func saveCredential(path, name, value string) (string, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return "", err
+	}
+
+	values, err := godotenv.Read(path)
+	if errors.Is(err, os.ErrNotExist) {
+		values = map[string]string{}
+	} else if err != nil {
+		return "", fmt.Errorf("Unable to read credentials file %s: %s", path, err)
+	}
+	values[name] = value
+
+	content, err := godotenv.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(path, []byte(content+"\n"), 0600)
+	if err != nil {
+		return "", fmt.Errorf("Unable to write credentials file %s: %s", path, err)
+	}
+	return path, nil
+}
+
+// Run the first-run setup prompt if we can, i.e. SetupIn is set or stdin
+// is a terminal. Returns nil if setup isn't possible, e.g. in a script.
+func runLLMSetup(config *ButterfishConfig) (*LLMSetup, error) {
+	in, out := config.SetupIn, config.SetupOut
+	if in == nil {
+		if !stdinIsTerminal() {
+			return nil, nil
+		}
+		in = os.Stdin
+	}
+	if out == nil {
+		out = os.Stdout
+	}
+
+	setup, err := PromptLLMSetup(in, out, config.CredentialsPath)
+	if err != nil {
+		return nil, err
+	}
+	setup.Apply(config)
+	return setup, nil
+}
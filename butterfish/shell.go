@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/signal"
 	"regexp"
@@ -17,11 +16,12 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/bakks/butterfish/bubbles/console"
 	"github.com/bakks/butterfish/prompt"
 	"github.com/bakks/butterfish/util"
 	"github.com/sashabaranov/go-openai/jsonschema"
 
-	"github.com/bakks/tiktoken-go"
+	"github.com/mitchellh/go-homedir"
 	"github.com/mitchellh/go-ps"
 	"golang.org/x/term"
 )
@@ -73,16 +73,18 @@ var LightShellColorScheme = &ShellColorScheme{
 func RunShell(ctx context.Context, config *ButterfishConfig) error {
 	envVars := []string{"BUTTERFISH_SHELL=1"}
 
-	ptmx, ptyCleanup, err := ptyCommand(ctx, envVars, []string{config.ShellBinary})
+	bf, err := NewButterfish(ctx, config)
 	if err != nil {
 		return err
 	}
-	defer ptyCleanup()
+	defer bf.Close()
 
-	bf, err := NewButterfish(ctx, config)
+	ptmx, terminal, err := ptyCommand(ctx, bf.Log, envVars, []string{config.ShellBinary})
 	if err != nil {
 		return err
 	}
+	defer terminal.Restore()
+	bf.terminal = terminal
 	//fmt.Println("Starting butterfish shell")
 
 	bf.ShellMultiplexer(ptmx, ptmx, os.Stdin, os.Stdout)
@@ -169,7 +171,10 @@ func (this *HistoryBuffer) GetTokenization(encoding string, length int) (string,
 // HistoryBlocks.
 type ShellHistory struct {
 	Blocks []*HistoryBuffer
-	mutex  sync.Mutex
+	// removes secrets from blocks as they're sent to the model, the blocks
+	// themselves keep the original text
+	Redactor *Redactor
+	mutex    sync.Mutex
 }
 
 func NewShellHistory() *ShellHistory {
@@ -249,6 +254,50 @@ func (this *ShellHistory) AppendFunctionOutput(name, data string) {
 	lastBlock.FunctionName = name
 }
 
+// The number of blocks in the history
+func (this *ShellHistory) Len() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return len(this.Blocks)
+}
+
+// The blocks from index start onwards with ANSI escape codes removed, e.g. to
+// save them to disk
+func (this *ShellHistory) BlocksSince(start int) []util.HistoryBlock {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	blocks := []util.HistoryBlock{}
+	for i := start; i < len(this.Blocks); i++ {
+		block := this.Blocks[i]
+		blocks = append(blocks, util.HistoryBlock{
+			Type:           block.Type,
+			Content:        sanitizeTTYString(block.Content.String()),
+			FunctionName:   block.FunctionName,
+			FunctionParams: block.FunctionParams,
+		})
+	}
+	return blocks
+}
+
+// Add blocks to the end of the history, e.g. ones returned by BlocksSince
+func (this *ShellHistory) AddBlocks(blocks []util.HistoryBlock) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, block := range blocks {
+		buffer := NewShellBuffer()
+		buffer.Write(block.Content)
+		this.Blocks = append(this.Blocks, &HistoryBuffer{
+			Type:           block.Type,
+			Content:        buffer,
+			FunctionName:   block.FunctionName,
+			FunctionParams: block.FunctionParams,
+		})
+	}
+}
+
 // Go back in history for a certain number of bytes.
 func (this *ShellHistory) GetLastNBytes(numBytes int, truncateLength int) []util.HistoryBlock {
 	this.mutex.Lock()
@@ -296,13 +345,13 @@ func (this *ShellHistory) IterateBlocks(cb func(block *HistoryBuffer) bool) {
 // This is not thread safe
 func (this *ShellHistory) LogRecentHistory() {
 	blocks := this.GetLastNBytes(2000, 512)
-	log.Printf("Recent history: =======================================")
+	util.DefaultLogger().Debugf("Recent history: =======================================")
 	builder := strings.Builder{}
 	for _, block := range blocks {
 		builder.WriteString(fmt.Sprintf("%s: %s\n", HistoryTypeToString(block.Type), block.Content))
 	}
-	log.Printf(builder.String())
-	log.Printf("=======================================")
+	util.DefaultLogger().Debugf("%s", builder.String())
+	util.DefaultLogger().Debugf("=======================================")
 }
 
 func HistoryBlocksToString(blocks []util.HistoryBlock) string {
@@ -321,6 +370,8 @@ const (
 	stateShell
 	statePrompting
 	statePromptResponse
+	stateGoalModeConfirm
+	stateGoalModeEdit
 )
 
 var stateNames = []string{
@@ -328,8 +379,23 @@ var stateNames = []string{
 	"Shell",
 	"Prompting",
 	"PromptResponse",
+	"GoalModeConfirm",
+	"GoalModeEdit",
 }
 
+// The user's answer when asked whether to run a goal mode command
+type GoalModeConfirmation int
+
+const (
+	GoalModeConfirmYes GoalModeConfirmation = iota
+	GoalModeConfirmNo
+	GoalModeConfirmEdit
+)
+
+// Asks the user whether to run a command proposed in goal mode, for
+// GoalModeConfirmEdit the edited command is also returned
+type GoalModeConfirmFunc func(cmd string) (GoalModeConfirmation, string)
+
 type AutosuggestResult struct {
 	Command    string
 	Suggestion string
@@ -358,11 +424,32 @@ type ShellState struct {
 	AutosuggestMaxTokens int
 
 	// The current state of the shell
-	State                int
-	GoalMode             bool
-	GoalModeBuffer       string
-	GoalModeGoal         string
-	GoalModeUnsafe       bool
+	State          int
+	GoalMode       bool
+	GoalModeBuffer string
+	GoalModeGoal   string
+	GoalModeUnsafe bool
+	// The command waiting for confirmation when GoalModeConfirm is set, the
+	// buffer used if the user edits it, and a note telling the model about an
+	// edit that is sent along with the command's result
+	GoalModeConfirmCmd    string
+	GoalModeConfirmBuffer *ShellBuffer
+	GoalModeEditNote      string
+	// Model responses acted on for the current goal, the command being run,
+	// and how many times each command has had the same result, used to stop
+	// goal mode when it runs too long or loops
+	GoalModeSteps   int
+	GoalModeCommand string
+	goalModeResults map[string]int
+	// When the goal mode command started running, used to report how long
+	// it took
+	GoalModeCommandStart time.Time
+	// Goal mode's progress, saved to GoalModeSessionPath so that it can be
+	// resumed, nil if sessions aren't saved
+	GoalModeSession *GoalModeSession
+	// If set, called to confirm goal mode commands rather than asking in the
+	// terminal, e.g. to script answers in tests
+	ConfirmCommand       GoalModeConfirmFunc
 	ActiveFunction       string
 	PromptSuffixCounter  int
 	ChildOutReader       chan *byteMsg
@@ -381,9 +468,9 @@ type ShellState struct {
 	Color                *ShellColorScheme
 	LastTabPassthrough   time.Time
 	parentInBuffer       []byte
-	// these are used to estimate number of tokens
-	AutosuggestEncoder *tiktoken.Tiktoken
-	PromptEncoder      *tiktoken.Tiktoken
+	// these are used to count tokens when trimming history to fit a model
+	AutosuggestTokenizer Tokenizer
+	PromptTokenizer      Tokenizer
 
 	// autosuggest config
 	AutosuggestEnabled bool
@@ -391,6 +478,25 @@ type ShellState struct {
 	AutosuggestCtx     context.Context
 	AutosuggestCancel  context.CancelFunc
 	AutosuggestBuffer  *ShellBuffer
+	// bounded history of commands, prompts, and answers used for autosuggest
+	AutosuggestHistory *HistoryRing
+	// commands persisted across sessions, nil if persistence is disabled
+	HistoryFile *HistoryFile
+
+	// optional recorder for a transcript of the session
+	Recorder *TranscriptRecorder
+
+	// the last command the user ran, used to fix it if it failed
+	LastCommand LastCommand
+	// Whether the last child output added to history ended in binary data,
+	// see historyOutput
+	binaryOutput bool
+	// Parses shell integration markers from child output, nil if shell
+	// integration is off
+	Integration *ShellIntegrationParser
+	// Matches child output against the configured watchers, nil if there
+	// are none
+	Watchers *OutputWatcher
 }
 
 func (this *ShellState) setState(state int) {
@@ -399,7 +505,7 @@ func (this *ShellState) setState(state int) {
 	}
 
 	if this.Butterfish.Config.Verbose > 1 {
-		log.Printf("State change: %s -> %s", stateNames[this.State], stateNames[state])
+		this.Butterfish.Log.Debugf("State change: %s -> %s", stateNames[this.State], stateNames[state])
 	}
 
 	this.State = state
@@ -478,7 +584,7 @@ func (this *ButterfishCtx) SetPS1(childIn io.Writer) {
 		// characters when calculating the cursor position
 		ps1 = "PS1=$'%%{%s%%}'$PS1$'%s%%{ %%?%s%%} '\n"
 	default:
-		log.Printf("Unknown shell %s, Butterfish is going to leave the PS1 alone. This means that you won't get a custom prompt in Butterfish, and Butterfish won't be able to parse the exit code of the previous command, used for certain features. Create an issue at https://github.com/bakks/butterfish.", shell)
+		this.Log.Warnf("Unknown shell %s, Butterfish is going to leave the PS1 alone. This means that you won't get a custom prompt in Butterfish, and Butterfish won't be able to parse the exit code of the previous command, used for certain features. Create an issue at https://github.com/bakks/butterfish.", shell)
 		return
 	}
 
@@ -515,7 +621,7 @@ func ParsePS1(data string, regex *regexp.Regexp, currIcon string) (int, int, str
 		var err error
 		lastStatus, err = strconv.Atoi(match[1])
 		if err != nil {
-			log.Printf("Error parsing PS1 match: %s", err)
+			util.DefaultLogger().Warnf("Error parsing PS1 match: %s", err)
 		}
 		prompts++
 	}
@@ -564,18 +670,29 @@ func (this *ShellState) FilterChildOut(data string) bool {
 	return false
 }
 
+// Child output as it should be kept in history, with binary data replaced
+// by a note, see filterBinaryOutput. Output is filtered a line at a time so
+// this may be called with consecutive chunks of a burst.
+func (this *ShellState) historyOutput(data string) string {
+	filtered, inBinary := filterBinaryOutput(data,
+		this.Butterfish.Config.ShellBinaryThreshold, this.binaryOutput)
+	this.binaryOutput = inBinary
+	return filtered
+}
+
 func (this *ButterfishCtx) ShellMultiplexer(
 	childIn io.Writer, childOut io.Reader,
 	parentIn io.Reader, parentOut io.Writer) {
 
 	this.SetPS1(childIn)
+	integrated := this.Config.ShellIntegration && this.SetShellIntegration(childIn)
 
 	colorScheme := DarkShellColorScheme
 	if !this.Config.ShellColorDark {
 		colorScheme = LightShellColorScheme
 	}
 
-	log.Printf("Starting shell multiplexer")
+	this.Log.Infof("Starting shell multiplexer")
 
 	childOutReader := make(chan *byteMsg, 8)
 	parentInReader := make(chan *byteMsg, 8)
@@ -612,27 +729,94 @@ func (this *ButterfishCtx) ShellMultiplexer(
 		Command:              NewShellBuffer(),
 		Prompt:               NewShellBuffer(),
 		TerminalWidth:        termWidth,
-		AutosuggestEnabled:   this.Config.ShellAutosuggestEnabled,
+		AutosuggestEnabled:   this.Config.ShellAutosuggestEnabled && this.featureEnabled(FeatureAutosuggest),
 		AutosuggestChan:      make(chan *AutosuggestResult),
 		Color:                colorScheme,
 		parentInBuffer:       []byte{},
 		PromptMaxTokens:      NumTokensForModel(this.Config.ShellPromptModel),
 		AutosuggestMaxTokens: NumTokensForModel(this.Config.ShellAutosuggestModel),
+		AutosuggestHistory: NewHistoryRing(this.Config.ShellAutosuggestHistoryEntries,
+			this.Config.ShellAutosuggestHistoryBytes),
 	}
 
 	shellState.Prompt.SetTerminalWidth(termWidth)
 	shellState.Prompt.SetColor(colorScheme.Prompt)
+	if integrated {
+		shellState.Integration = &ShellIntegrationParser{}
+	}
+	shellState.LastCommand.BinaryThreshold = this.Config.ShellBinaryThreshold
+	shellState.LastCommand.Redactor = this.Redactor
+	shellState.History.Redactor = this.Redactor
 
-	go readerToChannel(childOut, childOutReader)
-	go readerToChannelWithPosition(parentIn, parentInReader, parentPositionChan)
+	if len(this.Config.Watchers) > 0 {
+		watchers, err := NewOutputWatcher(this.Config.Watchers, this.Config.WatcherDebounce)
+		if err != nil {
+			this.Log.Warnf("Unable to start output watchers: %s", err)
+		} else {
+			shellState.Watchers = watchers
+		}
+	}
+
+	if this.Config.ShellHistoryPath != "" {
+		shellState.loadHistoryFile(this.Config.ShellHistoryPath, this.Config.ShellHistoryMaxBytes)
+	}
+
+	if this.Config.ShellRecordPath != "" {
+		recorder, err := OpenTranscriptRecorder(this.Config.ShellRecordPath, this.Config.ShellRecordANSIMode)
+		if err != nil {
+			this.Log.Warnf("Unable to start transcript recorder: %s", err)
+		} else {
+			shellState.Recorder = recorder
+			this.addCloser(recorder)
+			defer recorder.Close()
+		}
+	}
+
+	this.goGuarded(func() {
+		readerToChannel(childOut, childOutReader, this.Log)
+	})
+	this.goGuarded(func() {
+		readerToChannelWithPosition(parentIn, parentInReader, parentPositionChan, this.Log)
+	})
 
 	// clear out any existing output to hide the PS1 export stuff
 	clearByteChan(childOutReader, 1000*time.Millisecond)
 
+	if this.Config.GoalModeResume != "" {
+		err := shellState.GoalModeResume(this.Config.GoalModeResume)
+		if err != nil {
+			fmt.Fprintf(shellState.PromptAnswerWriter, "%sUnable to resume goal mode: %s%s\n", colorScheme.Error, err, colorScheme.Command)
+		}
+	}
+
 	// start
 	shellState.Mux()
 }
 
+// Open the persistent history file and seed autosuggest history with its
+// most recent entries. Errors are logged rather than returned since the
+// shell works fine without it.
+func (this *ShellState) loadHistoryFile(path string, maxBytes int64) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		this.Butterfish.Log.Warnf("Unable to open history file %s: %s", path, err)
+		return
+	}
+
+	this.HistoryFile = NewHistoryFile(path, maxBytes)
+	this.HistoryFile.Redactor = this.Butterfish.Redactor
+	entries, err := this.HistoryFile.Load(this.Butterfish.Config.ShellAutosuggestHistoryEntries)
+	if err != nil {
+		this.Butterfish.Log.Warnf("Unable to load history file %s: %s", path, err)
+		return
+	}
+
+	for _, entry := range entries {
+		this.AutosuggestHistory.Add(entry)
+	}
+	this.Butterfish.Log.Infof("Loaded %d entries from history file %s", len(entries), path)
+}
+
 func (this *ShellState) Errorf(format string, args ...any) {
 	this.PrintErrorChan <- fmt.Errorf(format, args...)
 }
@@ -668,10 +852,10 @@ func parseCommandParams(params string) (string, error) {
 
 	// check for an uneven number of quotes
 	if strings.Count(cmd, "\"")%2 == 1 {
-		log.Printf("Uneven number of double quotes in command: %s", cmd)
+		util.DefaultLogger().Debugf("Uneven number of double quotes in command: %s", cmd)
 	}
 	if strings.Count(cmd, "'")%2 == 1 {
-		log.Printf("Uneven number of single quotes in command: %s", cmd)
+		util.DefaultLogger().Debugf("Uneven number of single quotes in command: %s", cmd)
 	}
 
 	return cmd, nil
@@ -701,7 +885,7 @@ func parseFinishParams(params string) (bool, error) {
 
 // TODO add a diagram of streams here
 func (this *ShellState) Mux() {
-	log.Printf("Started shell mux")
+	this.Butterfish.Log.Infof("Started shell mux")
 	childOutBuffer := []byte{}
 
 	for {
@@ -710,7 +894,7 @@ func (this *ShellState) Mux() {
 			return
 
 		case err := <-this.PrintErrorChan:
-			log.Printf("Error: %s", err.Error())
+			this.Butterfish.Log.Errorf("Error: %s", err.Error())
 			this.History.Append(historyTypeShellOutput, err.Error())
 			fmt.Fprintf(this.ParentOut, "%s%s", this.Color.Error, err.Error())
 			this.setState(stateNormal)
@@ -730,10 +914,10 @@ func (this *ShellState) Mux() {
 		case <-this.Sigwinch:
 			termWidth, _, err := term.GetSize(int(os.Stdout.Fd()))
 			if err != nil {
-				log.Printf("Error getting terminal size after SIGWINCH: %s", err)
+				this.Butterfish.Log.Warnf("Error getting terminal size after SIGWINCH: %s", err)
 			}
 			if this.Butterfish.Config.Verbose > 0 {
-				log.Printf("Got SIGWINCH with new width %d", termWidth)
+				this.Butterfish.Log.Debugf("Got SIGWINCH with new width %d", termWidth)
 			}
 			this.TerminalWidth = termWidth
 			this.Prompt.SetTerminalWidth(termWidth)
@@ -760,7 +944,7 @@ func (this *ShellState) Mux() {
 			case statePromptResponse:
 				continue
 			default:
-				log.Printf("Got autosuggest result in unexpected state %d", this.State)
+				this.Butterfish.Log.Debugf("Got autosuggest result in unexpected state %d", this.State)
 				continue
 			}
 
@@ -769,9 +953,12 @@ func (this *ShellState) Mux() {
 		// We got an LLM prompt response, handle the response by adding to history,
 		// calling functions returned, etc.
 		case output := <-this.PromptOutputChan:
+			normalizeFunctionCall(output)
+			this.Recorder.Record(transcriptLLM, []byte(output.Completion))
 			historyData := output.Completion
 			if historyData != "" {
 				this.History.Append(historyTypeLLMOutput, historyData)
+				this.AutosuggestHistory.Add(historyData)
 			}
 			if output.FunctionName != "" {
 				this.History.AddFunctionCall(output.FunctionName, output.FunctionParameters)
@@ -780,7 +967,9 @@ func (this *ShellState) Mux() {
 			// If there is child output waiting to be printed, print that now
 			if len(childOutBuffer) > 0 {
 				this.ParentOut.Write(childOutBuffer)
-				this.History.Append(historyTypeShellOutput, string(childOutBuffer))
+				historyOutput := this.historyOutput(string(childOutBuffer))
+				this.History.Append(historyTypeShellOutput, historyOutput)
+				this.AutosuggestHistory.AddOutput(historyOutput)
 				childOutBuffer = []byte{}
 			}
 
@@ -801,17 +990,25 @@ func (this *ShellState) Mux() {
 
 		case childOutMsg := <-this.ChildOutReader:
 			if childOutMsg == nil {
-				log.Println("Child out reader closed")
+				this.Butterfish.Log.Debugf("Child out reader closed")
 				this.Butterfish.Cancel()
 				return
 			}
 
 			if this.Butterfish.Config.Verbose > 2 {
-				log.Printf("Child out: %x", string(childOutMsg.Data))
+				this.Butterfish.Log.Debugf("Child out: %x", string(childOutMsg.Data))
 			}
+			this.Recorder.Record(transcriptChildOut, childOutMsg.Data)
 
-			lastStatus, prompts, childOutStr := this.ParsePS1(string(childOutMsg.Data))
+			childOutData := string(childOutMsg.Data)
+			var segments []ShellSegment
+			if this.Integration != nil {
+				childOutData, segments = this.Integration.Parse(childOutData)
+			}
+
+			lastStatus, prompts, childOutStr := this.ParsePS1(childOutData)
 			this.PromptSuffixCounter += prompts
+			this.captureCommandOutput(childOutData, lastStatus, prompts)
 
 			if prompts > 0 && this.State == stateNormal && !this.GoalMode {
 				// If we get a prompt and we're at the start of a command
@@ -831,9 +1028,17 @@ func (this *ShellState) Mux() {
 				continue
 			}
 
+			// binary data is shown in the terminal but kept out of history, and
+			// with shell integration so are the prompt and echoed command
+			historyStr := childOutStr
+			if this.Integration != nil {
+				historyStr = shellOutputText(segments)
+			}
+			historyStr = this.historyOutput(historyStr)
+
 			endOfFunctionCall := false
 			if this.GoalMode {
-				this.GoalModeBuffer += childOutStr
+				this.GoalModeBuffer += historyStr
 				if this.PromptSuffixCounter >= 2 {
 					// this means that since starting to collect command function call
 					// output, we've seen two prompts, which means the function call
@@ -847,11 +1052,15 @@ func (this *ShellState) Mux() {
 			// If we're getting child output while typing in a shell command, this
 			// could mean the user is paging through old commands, or doing a tab
 			// completion, or something unknown, so we don't want to add to history.
-			if this.State != stateShell && !this.FilterChildOut(string(childOutMsg.Data)) {
-				if this.ActiveFunction != "" {
-					this.History.AppendFunctionOutput(this.ActiveFunction, childOutStr)
+			if this.State != stateShell && !this.FilterChildOut(childOutData) {
+				if this.GoalMode && this.ActiveFunction == "command" {
+					// the output is given to the model when the command finishes,
+					// see goalModeCommandDone
+				} else if this.ActiveFunction != "" {
+					this.History.AppendFunctionOutput(this.ActiveFunction, historyStr)
 				} else {
-					this.History.Append(historyTypeShellOutput, childOutStr)
+					this.History.Append(historyTypeShellOutput, historyStr)
+					this.AutosuggestHistory.AddOutput(historyStr)
 				}
 			}
 
@@ -866,7 +1075,7 @@ func (this *ShellState) Mux() {
 				timeSinceTab := timestamp.Sub(this.LastTabPassthrough)
 				if timeSinceTab < AUTOSUGGEST_TAB_WINDOW {
 					if this.Butterfish.Config.Verbose > 1 {
-						log.Printf("Time since tab: %s, adding to command: %s",
+						this.Butterfish.Log.Debugf("Time since tab: %s, adding to command: %s",
 							timeSinceTab, childOutStr)
 					}
 					this.Command.Write(childOutStr)
@@ -876,14 +1085,19 @@ func (this *ShellState) Mux() {
 
 			this.ParentOut.Write([]byte(childOutStr))
 
+			// the user typing and goal mode's commands aren't watched
+			if this.State != stateShell && !this.GoalMode {
+				this.watchChildOutput(historyStr)
+			}
+
 			if endOfFunctionCall {
 				// move cursor to the beginning of the line and clear the line
 				fmt.Fprintf(this.ParentOut, "\r%s", ESC_CLEAR)
-				var status string
 				if this.ActiveFunction == "command" {
-					status = fmt.Sprintf("Exit Code: %d\n", lastStatus)
+					this.goalModeCommandDone(lastStatus)
+				} else {
+					this.GoalModeFunctionResponse("")
 				}
-				this.GoalModeFunctionResponse(status)
 				this.ActiveFunction = ""
 				this.GoalModeBuffer = ""
 				this.PromptSuffixCounter = 0
@@ -891,11 +1105,12 @@ func (this *ShellState) Mux() {
 
 		case parentInMsg := <-this.ParentInReader:
 			if parentInMsg == nil {
-				log.Println("Parent in reader closed")
+				this.Butterfish.Log.Debugf("Parent in reader closed")
 				this.Butterfish.Cancel()
 				return
 			}
 
+			this.Recorder.Record(transcriptParentIn, parentInMsg.Data)
 			this.ParentInputLoop(parentInMsg.Data)
 		}
 	}
@@ -903,7 +1118,7 @@ func (this *ShellState) Mux() {
 
 func (this *ShellState) ParentInputLoop(data []byte) {
 	if this.Butterfish.Config.Verbose > 2 {
-		log.Printf("Parent in: %x", data)
+		this.Butterfish.Log.Debugf("Parent in: %x", data)
 	}
 
 	// include any cached data
@@ -952,10 +1167,12 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 		// We're buffering the input right now so we check both the first and last
 		// bytes for Ctrl-C
 		if data[0] == 0x03 || data[len(data)-1] == 0x03 {
-			log.Printf("Canceling prompt response")
+			this.Butterfish.Log.Debugf("Canceling prompt response")
 			this.PromptResponseCancel()
 			this.PromptResponseCancel = nil
-			this.GoalMode = false
+			if this.GoalMode {
+				this.goalModeInterrupt()
+			}
 			this.setState(stateNormal)
 			if data[0] == 0x03 {
 				return data[1:]
@@ -979,7 +1196,7 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			if this.GoalMode {
 				// Ctrl-C while in goal mode
 				fmt.Fprintf(this.PromptAnswerWriter, "\n%sExited goal mode.%s\n", this.Color.Answer, this.Color.Command)
-				this.GoalMode = false
+				this.goalModeInterrupt()
 			}
 
 			if this.Command != nil {
@@ -1015,20 +1232,35 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			this.Prompt.SetPromptLength(col - 1 - this.Prompt.Size())
 			return data[1:]
 
-		} else if data[0] == '\t' { // user is asking to fill in an autosuggest
+		} else if n := this.keyPressed(console.KeyActionFixCommand, data); n > 0 && !this.GoalMode {
+			this.ClearAutosuggest(this.Color.Command)
+			this.ParentOut.Write([]byte("\n\r"))
+			this.SendFixCommand()
+			return data[n:]
+
+		} else if n := this.keyPressed(console.KeyActionAcceptSuggestion, data); n > 0 {
+			// user is asking to fill in an autosuggest
 			if this.LastAutosuggest != "" {
 				this.RealizeAutosuggest(this.Command, true, this.Color.Command)
 				this.setState(stateShell)
-				return data[1:]
+				return data[n:]
 			} else {
-				// no last autosuggest found, just forward the tab
+				// no last autosuggest found, just forward the key
 				this.LastTabPassthrough = time.Now()
-				this.ChildIn.Write([]byte{data[0]})
+				this.ChildIn.Write(data[:n])
 			}
-			return data[1:]
+			return data[n:]
+
+		} else if n := this.keyPressed(console.KeyActionRejectSuggestion, data); n > 0 && this.LastAutosuggest != "" {
+			this.ClearAutosuggest(this.Color.Command)
+			return data[n:]
 
 		} else if data[0] == '\r' {
 			this.ClearAutosuggest(this.Color.Command)
+			if this.GoalMode && this.GoalModeCommand != "" {
+				// the user is running the command goal mode proposed
+				this.GoalModeCommandStart = time.Now()
+			}
 			this.ChildIn.Write(data)
 			return data[1:]
 
@@ -1082,8 +1314,8 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			toPrint := this.Prompt.Write(string(data))
 			this.ParentOut.Write(toPrint)
 
-		} else if data[0] == '\t' { // user is asking to fill in an autosuggest
-			// Tab was pressed, fill in lastAutosuggest
+		} else if n := this.keyPressed(console.KeyActionAcceptSuggestion, data); n > 0 {
+			// user is asking to fill in an autosuggest
 			if this.LastAutosuggest != "" {
 				this.RealizeAutosuggest(this.Prompt, false, this.Color.Prompt)
 			} else {
@@ -1091,7 +1323,11 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 				this.ParentOut.Write(data)
 			}
 
-			return data[1:]
+			return data[n:]
+
+		} else if n := this.keyPressed(console.KeyActionRejectSuggestion, data); n > 0 && this.LastAutosuggest != "" {
+			this.ClearAutosuggest(this.Color.Prompt)
+			return data[n:]
 
 		} else if data[0] == 0x03 { // Ctrl-C
 			if this.PromptResponseCancel != nil {
@@ -1124,7 +1360,17 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 
 			index := bytes.Index(data, []byte{'\r'})
 			this.ChildIn.Write(data[:index+1])
+			if !this.GoalMode {
+				this.LastCommand.Start(this.Command.String())
+			}
 			this.History.Append(historyTypeShellInput, this.Command.String())
+			this.AutosuggestHistory.Add(this.Command.String())
+			if this.HistoryFile != nil {
+				err := this.HistoryFile.Append(this.Command.String())
+				if err != nil {
+					this.Butterfish.Log.Warnf("Unable to write to history file: %s", err)
+				}
+			}
 			this.Command = NewShellBuffer()
 
 			if this.AutosuggestCancel != nil {
@@ -1146,16 +1392,20 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 
 			return data[1:]
 
-		} else if data[0] == '\t' { // user is asking to fill in an autosuggest
-			// Tab was pressed, fill in lastAutosuggest
+		} else if n := this.keyPressed(console.KeyActionAcceptSuggestion, data); n > 0 {
+			// user is asking to fill in an autosuggest
 			if this.LastAutosuggest != "" {
 				this.RealizeAutosuggest(this.Command, true, this.Color.Command)
 			} else {
-				// no last autosuggest found, just forward the tab
+				// no last autosuggest found, just forward the key
 				this.LastTabPassthrough = time.Now()
-				this.ChildIn.Write([]byte{data[0]})
+				this.ChildIn.Write(data[:n])
 			}
-			return data[1:]
+			return data[n:]
+
+		} else if n := this.keyPressed(console.KeyActionRejectSuggestion, data); n > 0 && this.LastAutosuggest != "" {
+			this.ClearAutosuggest(this.Color.Command)
+			return data[n:]
 
 		} else { // otherwise user is typing a command
 			this.Command.Write(string(data))
@@ -1166,6 +1416,42 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 			}
 		}
 
+	case stateGoalModeConfirm:
+		// Waiting for a y/n/e answer to run a goal mode command
+		switch data[0] {
+		case 'y', 'Y':
+			fmt.Fprintf(this.PromptAnswerWriter, "\n")
+			this.goalModeConfirmed(this.GoalModeConfirmCmd, GoalModeConfirmYes, "")
+		case 'n', 'N':
+			fmt.Fprintf(this.PromptAnswerWriter, "\n")
+			this.goalModeConfirmed(this.GoalModeConfirmCmd, GoalModeConfirmNo, "")
+		case 'e', 'E':
+			this.goalModeConfirmEdit()
+		case 0x03: // Ctrl-C
+			fmt.Fprintf(this.PromptAnswerWriter, "\n%sExited goal mode.%s\n", this.Color.Answer, this.Color.Command)
+			this.GoalModeConfirmCmd = ""
+			this.goalModeInterrupt()
+			this.setState(stateNormal)
+		}
+		return data[1:]
+
+	case stateGoalModeEdit:
+		if hasCarriageReturn {
+			index := bytes.Index(data, []byte{'\r'})
+			this.ParentOut.Write(this.GoalModeConfirmBuffer.Write(string(data[:index])))
+			this.ParentOut.Write([]byte("\n\r"))
+			edited := this.GoalModeConfirmBuffer.String()
+			this.goalModeConfirmed(this.GoalModeConfirmCmd, GoalModeConfirmEdit, edited)
+			return data[index+1:]
+
+		} else if data[0] == 0x03 { // Ctrl-C skips the command
+			this.ParentOut.Write([]byte("\n\r"))
+			this.goalModeConfirmed(this.GoalModeConfirmCmd, GoalModeConfirmNo, "")
+			return data[1:]
+		}
+
+		this.ParentOut.Write(this.GoalModeConfirmBuffer.Write(string(data)))
+
 	default:
 		panic("Unknown state")
 	}
@@ -1178,9 +1464,9 @@ func (this *ShellState) ParentInput(ctx context.Context, data []byte) []byte {
 // executing the next step in goal mode. We have to do this in a goroutine
 // because otherwise we would block the main thread.
 func (this *ShellState) SendPromptResponse(data string) {
-	go func() {
+	this.Butterfish.goGuarded(func() {
 		this.PromptOutputChan <- &util.CompletionResponse{Completion: data}
-	}()
+	})
 }
 
 func (this *ShellState) PrintStatus() {
@@ -1192,7 +1478,7 @@ func (this *ShellState) PrintStatus() {
 
 	text += fmt.Sprintf("Prompting model:       %s\n", this.Butterfish.Config.ShellPromptModel)
 	text += fmt.Sprintf("Prompt history window: %d tokens\n", this.PromptMaxTokens)
-	text += fmt.Sprintf("Autosuggest:           %t\n", this.Butterfish.Config.ShellAutosuggestEnabled)
+	text += fmt.Sprintf("Autosuggest:           %t\n", this.AutosuggestEnabled)
 	text += fmt.Sprintf("Autosuggest model:     %s\n", this.Butterfish.Config.ShellAutosuggestModel)
 	text += fmt.Sprintf("Autosuggest timeout:   %s\n", this.Butterfish.Config.ShellAutosuggestTimeout)
 	text += fmt.Sprintf("Autosuggest history:   %d tokens\n", this.AutosuggestMaxTokens)
@@ -1209,14 +1495,22 @@ func (this *ShellState) PrintHelp() {
 	- GPT will be able to see your shell history, so you can ask contextual questions like "why didn't my last command work?"
 	- Type "Status" to show the current Butterfish configuration
 	- Type "History" to show the recent history that will be sent to GPT
+	- Type "Fix" or press Ctrl-G to explain and fix the last command if it failed
 `
 	fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s", this.Color.Answer, text, this.Color.Command)
 	this.SendPromptResponse(text)
 }
 
 func (this *ShellState) PrintHistory() {
+	tokenizer, err := this.getPromptTokenizer()
+	if err != nil {
+		this.PrintError(err)
+		return
+	}
+
 	maxHistoryBlockTokens := this.Butterfish.Config.ShellMaxHistoryBlockTokens
-	historyBlocks, _ := getHistoryBlocksByTokens(this.History, this.getPromptEncoder(),
+	historyBlocks, _ := getHistoryBlocksByTokens(this.History,
+		tokenizer, this.Butterfish.Config.ShellPromptModel,
 		maxHistoryBlockTokens, this.PromptMaxTokens, 4)
 	strBuilder := strings.Builder{}
 
@@ -1242,6 +1536,12 @@ func (this *ShellState) PrintHistory() {
 }
 
 func (this *ShellState) GoalModeStart() {
+	if !this.Butterfish.featureEnabled(FeatureGoalMode) {
+		this.Prompt.Clear()
+		this.SendPromptResponse("")
+		return
+	}
+
 	// Get the prompt after the bang
 	goal := this.Prompt.String()[1:]
 	if goal == "" {
@@ -1257,61 +1557,251 @@ func (this *ShellState) GoalModeStart() {
 	}
 
 	this.GoalMode = true
-	fmt.Fprintf(this.PromptAnswerWriter, "%sGoal mode starting...%s\n", this.Color.Answer, this.Color.Command)
+	if this.Butterfish.Config.GoalModeDryRun {
+		fmt.Fprintf(this.PromptAnswerWriter, "%sGoal mode starting in dry run mode, commands will be printed but not run...%s\n", this.Color.Answer, this.Color.Command)
+	} else {
+		fmt.Fprintf(this.PromptAnswerWriter, "%sGoal mode starting...%s\n", this.Color.Answer, this.Color.Command)
+	}
 	this.GoalModeGoal = goal
+	this.GoalModeSteps = 0
+	this.GoalModeCommand = ""
+	this.goalModeResults = map[string]int{}
 	this.Prompt.Clear()
 
+	this.GoalModeSession = nil
+	if this.Butterfish.Config.GoalModeSessionPath != "" {
+		this.GoalModeSession = NewGoalModeSession(goal, this.GoalModeUnsafe)
+		this.GoalModeSession.historyStart = this.History.Len()
+	}
+
 	prompt := "Start now."
-	log.Printf("Starting goal mode: %s", this.GoalModeGoal)
+	this.Butterfish.Log.Infof("Starting goal mode: %s", this.GoalModeGoal)
 	this.goalModePrompt(prompt)
 }
 
+// Resume the goal mode session with the given name from GoalModeSessionPath,
+// restoring its history so the model picks up where it left off
+func (this *ShellState) GoalModeResume(name string) error {
+	if !this.Butterfish.featureEnabled(FeatureGoalMode) {
+		return nil
+	}
+
+	dir := this.Butterfish.Config.GoalModeSessionPath
+	if dir == "" {
+		return fmt.Errorf("Goal mode sessions aren't saved, no session path is set")
+	}
+
+	session, err := LoadGoalModeSession(dir, name)
+	if err != nil {
+		return err
+	}
+
+	session.historyStart = this.History.Len()
+	this.History.AddBlocks(session.History)
+	session.Status = GoalModeSessionRunning
+
+	this.GoalMode = true
+	this.GoalModeGoal = session.Goal
+	this.GoalModeUnsafe = session.Unsafe
+	this.GoalModeSteps = session.Steps
+	this.GoalModeCommand = ""
+	this.goalModeResults = map[string]int{}
+	for _, step := range session.Commands {
+		this.goalModeResults[step.Command+"\x00"+step.Result]++
+	}
+	this.GoalModeSession = session
+
+	fmt.Fprintf(this.PromptAnswerWriter, "%sResuming goal mode session %s: %s%s\n", this.Color.Answer, session.Name, session.Goal, this.Color.Command)
+	this.Butterfish.Log.Infof("Resuming goal mode session %s: %s", session.Name, session.Goal)
+	this.goalModePrompt("You were interrupted, continue toward the goal from where you left off.")
+	return nil
+}
+
+// Save goal mode's progress with the given status, errors are logged since
+// goal mode carries on without it
+func (this *ShellState) goalModeSave(status string) {
+	session := this.GoalModeSession
+	if session == nil {
+		return
+	}
+
+	session.Status = status
+	session.Steps = this.GoalModeSteps
+	session.Updated = time.Now()
+	session.History = this.History.BlocksSince(session.historyStart)
+
+	err := session.Save(this.Butterfish.Config.GoalModeSessionPath, this.Butterfish.Redactor)
+	if err != nil {
+		this.Butterfish.Log.Warnf("Unable to save goal mode session %s: %s", session.Name, err)
+	}
+}
+
+// The user exited goal mode with Ctrl-C
+func (this *ShellState) goalModeInterrupt() {
+	this.GoalMode = false
+	this.goalModeSave(GoalModeSessionInterrupted)
+}
+
 func (this *ShellState) GoalModeChat() {
 	prompt := this.Prompt.String()
 	this.Prompt.Clear()
 
-	log.Printf("Goal mode chat: %s\n", prompt)
+	this.Butterfish.Log.Debugf("Goal mode chat: %s", prompt)
 	this.goalModePrompt(prompt)
 }
 
 func (this *ShellState) GoalModeFunctionResponse(output string) {
-	log.Printf("Goal mode response: %s\n", output)
+	result := strings.TrimSpace(sanitizeTTYString(this.GoalModeBuffer)) + "\n" + output
+	this.goalModeRespond(output, result, result)
+}
+
+// Send the result of a command goal mode ran back to the model, rendered
+// with the goal mode command result prompt
+func (this *ShellState) goalModeCommandDone(exitCode int) {
+	result := &GoalModeCommandResult{
+		Command:  this.GoalModeCommand,
+		ExitCode: exitCode,
+		Output: this.Butterfish.Redactor.Redact(
+			goalModeCommandOutput(this.GoalModeCommand, this.GoalModeBuffer)),
+		Duration: time.Since(this.GoalModeCommandStart),
+	}
+
+	output, err := result.Format(this.Butterfish.PromptLibrary,
+		this.Butterfish.Config.GoalModeMaxOutputBytes)
+	if err != nil {
+		this.Butterfish.Log.Errorf("Error formatting goal mode command result: %s", err)
+		output = fmt.Sprintf("%s\nExit Code: %d\n", result.Output, exitCode)
+	}
+
+	this.goalModeRespond(output, output, result.repeatKey())
+}
+
+// Give output to the model as the result of the function it called and
+// continue toward the goal. The result is recorded in the session, and key
+// identifies it when checking whether the model is repeating itself.
+func (this *ShellState) goalModeRespond(output, result, key string) {
+	this.Butterfish.Log.Debugf("Goal mode response: %s", output)
+
+	cmd := this.GoalModeCommand
+	repeats := this.recordGoalModeResult(result, key)
+	if repeats > 1 && repeats < goalModeMaxRepeats {
+		output += fmt.Sprintf("\nYou have run this command %d times with the same result, you are repeating yourself. Try a different approach, ask the user for input, or finish.\n", repeats)
+	}
+
 	if output != "" {
-		this.History.AppendFunctionOutput(this.ActiveFunction, output)
+		this.History.AppendFunctionOutput(this.ActiveFunction, this.GoalModeEditNote+output)
 	}
 	this.ActiveFunction = ""
+	this.GoalModeEditNote = ""
+
+	if repeats >= goalModeMaxRepeats {
+		this.goalModeAbort(fmt.Sprintf("the command %s was run %d times with the same result", cmd, repeats))
+		return
+	}
 	this.goalModePrompt("")
 }
 
+// Goal mode gives up once a command has had the same result this many times
+const goalModeMaxRepeats = 3
+
+// Record the result of the command goal mode ran and return how many times
+// that command has had a result with this key. Returns 0 if no command was
+// run.
+func (this *ShellState) recordGoalModeResult(result, key string) int {
+	if this.GoalModeCommand == "" {
+		return 0
+	}
+	if this.goalModeResults == nil {
+		this.goalModeResults = map[string]int{}
+	}
+
+	key = this.GoalModeCommand + "\x00" + key
+	if this.GoalModeSession != nil {
+		this.GoalModeSession.Commands = append(this.GoalModeSession.Commands,
+			GoalModeStep{Command: this.GoalModeCommand, Result: result})
+	}
+	this.GoalModeCommand = ""
+	this.goalModeResults[key]++
+	return this.goalModeResults[key]
+}
+
+// Stop pursuing the goal and tell the user why
+func (this *ShellState) goalModeAbort(reason string) {
+	this.Butterfish.Log.Infof("Goal mode aborted: %s", reason)
+	fmt.Fprintf(this.PromptAnswerWriter, "%sExited goal mode, %s.%s\n", this.Color.Error, reason, this.Color.Command)
+	this.GoalMode = false
+	this.GoalModeCommand = ""
+	this.GoalModeEditNote = ""
+	this.setState(stateNormal)
+	this.goalModeSave(GoalModeSessionAborted)
+}
+
+// The model may call a function directly or through a tool call, copy a tool
+// call into FunctionName and FunctionParameters so both are handled the same
+func normalizeFunctionCall(output *util.CompletionResponse) {
+	if call := output.CalledFunction(); call != nil {
+		output.FunctionName = call.Name
+		output.FunctionParameters = call.Parameters
+	}
+}
+
 func (this *ShellState) GoalModeFunction(output *util.CompletionResponse) {
 	switch output.FunctionName {
 	case "command":
-		log.Printf("Goal mode command: %s", output.FunctionParameters)
+		this.Butterfish.Log.Debugf("Goal mode command: %s", output.FunctionParameters)
 		this.GoalModeBuffer = ""
 		this.PromptSuffixCounter = 0
 		this.setState(stateNormal)
 		cmd, err := parseCommandParams(output.FunctionParameters)
 		if err != nil {
 			// we failed to parse the command json, send error back to model
-			log.Printf("Error parsing function arguments: %s", err)
+			this.Butterfish.Log.Warnf("Error parsing function arguments: %s", err)
 			modelStr := fmt.Sprintf("Error parsing your json, try again: %s", err)
 			this.GoalModeFunctionResponse(modelStr)
 			return
 		}
-		log.Printf("Goal mode command: %s", cmd)
+		this.Butterfish.Log.Debugf("Goal mode command: %s", cmd)
+		this.GoalModeCommand = cmd
+
+		err = this.Butterfish.CommandFilter.Check(cmd)
+		if err != nil {
+			// refuse to run the command and let the model try something else
+			this.Butterfish.Log.Infof("Goal mode refused command %s: %s", cmd, err)
+			fmt.Fprintf(this.PromptAnswerWriter, "%sRefused to run: %s (%s)%s\n", this.Color.Error, cmd, err, this.Color.Command)
+			modelStr := fmt.Sprintf("The command was refused and not executed because the %s. Try a different approach.", err)
+			this.GoalModeFunctionResponse(modelStr)
+			return
+		}
+
+		if this.Butterfish.Config.GoalModeDryRun {
+			// print the command rather than running it, and tell the model it
+			// succeeded so that it continues with its plan
+			this.Butterfish.Log.Infof("Goal mode dry run, not executing: %s", cmd)
+			fmt.Fprintf(this.PromptAnswerWriter, "%sDry run, would have run: %s%s\n", this.Color.GoalMode, cmd, this.Color.Command)
+			modelStr := "Dry run mode: the command was not executed. Assume it succeeded with exit code 0 and continue toward the goal."
+			this.GoalModeFunctionResponse(modelStr)
+			return
+		}
+
+		if this.Butterfish.Config.GoalModeConfirm {
+			this.goalModeConfirm(cmd)
+			return
+		}
+
+		this.GoalModeCommandStart = time.Now()
 		fmt.Fprintf(this.ChildIn, "%s", cmd)
 		if this.GoalModeUnsafe {
 			fmt.Fprintf(this.ChildIn, "\n")
 		}
 
 	case "user_input":
-		log.Printf("Goal mode user_input: %s", output.FunctionParameters)
+		this.Butterfish.Log.Debugf("Goal mode user_input: %s", output.FunctionParameters)
 		this.GoalModeBuffer = ""
 		this.PromptSuffixCounter = -999999
 		this.setState(stateNormal)
 		question, err := parseUserInputParams(output.FunctionParameters)
 		if err != nil {
-			log.Printf("Error parsing function arguments: %s", err)
+			this.Butterfish.Log.Warnf("Error parsing function arguments: %s", err)
 			modelStr := fmt.Sprintf("Error parsing your json, try again: %s", err)
 			this.GoalModeFunctionResponse(modelStr)
 			return
@@ -1320,12 +1810,12 @@ func (this *ShellState) GoalModeFunction(output *util.CompletionResponse) {
 		fmt.Fprintf(this.PromptAnswerWriter, "%s%s%s\n", this.Color.Answer, question, this.Color.Command)
 
 	case "finish":
-		log.Printf("Goal mode finishing: %s", output.FunctionParameters)
+		this.Butterfish.Log.Debugf("Goal mode finishing: %s", output.FunctionParameters)
 		this.GoalModeBuffer = ""
 		this.setState(stateNormal)
 		success, err := parseFinishParams(output.FunctionParameters)
 		if err != nil {
-			log.Printf("Error parsing function arguments: %s", err)
+			this.Butterfish.Log.Warnf("Error parsing function arguments: %s", err)
 			modelStr := fmt.Sprintf("Error parsing your json, try again: %s", err)
 			this.History.AppendFunctionOutput(output.FunctionName, modelStr)
 			this.GoalModeFunctionResponse(modelStr)
@@ -1333,27 +1823,101 @@ func (this *ShellState) GoalModeFunction(output *util.CompletionResponse) {
 		}
 
 		result := "SUCCESS"
+		status := GoalModeSessionSuccess
 		if !success {
 			result = "FAILURE"
+			status = GoalModeSessionFailure
 		}
 
 		fmt.Fprintf(this.PromptAnswerWriter, "%sExited goal mode with %s.%s\n", this.Color.Answer, result, this.Color.Command)
 		this.GoalMode = false
+		this.goalModeSave(status)
 
 	case "":
-		log.Printf("No function called in goal mode")
+		this.Butterfish.Log.Warnf("No function called in goal mode")
 		modelStr := fmt.Sprintf("You must call a function in goal mode responses.")
 		this.History.Append(historyTypePrompt, modelStr)
 		this.GoalModeFunctionResponse("")
 
 	default:
-		log.Printf("Invalid function name called in goal mode: %s", output.FunctionName)
+		this.Butterfish.Log.Warnf("Invalid function name called in goal mode: %s", output.FunctionName)
 		modelStr := fmt.Sprintf("Invalid function name: %s", output.FunctionName)
 		this.GoalModeFunctionResponse(modelStr)
 
 	}
 }
 
+// Ask the user whether to run a command the model proposed. If there's no
+// ConfirmCommand callback we print the question and wait for an answer in
+// ParentInput.
+func (this *ShellState) goalModeConfirm(cmd string) {
+	if this.ConfirmCommand != nil {
+		decision, edited := this.ConfirmCommand(cmd)
+		this.goalModeConfirmed(cmd, decision, edited)
+		return
+	}
+
+	this.GoalModeConfirmCmd = cmd
+	this.setState(stateGoalModeConfirm)
+	fmt.Fprintf(this.PromptAnswerWriter, "%sRun %s? [y]es, [n]o, [e]dit: %s",
+		this.Color.GoalMode, cmd, this.Color.Command)
+}
+
+// Start editing the command waiting for confirmation, the user submits the
+// edited command with enter
+func (this *ShellState) goalModeConfirmEdit() {
+	this.setState(stateGoalModeEdit)
+	fmt.Fprintf(this.PromptAnswerWriter, "\n%sEdit command: %s", this.Color.GoalMode, this.Color.Command)
+
+	_, col := this.GetCursorPosition()
+	this.GoalModeConfirmBuffer = NewShellBuffer()
+	this.GoalModeConfirmBuffer.SetTerminalWidth(this.TerminalWidth)
+	this.GoalModeConfirmBuffer.SetPromptLength(col - 1)
+	this.ParentOut.Write(this.GoalModeConfirmBuffer.Write(this.GoalModeConfirmCmd))
+}
+
+// Act on the user's answer: run the command, run the edited command, or tell
+// the model the command was skipped. An edited command goes through the
+// command filter again and the model is told what was run instead.
+func (this *ShellState) goalModeConfirmed(cmd string, decision GoalModeConfirmation, edited string) {
+	this.GoalModeConfirmCmd = ""
+	this.GoalModeConfirmBuffer = nil
+	this.setState(stateNormal)
+
+	if decision == GoalModeConfirmEdit {
+		edited = strings.TrimSpace(edited)
+		if edited == "" {
+			decision = GoalModeConfirmNo
+		} else if edited != cmd {
+			err := this.Butterfish.CommandFilter.Check(edited)
+			if err != nil {
+				this.Butterfish.Log.Infof("Goal mode refused edited command %s: %s", edited, err)
+				fmt.Fprintf(this.PromptAnswerWriter, "%sRefused to run: %s (%s)%s\n", this.Color.Error, edited, err, this.Color.Command)
+				modelStr := fmt.Sprintf("The user edited your command to \"%s\" but it was refused and not executed because the %s. Try a different approach.", edited, err)
+				this.GoalModeFunctionResponse(modelStr)
+				return
+			}
+
+			this.Butterfish.Log.Infof("Goal mode command edited by user: %s", edited)
+			this.GoalModeEditNote = fmt.Sprintf("The user edited the command before running it, this was run instead: %s\n", edited)
+			cmd = edited
+			this.GoalModeCommand = cmd
+		}
+	}
+
+	if decision == GoalModeConfirmNo {
+		this.Butterfish.Log.Infof("Goal mode command skipped by user: %s", cmd)
+		fmt.Fprintf(this.PromptAnswerWriter, "%sSkipped: %s%s\n", this.Color.GoalMode, cmd, this.Color.Command)
+		modelStr := "The user chose not to run the command and it was not executed. Try a different approach or ask the user for input."
+		this.GoalModeFunctionResponse(modelStr)
+		return
+	}
+
+	// the user approved the command so we run it immediately
+	this.GoalModeCommandStart = time.Now()
+	fmt.Fprintf(this.ChildIn, "%s\n", cmd)
+}
+
 var goalModeFunctions = []util.FunctionDefinition{
 	{
 		Name:        "command",
@@ -1404,21 +1968,29 @@ var goalModeFunctions = []util.FunctionDefinition{
 var goalModeFunctionsString string
 
 // serialize goalModeFunctions to json and cache in goalModeFunctionsString
-func getGoalModeFunctionsString() string {
+func getGoalModeFunctionsString() (string, error) {
 	if goalModeFunctionsString == "" {
 		bytes, err := json.Marshal(goalModeFunctions)
 		if err != nil {
-			log.Fatal(err)
+			return "", fmt.Errorf("Error serializing goal mode functions: %s", err)
 		}
 		goalModeFunctionsString = string(bytes)
-		log.Printf("goalModeFunctionsString: %s", goalModeFunctionsString)
+		util.DefaultLogger().Debugf("goalModeFunctionsString: %s", goalModeFunctionsString)
 	}
-	return goalModeFunctionsString
+	return goalModeFunctionsString, nil
 }
 
 func (this *ShellState) goalModePrompt(lastPrompt string) {
+	maxSteps := this.Butterfish.Config.GoalModeMaxSteps
+	if maxSteps > 0 && this.GoalModeSteps >= maxSteps {
+		this.goalModeAbort(fmt.Sprintf("reached the limit of %d steps without finishing", maxSteps))
+		return
+	}
+	this.GoalModeSteps++
+	this.goalModeSave(GoalModeSessionRunning)
+
 	this.setState(statePromptResponse)
-	requestCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	requestCtx, cancel := context.WithCancel(context.Background())
 	this.PromptResponseCancel = cancel
 
 	sysMsg, err := this.Butterfish.PromptLibrary.GetPrompt(
@@ -1427,13 +1999,19 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 		"sysinfo", GetSystemInfo())
 	if err != nil {
 		msg := fmt.Errorf("ERROR: could not retrieve prompting system message: %s", err)
-		log.Println(msg)
+		this.Butterfish.Log.Errorf("%s", msg)
 		this.PrintError(msg)
 		return
 	}
 
+	functions, err := getGoalModeFunctionsString()
+	if err != nil {
+		this.PrintError(err)
+		return
+	}
+
 	tokensForAnswer := 1024
-	lastPrompt, historyBlocks, err := this.AssembleChat(lastPrompt, sysMsg, getGoalModeFunctionsString(), tokensForAnswer)
+	lastPrompt, historyBlocks, err := this.AssembleChat(lastPrompt, sysMsg, functions, tokensForAnswer)
 	if err != nil {
 		this.PrintError(err)
 		return
@@ -1444,18 +2022,55 @@ func (this *ShellState) goalModePrompt(lastPrompt string) {
 		Prompt:        lastPrompt,
 		Model:         this.Butterfish.Config.ShellPromptModel,
 		MaxTokens:     tokensForAnswer,
-		Temperature:   0.6,
+		Temperature:   this.Butterfish.Config.GoalModeTemperature,
+		TopP:          this.Butterfish.Config.GoalModeTopP,
 		HistoryBlocks: historyBlocks,
 		SystemMessage: sysMsg,
 		Functions:     goalModeFunctions,
 		Verbose:       this.Butterfish.Config.Verbose > 0,
+		Feature:       FeatureGoalMode,
+		Timeout:       this.Butterfish.Config.RequestTimeout,
+	}
+
+	// The model's reasoning streams to the console as it's generated, but the
+	// function call is only acted on once the whole response has arrived on
+	// PromptOutputChan and been parsed. We run this in a goroutine so that we
+	// can still receive input like Ctrl-C while waiting for the response.
+	writer := &goalModeStreamWriter{
+		Writer:        this.PromptAnswerWriter,
+		FunctionColor: this.Color.GoalMode,
+		TextColor:     this.Color.Answer,
+	}
+	this.Butterfish.goGuarded(func() {
+		CompletionRoutine(request, this.Butterfish.LLMClient,
+			writer, this.PromptOutputChan,
+			this.Color.Answer, this.Color.Error, this.StyleWriter)
+	})
+}
+
+// Writes a streaming goal mode response, the model's reasoning in the answer
+// color and the function call it makes in the goal mode color
+type goalModeStreamWriter struct {
+	Writer        io.Writer
+	FunctionColor string
+	TextColor     string
+	inFunction    bool
+}
+
+func (this *goalModeStreamWriter) Write(p []byte) (int, error) {
+	if this.inFunction {
+		this.inFunction = false
+		this.Writer.Write([]byte(this.TextColor))
 	}
+	return this.Writer.Write(p)
+}
 
-	// we run this in a goroutine so that we can still receive input
-	// like Ctrl-C while waiting for the response
-	go CompletionRoutine(request, this.Butterfish.LLMClient,
-		this.PromptAnswerWriter, this.PromptOutputChan,
-		this.Color.GoalMode, this.Color.Error, this.StyleWriter)
+func (this *goalModeStreamWriter) WriteFunctionCall(p []byte) (int, error) {
+	if !this.inFunction {
+		this.inFunction = true
+		this.Writer.Write([]byte(this.FunctionColor))
+	}
+	return this.Writer.Write(p)
 }
 
 func (this *ShellState) HandleLocalPrompt() bool {
@@ -1469,6 +2084,9 @@ func (this *ShellState) HandleLocalPrompt() bool {
 		this.PrintHelp()
 	case "history":
 		this.PrintHistory()
+	case "fix":
+		this.Prompt.Clear()
+		this.SendFixCommand()
 	default:
 		return false
 	}
@@ -1476,24 +2094,6 @@ func (this *ShellState) HandleLocalPrompt() bool {
 	return true
 }
 
-// Given an encoder, a string, and a maximum number of takens, we count the
-// number of tokens in the string and truncate to the max tokens if the would
-// exceed it. Returns the number of tokens, the truncated string, and a bool
-// indicating whether the string was truncated.
-func countAndTruncate(data string,
-	encoder *tiktoken.Tiktoken,
-	maxTokens int) (int, string, bool) {
-	tokens := encoder.Encode(data, nil, nil)
-	truncated := false
-	if len(tokens) >= maxTokens {
-		tokens = tokens[:maxTokens]
-		data = encoder.Decode(tokens)
-		truncated = true
-	}
-
-	return len(tokens), data, truncated
-}
-
 // Prepare to call assembleChat() based on the ShellState variables for
 // calculating token limits.
 func (this *ShellState) AssembleChat(prompt, sysMsg, functions string, reserveForAnswer int) (string, []util.HistoryBlock, error) {
@@ -1505,8 +2105,13 @@ func (this *ShellState) AssembleChat(prompt, sysMsg, functions string, reserveFo
 	// How much for the total request (prompt, history, sys msg)
 	maxCombinedPromptTokens := totalTokens - reserveForAnswer
 
+	tokenizer, err := this.getPromptTokenizer()
+	if err != nil {
+		return "", nil, err
+	}
+
 	return assembleChat(prompt, sysMsg, functions, this.History,
-		this.Butterfish.Config.ShellPromptModel, this.getPromptEncoder(),
+		this.Butterfish.Config.ShellPromptModel, tokenizer,
 		maxPromptTokens, maxHistoryBlockTokens, maxCombinedPromptTokens)
 }
 
@@ -1519,7 +2124,7 @@ func assembleChat(
 	functions string,
 	history *ShellHistory,
 	model string,
-	encoder *tiktoken.Tiktoken,
+	tokenizer Tokenizer,
 	maxPromptTokens int,
 	maxHistoryBlockTokens int,
 	maxTokens int,
@@ -1531,16 +2136,16 @@ func assembleChat(
 	usedTokens := 3
 
 	// account for prompt
-	numPromptTokens, prompt, truncated := countAndTruncate(prompt, encoder, maxPromptTokens)
+	numPromptTokens, prompt, truncated := truncateToTokens(tokenizer, prompt, maxPromptTokens)
 	if truncated {
-		log.Printf("WARNING: truncated the prompt to %d tokens", numPromptTokens)
+		util.DefaultLogger().Warnf("Truncated the prompt to %d tokens", numPromptTokens)
 	}
 	usedTokens += numPromptTokens
 
 	// account for system message
-	sysMsgTokens := encoder.Encode(sysMsg, nil, nil)
+	sysMsgTokens := tokenizer.Encode(sysMsg)
 	if len(sysMsgTokens) > 1028 {
-		log.Printf("WARNING: the system message is very long, this may cause you to hit the token limit. Recommend you reduce the size in prompts.yaml")
+		util.DefaultLogger().Warnf("The system message is very long, this may cause you to hit the token limit. Recommend you reduce the size in prompts.yaml")
 	}
 
 	usedTokens += usedTokens + len(sysMsgTokens)
@@ -1549,9 +2154,9 @@ func assembleChat(
 	}
 
 	// account for functions
-	functionTokens := encoder.Encode(functions, nil, nil)
+	functionTokens := tokenizer.Encode(functions)
 	if len(functionTokens) > 1028 {
-		log.Printf("WARNING: the functions are very long and are taking up %d tokens. This may cause you to hit the token limit.", functionTokens)
+		util.DefaultLogger().Warnf("The functions are very long and are taking up %d tokens. This may cause you to hit the token limit.", functionTokens)
 	}
 
 	usedTokens += usedTokens + len(functionTokens)
@@ -1561,7 +2166,8 @@ func assembleChat(
 
 	blocks, historyTokens := getHistoryBlocksByTokens(
 		history,
-		encoder,
+		tokenizer,
+		model,
 		maxHistoryBlockTokens,
 		maxTokens-usedTokens,
 		tokensPerMessage)
@@ -1577,11 +2183,13 @@ func assembleChat(
 // Iterate through a history and build a list of HistoryBlocks up until the
 // maximum number of tokens is reached. A single block will be truncated to
 // the maxHistoryBlockTokens number. Each block will start at a baseline of
-// tokensPerMessage number of tokens.
+// tokensPerMessage number of tokens. Tokenizations of each block are cached
+// under the model name since different models count tokens differently.
 // We return the history blocks and the number of tokens it uses.
 func getHistoryBlocksByTokens(
 	history *ShellHistory,
-	encoder *tiktoken.Tiktoken,
+	tokenizer Tokenizer,
+	model string,
 	maxHistoryBlockTokens,
 	maxTokens,
 	tokensPerMessage int,
@@ -1599,35 +2207,34 @@ func getHistoryBlocksByTokens(
 		roleString := ShellHistoryTypeToRole(block.Type)
 
 		// add tokens for role
-		msgTokens += len(encoder.Encode(roleString, nil, nil))
+		msgTokens += len(tokenizer.Encode(roleString))
 
 		if block.FunctionName != "" {
 			// add tokens for function name
-			msgTokens += len(encoder.Encode(block.FunctionName, nil, nil))
+			msgTokens += len(tokenizer.Encode(block.FunctionName))
 		}
 		if block.FunctionParams != "" {
 			// add tokens for function params
-			msgTokens += len(encoder.Encode(block.FunctionParams, nil, nil))
+			msgTokens += len(tokenizer.Encode(block.FunctionParams))
 		}
 
 		// check existing block tokenizations
 		contentLen := block.Content.Size()
-		content, contentTokens, ok := block.GetTokenization(encoder.EncoderName(), contentLen)
+		content, contentTokens, ok := block.GetTokenization(model, contentLen)
 
 		if !ok { // cache miss
-			contentStr := block.Content.String()
-			// avoid processing super long strings with a ceiling
+			// remove ANSI escape codes and secrets, before truncating so that
+			// a secret cut at the ceiling can't slip past the redactor
+			historyContent := history.Redactor.Redact(sanitizeTTYString(block.Content.String()))
+			// avoid tokenizing super long strings with a ceiling
 			ceiling := maxHistoryBlockTokens * 4
-			if contentLen > ceiling {
-				contentStr = contentStr[:ceiling]
+			if len(historyContent) > ceiling {
+				historyContent = historyContent[:ceiling]
 			}
-
-			// remove ANSI escape codes
-			historyContent := sanitizeTTYString(contentStr)
 			// encode and truncate
-			contentTokens, content, _ = countAndTruncate(historyContent, encoder, maxHistoryBlockTokens)
+			contentTokens, content, _ = truncateToTokens(tokenizer, historyContent, maxHistoryBlockTokens)
 			// save truncated string
-			block.SetTokenization(encoder.EncoderName(), contentLen, contentTokens, content)
+			block.SetTokenization(model, contentLen, contentTokens, content)
 		}
 		msgTokens += contentTokens
 
@@ -1653,6 +2260,42 @@ func getHistoryBlocksByTokens(
 }
 
 func (this *ShellState) SendPrompt() {
+	this.sendPrompt(this.Prompt.String(), this.Prompt.String(), true, FeatureShellPrompt)
+}
+
+// If data starts with a key bound to the action then return the length of
+// the key's input, otherwise 0
+func (this *ShellState) keyPressed(action console.KeyAction, data []byte) int {
+	keybindings := this.Butterfish.Config.Keybindings
+	if keybindings == nil {
+		keybindings = console.DefaultKeybindings()
+	}
+	return keybindings.MatchPrefix(action, data)
+}
+
+// Ask the LLM to explain why the last command failed and suggest a fixed
+// command, filling in the fix command prompt from what we captured
+func (this *ShellState) SendFixCommand() {
+	if !this.Butterfish.featureEnabled(FeatureFixCommand) {
+		this.SendPromptResponse("")
+		return
+	}
+
+	promptStr, err := this.fixCommandPrompt()
+	if err != nil {
+		this.setState(statePromptResponse)
+		this.PrintError(err)
+		return
+	}
+
+	this.sendPrompt(promptStr, "Fix the last command: "+this.LastCommand.Command, false, FeatureFixCommand)
+}
+
+// Send a prompt to the LLM, streaming the answer to the terminal. The
+// history entry is what's recorded for the prompt in the shell history,
+// and if withHistory is set the shell history is sent along with the
+// prompt. The request is reported as feature in usage events.
+func (this *ShellState) sendPrompt(promptStr, historyEntry string, withHistory bool, feature string) {
 	this.setState(statePromptResponse)
 
 	requestCtx, cancel := context.WithCancel(context.Background())
@@ -1666,12 +2309,16 @@ func (this *ShellState) SendPrompt() {
 		return
 	}
 
-	prompt := this.Prompt.String()
-	tokensReservedForAnswer := this.Butterfish.Config.ShellMaxResponseTokens
-	prompt, historyBlocks, err := this.AssembleChat(prompt, sysMsg, "", tokensReservedForAnswer)
-	if err != nil {
-		this.PrintError(err)
-		return
+	prompt := promptStr
+	sysMsg, tokensReservedForAnswer := this.Butterfish.Config.AnswerVerbosity.Apply(
+		sysMsg, this.Butterfish.Config.ShellMaxResponseTokens)
+	var historyBlocks []util.HistoryBlock
+	if withHistory {
+		prompt, historyBlocks, err = this.AssembleChat(prompt, sysMsg, "", tokensReservedForAnswer)
+		if err != nil {
+			this.PrintError(err)
+			return
+		}
 	}
 
 	request := &util.CompletionRequest{
@@ -1679,20 +2326,26 @@ func (this *ShellState) SendPrompt() {
 		Prompt:        prompt,
 		Model:         this.Butterfish.Config.ShellPromptModel,
 		MaxTokens:     tokensReservedForAnswer,
-		Temperature:   0.7,
+		Temperature:   this.Butterfish.Config.ShellPromptTemperature,
+		TopP:          this.Butterfish.Config.ShellPromptTopP,
 		HistoryBlocks: historyBlocks,
 		SystemMessage: sysMsg,
+		Feature:       feature,
 		Verbose:       this.Butterfish.Config.Verbose > 0,
 		TokenTimeout:  this.Butterfish.Config.TokenTimeout,
+		Timeout:       this.Butterfish.Config.RequestTimeout,
 	}
 
-	this.History.Append(historyTypePrompt, this.Prompt.String())
+	this.History.Append(historyTypePrompt, historyEntry)
+	this.AutosuggestHistory.Add(historyEntry)
 
 	// we run this in a goroutine so that we can still receive input
 	// like Ctrl-C while waiting for the response
-	go CompletionRoutine(request, this.Butterfish.LLMClient,
-		this.PromptAnswerWriter, this.PromptOutputChan,
-		this.Color.Answer, this.Color.Error, this.StyleWriter)
+	this.Butterfish.goGuarded(func() {
+		CompletionRoutine(request, this.Butterfish.LLMClient,
+			this.PromptAnswerWriter, this.PromptOutputChan,
+			this.Color.Answer, this.Color.Error, this.StyleWriter)
+	})
 
 	this.Prompt.Clear()
 }
@@ -1712,8 +2365,11 @@ func CompletionRoutine(
 	// handle any completion errors
 	if err != nil {
 		errStr := fmt.Sprintf("Error prompting LLM: %s\n", err)
+		if hint := LLMErrorHint(err); hint != "" {
+			errStr += hint + "\n"
+		}
 
-		log.Printf("%s", errStr)
+		util.DefaultLogger().Errorf("%s", errStr)
 
 		if !strings.Contains(errStr, "context canceled") {
 			fmt.Fprintf(writer, "%s%s", errorColor, errStr)
@@ -1735,7 +2391,7 @@ func CompletionRoutine(
 // When the user presses tab or a similar hotkey, we want to turn the
 // autosuggest into a real command
 func (this *ShellState) RealizeAutosuggest(buffer *ShellBuffer, sendToChild bool, colorStr string) {
-	log.Printf("Realizing autosuggest: %s", this.LastAutosuggest)
+	this.Butterfish.Log.Debugf("Realizing autosuggest: %s", this.LastAutosuggest)
 
 	writer := this.ParentOut
 	if sendToChild {
@@ -1791,7 +2447,7 @@ func (this *ShellState) ShowAutosuggest(
 
 	if result.Command != buffer.String() {
 		// this is an old result, it doesn't match the current command/prompt buffer
-		log.Printf("Autosuggest result is old, ignoring. Expected: %s, got: %s", buffer.String(), result.Command)
+		this.Butterfish.Log.Debugf("Autosuggest result is old, ignoring. Expected: %s, got: %s", buffer.String(), result.Command)
 		// TODO we can check the prefix and try to continue in this case
 		return
 	}
@@ -1880,37 +2536,42 @@ func (this *ShellState) ClearAutosuggest(colorStr string) {
 	this.AutosuggestBuffer = nil
 }
 
-func (this *ShellState) getAutosuggestEncoder() *tiktoken.Tiktoken {
-	if this.AutosuggestEncoder == nil {
+// Returns nil if there's no tokenizer for the autosuggest model, in which
+// case autosuggest history isn't trimmed to the model's context window
+func (this *ShellState) getAutosuggestTokenizer() Tokenizer {
+	if this.AutosuggestTokenizer == nil {
 		modelName := this.Butterfish.Config.ShellAutosuggestModel
-		encoder, err := tiktoken.EncodingForModel(modelName)
+		tokenizer, err := this.Butterfish.tokenizerForModel(modelName)
 		if err != nil {
-			panic(fmt.Sprintf("Error getting encoder for autosuggest model %s: %s", modelName, err))
+			this.Butterfish.Log.Warnf("Error getting tokenizer for autosuggest model %s: %s", modelName, err)
+			return nil
 		}
 
-		this.AutosuggestEncoder = encoder
+		this.AutosuggestTokenizer = tokenizer
 	}
 
-	return this.AutosuggestEncoder
+	return this.AutosuggestTokenizer
 }
 
-func (this *ShellState) getPromptEncoder() *tiktoken.Tiktoken {
-	if this.PromptEncoder == nil {
+func (this *ShellState) getPromptTokenizer() (Tokenizer, error) {
+	if this.PromptTokenizer == nil {
 		modelName := this.Butterfish.Config.ShellPromptModel
-		encoder, err := tiktoken.EncodingForModel(modelName)
+		tokenizer, err := this.Butterfish.tokenizerForModel(modelName)
 		if err != nil {
-			panic(fmt.Sprintf("Error getting encoder for prompt model %s: %s", modelName, err))
+			return nil, fmt.Errorf("Error getting tokenizer for prompt model %s: %s", modelName, err)
 		}
 
-		this.PromptEncoder = encoder
+		this.PromptTokenizer = tokenizer
 	}
 
-	return this.PromptEncoder
+	return this.PromptTokenizer, nil
 }
 
 // rewrite this for autosuggest
 func (this *ShellState) RequestAutosuggest(delay time.Duration, command string) {
-	if !this.AutosuggestEnabled {
+	// the shell turns AutosuggestEnabled off when the feature is disabled,
+	// this also covers shells set up without it
+	if !this.AutosuggestEnabled || !this.Butterfish.Config.FeatureEnabled(FeatureAutosuggest) {
 		return
 	}
 
@@ -1940,21 +2601,31 @@ func (this *ShellState) RequestAutosuggest(delay time.Duration, command string)
 	}
 
 	if err != nil {
-		log.Printf("Error getting prompt from library: %s", err)
+		this.Butterfish.Log.Errorf("Error getting prompt from library: %s", err)
 		return
 	}
 
-	go RequestCancelableAutosuggest(
-		this.AutosuggestCtx,
-		delay,
-		command,
-		suggestPrompt,
-		this.Butterfish.LLMClient,
-		this.Butterfish.Config.ShellAutosuggestModel,
-		this.Butterfish.Config.Verbose > 1,
-		this.History,
-		this.Butterfish.Config.ShellMaxHistoryBlockTokens,
-		this.AutosuggestChan)
+	// evaluated now since the context is replaced by the next request
+	ctx := this.AutosuggestCtx
+	history := this.Butterfish.Redactor.Redact(this.AutosuggestHistory.Snapshot())
+	tokenizer := this.getAutosuggestTokenizer()
+	this.Butterfish.goGuarded(func() {
+		RequestCancelableAutosuggest(
+			ctx,
+			delay,
+			command,
+			suggestPrompt,
+			this.Butterfish.LLMClient,
+			this.Butterfish.Config.ShellAutosuggestModel,
+			this.Butterfish.Config.ShellAutosuggestTemperature,
+			this.Butterfish.Config.ShellAutosuggestTopP,
+			this.Butterfish.Config.ShellAutosuggestRequestTimeout,
+			this.Butterfish.Config.Verbose > 1,
+			history,
+			tokenizer,
+			this.AutosuggestMaxTokens,
+			this.AutosuggestChan)
+	})
 
 }
 
@@ -1967,9 +2638,13 @@ func RequestCancelableAutosuggest(
 	rawPrompt string,
 	llmClient LLM,
 	model string,
+	temperature float32,
+	topP float32,
+	timeout time.Duration,
 	verbose bool,
-	history *ShellHistory,
-	maxHistoryBlockTokens int,
+	historyStr string,
+	tokenizer Tokenizer,
+	maxTokens int,
 	autosuggestChan chan<- *AutosuggestResult) {
 
 	if delay > 0 {
@@ -1980,18 +2655,20 @@ func RequestCancelableAutosuggest(
 	}
 
 	totalTokens := 1600 // limit autosuggest to 1600 tokens for cost reasons
+	if maxTokens > 0 && maxTokens < totalTokens {
+		totalTokens = maxTokens
+	}
 	reserveForAnswer := 64
 
-	encoder, err := tiktoken.EncodingForModel(model)
-	if err != nil {
-		panic(fmt.Sprintf("Error getting encoder for prompt model %s: %s", model, err))
+	// trim the oldest history so the whole prompt fits in the token limit
+	if tokenizer != nil {
+		historyBudget := totalTokens - reserveForAnswer -
+			len(tokenizer.Encode(rawPrompt)) - len(tokenizer.Encode(currCommand))
+		_, historyStr = trimToLastTokens(tokenizer, historyStr, historyBudget)
 	}
 
-	historyBlocks, _ := getHistoryBlocksByTokens(history, encoder,
-		maxHistoryBlockTokens, totalTokens-reserveForAnswer, 4)
-
-	historyStr := HistoryBlocksToString(historyBlocks)
 	var prmpt string
+	var err error
 
 	if currCommand != "" {
 		prmpt, err = prompt.Interpolate(rawPrompt,
@@ -2003,7 +2680,7 @@ func RequestCancelableAutosuggest(
 	}
 
 	if err != nil {
-		log.Printf("Autosuggest error: %s", err)
+		util.DefaultLogger().Warnf("Autosuggest error: %s", err)
 		return
 	}
 
@@ -2012,14 +2689,17 @@ func RequestCancelableAutosuggest(
 		Prompt:      prmpt,
 		Model:       model,
 		MaxTokens:   reserveForAnswer,
-		Temperature: 0.2,
+		Temperature: temperature,
+		TopP:        topP,
 		Verbose:     verbose,
+		Timeout:     timeout,
+		Feature:     FeatureAutosuggest,
 	}
 
 	response, err := llmClient.Completion(request)
 	if err != nil {
 		if !strings.Contains(err.Error(), "context canceled") {
-			log.Printf("Autosuggest error: %s", err)
+			util.DefaultLogger().Warnf("Autosuggest error: %s", err)
 		}
 		return
 	}
@@ -2088,7 +2768,7 @@ func HasRunningChildren() bool {
 	// get the number of child processes
 	count, err := countChildPids(pid)
 	if err != nil {
-		log.Printf("Error counting child processes: %s", err)
+		util.DefaultLogger().Warnf("Error counting child processes: %s", err)
 		return false
 	}
 
@@ -0,0 +1,194 @@
+package butterfish
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Shell integration has the wrapped shell mark where its prompt, the
+// command being typed, and the command's output start and end, using the
+// OSC 133 escape sequences that terminals like iTerm2 and WezTerm also
+// understand. Without it the boundaries are guessed from raw terminal
+// output, which mixes the prompt and the echoed command in with output.
+
+// The part of the terminal output a segment of child output belongs to
+type ShellRegion int
+
+const (
+	// Output before the first marker or between a command finishing and
+	// the next prompt
+	RegionUnknown ShellRegion = iota
+	RegionPrompt
+	// The command line as the user types it, echoed by the shell
+	RegionCommand
+	RegionOutput
+)
+
+var shellRegionNames = []string{"unknown", "prompt", "command", "output"}
+
+func (this ShellRegion) String() string {
+	if int(this) < len(shellRegionNames) {
+		return shellRegionNames[this]
+	}
+	return fmt.Sprintf("ShellRegion(%d)", int(this))
+}
+
+// A piece of child output and the region it was written in. Finished is set
+// on the output segment ended by a command finishing, with its exit status.
+type ShellSegment struct {
+	Region   ShellRegion
+	Text     string
+	Finished bool
+	ExitCode int
+}
+
+// OSC 133 markers: A prompt start, B command start, C output start, and D
+// command finished with an optional exit status. Terminated by BEL or ST.
+var shellMarkerRegex = regexp.MustCompile("\x1b\\]133;([ABCD])(?:;([^\x07\x1b]*))?(?:\x07|\x1b\\\\)")
+
+const shellMarkerPrefix = "\x1b]133;"
+
+// Splits child output into segments at shell integration markers and
+// removes the markers so they aren't displayed. Markers can be split across
+// calls to Parse, the start of one at the end of data is held back until the
+// rest arrives.
+type ShellIntegrationParser struct {
+	region  ShellRegion
+	partial string
+}
+
+// Parse the next chunk of child output, returning it with any markers
+// removed and its segments in order. Adjacent text in the same region is
+// one segment, and empty segments are only returned to mark a command
+// finishing.
+func (this *ShellIntegrationParser) Parse(data string) (string, []ShellSegment) {
+	data = this.partial + data
+	this.partial = ""
+	if index := partialShellMarker(data); index != -1 {
+		this.partial = data[index:]
+		data = data[:index]
+	}
+
+	segments := []ShellSegment{}
+	display := strings.Builder{}
+	last := 0
+
+	for _, match := range shellMarkerRegex.FindAllStringSubmatchIndex(data, -1) {
+		text := data[last:match[0]]
+		display.WriteString(text)
+		last = match[1]
+
+		marker := data[match[2]:match[3]]
+		finished := marker == "D"
+		exitCode := 0
+		if finished && match[4] != -1 {
+			var err error
+			exitCode, err = strconv.Atoi(data[match[4]:match[5]])
+			if err != nil {
+				util.DefaultLogger().Warnf("Unable to parse exit status in shell integration marker: %s", err)
+			}
+		}
+
+		if text != "" || (finished && this.region == RegionOutput) {
+			segments = append(segments, ShellSegment{
+				Region:   this.region,
+				Text:     text,
+				Finished: finished && this.region == RegionOutput,
+				ExitCode: exitCode,
+			})
+		}
+
+		switch marker {
+		case "A":
+			this.region = RegionPrompt
+		case "B":
+			this.region = RegionCommand
+		case "C":
+			this.region = RegionOutput
+		case "D":
+			this.region = RegionUnknown
+		}
+	}
+
+	if last < len(data) {
+		display.WriteString(data[last:])
+		segments = append(segments, ShellSegment{Region: this.region, Text: data[last:]})
+	}
+
+	return display.String(), segments
+}
+
+// Markers are short, so text that started like one but hasn't been
+// terminated after this many bytes isn't held back any longer
+const maxShellMarkerLength = 256
+
+// The index of a marker cut off at the end of data, or -1 if there isn't one
+func partialShellMarker(data string) int {
+	// a marker that has started but hasn't been terminated
+	if index := strings.LastIndex(data, shellMarkerPrefix); index != -1 {
+		rest := data[index+len(shellMarkerPrefix):]
+		if !strings.ContainsRune(rest, '\x07') && !strings.Contains(rest, "\x1b\\") &&
+			len(data)-index < maxShellMarkerLength {
+			return index
+		}
+	}
+
+	// the start of the prefix itself
+	index := strings.LastIndexByte(data, '\x1b')
+	if index != -1 && len(data)-index < len(shellMarkerPrefix) &&
+		strings.HasPrefix(shellMarkerPrefix, data[index:]) {
+		return index
+	}
+	return -1
+}
+
+// Join the text of the output segments, i.e. what commands printed
+func shellOutputText(segments []ShellSegment) string {
+	output := strings.Builder{}
+	for _, segment := range segments {
+		if segment.Region == RegionOutput {
+			output.WriteString(segment.Text)
+		}
+	}
+	return output.String()
+}
+
+// Shell snippets that emit the markers, they wrap the PS1 set by SetPS1 so
+// they're sent after it
+var shellIntegrationScripts = map[string]string{
+	"bash": `__butterfish_status() { __butterfish_last=$?; }
+__butterfish_preexec() { [ -n "$__butterfish_at_prompt" ] || return; __butterfish_at_prompt=; printf '\033]133;C\007'; }
+__butterfish_precmd() { printf '\033]133;D;%s\007' "$__butterfish_last"; __butterfish_at_prompt=1; return $__butterfish_last; }
+PROMPT_COMMAND="__butterfish_status;${PROMPT_COMMAND:+$PROMPT_COMMAND;}__butterfish_precmd"
+__butterfish_at_prompt=1; trap '__butterfish_preexec' DEBUG
+PS1=$'\\[\033]133;A\007\\]'$PS1$'\\[\033]133;B\007\\]'
+`,
+	"zsh": `__butterfish_precmd() { print -n "\e]133;D;$?\a"; }
+__butterfish_preexec() { print -n "\e]133;C\a"; }
+precmd_functions=(__butterfish_precmd $precmd_functions); preexec_functions+=(__butterfish_preexec)
+PS1=$'%{\e]133;A\a%}'$PS1$'%{\e]133;B\a%}'
+`,
+}
+
+// Send the shell integration snippet for the configured shell to the
+// child, returning false if the shell isn't supported
+func (this *ButterfishCtx) SetShellIntegration(childIn io.Writer) bool {
+	shell := this.Config.ParseShell()
+	if shell == "sh" {
+		shell = "bash"
+	}
+
+	script, ok := shellIntegrationScripts[shell]
+	if !ok {
+		this.Log.Infof("Shell integration isn't supported for %s, command boundaries will be guessed from the output", shell)
+		return false
+	}
+
+	io.WriteString(childIn, script)
+	return true
+}
@@ -0,0 +1,245 @@
+package butterfish
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+
+	"github.com/bakks/butterfish/embedding"
+	"github.com/bakks/butterfish/prompt"
+	"github.com/bakks/butterfish/util"
+)
+
+// A file or directory in a directory summary. File summaries come from the
+// file's content, directory summaries are reduced from their children's.
+type summaryNode struct {
+	Path     string
+	IsDir    bool
+	Summary  string
+	Children []*summaryNode
+}
+
+// SummarizeDirectory summarizes every file under path that indexing would
+// embed, i.e. respecting the max file size and .gitignore files, running up
+// to workers file summaries at once. Each directory is then summarized from
+// the summaries of its files and subdirectories, and the whole tree is
+// printed.
+func (this *ButterfishCtx) SummarizeDirectory(path string, chunkSize, maxChunks, workers int, maxFileSize int64, useGitignore bool) error {
+	// reuse the index's file filters so we summarize what we'd embed
+	filter := embedding.NewDiskCachedEmbeddingIndex(nil, io.Discard)
+	filter.MaxFileSize = maxFileSize
+	filter.UseGitignore = useGitignore
+	filter.IgnoreDirs = append(filter.IgnoreDirs, this.Config.IndexIgnoreDirs...)
+
+	files, err := filter.ListIndexableFiles(this.Ctx, path)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("No files to summarize in %s", path)
+	}
+
+	root, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	tree := buildSummaryTree(root, files)
+	err = this.summarizeLeaves(afero.NewOsFs(), tree, chunkSize, maxChunks, workers)
+	if err != nil {
+		return err
+	}
+
+	err = this.summarizeDirectories(tree)
+	if err != nil {
+		return err
+	}
+
+	this.printSummaryTree(tree, root, 0)
+	return nil
+}
+
+// Arrange a sorted list of files under root into a tree of directories
+func buildSummaryTree(root string, files []string) *summaryNode {
+	tree := &summaryNode{Path: root, IsDir: true}
+	dirs := map[string]*summaryNode{root: tree}
+
+	// find or create the node for a directory, creating its parents as needed
+	var dirNode func(path string) *summaryNode
+	dirNode = func(path string) *summaryNode {
+		if node, ok := dirs[path]; ok {
+			return node
+		}
+		node := &summaryNode{Path: path, IsDir: true}
+		dirs[path] = node
+		parent := dirNode(filepath.Dir(path))
+		parent.Children = append(parent.Children, node)
+		return node
+	}
+
+	for _, file := range files {
+		if file == root {
+			// summarizing a single file
+			return &summaryNode{Path: file}
+		}
+		parent := dirNode(filepath.Dir(file))
+		parent.Children = append(parent.Children, &summaryNode{Path: file})
+	}
+
+	return tree
+}
+
+// Return the file nodes in the tree, depth first
+func summaryLeaves(node *summaryNode) []*summaryNode {
+	if !node.IsDir {
+		return []*summaryNode{node}
+	}
+
+	leaves := []*summaryNode{}
+	for _, child := range node.Children {
+		leaves = append(leaves, summaryLeaves(child)...)
+	}
+	return leaves
+}
+
+// Summarize each file in the tree using a pool of workers, the first error
+// stops the remaining files from being summarized
+func (this *ButterfishCtx) summarizeLeaves(fs afero.Fs, tree *summaryNode, chunkSize, maxChunks, workers int) error {
+	leaves := summaryLeaves(tree)
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan *summaryNode)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for leaf := range queue {
+				err := this.summarizeFile(fs, leaf, chunkSize, maxChunks)
+				if err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("Unable to summarize %s: %w", leaf.Path, err)
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, leaf := range leaves {
+		mutex.Lock()
+		failed := firstErr != nil
+		mutex.Unlock()
+		if failed || this.Ctx.Err() != nil {
+			break
+		}
+		queue <- leaf
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = this.Ctx.Err()
+	}
+	return firstErr
+}
+
+func (this *ButterfishCtx) summarizeFile(fs afero.Fs, node *summaryNode, chunkSize, maxChunks int) error {
+	chunks, err := util.GetFileChunks(this.Ctx, fs, node.Path, chunkSize, maxChunks)
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	// files are summarized concurrently so their summaries aren't streamed
+	node.Summary, err = this.summarize(chunks, nil)
+	return err
+}
+
+// Summarize each directory from its children's summaries, working up from
+// the deepest directories
+func (this *ButterfishCtx) summarizeDirectories(node *summaryNode) error {
+	if !node.IsDir {
+		return nil
+	}
+
+	sort.Slice(node.Children, func(i, j int) bool {
+		return node.Children[i].Path < node.Children[j].Path
+	})
+
+	facts := strings.Builder{}
+	for _, child := range node.Children {
+		err := this.summarizeDirectories(child)
+		if err != nil {
+			return err
+		}
+
+		if child.Summary == "" {
+			continue
+		}
+		name := filepath.Base(child.Path)
+		if child.IsDir {
+			name += "/"
+		}
+		fmt.Fprintf(&facts, "%s:\n%s\n\n", name, child.Summary)
+	}
+
+	if facts.Len() == 0 {
+		return nil
+	}
+
+	req, err := this.summarizeRequest()
+	if err != nil {
+		return err
+	}
+	req.Prompt, err = this.PromptLibrary.GetPrompt(prompt.PromptSummarizeListOfFacts,
+		"content", facts.String())
+	if err != nil {
+		return err
+	}
+
+	resp, err := this.LLMClient.Completion(req)
+	if err != nil {
+		return err
+	}
+
+	node.Summary = strings.TrimSpace(resp.Completion)
+	return nil
+}
+
+// Print each node's path relative to root followed by its summary, indented
+// by depth
+func (this *ButterfishCtx) printSummaryTree(node *summaryNode, root string, depth int) {
+	indent := strings.Repeat("  ", depth)
+
+	name, err := filepath.Rel(root, node.Path)
+	if err != nil || name == "." {
+		name = node.Path
+	}
+	if node.IsDir {
+		name += "/"
+	}
+
+	this.StylePrintf(StyleQuestion, "%s%s\n", indent, name)
+	if node.Summary != "" {
+		summary := indent + "  " + strings.ReplaceAll(node.Summary, "\n", "\n"+indent+"  ")
+		this.StylePrintf(StyleSummarize, "%s\n\n", summary)
+	}
+
+	for _, child := range node.Children {
+		this.printSummaryTree(child, root, depth+1)
+	}
+}
@@ -0,0 +1,73 @@
+package butterfish
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+
+	"github.com/bakks/butterfish/util"
+)
+
+// Restores the terminal put in raw mode for the wrapped shell and closes
+// its pty, exactly once, whether the shell exits normally or a goroutine
+// panics. A panic in a goroutine ends the process without running the
+// deferred calls of other goroutines, so without this a crash in e.g. the
+// resize handler leaves the user's terminal in raw mode.
+type terminalGuard struct {
+	cleanup func() error
+	once    sync.Once
+	err     error
+
+	// called with the panic value once the terminal is restored, re-raises
+	// the panic by default, replaced by tests
+	onPanic func(value interface{})
+}
+
+func newTerminalGuard(cleanup func() error) *terminalGuard {
+	return &terminalGuard{
+		cleanup: cleanup,
+		onPanic: func(value interface{}) { panic(value) },
+	}
+}
+
+// Restore the terminal and close the pty, later calls return the result of
+// the first
+func (this *terminalGuard) Restore() error {
+	this.once.Do(func() {
+		this.err = this.cleanup()
+	})
+	return this.err
+}
+
+// Deferred at the start of goroutines that run while the terminal is raw.
+// If the goroutine panics then the terminal is restored before the panic
+// continues, so the stack trace is readable and the shell usable. A nil
+// guard leaves the panic alone.
+func (this *terminalGuard) RecoverPanic() {
+	if this == nil {
+		return
+	}
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	err := this.Restore()
+	if err != nil {
+		util.DefaultLogger().Errorf("Unable to restore terminal: %s", err)
+	}
+	util.DefaultLogger().Errorf("Panic: %v\n%s", value, debug.Stack())
+	fmt.Fprintf(os.Stderr, "\nButterfish crashed, the terminal has been restored\n")
+	this.onPanic(value)
+}
+
+// Run f in a goroutine that restores the terminal if it panics, see
+// terminalGuard
+func (this *ButterfishCtx) goGuarded(f func()) {
+	guard := this.terminal
+	go func() {
+		defer guard.RecoverPanic()
+		f()
+	}()
+}
@@ -0,0 +1,151 @@
+package butterfish
+
+import (
+	"github.com/bakks/tiktoken-go"
+)
+
+// Tokenizer converts text to and from the tokens a model sees, this is used
+// to fit history and snippets into a model's context window. Token counts
+// vary by model so backends other than OpenAI can supply their own, see
+// ButterfishConfig.TokenizerForModel.
+type Tokenizer interface {
+	Encode(text string) []int
+	Decode(tokens []int) string
+}
+
+// Wraps a tiktoken encoding, used for OpenAI models
+type tiktokenTokenizer struct {
+	encoder *tiktoken.Tiktoken
+}
+
+func (this *tiktokenTokenizer) Encode(text string) []int {
+	return this.encoder.Encode(text, nil, nil)
+}
+
+func (this *tiktokenTokenizer) Decode(tokens []int) string {
+	return this.encoder.Decode(tokens)
+}
+
+// Return the tiktoken encoding for an OpenAI model
+func NewTiktokenTokenizer(model string) (Tokenizer, error) {
+	encoder, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		return nil, err
+	}
+	return &tiktokenTokenizer{encoder: encoder}, nil
+}
+
+// Keep the first maxTokens tokens of data. Returns the number of tokens, the
+// truncated string, and a bool indicating whether the string was truncated.
+func truncateToTokens(tokenizer Tokenizer, data string, maxTokens int) (int, string, bool) {
+	tokens := tokenizer.Encode(data)
+	if len(tokens) <= maxTokens {
+		return len(tokens), data, false
+	}
+	if maxTokens <= 0 {
+		return 0, "", true
+	}
+
+	tokens = tokens[:maxTokens]
+	return len(tokens), tokenizer.Decode(tokens), true
+}
+
+// Keep the last maxTokens tokens of data, dropping the oldest content first.
+// Decoding a slice of tokens and encoding it again doesn't always give the
+// same tokens back, so we re-check and drop further tokens from the front
+// until the result fits. Returns the number of tokens and the trimmed string.
+func trimToLastTokens(tokenizer Tokenizer, data string, maxTokens int) (int, string) {
+	tokens := tokenizer.Encode(data)
+	if len(tokens) <= maxTokens {
+		return len(tokens), data
+	}
+
+	for start := len(tokens) - maxTokens; start < len(tokens); start++ {
+		trimmed := tokenizer.Decode(tokens[start:])
+		numTokens := len(tokenizer.Encode(trimmed))
+		if numTokens <= maxTokens {
+			return numTokens, trimmed
+		}
+	}
+
+	return 0, ""
+}
+
+// Join parts with sep, in order, keeping the result within maxTokens. Parts
+// are added whole while they fit, the first part that doesn't fit is
+// truncated to the remaining budget and the rest are dropped. This is used
+// for search snippets, which are ordered best match first. Returns the
+// joined string and the number of parts at least partly included.
+func joinWithinTokens(tokenizer Tokenizer, parts []string, sep string, maxTokens int) (string, int) {
+	joined := ""
+	numParts := 0
+	for i, part := range parts {
+		prefix := joined
+		if i > 0 {
+			prefix += sep
+		}
+		candidate := prefix + part
+
+		_, truncated, wasTruncated := truncateToTokens(tokenizer, candidate, maxTokens)
+		if !wasTruncated {
+			joined = candidate
+			numParts++
+			continue
+		}
+
+		// only use the truncated string if some of the part made it in, and
+		// check it fits since it may re-encode differently
+		if len(truncated) > len(prefix) && len(tokenizer.Encode(truncated)) <= maxTokens {
+			joined = truncated
+			numParts++
+		}
+		break
+	}
+
+	return joined, numParts
+}
+
+// Split data into pieces of at most maxTokens tokens each, in order, so that
+// joining the pieces gives back data
+func splitToTokens(tokenizer Tokenizer, data string, maxTokens int) []string {
+	tokens := tokenizer.Encode(data)
+	pieces := []string{}
+	if maxTokens <= 0 {
+		return pieces
+	}
+
+	for start := 0; start < len(tokens); start += maxTokens {
+		end := start + maxTokens
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		pieces = append(pieces, tokenizer.Decode(tokens[start:end]))
+	}
+
+	return pieces
+}
+
+// Pack parts, in order, into groups joined with sep that each fit within
+// maxTokens. Parts are kept whole unless a part doesn't fit on its own, in
+// which case it's truncated to maxTokens and becomes its own group.
+func groupWithinTokens(tokenizer Tokenizer, parts []string, sep string, maxTokens int) []string {
+	groups := []string{}
+	group := ""
+
+	for _, part := range parts {
+		if group != "" {
+			candidate := group + sep + part
+			if len(tokenizer.Encode(candidate)) <= maxTokens {
+				group = candidate
+				continue
+			}
+			groups = append(groups, group)
+		}
+		_, group, _ = truncateToTokens(tokenizer, part, maxTokens)
+	}
+
+	if group != "" {
+		groups = append(groups, group)
+	}
+	return groups
+}
@@ -0,0 +1,66 @@
+package butterfish
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How long answers to questions and command fixes should be. The default
+// prompts ask for succinct answers, terse asks for even shorter ones and
+// detailed for thorough explanations, by adding an instruction to the
+// system message and scaling the answer's max tokens.
+type Verbosity int
+
+const (
+	// Use the prompts and max tokens as configured
+	VerbosityNormal Verbosity = iota
+	VerbosityTerse
+	VerbosityDetailed
+)
+
+var verbosityNames = []string{"normal", "terse", "detailed"}
+
+func (this Verbosity) String() string {
+	if int(this) < len(verbosityNames) {
+		return verbosityNames[this]
+	}
+	return fmt.Sprintf("Verbosity(%d)", int(this))
+}
+
+func ParseVerbosity(name string) (Verbosity, error) {
+	for i, verbosityName := range verbosityNames {
+		if strings.EqualFold(name, verbosityName) {
+			return Verbosity(i), nil
+		}
+	}
+	return VerbosityNormal, fmt.Errorf("Unknown verbosity %q, expected terse, normal, or detailed", name)
+}
+
+const (
+	terseInstruction    = "Keep your answer as short as possible, a sentence or two, without explanation unless it's essential."
+	detailedInstruction = "Give a thorough, detailed answer, explaining your reasoning and any caveats or alternatives."
+)
+
+// Adjust a request's system message and max tokens for this verbosity.
+// Terse halves max tokens and detailed doubles them, 0 means the model's
+// default and is left alone.
+func (this Verbosity) Apply(sysMsg string, maxTokens int) (string, int) {
+	var instruction string
+	switch this {
+	case VerbosityTerse:
+		instruction = terseInstruction
+		if maxTokens > 1 {
+			maxTokens /= 2
+		}
+	case VerbosityDetailed:
+		instruction = detailedInstruction
+		maxTokens *= 2
+	default:
+		return sysMsg, maxTokens
+	}
+
+	if sysMsg == "" {
+		return instruction, maxTokens
+	}
+	return strings.TrimRight(sysMsg, "\n") + "\n\n" + instruction, maxTokens
+}
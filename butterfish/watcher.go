@@ -0,0 +1,152 @@
+package butterfish
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Actions a watcher can take when its pattern matches the wrapped shell's
+// output
+const (
+	// Print a note that the output matched
+	WatchActionNotify = "notify"
+	// Offer to explain and fix the command that printed the output, even if
+	// it exits successfully
+	WatchActionFix = "fix"
+)
+
+// By default a watcher fires at most once in this long, so e.g. a stack
+// trace of many matching lines is only reported once
+const DefaultWatcherDebounce = 10 * time.Second
+
+// Lines longer than this are matched in pieces, so output without newlines
+// isn't buffered forever
+const watcherMaxLineBytes = 4096
+
+// Watches the wrapped shell's output for a regex, e.g. "command not found"
+// or the start of a stack trace, and takes Action when a line matches
+type Watcher struct {
+	Pattern string
+	Action  string
+}
+
+// Parse a watcher given as action:pattern, e.g. "fix:command not found",
+// the pattern is everything after the first colon
+func ParseWatcher(spec string) (Watcher, error) {
+	action, pattern, ok := strings.Cut(spec, ":")
+	if !ok || pattern == "" {
+		return Watcher{}, fmt.Errorf("Invalid watcher %q, expected action:pattern, e.g. fix:command not found", spec)
+	}
+
+	watcher := Watcher{Pattern: pattern, Action: action}
+	_, err := compileWatcher(watcher)
+	if err != nil {
+		return Watcher{}, err
+	}
+	return watcher, nil
+}
+
+func compileWatcher(watcher Watcher) (*regexp.Regexp, error) {
+	if watcher.Action != WatchActionNotify && watcher.Action != WatchActionFix {
+		return nil, fmt.Errorf("Unknown watcher action %q, expected %s or %s",
+			watcher.Action, WatchActionNotify, WatchActionFix)
+	}
+
+	re, err := regexp.Compile(watcher.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid watcher pattern %q: %s", watcher.Pattern, err)
+	}
+	return re, nil
+}
+
+type compiledWatcher struct {
+	Watcher
+	regex     *regexp.Regexp
+	lastFired time.Time
+}
+
+// Matches sanitized child output against the configured watchers a line at
+// a time. Output arrives in arbitrary chunks so an unfinished line is kept
+// until the rest of it arrives.
+type OutputWatcher struct {
+	// A watcher that has fired won't fire again until this long has passed
+	Debounce time.Duration
+
+	watchers []*compiledWatcher
+	partial  string
+	// replaced by tests
+	now func() time.Time
+}
+
+func NewOutputWatcher(watchers []Watcher, debounce time.Duration) (*OutputWatcher, error) {
+	compiled := make([]*compiledWatcher, 0, len(watchers))
+	for _, watcher := range watchers {
+		re, err := compileWatcher(watcher)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, &compiledWatcher{Watcher: watcher, regex: re})
+	}
+
+	return &OutputWatcher{
+		Debounce: debounce,
+		watchers: compiled,
+		now:      time.Now,
+	}, nil
+}
+
+// Add child output, which should already be sanitized, and return the
+// watchers that matched a finished line and aren't debounced, in the order
+// they were configured. A nil watcher matches nothing.
+func (this *OutputWatcher) Write(data string) []Watcher {
+	if this == nil || len(this.watchers) == 0 {
+		return nil
+	}
+
+	data = this.partial + strings.ReplaceAll(data, "\r", "")
+	lines := strings.Split(data, "\n")
+	this.partial = lines[len(lines)-1]
+	lines = lines[:len(lines)-1]
+	if len(this.partial) > watcherMaxLineBytes {
+		lines = append(lines, this.partial)
+		this.partial = ""
+	}
+
+	matched := []Watcher{}
+	now := this.now()
+	for _, watcher := range this.watchers {
+		if !watcher.lastFired.IsZero() && now.Sub(watcher.lastFired) < this.Debounce {
+			continue
+		}
+
+		for _, line := range lines {
+			if watcher.regex.MatchString(line) {
+				watcher.lastFired = now
+				matched = append(matched, watcher.Watcher)
+				break
+			}
+		}
+	}
+
+	return matched
+}
+
+// Check child output against the watchers and act on any that match. The
+// output is sanitized here since watchers match what the user sees.
+func (this *ShellState) watchChildOutput(data string) {
+	for _, watcher := range this.Watchers.Write(sanitizeTTYString(data)) {
+		var note string
+		switch watcher.Action {
+		case WatchActionNotify:
+			note = fmt.Sprintf("Output matched %q", watcher.Pattern)
+		case WatchActionFix:
+			this.LastCommand.Flag(watcher.Pattern)
+			note = fmt.Sprintf("Output matched %q, type Fix or press Ctrl-G once the command finishes to explain and fix it",
+				watcher.Pattern)
+		}
+
+		fmt.Fprintf(this.ParentOut, "\r\n%s%s%s\r\n", this.Color.Answer, note, this.Color.Command)
+	}
+}
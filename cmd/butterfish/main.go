@@ -5,9 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 	"runtime"
-	"strings"
 	"time"
 
 	"github.com/alecthomas/kong"
@@ -16,7 +14,9 @@ import (
 
 	//_ "net/http/pprof"
 
+	"github.com/bakks/butterfish/bubbles/console"
 	bf "github.com/bakks/butterfish/butterfish"
+	"github.com/bakks/butterfish/embedding"
 	"github.com/bakks/butterfish/util"
 )
 
@@ -54,6 +54,7 @@ Here are special Butterfish commands:
   - Help : Give hints about usage.
   - Status : Show the current Butterfish configuration.
   - History : Print out the history that would be sent in a GPT prompt.
+  - Fix : Explain why the last command failed and suggest a fixed command, also available by pressing Ctrl-G at an empty command line.
 
 If you do not have OpenAI free credits then you will need a subscription and you will need to pay for OpenAI API use. Autosuggest will probably be the most expensive feature. You can reduce spend by disabling shell autosuggest (-A) or increasing the autosuggest timeout (e.g. -t 2000).`
 
@@ -72,23 +73,91 @@ func (v *VerboseFlag) BeforeResolve() error {
 // invoked, rather than when we're inside a butterfish console).
 // Kong will parse os.Args based on this struct.
 type CliConfig struct {
-	Verbose      VerboseFlag      `short:"v" default:"false" help:"Verbose mode, prints full LLM prompts (sometimes to log file). Use multiple times for more verbosity, e.g. -vv."`
-	Log          bool             `short:"L" default:"false" help:"Write verbose content to a log file rather than stdout, usually /var/tmp/butterfish.log"`
-	Version      kong.VersionFlag `short:"V" help:"Print version information and exit."`
-	BaseURL      string           `short:"u" default:"https://api.openai.com/v1" help:"Base URL for OpenAI-compatible API. Enables local models with a compatible interface."`
-	TokenTimeout int              `short:"z" default:"10000" help:"Timeout before first prompt token is received and between individual tokens. In milliseconds."`
+	Verbose           VerboseFlag      `short:"v" default:"false" help:"Verbose mode, prints full LLM prompts (sometimes to log file). Use multiple times for more verbosity, e.g. -vv."`
+	Log               bool             `short:"L" default:"false" help:"Write verbose content to a log file rather than stdout, usually /var/tmp/butterfish.log"`
+	LogLevel          string           `default:"" help:"Minimum level of messages to log: debug, info, warn, or error. Defaults to debug in verbose mode and info otherwise."`
+	Version           kong.VersionFlag `short:"V" help:"Print version information and exit."`
+	BaseURL           string           `short:"u" default:"https://api.openai.com/v1" help:"Base URL for OpenAI-compatible API. Enables local models with a compatible interface."`
+	FallbackBaseURL   string           `help:"Base URL of an OpenAI-compatible API to use when the primary API is unavailable, e.g. down or rate limiting, such as a local model."`
+	AzureEndpoint     string           `help:"Azure OpenAI resource endpoint, e.g. https://my-resource.openai.azure.com. If set then requests go to Azure rather than --base-url."`
+	AzureDeployment   string           `help:"Azure OpenAI deployment to send every request to, or comma-separated model=deployment pairs. Defaults to a deployment named after the model."`
+	AzureAPIVersion   string           `help:"Azure OpenAI API version, defaults to 2024-02-01."`
+	TokenTimeout      int              `short:"z" default:"10000" help:"Timeout before first prompt token is received and between individual tokens. In milliseconds."`
+	RequestTimeout    int              `default:"120000" help:"Deadline for an entire LLM request, including streaming the response. 0 disables. In milliseconds."`
+	RequestsPerMinute int              `default:"0" help:"Maximum LLM requests per minute, requests wait for capacity rather than failing. 0 means no limit."`
+	TokensPerMinute   int              `default:"0" help:"Maximum LLM tokens per minute (estimated from the prompt and maximum response), requests wait for capacity rather than failing. 0 means no limit."`
+	EmbeddingBatch    int              `default:"0" help:"Maximum number of strings sent in each embeddings request, larger inputs are split into several requests. 0 uses the API's limit of 2048."`
+	EmbeddingTokens   int              `default:"0" help:"Maximum estimated tokens sent in each embeddings request, larger inputs are split into several requests. 0 uses the API's limit of about 300000."`
+	EmbeddingWorkers  int              `default:"1" help:"Number of embeddings requests sent at once when an input is split."`
+	ColorScheme       string           `default:"auto" enum:"auto,dark,light" help:"Color scheme, auto detects the terminal background from $COLORFGBG or $BUTTERFISH_COLOR_SCHEME."`
+	NoColor           bool             `default:"false" help:"Print plain text without colors or other ANSI codes. This is the default when output isn't a terminal."`
+	OutputFormat      string           `default:"text" enum:"text,json" help:"Print indexquestion results as styled text, or as a single JSON object with the answer, sources, and model for scripts."`
+	ColorFile         string           `help:"Path to a YAML or JSON file defining a custom color scheme (Foreground, Background, Error, Color1-Color6, Grey as hex colors). Overrides --color-scheme."`
+	WatchPrompts      bool             `default:"false" help:"Reload the prompt library (~/.config/butterfish/prompts.yaml) when it changes, rather than only at startup."`
+	PromptURL         string           `help:"Fetch prompts from this URL, which serves a prompt library in the same yaml format as prompts.yaml, e.g. a team's central prompts. The local library is used for prompts it doesn't serve and when it can't be reached."`
+	PromptURLTTL      int              `name:"prompt-url-ttl" default:"300000" help:"How long prompts fetched from --prompt-url are used before checking for changes. In milliseconds."`
+	PromptPrefix      string           `help:"Text added before every user prompt sent to the LLM, after its fields are filled in. System messages are left as is."`
+	PromptSuffix      string           `help:"Text added after every user prompt sent to the LLM, after its fields are filled in. System messages are left as is."`
+	EmbeddingModel    string           `default:"text-embedding-ada-002" help:"Model used to embed files for the index. Cached embeddings from a different model are ignored and files are embedded again."`
+	IndexCache        string           `default:"readwrite" enum:"readwrite,readonly,off" help:"How the embedding index uses its .butterfish_index cache files: readwrite loads and saves them, readonly loads them but keeps new embeddings in memory, off ignores them."`
+	IndexShards       int              `default:"0" help:"Search the embedding index in shards of this many directories, merging the best results of each, so that a very large index isn't scored all at once. 0 searches it as one."`
+	IndexShardWorkers int              `default:"1" help:"Number of index shards searched at once."`
+	IndexLazyLoad     bool             `default:"false" help:"Only read each .butterfish_index cache file when a search reaches it, rather than holding the whole index in memory."`
+	IndexANN          int              `default:"0" help:"Search the embedding index approximately with an HNSW graph once it holds at least this many vectors, much faster for large indexes but may miss some of the best results. 0 always searches exactly."`
+	IndexANNEf        int              `default:"64" help:"Candidates examined by each approximate index search, higher finds the best results more often but is slower."`
+	IndexSharedCache  bool             `default:"false" help:"Keep embeddings in a cache shared by every project's index as well, keyed by a hash of the content, model, and vector size, so that identical files in different projects, e.g. dependencies, are only embedded once."`
+	IndexSharedDir    string           `default:"~/.cache/butterfish/embeddings" help:"Directory of the shared embedding cache."`
+	IndexSaveIdle     int              `default:"30000" help:"While indexing, save the files embedded so far after this long without another file finishing, so they aren't lost if butterfish is killed. In milliseconds, 0 disables."`
+	IndexSaveFiles    int              `default:"100" help:"While indexing, save the files embedded so far once this many are waiting to be saved. 0 disables."`
+	EnvFile           string           `help:"Load OPENAI_API_KEY, OPENAI_TOKEN, and BUTTERFISH_ variables from this dotenv file, e.g. .env for per-project credentials. They're exported to commands butterfish runs. Variables already in the environment take precedence. Other variables in the file are ignored."`
+	Disable           []string         `help:"Features to turn off, comma separated: autosuggest, goal_mode, fix_command, indexquestion. Disabled features do nothing rather than calling the LLM."`
+	ResponseCache     int              `default:"0" help:"Reuse responses to identical LLM requests (same model, prompt, system message, temperature, etc.) rather than paying for them again, keeping up to this many. 0 disables."`
+	ResponseCacheTTL  int              `name:"response-cache-ttl" default:"3600000" help:"How long cached responses are reused for, 0 means forever. In milliseconds."`
+	ResponseCacheFile string           `default:"~/.cache/butterfish/responses.json" help:"File the response cache is kept in between runs. Set to an empty string to only cache within a run."`
+	AnswerLog         string           `help:"Append the raw text of answers streamed by commands like prompt and question to this file, as they're displayed."`
+	StreamRate        int              `default:"0" help:"Display streamed answers at most this many characters per second, smoothing output that arrives faster than the terminal draws it. 0 means no limit."`
+	IndexExtensions   []string         `help:"Only index files with these extensions, comma separated, e.g. .go,.md, the leading dot is optional. Defaults to every text file."`
+	IndexLanguages    []string         `help:"Only answer questions from indexed files in these languages, comma separated, e.g. go,markdown. Languages are detected from file extensions or shebang lines."`
+	FixMaxOutput      int              `default:"4096" help:"When asking for a fix to a failed command, its output is truncated to this many bytes, keeping the start and end. 0 means no limit."`
+	Redact            []string         `sep:"none" help:"Regex for secrets to replace with [REDACTED] in terminal history and command output before they're sent to the LLM, added to the defaults (AWS keys, bearer tokens, private keys, and the like). If the regex has capture groups only they are replaced. Can be repeated."`
+	NoRedact          bool             `default:"false" help:"Send terminal history and command output to the LLM without redacting secrets."`
+	AnswerVerbosity   string           `default:"normal" enum:"terse,normal,detailed" help:"Length of answers from indexquestion and shell mode prompts, and of explanations when fixing a failed command in exec or shell mode. Terse halves their max tokens and detailed doubles them."`
+	IndexNamespace    string           `help:"Keep the embedding index in a separate namespace, with its own cache files, so that projects don't mix. Use 'auto' to name it after the current directory."`
 
 	Shell struct {
-		Bin                       string `short:"b" help:"Shell to use (e.g. /bin/zsh), defaults to $SHELL."`
-		Model                     string `short:"m" default:"gpt-4-turbo" help:"Model for when the user manually enters a prompt."`
-		AutosuggestDisabled       bool   `short:"A" default:"false" help:"Disable autosuggest."`
-		AutosuggestModel          string `short:"a" default:"gpt-3.5-turbo-instruct" help:"Model for autosuggest"`
-		AutosuggestTimeout        int    `short:"t" default:"500" help:"Delay after typing before autosuggest (lower values trigger more calls and are more expensive). In milliseconds."`
-		NewlineAutosuggestTimeout int    `short:"T" default:"3500" help:"Timeout for autosuggest on a fresh line, i.e. before a command has started. Negative values disable. In milliseconds."`
-		NoCommandPrompt           bool   `short:"p" default:"false" help:"Don't change command prompt (shell PS1 variable). If not set, an emoji will be added to the prompt as a reminder you're in Shell Mode."`
-		LightColor                bool   `short:"l" default:"false" help:"Light color mode, appropriate for a terminal with a white(ish) background"`
-		MaxHistoryBlockTokens     int    `short:"H" default:"1024" help:"Maximum number of tokens of each block of history. For example, if a command has a very long output, it will be truncated to this length when sending the shell's history."`
-		MaxResponseTokens         int    `short:"R" default:"2048" help:"Maximum number of tokens in a response when prompting."`
+		Bin                       string   `short:"b" help:"Shell to use (e.g. /bin/zsh), defaults to $SHELL."`
+		Model                     string   `short:"m" default:"gpt-4-turbo" help:"Model for when the user manually enters a prompt."`
+		AutosuggestDisabled       bool     `short:"A" default:"false" help:"Disable autosuggest."`
+		AutosuggestModel          string   `short:"a" default:"gpt-3.5-turbo-instruct" help:"Model for autosuggest"`
+		AutosuggestTimeout        int      `short:"t" default:"500" help:"Delay after typing before autosuggest (lower values trigger more calls and are more expensive). In milliseconds."`
+		NewlineAutosuggestTimeout int      `short:"T" default:"3500" help:"Timeout for autosuggest on a fresh line, i.e. before a command has started. Negative values disable. In milliseconds."`
+		NoCommandPrompt           bool     `short:"p" default:"false" help:"Don't change command prompt (shell PS1 variable). If not set, an emoji will be added to the prompt as a reminder you're in Shell Mode."`
+		LightColor                bool     `short:"l" default:"false" help:"Light color mode, appropriate for a terminal with a white(ish) background"`
+		MaxHistoryBlockTokens     int      `short:"H" default:"1024" help:"Maximum number of tokens of each block of history. For example, if a command has a very long output, it will be truncated to this length when sending the shell's history."`
+		MaxResponseTokens         int      `short:"R" default:"2048" help:"Maximum number of tokens in a response when prompting."`
+		AutosuggestRequestTimeout int      `default:"5000" help:"Deadline for each autosuggest request, shorter than --request-timeout since a late suggestion is useless. In milliseconds."`
+		AutosuggestHistoryEntries int      `default:"64" help:"Maximum number of history entries (commands, prompts, answers) sent with autosuggest requests. 0 means no limit."`
+		AutosuggestHistoryBytes   int      `default:"4096" help:"Maximum number of bytes of history sent with autosuggest requests. 0 means no limit."`
+		HistoryFile               string   `default:"~/.local/share/butterfish/history" help:"File that shell commands are saved to so autosuggest can use them in later sessions."`
+		HistoryFileMaxBytes       int64    `default:"1048576" help:"Rotate the history file once it reaches this many bytes."`
+		NoHistoryFile             bool     `default:"false" help:"Don't save shell commands to the history file or load them at startup."`
+		BinaryThreshold           float64  `default:"0.3" help:"Lines of output where more than this fraction of characters aren't printable are treated as binary, shown in the terminal but left out of the history sent to the LLM. 0 disables."`
+		ShellIntegration          bool     `default:"false" help:"Have the shell mark where prompts, commands, and output start and end (OSC 133 sequences) so that history sent to the LLM has exactly each command's output. bash and zsh only."`
+		RecordPath                string   `help:"Record a transcript of the session to timestamped files in this directory, one sanitized and one raw."`
+		RecordAnsi                string   `default:"preserve" enum:"strip,preserve,normalize" help:"How terminal control codes are handled in the sanitized transcript: strip them, preserve them, or normalize to only non-redundant colors."`
+		DryRun                    bool     `default:"false" help:"Goal mode dry run, commands the model proposes are printed but never executed."`
+		Confirm                   bool     `default:"false" help:"Goal mode asks before running each command the model proposes, answer y to run it, n to skip it, or e to edit it first."`
+		MaxSteps                  int      `default:"30" help:"Goal mode gives up after acting on this many model responses, 0 means no limit."`
+		MaxOutput                 int      `default:"4096" help:"Goal mode truncates the output of each command given back to the model to this many bytes, 0 means no limit."`
+		SessionDir                string   `default:"~/.local/share/butterfish/sessions" help:"Directory goal mode saves its progress to so that it can be resumed with --resume. Set to an empty string to disable."`
+		Resume                    string   `help:"Resume a goal mode session saved in --session-dir, e.g. one exited with Ctrl-C."`
+		ListSessions              bool     `default:"false" help:"List the goal mode sessions saved in --session-dir and exit."`
+		GoalAllow                 []string `sep:"none" help:"Regex patterns for commands goal mode may run, if set then every command must match one. Can be repeated."`
+		GoalDeny                  []string `sep:"none" help:"Regex patterns for commands goal mode must refuse, added to the default deny list (dd, mkfs). rm -rf is always refused. Can be repeated."`
+		Watch                     []string `sep:"none" help:"Watch command output for a regex and act when a line matches, given as action:pattern, e.g. fix:command not found. Actions are notify, which prints a note, and fix, which offers to explain and fix the command. Can be repeated."`
+		WatchDebounce             int      `default:"10000" help:"Each --watch pattern fires at most once in this long, so repeated matches aren't reported again. In milliseconds."`
+
+		Keybinding map[string]string `help:"Rebind a key action, e.g. --keybinding fix_command=ctrl+x. Actions are accept_suggestion (tab), reject_suggestion (unbound), and fix_command (ctrl+g). Use a comma-separated list for several keys, or none to unbind."`
 	} `cmd:"" help:"${shell_help}"`
 
 	// We include the cliConsole options here so that we can parse them and hand them
@@ -96,6 +165,9 @@ type CliConfig struct {
 	bf.CliCommandConfig
 }
 
+// Find a token in the environment or the credentials file. If there isn't
+// one then NewButterfish asks for a provider and token when stdin is a
+// terminal, see bf.PromptLLMSetup.
 func getOpenAIToken() string {
 	path, err := homedir.Expand(defaultEnvPath)
 	if err != nil {
@@ -104,63 +176,104 @@ func getOpenAIToken() string {
 
 	// We attempt to get a token from env vars plus an env file
 	godotenv.Load(path)
+	token, _, _ := bf.ResolveOpenAIToken("", os.Getenv, path)
+	return token
+}
 
-	token := os.Getenv("OPENAI_TOKEN")
-	if token != "" {
-		return token
+func makeButterfishConfig(options *CliConfig, samplingEnv *bf.SamplingEnv, projectConfig *bf.ProjectConfig) *bf.ButterfishConfig {
+	config := bf.MakeButterfishConfig()
+	config.PromptLibraryPath = defaultPromptPath
+	// the environment takes precedence over the project config
+	projectConfig.Apply(config)
+	samplingEnv.Apply(config)
+	config.EnvFile = options.EnvFile
+	config.OpenAIToken = getOpenAIToken()
+	config.BaseURL = options.BaseURL
+	config.FallbackBaseURL = options.FallbackBaseURL
+	config.AzureEndpoint = options.AzureEndpoint
+	config.AzureDeployment = options.AzureDeployment
+	config.AzureAPIVersion = options.AzureAPIVersion
+	config.PromptLibraryWatch = options.WatchPrompts
+	config.PromptLibraryURL = options.PromptURL
+	config.PromptLibraryTTL = time.Duration(options.PromptURLTTL) * time.Millisecond
+	config.GlobalPromptPrefix = options.PromptPrefix
+	config.GlobalPromptSuffix = options.PromptSuffix
+	config.TokenTimeout = time.Duration(options.TokenTimeout) * time.Millisecond
+	config.RequestTimeout = time.Duration(options.RequestTimeout) * time.Millisecond
+	config.RequestsPerMinute = options.RequestsPerMinute
+	config.TokensPerMinute = options.TokensPerMinute
+	config.EmbeddingBatchSize = options.EmbeddingBatch
+	config.EmbeddingBatchTokens = options.EmbeddingTokens
+	config.EmbeddingBatchWorkers = options.EmbeddingWorkers
+	config.LogLevel = options.LogLevel
+	config.ResponseCacheEntries = options.ResponseCache
+	config.ResponseCacheTTL = time.Duration(options.ResponseCacheTTL) * time.Millisecond
+	config.ResponseCachePath = options.ResponseCacheFile
+
+	colorScheme, err := bf.SelectColorScheme(options.ColorScheme)
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	token = os.Getenv("OPENAI_API_KEY")
-	if token != "" {
-		return token
+	if colorScheme == nil {
+		// auto detection reads the scheme from the environment
+		err = bf.CheckColorSchemeEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	// If we don't have a token, we'll prompt the user to create one
-	fmt.Printf("Butterfish requires an OpenAI API key, please visit https://beta.openai.com/account/api-keys to create one and paste it below (it should start with sk-):\n")
-
-	// read in the token and validate
-	fmt.Scanln(&token)
-	token = strings.TrimSpace(token)
-	if token == "" {
-		log.Fatal("No token provided, exiting")
+	config.OutputFormat = options.OutputFormat
+	if options.NoColor || options.OutputFormat == bf.OutputFormatJSON {
+		config.SetPlainOutput(true)
 	}
-	if !strings.HasPrefix(token, "sk-") {
-		log.Fatal("Invalid token provided, exiting")
+	if colorScheme != nil {
+		config.SetColorScheme(colorScheme)
 	}
+	config.ColorSchemePath = options.ColorFile
 
-	// attempt to write a .env file
-	fmt.Printf("\nSaving token to %s\n", path)
-	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if options.AnswerLog != "" {
+		path, err := homedir.Expand(options.AnswerLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.StreamTee, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	config.StreamCharsPerSecond = options.StreamRate
+
+	config.EmbeddingModel = options.EmbeddingModel
+	config.IndexNamespace = options.IndexNamespace
+	config.IndexExtensions = options.IndexExtensions
+	config.IndexLanguages = options.IndexLanguages
+	config.FixCommandMaxOutputBytes = options.FixMaxOutput
+	config.RedactPatterns = append(config.RedactPatterns, options.Redact...)
+	if options.NoRedact {
+		config.RedactPatterns = nil
+	}
+	config.AnswerVerbosity, err = bf.ParseVerbosity(options.AnswerVerbosity)
 	if err != nil {
-		fmt.Printf("Error creating directory: %s\n", err.Error())
-		return token
+		log.Fatal(err)
 	}
-
-	envFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	config.Features, err = bf.ParseDisabledFeatures(options.Disable)
 	if err != nil {
-		fmt.Printf("Error creating file: %s\n", err.Error())
-		return token
+		log.Fatal(err)
 	}
-	defer envFile.Close()
-
-	content := fmt.Sprintf("OPENAI_TOKEN=%s\n", token)
-	_, err = envFile.WriteString(content)
+	config.IndexAutoSaveInterval = time.Duration(options.IndexSaveIdle) * time.Millisecond
+	config.IndexAutoSaveThreshold = options.IndexSaveFiles
+	config.IndexShardSize = options.IndexShards
+	config.IndexShardWorkers = options.IndexShardWorkers
+	config.IndexLazyLoad = options.IndexLazyLoad
+	config.IndexANNThreshold = options.IndexANN
+	config.IndexANNEfSearch = options.IndexANNEf
+	if options.IndexSharedCache {
+		config.IndexSharedCachePath = options.IndexSharedDir
+	}
+	config.IndexCacheMode, err = embedding.ParseCacheMode(options.IndexCache)
 	if err != nil {
-		fmt.Printf("Error writing file: %s\n", err.Error())
+		log.Fatal(err)
 	}
 
-	fmt.Printf("Token saved, you can edit it at any time at %s\n\n", path)
-
-	return token
-}
-
-func makeButterfishConfig(options *CliConfig) *bf.ButterfishConfig {
-	config := bf.MakeButterfishConfig()
-	config.OpenAIToken = getOpenAIToken()
-	config.BaseURL = options.BaseURL
-	config.PromptLibraryPath = defaultPromptPath
-	config.TokenTimeout = time.Duration(options.TokenTimeout) * time.Millisecond
-
 	if options.Verbose {
 		config.Verbose = verboseCount
 	}
@@ -174,19 +287,51 @@ func getBuildInfo() string {
 	return fmt.Sprintf("%s %s %s\n(commit %s) (built %s)\n%s\n", BuildVersion, buildOs, buildArch, BuildCommit, BuildTimestamp, license)
 }
 
-func main() {
-	// start pprof server in goroutine
-	// go func() {
-	// 	log.Println(http.ListenAndServe("localhost:6060", nil))
-	// }()
+// Print the saved goal mode sessions, most recent first
+func printGoalModeSessions(dir string) error {
+	sessions, skipped, err := bf.ListGoalModeSessions(dir)
+	if err != nil {
+		return err
+	}
+	for _, err := range skipped {
+		fmt.Fprintf(os.Stderr, "Skipping unreadable session: %s\n", err)
+	}
+
+	if len(sessions) == 0 {
+		fmt.Printf("No goal mode sessions in %s\n", dir)
+		return nil
+	}
+
+	for _, session := range sessions {
+		fmt.Printf("%s  %-11s  %3d steps  %s\n", session.Name, session.Status,
+			session.Steps, session.Goal)
+	}
+	return nil
+}
 
+// Parse the command line, flags not given explicitly default to the
+// sampling env vars and then the project's .butterfish.yaml
+func parseCli() (*CliConfig, *kong.Context, *bf.SamplingEnv, *bf.ProjectConfig) {
 	desc := fmt.Sprintf("%s\n%s", description, getBuildInfo())
 	cli := &CliConfig{}
 
+	samplingEnv, err := bf.ReadSamplingEnv(os.Getenv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	projectConfig, err := bf.DiscoverProjectConfig(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
 	cliParser, err := kong.New(cli,
 		kong.Name("butterfish"),
 		kong.Description(desc),
 		kong.UsageOnError(),
+		kong.Resolvers(bf.ChainResolvers(samplingEnv.Resolver(), projectConfig.Resolver())),
 		kong.Vars{
 			"shell_help": shell_help,
 			"version":    getBuildInfo(),
@@ -199,7 +344,29 @@ func main() {
 	parsedCmd, err := cliParser.Parse(os.Args[1:])
 	cliParser.FatalIfErrorf(err)
 
-	config := makeButterfishConfig(cli)
+	return cli, parsedCmd, samplingEnv, projectConfig
+}
+
+func main() {
+	// start pprof server in goroutine
+	// go func() {
+	// 	log.Println(http.ListenAndServe("localhost:6060", nil))
+	// }()
+
+	cli, parsedCmd, samplingEnv, projectConfig := parseCli()
+
+	// variables in the .env file can set flag defaults, so if it set any
+	// then parse again with them
+	loaded, err := bf.LoadEnvFile(cli.EnvFile, os.LookupEnv, os.Setenv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if len(loaded) > 0 {
+		cli, parsedCmd, samplingEnv, projectConfig = parseCli()
+	}
+
+	config := makeButterfishConfig(cli, samplingEnv, projectConfig)
 	config.BuildInfo = getBuildInfo()
 	ctx := context.Background()
 
@@ -207,6 +374,19 @@ func main() {
 
 	switch parsedCmd.Command() {
 	case "shell":
+		sessionDir, err := homedir.Expand(cli.Shell.SessionDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if cli.Shell.ListSessions {
+			err = printGoalModeSessions(sessionDir)
+			if err != nil {
+				fmt.Fprintf(errorWriter, "%s\n", err)
+				os.Exit(4)
+			}
+			return
+		}
+
 		logfileName := util.InitLogging(ctx)
 		fmt.Printf("Logging to %s\n", logfileName)
 
@@ -236,6 +416,40 @@ func main() {
 		config.ShellLeavePromptAlone = cli.Shell.NoCommandPrompt
 		config.ShellMaxHistoryBlockTokens = cli.Shell.MaxHistoryBlockTokens
 		config.ShellMaxResponseTokens = cli.Shell.MaxResponseTokens
+		config.ShellAutosuggestRequestTimeout = time.Duration(cli.Shell.AutosuggestRequestTimeout) * time.Millisecond
+		config.ShellAutosuggestHistoryEntries = cli.Shell.AutosuggestHistoryEntries
+		config.ShellAutosuggestHistoryBytes = cli.Shell.AutosuggestHistoryBytes
+		if !cli.Shell.NoHistoryFile {
+			config.ShellHistoryPath = cli.Shell.HistoryFile
+		}
+		config.ShellHistoryMaxBytes = cli.Shell.HistoryFileMaxBytes
+		config.ShellBinaryThreshold = cli.Shell.BinaryThreshold
+		config.ShellIntegration = cli.Shell.ShellIntegration
+		config.GoalModeDryRun = cli.Shell.DryRun
+		config.GoalModeConfirm = cli.Shell.Confirm
+		config.GoalModeMaxSteps = cli.Shell.MaxSteps
+		config.GoalModeMaxOutputBytes = cli.Shell.MaxOutput
+		config.GoalModeSessionPath = sessionDir
+		config.GoalModeResume = cli.Shell.Resume
+		config.ShellRecordPath = cli.Shell.RecordPath
+		config.ShellRecordANSIMode, err = bf.ParseANSIMode(cli.Shell.RecordAnsi)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Keybindings, err = console.ParseKeybindings(cli.Shell.Keybinding)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.GoalModeAllowPatterns = cli.Shell.GoalAllow
+		config.GoalModeDenyPatterns = append(config.GoalModeDenyPatterns, cli.Shell.GoalDeny...)
+		for _, spec := range cli.Shell.Watch {
+			watcher, err := bf.ParseWatcher(spec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			config.Watchers = append(config.Watchers, watcher)
+		}
+		config.WatcherDebounce = time.Duration(cli.Shell.WatchDebounce) * time.Millisecond
 
 		bf.RunShell(ctx, config)
 
@@ -251,9 +465,16 @@ func main() {
 		//butterfishCtx.Config.Styles.PrintTestColors()
 
 		err = butterfishCtx.ExecCommand(parsedCmd, &cli.CliCommandConfig)
+		closeErr := butterfishCtx.Close()
+		if err == nil {
+			err = closeErr
+		}
 
 		if err != nil {
-			butterfishCtx.StylePrintf(config.Styles.Error, "Error: %s\n", err.Error())
+			butterfishCtx.StylePrintf(bf.StyleError, "Error: %s\n", err.Error())
+			if hint := bf.LLMErrorHint(err); hint != "" {
+				butterfishCtx.StylePrintf(bf.StyleError, "%s\n", hint)
+			}
 			os.Exit(4)
 		}
 	}
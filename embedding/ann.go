@@ -0,0 +1,113 @@
+package embedding
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Approximate search: with ANNThreshold set, an HNSW graph of every vector
+// in the index is built after LoadPaths, or by the first search after the
+// index changes, and searches walk the graph rather than scoring every
+// vector. The graph covers the vectors matching SearchLanguages when it was
+// built and is rebuilt if they change. Indexes with fewer vectors than the
+// threshold are searched exactly since scoring everything is already fast.
+
+// The HNSW graph over the index and what its nodes refer to
+type annIndex struct {
+	// nil if the index is smaller than ANNThreshold and is searched exactly
+	graph      *HNSW
+	candidates []*VectorSearchResult
+	aliases    map[chunkKey][]ChunkLocation
+	dimensions int
+	// the SearchLanguages the graph was built for
+	languages string
+}
+
+// Drop the graph after the index changes, it's rebuilt by the next search
+func (this *DiskCachedEmbeddingIndex) invalidateANN() {
+	this.ann = nil
+}
+
+// The current graph, building it if the index changed since the last one.
+// Returns nil if approximate search is off.
+func (this *DiskCachedEmbeddingIndex) annGraph(ctx context.Context) (*annIndex, error) {
+	if this.ANNThreshold <= 0 {
+		return nil, nil
+	}
+
+	languages := strings.Join(this.SearchLanguages, ",")
+	if this.ann != nil && this.ann.languages == languages {
+		return this.ann, nil
+	}
+
+	// the graph covers the whole index so lazily registered files are read
+	err := this.loadUnloaded()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, vectors, aliases, err := this.shardCandidates(ctx, this.searchDirectories())
+	if err != nil {
+		return nil, err
+	}
+
+	ann := &annIndex{languages: languages}
+	if len(vectors) >= this.ANNThreshold {
+		ann.dimensions = len(vectors[0])
+		for _, vector := range vectors {
+			if len(vector) != ann.dimensions {
+				// leave mixed dimensions to the exact search to report
+				ann.dimensions = -1
+				break
+			}
+		}
+	}
+
+	if ann.dimensions > 0 {
+		if this.Verbosity >= 1 {
+			fmt.Fprintf(this.Out, "Building approximate search index of %d vectors\n", len(vectors))
+		}
+
+		graph := NewHNSW(DefaultHNSWM, DefaultHNSWEfConstruction, 1)
+		for _, vector := range vectors {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			graph.Add(vector)
+		}
+
+		ann.graph = graph
+		ann.candidates = candidates
+		ann.aliases = aliases
+	}
+
+	this.ann = ann
+	return ann, nil
+}
+
+// Search the graph for about the best numResults. Returns nil if the query
+// can't be answered from the graph and the exact search should be used.
+func (this *DiskCachedEmbeddingIndex) searchANN(ctx context.Context,
+	queryVector []float32, numResults int) ([]*VectorSearchResult, error) {
+	ann, err := this.annGraph(ctx)
+	if err != nil || ann == nil || ann.graph == nil || ann.dimensions != len(queryVector) {
+		return nil, err
+	}
+
+	ef := this.ANNEfSearch
+	if ef <= 0 {
+		ef = DefaultHNSWEfSearch
+	}
+
+	ranked := ann.graph.Search(float32To64(queryVector), numResults, ef)
+	results := make([]*VectorSearchResult, len(ranked))
+	for i, scored := range ranked {
+		// copy since results are filled in by the caller
+		result := *ann.candidates[scored.Index]
+		result.Score = scored.Score
+		result.Aliases = ann.aliases[chunkKey{result.FilePath, result.Start}]
+		results[i] = &result
+	}
+	return results, nil
+}
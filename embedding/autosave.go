@@ -0,0 +1,109 @@
+package embedding
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock schedules auto-saves, tests replace it to fire them on demand
+type Clock interface {
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A scheduled call that can be canceled, like time.Timer
+type Timer interface {
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (this systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Saves files embedded so far while embedFiles is still running, once
+// threshold files are waiting or interval passes without another file
+// finishing. All methods other than idle are called with mutex held, which
+// is the lock embedFiles uses to guard its results.
+type autoSaver struct {
+	interval  time.Duration
+	threshold int
+	clock     Clock
+	mutex     *sync.Mutex
+	flush     func()
+
+	pending int
+	timer   Timer
+	// incremented whenever the timer is replaced, so that a timer which
+	// fired while waiting for the lock doesn't save early
+	generation int
+	stopped    bool
+}
+
+// Return an autoSaver calling flush, or nil if auto-saving is disabled
+func (this *DiskCachedEmbeddingIndex) newAutoSaver(mutex *sync.Mutex, flush func()) *autoSaver {
+	if this.CacheMode != CacheReadWrite ||
+		(this.AutoSaveInterval <= 0 && this.AutoSaveThreshold <= 0) {
+		return nil
+	}
+
+	clock := this.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	return &autoSaver{
+		interval:  this.AutoSaveInterval,
+		threshold: this.AutoSaveThreshold,
+		clock:     clock,
+		mutex:     mutex,
+		flush:     flush,
+	}
+}
+
+// Record that a file finished embedding
+func (this *autoSaver) finished() {
+	this.pending++
+	if this.threshold > 0 && this.pending >= this.threshold {
+		this.save()
+		return
+	}
+
+	if this.interval > 0 {
+		this.stopTimer()
+		generation := this.generation
+		this.timer = this.clock.AfterFunc(this.interval, func() {
+			this.idle(generation)
+		})
+	}
+}
+
+func (this *autoSaver) idle(generation int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.stopped || generation != this.generation || this.pending == 0 {
+		return
+	}
+	this.save()
+}
+
+func (this *autoSaver) save() {
+	this.stopTimer()
+	this.pending = 0
+	this.flush()
+}
+
+// Stop auto-saving, embedFiles saves whatever is left itself
+func (this *autoSaver) stop() {
+	this.stopTimer()
+	this.stopped = true
+}
+
+func (this *autoSaver) stopTimer() {
+	if this.timer != nil {
+		this.timer.Stop()
+		this.timer = nil
+	}
+	this.generation++
+}
@@ -0,0 +1,203 @@
+package embedding
+
+import (
+	"path/filepath"
+	"sort"
+
+	pb "github.com/bakks/butterfish/proto"
+)
+
+// A chunk of an indexed file that was collapsed into a near duplicate when
+// indexing, see DiskCachedEmbeddingIndex.DedupThreshold
+type ChunkLocation struct {
+	FilePath string
+	Start    uint64
+	End      uint64
+	Heading  string
+}
+
+// Identifies a chunk by the absolute path of its file and its start offset
+type chunkKey struct {
+	path  string
+	start uint64
+}
+
+// A chunk with its own vector that others may be collapsed into
+type representative struct {
+	key    chunkKey
+	vector []float64
+}
+
+// An embedded file with its absolute path
+type pathEmbeddings struct {
+	path  string
+	files *pb.FileEmbeddings
+}
+
+// True if the embedding was collapsed into another chunk and has no vector
+func isAlias(embedding *pb.AnnotatedEmbedding) bool {
+	return embedding.AliasPath != ""
+}
+
+// Collapse chunks of newly embedded files into earlier chunks, either in the
+// index or in files before them in newFiles, whose cosine similarity is at
+// least DedupThreshold. A collapsed chunk keeps its byte range but its
+// vector is replaced with the location of the chunk it duplicates. Returns
+// the number of chunks collapsed.
+func (this *DiskCachedEmbeddingIndex) dedupFiles(newFiles []pathEmbeddings) int {
+	if this.DedupThreshold <= 0 {
+		return 0
+	}
+
+	isNew := make(map[string]bool, len(newFiles))
+	for _, file := range newFiles {
+		isNew[file.path] = true
+	}
+
+	// walk the index in sorted order so that ties go to the same chunk
+	// every time
+	representatives := []representative{}
+	dirPaths := make([]string, 0, len(this.Index))
+	for dirPath := range this.Index {
+		dirPaths = append(dirPaths, dirPath)
+	}
+	sort.Strings(dirPaths)
+
+	for _, dirPath := range dirPaths {
+		dirIndex := this.Index[dirPath]
+		names := make([]string, 0, len(dirIndex.Files))
+		for name := range dirIndex.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fileIndex := dirIndex.Files[name]
+			path := filepath.Join(dirPath, name)
+			if isNew[path] {
+				continue
+			}
+			for _, embedding := range fileIndex.Embeddings {
+				if isAlias(embedding) {
+					continue
+				}
+				representatives = append(representatives, representative{
+					key:    chunkKey{path, embedding.Start},
+					vector: float32To64(embeddingVector(embedding)),
+				})
+			}
+		}
+	}
+
+	collapsed := 0
+	for _, file := range newFiles {
+		for _, embedding := range file.files.Embeddings {
+			vector := float32To64(embeddingVector(embedding))
+
+			best := -1
+			var bestScore float64
+			for i, rep := range representatives {
+				score, err := CosineSimilarity(vector, rep.vector)
+				if err == nil && score >= this.DedupThreshold && (best == -1 || score > bestScore) {
+					best = i
+					bestScore = score
+				}
+			}
+
+			if best == -1 {
+				representatives = append(representatives, representative{
+					key:    chunkKey{file.path, embedding.Start},
+					vector: vector,
+				})
+				continue
+			}
+
+			embedding.AliasPath = representatives[best].key.path
+			embedding.AliasStart = representatives[best].key.start
+			embedding.Vector = nil
+			embedding.Quantized = nil
+			embedding.Scale = 0
+			collapsed++
+		}
+	}
+
+	return collapsed
+}
+
+// True if one of the file's chunks was collapsed into a chunk that's no
+// longer in the index, e.g. because that file changed and was embedded
+// again. Such chunks can't be found by searching so the file needs to be
+// embedded again too.
+func (this *DiskCachedEmbeddingIndex) hasOrphanedAlias(fileIndex *pb.FileEmbeddings) bool {
+	for _, embedding := range fileIndex.Embeddings {
+		if isAlias(embedding) && !this.hasRepresentative(embedding.AliasPath, embedding.AliasStart) {
+			return true
+		}
+	}
+	return false
+}
+
+// Collect files with chunks collapsed into chunks that may have changed, as
+// work for embedFiles. That's files with aliases into files that were just
+// embedded again, other than the files in done which were collapsed against
+// their new chunks, and files with orphaned aliases, see hasOrphanedAlias.
+func (this *DiskCachedEmbeddingIndex) orphanedWork(done *indexWork, replaced map[string]bool) *indexWork {
+	embedded := map[string]bool{}
+	for _, job := range done.files {
+		embedded[filepath.Join(job.dirPath, job.name)] = true
+	}
+
+	work := &indexWork{}
+	for dirPath, dirIndex := range this.Index {
+		found := false
+		for name, fileIndex := range dirIndex.Files {
+			if embedded[filepath.Join(dirPath, name)] ||
+				!(this.hasOrphanedAlias(fileIndex) || hasAliasInto(fileIndex, replaced)) {
+				continue
+			}
+			found = true
+			work.files = append(work.files, &embedJob{
+				dirIndex: dirIndex,
+				dirPath:  dirPath,
+				name:     name,
+			})
+		}
+		if found {
+			work.dirs = append(work.dirs, dirPath)
+		}
+	}
+
+	// embed in a stable order so that dedup picks the same representatives
+	sort.Slice(work.files, func(i, j int) bool {
+		return filepath.Join(work.files[i].dirPath, work.files[i].name) <
+			filepath.Join(work.files[j].dirPath, work.files[j].name)
+	})
+	return work
+}
+
+func hasAliasInto(fileIndex *pb.FileEmbeddings, paths map[string]bool) bool {
+	for _, embedding := range fileIndex.Embeddings {
+		if isAlias(embedding) && paths[embedding.AliasPath] {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *DiskCachedEmbeddingIndex) hasRepresentative(path string, start uint64) bool {
+	dirIndex, ok := this.Index[filepath.Dir(path)]
+	if !ok {
+		return false
+	}
+	fileIndex, ok := dirIndex.Files[filepath.Base(path)]
+	if !ok {
+		return false
+	}
+
+	for _, embedding := range fileIndex.Embeddings {
+		if embedding.Start == start && !isAlias(embedding) {
+			return true
+		}
+	}
+	return false
+}
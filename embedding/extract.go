@@ -0,0 +1,453 @@
+package embedding
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// A Document is the text extracted from a file, split into sections that
+// chunks are cut from so a chunk never spans two sections
+type Document struct {
+	Text     string
+	Sections []DocumentSection
+}
+
+// A DocumentSection is a byte range of a Document's Text with the path of
+// headings it falls under
+type DocumentSection struct {
+	Heading string // e.g. "Install > Linux", empty before the first heading
+	Start   int
+	End     int
+}
+
+// A DocumentExtractor turns the contents of a file into a Document, letting
+// the index embed file types that aren't plain text or that have structure
+// worth keeping. Extraction must be deterministic since search results are
+// recovered by extracting the file again and reading the chunk's range.
+type DocumentExtractor interface {
+	Extract(data []byte) (*Document, error)
+}
+
+// Extractors used by default, keyed by lowercase file extension
+func DefaultExtractors() map[string]DocumentExtractor {
+	return map[string]DocumentExtractor{
+		".md":       &MarkdownExtractor{},
+		".markdown": &MarkdownExtractor{},
+		".pdf":      &PDFExtractor{},
+	}
+}
+
+// Return the extractor for a file based on its extension, or nil if the
+// file should be chunked as plain text
+func (this *DiskCachedEmbeddingIndex) extractorFor(path string) DocumentExtractor {
+	if this.Extractors == nil {
+		return nil
+	}
+	return this.Extractors[strings.ToLower(filepath.Ext(path))]
+}
+
+// MarkdownExtractor splits a Markdown file into sections at each ATX
+// heading (lines starting with #), ignoring headings inside fenced code
+// blocks. The text is the file unchanged.
+type MarkdownExtractor struct{}
+
+var markdownHeadingRegex = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+
+func (this *MarkdownExtractor) Extract(data []byte) (*Document, error) {
+	text := string(data)
+	doc := &Document{Text: text}
+
+	headings := []string{} // heading at each level, 1-6
+	heading := ""
+	start := 0
+	fence := ""
+
+	for offset := 0; offset < len(text); {
+		end := strings.IndexByte(text[offset:], '\n')
+		if end == -1 {
+			end = len(text)
+		} else {
+			end += offset + 1
+		}
+		line := strings.TrimRight(text[offset:end], "\r\n")
+
+		trimmed := strings.TrimLeft(line, " ")
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+		} else if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+		} else if match := markdownHeadingRegex.FindStringSubmatch(line); match != nil {
+			if offset > start {
+				doc.Sections = append(doc.Sections, DocumentSection{heading, start, offset})
+			}
+
+			level := len(match[1])
+			for len(headings) < level {
+				headings = append(headings, "")
+			}
+			headings = append(headings[:level-1], strings.TrimSpace(match[2]))
+			heading = joinHeadings(headings)
+			start = offset
+		}
+
+		offset = end
+	}
+
+	if len(text) > start {
+		doc.Sections = append(doc.Sections, DocumentSection{heading, start, len(text)})
+	}
+
+	return doc, nil
+}
+
+// Join the headings leading to a section, skipping levels that were jumped
+// over, e.g. a ### directly under a #
+func joinHeadings(headings []string) string {
+	parts := []string{}
+	for _, heading := range headings {
+		if heading != "" {
+			parts = append(parts, heading)
+		}
+	}
+	return strings.Join(parts, " > ")
+}
+
+// A chunk of a Document to be embedded
+type documentChunk struct {
+	Heading string
+	Start   int
+	End     int
+}
+
+// Cut each section of a document into chunks of at most chunkSize bytes,
+// breaking at a newline where there's one in the second half of the chunk
+// and never in the middle of a UTF-8 character. Sections with only
+// whitespace are skipped. maxChunks of -1 means no limit.
+func chunkDocument(doc *Document, chunkSize, maxChunks int) []documentChunk {
+	chunks := []documentChunk{}
+
+	for _, section := range doc.Sections {
+		for start := section.Start; start < section.End; {
+			if maxChunks != -1 && len(chunks) >= maxChunks {
+				return chunks
+			}
+
+			end := start + chunkSize
+			if end >= section.End {
+				end = section.End
+			} else {
+				if newline := strings.LastIndexByte(doc.Text[start:end], '\n'); newline >= chunkSize/2 {
+					end = start + newline + 1
+				}
+				for end > start+1 && !utf8.RuneStart(doc.Text[end]) {
+					end--
+				}
+			}
+
+			if strings.TrimSpace(doc.Text[start:end]) != "" {
+				chunks = append(chunks, documentChunk{section.Heading, start, end})
+			}
+			start = end
+		}
+	}
+
+	return chunks
+}
+
+// PDFExtractor pulls the text out of a PDF's page content streams. This is
+// a best effort without a full PDF parser: it handles uncompressed and
+// Flate compressed streams and the common text operators, but text in fonts
+// with custom encodings (e.g. many CID fonts) won't come out readable. The
+// whole document is one section since PDFs rarely record their headings.
+type PDFExtractor struct {
+	// The most bytes a compressed stream is inflated to, the rest of the
+	// stream is dropped. DefaultMaxPDFStreamSize if zero.
+	MaxStreamSize int64
+}
+
+// Compressed streams can inflate to many times their size, this keeps a
+// small malicious PDF from using up memory
+const DefaultMaxPDFStreamSize = 16 * 1024 * 1024
+
+var pdfStreamRegex = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+
+func (this *PDFExtractor) Extract(data []byte) (*Document, error) {
+	var text strings.Builder
+	maxStreamSize := this.MaxStreamSize
+	if maxStreamSize <= 0 {
+		maxStreamSize = DefaultMaxPDFStreamSize
+	}
+
+	for _, match := range pdfStreamRegex.FindAllSubmatchIndex(data, -1) {
+		dict := data[match[2]:match[3]]
+		// content streams have no type, fonts, images, and metadata do
+		if bytes.Contains(dict, []byte("/Type")) || bytes.Contains(dict, []byte("/Subtype")) {
+			continue
+		}
+
+		stream := data[match[1]:]
+		end := bytes.Index(stream, []byte("endstream"))
+		if end == -1 {
+			continue
+		}
+		stream = stream[:end]
+
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			reader, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			stream, err = io.ReadAll(io.LimitReader(reader, maxStreamSize))
+			if err != nil && len(stream) == 0 {
+				continue
+			}
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			// some other encoding we can't decode
+			continue
+		}
+
+		pdfContentText(stream, &text)
+	}
+
+	str := strings.TrimSpace(text.String())
+	doc := &Document{Text: str}
+	if str != "" {
+		doc.Sections = []DocumentSection{{Start: 0, End: len(str)}}
+	}
+	return doc, nil
+}
+
+// Scan a page content stream, writing the strings shown by text operators
+// and a newline whenever the text moves to a new line
+func pdfContentText(content []byte, out *strings.Builder) {
+	operands := []string{}
+	lineHasText := false
+
+	newline := func() {
+		if lineHasText {
+			out.WriteString("\n")
+			lineHasText = false
+		}
+	}
+	show := func(str string) {
+		out.WriteString(str)
+		if str != "" {
+			lineHasText = true
+		}
+	}
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '(':
+			str, next := pdfLiteralString(content, i)
+			operands = append(operands, str)
+			i = next
+
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end == -1 {
+				return
+			}
+			operands = append(operands, pdfHexString(content[i+1:i+end]))
+			i += end + 1
+
+		case c == '[':
+			// a TJ array, strings interleaved with kerning adjustments where
+			// large negative adjustments are usually word spaces
+			var array strings.Builder
+			i++
+			for i < len(content) && content[i] != ']' {
+				switch content[i] {
+				case '(':
+					var str string
+					str, i = pdfLiteralString(content, i)
+					array.WriteString(str)
+				case '<':
+					end := bytes.IndexByte(content[i:], '>')
+					if end == -1 {
+						return
+					}
+					array.WriteString(pdfHexString(content[i+1 : i+end]))
+					i += end + 1
+				default:
+					start := i
+					for i < len(content) && strings.IndexByte("-+.0123456789", content[i]) != -1 {
+						i++
+					}
+					if i == start {
+						i++
+					} else if n, err := strconv.ParseFloat(string(content[start:i]), 64); err == nil && n < -200 {
+						array.WriteString(" ")
+					}
+				}
+			}
+			operands = append(operands, array.String())
+			i++
+
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+
+		case isPDFWhitespace(c):
+			i++
+
+		default:
+			start := i
+			if c == '/' {
+				i++
+			}
+			for i < len(content) && !isPDFWhitespace(content[i]) && !isPDFDelimiter(content[i]) {
+				i++
+			}
+			if i == start {
+				i++
+				continue
+			}
+			token := string(content[start:i])
+
+			if _, err := strconv.ParseFloat(token, 64); err == nil || token[0] == '/' {
+				operands = append(operands, token)
+				continue
+			}
+
+			// token is an operator
+			switch token {
+			case "Tj", "TJ":
+				if len(operands) > 0 {
+					show(operands[len(operands)-1])
+				}
+			case "'", "\"":
+				newline()
+				if len(operands) > 0 {
+					show(operands[len(operands)-1])
+				}
+			case "T*", "Tm", "ET":
+				newline()
+			case "Td", "TD":
+				// only a vertical move starts a new line
+				if len(operands) >= 2 && operands[len(operands)-1] != "0" {
+					newline()
+				}
+			}
+			operands = operands[:0]
+		}
+	}
+
+	newline()
+}
+
+// Read a PDF literal string starting at the opening parenthesis at i,
+// returning the decoded string and the index after the closing parenthesis
+func pdfLiteralString(content []byte, i int) (string, int) {
+	var buf []byte
+	depth := 0
+
+	for i++; i < len(content); i++ {
+		c := content[i]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return pdfDecodeText(buf), i + 1
+			}
+			depth--
+		case '\\':
+			i++
+			if i >= len(content) {
+				break
+			}
+			c = content[i]
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r', '\n':
+				// line continuation
+				if c == '\r' && i+1 < len(content) && content[i+1] == '\n' {
+					i++
+				}
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					n := 0
+					for j := 0; j < 3 && i < len(content) && content[i] >= '0' && content[i] <= '7'; j++ {
+						n = n*8 + int(content[i]-'0')
+						i++
+					}
+					i--
+					c = byte(n)
+				}
+			}
+		}
+		buf = append(buf, c)
+	}
+
+	return pdfDecodeText(buf), i
+}
+
+func pdfHexString(hex []byte) string {
+	digits := []byte{}
+	for _, c := range hex {
+		if !isPDFWhitespace(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+
+	buf := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		n, err := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		if err != nil {
+			return ""
+		}
+		buf = append(buf, byte(n))
+	}
+	return pdfDecodeText(buf)
+}
+
+// Decode string bytes as UTF-16 if they start with a byte order mark,
+// otherwise as Latin-1, which is close to the standard PDF encodings
+func pdfDecodeText(buf []byte) string {
+	if len(buf) >= 2 && buf[0] == 0xfe && buf[1] == 0xff {
+		units := make([]uint16, 0, len(buf)/2)
+		for i := 2; i+1 < len(buf); i += 2 {
+			units = append(units, uint16(buf[i])<<8|uint16(buf[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+
+	runes := make([]rune, len(buf))
+	for i, b := range buf {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+func isPDFWhitespace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) != -1
+}
@@ -0,0 +1,184 @@
+package embedding
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarkdownExtractorSections(t *testing.T) {
+	data, err := os.ReadFile("testdata/guide.md")
+	assert.NoError(t, err)
+
+	doc, err := (&MarkdownExtractor{}).Extract(data)
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), doc.Text)
+
+	headings := []string{}
+	for _, section := range doc.Sections {
+		headings = append(headings, section.Heading)
+	}
+	assert.Equal(t, []string{
+		"",
+		"Install",
+		"Install > Linux",
+		"Install > macOS",
+		"Install > macOS > Apple silicon",
+		"Usage",
+	}, headings)
+
+	// sections cover the whole file in order
+	offset := 0
+	for _, section := range doc.Sections {
+		assert.Equal(t, offset, section.Start)
+		offset = section.End
+	}
+	assert.Equal(t, len(doc.Text), offset)
+
+	// a comment in a fenced code block isn't a heading
+	linux := doc.Sections[2]
+	assert.True(t, strings.HasPrefix(doc.Text[linux.Start:linux.End], "## Linux\n"))
+	assert.Contains(t, doc.Text[linux.Start:linux.End], "# not a heading")
+}
+
+func TestMarkdownExtractorSkippedLevel(t *testing.T) {
+	doc, err := (&MarkdownExtractor{}).Extract([]byte("# Top\n### Deep\ntext\n## Middle\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(doc.Sections))
+	assert.Equal(t, "Top > Deep", doc.Sections[1].Heading)
+	assert.Equal(t, "Top > Middle", doc.Sections[2].Heading)
+}
+
+func TestChunkDocument(t *testing.T) {
+	data, err := os.ReadFile("testdata/guide.md")
+	assert.NoError(t, err)
+	doc, err := (&MarkdownExtractor{}).Extract(data)
+	assert.NoError(t, err)
+
+	chunks := chunkDocument(doc, 32, -1)
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, chunk.End-chunk.Start, 32)
+
+		// chunks never cross a section boundary
+		inSection := false
+		for _, section := range doc.Sections {
+			if chunk.Start >= section.Start && chunk.End <= section.End {
+				assert.Equal(t, section.Heading, chunk.Heading)
+				inSection = true
+			}
+		}
+		assert.True(t, inSection, "chunk %d-%d spans sections", chunk.Start, chunk.End)
+	}
+
+	limited := chunkDocument(doc, 32, 3)
+	assert.Equal(t, chunks[:3], limited)
+}
+
+// Index the Markdown fixture and make sure a search result carries the
+// headings of the section it was found in
+func TestIndexMarkdownHeadings(t *testing.T) {
+	data, err := os.ReadFile("testdata/guide.md")
+	assert.NoError(t, err)
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/docs/guide.md", data, 0644))
+
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.Embedder = &keywordEmbedder{
+		Keywords: []string{"apt", "brew", "silicon"},
+	}
+	ctx := context.Background()
+
+	err = index.IndexPath(ctx, "/docs", false, 256, 64)
+	assert.NoError(t, err)
+
+	results, err := index.Search(ctx, "brew", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "/docs/guide.md", results[0].FilePath)
+	assert.Equal(t, "Install > macOS", results[0].Heading)
+	assert.Equal(t, "## macOS ##\n\nUse brew install butterfish.\n\n", results[0].Content)
+}
+
+// Build a minimal PDF with one plain and one compressed content stream, plus
+// a font stream that should be ignored
+func makeTestPDF(t *testing.T) []byte {
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	_, err := writer.Write([]byte("BT /F1 12 Tf 72 700 Td (Second page) Tj ET"))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	plain := "BT /F1 12 Tf 72 720 Td (Hello \\(PDF\\)) Tj 0 -14 Td [(Wor) -20 (ld) -300 (again)] TJ ET"
+	fmt.Fprintf(&pdf, "4 0 obj\n<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(plain), plain)
+	fmt.Fprintf(&pdf, "5 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", compressed.Len())
+	pdf.Write(compressed.Bytes())
+	pdf.WriteString("\nendstream\nendobj\n")
+	pdf.WriteString("6 0 obj\n<< /Length 12 /Subtype /Type1C >>\nstream\n(Font data) Tj\nendstream\nendobj\n")
+	pdf.WriteString("%%EOF\n")
+	return pdf.Bytes()
+}
+
+func TestPDFExtractor(t *testing.T) {
+	doc, err := (&PDFExtractor{}).Extract(makeTestPDF(t))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello (PDF)\nWorld again\nSecond page", doc.Text)
+	assert.Equal(t, []DocumentSection{{Start: 0, End: len(doc.Text)}}, doc.Sections)
+
+	// PDFs are binary but are indexed through the extractor
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/docs/paper.pdf", makeTestPDF(t), 0644))
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	ctx := context.Background()
+	assert.NoError(t, index.IndexPath(ctx, "/docs", false, 512, 8))
+
+	results, err := index.Search(ctx, "hello", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, doc.Text, results[0].Content)
+}
+
+// Inflating a compressed stream stops at MaxStreamSize
+func TestPDFExtractorMaxStreamSize(t *testing.T) {
+	extractor := &PDFExtractor{MaxStreamSize: 20}
+	doc, err := extractor.Extract(makeTestPDF(t))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello (PDF)\nWorld again", doc.Text)
+}
+
+// Counts calls to the wrapped extractor
+type countingExtractor struct {
+	DocumentExtractor
+	Calls int
+}
+
+func (this *countingExtractor) Extract(data []byte) (*Document, error) {
+	this.Calls++
+	return this.DocumentExtractor.Extract(data)
+}
+
+// Search results from the same file share one extraction
+func TestPopulateSearchResultsExtractsOnce(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/docs/paper.pdf", makeTestPDF(t), 0644))
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	extractor := &countingExtractor{DocumentExtractor: &PDFExtractor{}}
+	index.Extractors = map[string]DocumentExtractor{".pdf": extractor}
+	ctx := context.Background()
+	assert.NoError(t, index.IndexPath(ctx, "/docs", false, 12, 8))
+
+	extractor.Calls = 0
+	results, err := index.Search(ctx, "hello", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, 1, extractor.Calls)
+	assert.Equal(t, "Hello (PDF)\n", results[0].Content)
+}
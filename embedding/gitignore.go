@@ -0,0 +1,202 @@
+package embedding
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+type gitignorePattern struct {
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// GitignoreMatcher holds the patterns from one .gitignore file, matched
+// against paths relative to the directory the file is in
+type GitignoreMatcher struct {
+	Dir      string
+	patterns []gitignorePattern
+}
+
+// Parse the contents of a .gitignore file located in dir. This follows the
+// gitignore rules: blank lines and # comments are skipped, ! negates a
+// pattern, a trailing / only matches directories, a pattern with a slash
+// anywhere else is relative to dir while other patterns match at any depth,
+// and *, ?, [...], and ** are supported.
+func ParseGitignore(dir string, content []byte) *GitignoreMatcher {
+	matcher := &GitignoreMatcher{Dir: dir}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		pattern := gitignorePattern{}
+		if line[0] == '!' {
+			pattern.negate = true
+			line = line[1:]
+		} else if line[0] == '\\' {
+			// escaped leading ! or #
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+
+		expr := globToRegex(line)
+		if anchored {
+			expr = "^" + expr + "$"
+		} else {
+			expr = "^(.*/)?" + expr + "$"
+		}
+
+		regex, err := regexp.Compile(expr)
+		if err != nil {
+			// a malformed pattern, e.g. an unclosed bracket, is ignored as git does
+			continue
+		}
+		pattern.regex = regex
+		matcher.patterns = append(matcher.patterns, pattern)
+	}
+
+	return matcher
+}
+
+// Convert a gitignore glob to a regular expression, without anchors
+func globToRegex(glob string) string {
+	var expr strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		char := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			// zero or more leading directories
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			// everything inside
+			expr.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case char == '*':
+			expr.WriteString("[^/]*")
+		case char == '?':
+			expr.WriteString("[^/]")
+		case char == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				expr.WriteString(regexp.QuoteMeta(glob[i:]))
+				return expr.String()
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case char == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+
+	return expr.String()
+}
+
+// Check a path against the patterns, the last matching pattern wins.
+// Returns whether any pattern matched and if so whether the path is ignored.
+func (this *GitignoreMatcher) Match(path string, isDir bool) (matched bool, ignored bool) {
+	rel, err := filepath.Rel(this.Dir, path)
+	if err != nil {
+		return false, false
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return false, false
+	}
+
+	for i := len(this.patterns) - 1; i >= 0; i-- {
+		pattern := this.patterns[i]
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.regex.MatchString(rel) {
+			return true, !pattern.negate
+		}
+	}
+
+	return false, false
+}
+
+// The gitignore files that apply to a directory, ordered from the top of the
+// tree down
+type gitignoreStack []*GitignoreMatcher
+
+// Patterns in deeper .gitignore files take precedence over shallower ones
+func (this gitignoreStack) Ignored(path string, isDir bool) bool {
+	for i := len(this) - 1; i >= 0; i-- {
+		matched, ignored := this[i].Match(path, isDir)
+		if matched {
+			return ignored
+		}
+	}
+	return false
+}
+
+// Return a new stack with the .gitignore in dir added, if there is one
+func (this gitignoreStack) push(fs afero.Fs, dir string) gitignoreStack {
+	content, err := afero.ReadFile(fs, filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return this
+	}
+
+	stack := make(gitignoreStack, len(this), len(this)+1)
+	copy(stack, this)
+	return append(stack, ParseGitignore(dir, content))
+}
+
+// Load the .gitignore files in the ancestors of dir, up to the root of the
+// git repository it's in, so that indexing a subdirectory honors them. If
+// dir isn't inside a repository then we return an empty stack.
+func ancestorGitignores(fs afero.Fs, dir string) gitignoreStack {
+	ancestors := []string{}
+	for current := dir; ; {
+		exists, _ := afero.Exists(fs, filepath.Join(current, ".git"))
+		if exists {
+			break
+		}
+
+		parent := filepath.Dir(current)
+		if parent == current {
+			// reached the filesystem root without finding a repository
+			return gitignoreStack{}
+		}
+		ancestors = append(ancestors, parent)
+		current = parent
+	}
+
+	stack := gitignoreStack{}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		stack = stack.push(fs, ancestors[i])
+	}
+	return stack
+}
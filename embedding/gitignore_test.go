@@ -0,0 +1,120 @@
+package embedding
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitignoreMatch(t *testing.T) {
+	matcher := ParseGitignore("/repo", []byte(`
+# comments and blank lines are skipped
+*.log
+!keep.log
+build/
+/secret.txt
+docs/**/*.html
+\#notacomment
+`))
+
+	testCases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"/repo/debug.log", false, true},
+		{"/repo/sub/debug.log", false, true},
+		{"/repo/keep.log", false, false},
+		{"/repo/build", true, true},
+		{"/repo/sub/build", true, true},
+		{"/repo/build", false, false},
+		{"/repo/secret.txt", false, true},
+		{"/repo/sub/secret.txt", false, false},
+		{"/repo/docs/index.html", false, true},
+		{"/repo/docs/api/v1/index.html", false, true},
+		{"/repo/index.html", false, false},
+		{"/repo/#notacomment", false, true},
+		{"/other/debug.log", false, false},
+	}
+
+	for _, testCase := range testCases {
+		_, ignored := matcher.Match(testCase.path, testCase.isDir)
+		assert.Equal(t, testCase.ignored, ignored, testCase.path)
+	}
+}
+
+func makeGitignoreFilesystem(t *testing.T) afero.Fs {
+	fs := afero.NewMemMapFs()
+	files := map[string]string{
+		"/repo/.git/HEAD":                  "ref: refs/heads/main",
+		"/repo/.gitignore":                 "*.log\nbuild/\n!keep.log\n",
+		"/repo/main.txt":                   "main",
+		"/repo/debug.log":                  "debug",
+		"/repo/keep.log":                   "keep",
+		"/repo/build/out.txt":              "out",
+		"/repo/node_modules/dep/index.txt": "dep",
+		"/repo/sub/.gitignore":             "generated.txt\n!important.log\n",
+		"/repo/sub/notes.txt":              "notes",
+		"/repo/sub/generated.txt":          "generated",
+		"/repo/sub/trace.log":              "trace",
+		"/repo/sub/important.log":          "important",
+	}
+
+	for path, content := range files {
+		assert.NoError(t, afero.WriteFile(fs, path, []byte(content), 0644))
+	}
+	return fs
+}
+
+func indexedFiles(index *DiskCachedEmbeddingIndex) []string {
+	files := index.IndexedFiles()
+	sort.Strings(files)
+	return files
+}
+
+func TestIndexHonorsGitignore(t *testing.T) {
+	ctx := context.Background()
+
+	fs := makeGitignoreFilesystem(t)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.IgnoreDirs = DefaultIgnoreDirs
+	err := index.IndexPath(ctx, "/repo", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"/repo/keep.log",
+		"/repo/main.txt",
+		"/repo/sub/important.log",
+		"/repo/sub/notes.txt",
+	}, indexedFiles(index))
+
+	// indexing a subdirectory still applies the repository's root .gitignore
+	fs = makeGitignoreFilesystem(t)
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	err = index.IndexPath(ctx, "/repo/sub", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"/repo/sub/important.log",
+		"/repo/sub/notes.txt",
+	}, indexedFiles(index))
+
+	// with gitignore disabled only the default ignore list applies
+	fs = makeGitignoreFilesystem(t)
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	index.IgnoreDirs = DefaultIgnoreDirs
+	index.UseGitignore = false
+	err = index.IndexPath(ctx, "/repo", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"/repo/build/out.txt",
+		"/repo/debug.log",
+		"/repo/keep.log",
+		"/repo/main.txt",
+		"/repo/sub/generated.txt",
+		"/repo/sub/important.log",
+		"/repo/sub/notes.txt",
+		"/repo/sub/trace.log",
+	}, indexedFiles(index))
+}
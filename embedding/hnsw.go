@@ -0,0 +1,263 @@
+package embedding
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// A Hierarchical Navigable Small World graph for approximate nearest
+// neighbor search by cosine similarity, see Malkov & Yashunin 2016. Each
+// vector is a node linked to its closest neighbors on layer 0, and a random
+// exponentially shrinking subset of nodes are also linked on higher layers.
+// A search walks greedily down from the sparse top layer to find a good
+// starting point, then explores layer 0 keeping the best ef candidates.
+// Larger ef finds the true nearest neighbors more often at the cost of
+// scoring more vectors.
+type HNSW struct {
+	// Neighbors kept per node on the upper layers, layer 0 keeps twice this
+	M int
+	// Candidates kept while linking a new node, higher builds a better
+	// graph more slowly
+	EfConstruction int
+
+	// vectors normalized to unit length so similarity is a dot product
+	vectors [][]float64
+	// the neighbors of each node on each of its layers
+	neighbors [][][]int
+	entry     int
+	maxLevel  int
+	levelMult float64
+	rng       *rand.Rand
+}
+
+// Defaults for NewHNSW and searches
+const (
+	DefaultHNSWM              = 16
+	DefaultHNSWEfConstruction = 100
+	DefaultHNSWEfSearch       = 64
+)
+
+// Create an empty graph, seed makes the layer assignment and so the search
+// results repeatable
+func NewHNSW(m, efConstruction int, seed int64) *HNSW {
+	if m < 2 {
+		m = 2
+	}
+	if efConstruction < m {
+		efConstruction = m
+	}
+
+	return &HNSW{
+		M:              m,
+		EfConstruction: efConstruction,
+		entry:          -1,
+		levelMult:      1 / math.Log(float64(m)),
+		rng:            rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Number of vectors in the graph
+func (this *HNSW) Len() int {
+	return len(this.vectors)
+}
+
+// Add a vector to the graph, returning its index, which is the order it was
+// added in
+func (this *HNSW) Add(vector []float64) int {
+	id := len(this.vectors)
+	this.vectors = append(this.vectors, normalize(vector))
+
+	level := int(math.Floor(-math.Log(1-this.rng.Float64()) * this.levelMult))
+	this.neighbors = append(this.neighbors, make([][]int, level+1))
+
+	if this.entry == -1 {
+		this.entry = id
+		this.maxLevel = level
+		return id
+	}
+
+	query := this.vectors[id]
+	entry := this.entry
+	for l := this.maxLevel; l > level; l-- {
+		entry = this.greedyClosest(query, entry, l)
+	}
+
+	top := level
+	if top > this.maxLevel {
+		top = this.maxLevel
+	}
+	for l := top; l >= 0; l-- {
+		candidates := this.searchLayer(query, entry, this.EfConstruction, l)
+		selected := candidates
+		if len(selected) > this.M {
+			selected = selected[:this.M]
+		}
+
+		links := make([]int, len(selected))
+		for i, candidate := range selected {
+			links[i] = candidate.Index
+			this.link(candidate.Index, id, l)
+		}
+		this.neighbors[id][l] = links
+		entry = candidates[0].Index
+	}
+
+	if level > this.maxLevel {
+		this.maxLevel = level
+		this.entry = id
+	}
+	return id
+}
+
+// Find about the k most similar vectors to the query, examining at least ef
+// candidates. Results are sorted by descending score, ties by index.
+func (this *HNSW) Search(query []float64, k, ef int) []ScoredIndex {
+	if len(this.vectors) == 0 || k <= 0 {
+		return []ScoredIndex{}
+	}
+	if ef < k {
+		ef = k
+	}
+
+	query = normalize(query)
+	entry := this.entry
+	for l := this.maxLevel; l > 0; l-- {
+		entry = this.greedyClosest(query, entry, l)
+	}
+
+	results := this.searchLayer(query, entry, ef, 0)
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
+
+// The number of neighbors a node keeps on a layer
+func (this *HNSW) maxNeighbors(level int) int {
+	if level == 0 {
+		return 2 * this.M
+	}
+	return this.M
+}
+
+// Link node to neighbor on a layer, if node then has too many neighbors
+// only the most similar are kept
+func (this *HNSW) link(node, neighbor, level int) {
+	links := append(this.neighbors[node][level], neighbor)
+	if len(links) > this.maxNeighbors(level) {
+		vector := this.vectors[node]
+		sort.SliceStable(links, func(i, j int) bool {
+			return dot(vector, this.vectors[links[i]]) > dot(vector, this.vectors[links[j]])
+		})
+		links = links[:this.maxNeighbors(level)]
+	}
+	this.neighbors[node][level] = links
+}
+
+// Follow the most similar neighbor on a layer until none is closer
+func (this *HNSW) greedyClosest(query []float64, entry, level int) int {
+	best := entry
+	bestScore := dot(query, this.vectors[entry])
+
+	for changed := true; changed; {
+		changed = false
+		for _, neighbor := range this.neighbors[best][level] {
+			score := dot(query, this.vectors[neighbor])
+			if score > bestScore {
+				best, bestScore, changed = neighbor, score, true
+			}
+		}
+	}
+	return best
+}
+
+// Explore a layer from entry keeping the best ef nodes found, returned
+// sorted by descending score
+func (this *HNSW) searchLayer(query []float64, entry, ef, level int) []ScoredIndex {
+	start := ScoredIndex{Index: entry, Score: dot(query, this.vectors[entry])}
+	visited := map[int]bool{entry: true}
+	candidates := &scoredHeap{best: true, items: []ScoredIndex{start}}
+	found := &scoredHeap{items: []ScoredIndex{start}}
+
+	for candidates.Len() > 0 {
+		current := heap.Pop(candidates).(ScoredIndex)
+		if found.Len() >= ef && current.Score < found.items[0].Score {
+			break
+		}
+
+		for _, neighbor := range this.neighbors[current.Index][level] {
+			if visited[neighbor] {
+				continue
+			}
+			visited[neighbor] = true
+
+			scored := ScoredIndex{Index: neighbor, Score: dot(query, this.vectors[neighbor])}
+			if found.Len() < ef || scored.Score > found.items[0].Score {
+				heap.Push(candidates, scored)
+				heap.Push(found, scored)
+				if found.Len() > ef {
+					heap.Pop(found)
+				}
+			}
+		}
+	}
+
+	results := found.items
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Index < results[j].Index
+	})
+	return results
+}
+
+// A heap of scored nodes, the best on top if best is set, otherwise the
+// worst
+type scoredHeap struct {
+	best  bool
+	items []ScoredIndex
+}
+
+func (this *scoredHeap) Len() int      { return len(this.items) }
+func (this *scoredHeap) Swap(i, j int) { this.items[i], this.items[j] = this.items[j], this.items[i] }
+func (this *scoredHeap) Less(i, j int) bool {
+	if this.best {
+		return this.items[i].Score > this.items[j].Score
+	}
+	return this.items[i].Score < this.items[j].Score
+}
+func (this *scoredHeap) Push(x interface{}) { this.items = append(this.items, x.(ScoredIndex)) }
+func (this *scoredHeap) Pop() interface{} {
+	last := this.items[len(this.items)-1]
+	this.items = this.items[:len(this.items)-1]
+	return last
+}
+
+// A copy of the vector scaled to unit length, a zero vector stays zero
+func normalize(vector []float64) []float64 {
+	norm := 0.0
+	for _, value := range vector {
+		norm += value * value
+	}
+
+	normalized := make([]float64, len(vector))
+	if norm == 0 {
+		return normalized
+	}
+	norm = math.Sqrt(norm)
+	for i, value := range vector {
+		normalized[i] = value / norm
+	}
+	return normalized
+}
+
+func dot(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
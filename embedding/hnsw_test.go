@@ -0,0 +1,117 @@
+package embedding
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func randomVectors(rng *rand.Rand, count, dimensions int) [][]float64 {
+	vectors := make([][]float64, count)
+	for i := range vectors {
+		vectors[i] = make([]float64, dimensions)
+		for j := range vectors[i] {
+			vectors[i][j] = rng.NormFloat64()
+		}
+	}
+	return vectors
+}
+
+// The fraction of the exact top k found by the approximate search
+func recall(exact, approximate []ScoredIndex) float64 {
+	found := map[int]bool{}
+	for _, scored := range approximate {
+		found[scored.Index] = true
+	}
+
+	hits := 0
+	for _, scored := range exact {
+		if found[scored.Index] {
+			hits++
+		}
+	}
+	return float64(hits) / float64(len(exact))
+}
+
+func TestHNSW(t *testing.T) {
+	graph := NewHNSW(4, 8, 1)
+	assert.Equal(t, []ScoredIndex{}, graph.Search([]float64{1, 0}, 3, 10))
+
+	vectors := [][]float64{{1, 0}, {0, 1}, {1, 1}, {-1, 0}, {2, 0.2}}
+	for i, vector := range vectors {
+		assert.Equal(t, i, graph.Add(vector))
+	}
+	assert.Equal(t, len(vectors), graph.Len())
+
+	// a graph this small is searched exhaustively so the results are exact
+	ranked := graph.Search([]float64{1, 0}, 3, 10)
+	expected, err := TopK([]float64{1, 0}, vectors, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(ranked))
+	for i := range expected {
+		assert.Equal(t, expected[i].Index, ranked[i].Index)
+		assert.InDelta(t, expected[i].Score, ranked[i].Score, 1e-9)
+	}
+}
+
+// The graph should find nearly all of the true nearest neighbors, more of
+// them as ef grows
+func TestHNSWRecall(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	vectors := randomVectors(rng, 3000, 32)
+	queries := randomVectors(rng, 50, 32)
+	k := 10
+
+	graph := NewHNSW(DefaultHNSWM, DefaultHNSWEfConstruction, 1)
+	for _, vector := range vectors {
+		graph.Add(vector)
+	}
+
+	previous := 0.0
+	for _, ef := range []int{10, 64, 200} {
+		total := 0.0
+		for _, query := range queries {
+			exact, err := TopK(query, vectors, k)
+			assert.NoError(t, err)
+			approximate := graph.Search(query, k, ef)
+			assert.Equal(t, k, len(approximate))
+			total += recall(exact, approximate)
+		}
+
+		average := total / float64(len(queries))
+		assert.GreaterOrEqual(t, average, previous, "ef %d", ef)
+		if ef >= DefaultHNSWEfSearch {
+			assert.GreaterOrEqual(t, average, 0.9, "ef %d", ef)
+		}
+		previous = average
+	}
+}
+
+func benchmarkNearest(b *testing.B, approximate bool) {
+	rng := rand.New(rand.NewSource(7))
+	vectors := randomVectors(rng, 10000, 128)
+	query := randomVectors(rng, 1, 128)[0]
+
+	graph := NewHNSW(DefaultHNSWM, DefaultHNSWEfConstruction, 1)
+	if approximate {
+		for _, vector := range vectors {
+			graph.Add(vector)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if approximate {
+			graph.Search(query, 10, DefaultHNSWEfSearch)
+			continue
+		}
+		_, err := TopK(query, vectors, 10)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExactNearest(b *testing.B)       { benchmarkNearest(b, false) }
+func BenchmarkApproximateNearest(b *testing.B) { benchmarkNearest(b, true) }
@@ -1,19 +1,20 @@
 package embedding
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"mime"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	pb "github.com/bakks/butterfish/proto"
-	"github.com/drewlanenga/govector"
 	"github.com/golang/protobuf/proto"
 	"github.com/spf13/afero"
 	fsutil "golang.org/x/tools/godoc/util"
@@ -35,11 +36,18 @@ type FileEmbeddingIndex interface {
 	PopulateSearchResults(ctx context.Context, embeddings []*VectorSearchResult) error
 	ClearPaths(ctx context.Context, paths []string) error
 	ClearPath(ctx context.Context, path string) error
-	LoadPaths(ctx context.Context, paths []string) error
+	LoadPaths(ctx context.Context, paths []string, progress ProgressFunc) error
 	LoadPath(ctx context.Context, path string) error
 	IndexPaths(ctx context.Context, paths []string, forceUpdate bool, chunkSize, maxChunks int) error
 	IndexPath(ctx context.Context, path string, forceUpdate bool, chunkSize, maxChunks int) error
 	IndexedFiles() []string
+	VerifyCache(ctx context.Context, paths []string) ([]CacheProblem, error)
+	RebuildCache(ctx context.Context, paths []string, chunkSize, maxChunks int) error
+	Stats() IndexStats
+	Save(path string) error
+	Load(path string) error
+	SetNamespace(name string) error
+	Namespace() string
 }
 
 type VectorSearchResult struct {
@@ -49,8 +57,20 @@ type VectorSearchResult struct {
 	End      uint64
 	Vector   []float32
 	Content  string
+	// Headings the result falls under in a structured document like Markdown,
+	// e.g. "Install > Linux", empty for plain text files
+	Heading string
+	// Language of the file, e.g. "go", see DetectLanguage
+	Language string
+	// Chunks with near identical content that were collapsed into this one
+	// when indexing, see DiskCachedEmbeddingIndex.DedupThreshold
+	Aliases []ChunkLocation
 }
 
+// Called as a batch operation makes progress with the number of items done
+// so far and the total number of items
+type ProgressFunc func(done, total int)
+
 type DiskCachedEmbeddingIndex struct {
 	// maps absolute path of directory to a directory Index
 	Index map[string]*pb.DirectoryIndex
@@ -74,15 +94,171 @@ type DiskCachedEmbeddingIndex struct {
 	// The name of the file to cache the index on disk
 	DotfileName string
 
+	// Whether cached embeddings are loaded from and saved to DotfileName
+	// files, defaults to both
+	CacheMode CacheMode
+
 	// When we call the embedder we batch chunks together into a single call,
 	// this is the number of chunks to batch together
 	ChunksPerCall int
 
+	// Number of files embedded concurrently when indexing, each worker makes
+	// its own embedding calls so this also bounds the concurrent API requests
+	Workers int
+
+	// If set, called after each file is embedded with the number of files
+	// done so far and the total number of files being embedded
+	Progress ProgressFunc
+
+	// While indexing, files embedded so far are stored and saved to their
+	// cache files after this long without another file finishing, or once
+	// AutoSaveThreshold files are waiting, so that little is lost if the
+	// process is killed. 0 disables either trigger. Only used when CacheMode
+	// is CacheReadWrite.
+	AutoSaveInterval  time.Duration
+	AutoSaveThreshold int
+
+	// Schedules auto-saves, defaults to the system clock
+	Clock Clock
+
+	// Directories with embeddings that haven't been written to disk yet,
+	// e.g. because saving failed, see SaveDirty
+	dirty map[string]bool
+
+	// The active namespace and the embeddings of the other namespaces, see
+	// SetNamespace
+	namespace  string
+	namespaces map[string]*namespaceIndex
+
 	// When we embed a path we skip these directories
 	IgnoreDirs []string
 
+	// If true then we also skip files and directories matched by .gitignore
+	// files, including those in parent directories up to the repository root
+	UseGitignore bool
+
 	// When we embed a path we skip these files
 	IgnoreFiles []string
+
+	// When we embed a path we skip files larger than this many bytes, 0 means
+	// no limit
+	MaxFileSize int64
+
+	// If set then only files with these extensions, e.g. ".go", are indexed.
+	// The leading dot is optional, so "go" matches too.
+	Extensions []string
+
+	// If set then searches only return chunks from files in these languages,
+	// e.g. "go", see DetectLanguage
+	SearchLanguages []string
+
+	// Name of the model used to calculate vectors, recorded in cache files
+	// and snapshots so that we don't mix in vectors from a different model.
+	// Cached directories from another model are ignored, so their files are
+	// embedded again.
+	EmbeddingModel string
+
+	// Extract text from files by lowercase extension, e.g. ".md", rather than
+	// chunking the raw file. This is how PDFs are indexed, and how Markdown
+	// is chunked by section with the section's headings kept on each chunk.
+	Extractors map[string]DocumentExtractor
+
+	// If true then newly embedded vectors are stored as int8 with a scale
+	// factor, using about a quarter of the memory at a small cost in search
+	// accuracy. Quantized and full precision vectors can be mixed in one
+	// index since each embedding records how it's stored.
+	Quantize bool
+
+	// If above 0 then searches split the directories into shards of this
+	// many directory indexes, each searched on its own for its best results
+	// which are then merged, so only one shard's candidates are held at a
+	// time. 0 searches everything as one shard.
+	ShardSize int
+	// Number of shards searched at once, defaults to 1
+	ShardWorkers int
+	// If set then loading only finds the cache files, each is read when a
+	// search reaches its shard and is dropped afterwards rather than kept in
+	// memory. Operations that need the whole index, e.g. IndexPaths or
+	// Stats, load the rest first.
+	LazyLoad bool
+	// Cache files found with LazyLoad that haven't been loaded, by the
+	// absolute path of their directory
+	unloaded map[string]string
+
+	// If above 0 then once the index holds at least this many vectors,
+	// searches use an approximate nearest neighbor graph rather than scoring
+	// every vector, see ann.go. Smaller indexes are searched exactly.
+	ANNThreshold int
+	// Candidates examined by each approximate search, higher finds the true
+	// best results more often but is slower, defaults to
+	// DefaultHNSWEfSearch
+	ANNEfSearch int
+	// The graph used for approximate search, nil until built or after the
+	// index changes
+	ann *annIndex
+
+	// If above 0 then newly embedded chunks whose cosine similarity to a
+	// chunk already in the index is at least this are collapsed into it,
+	// e.g. license headers repeated across files. The collapsed chunk keeps
+	// no vector and is returned in the Aliases of the chunk it duplicates,
+	// so search results aren't crowded with copies of the same text.
+	DedupThreshold float64
+
+	// If set then chunks are looked up in this store shared with other
+	// indexes before being embedded, and new embeddings are added to it, see
+	// SharedEmbeddingCache. It follows CacheMode.
+	SharedCache *SharedEmbeddingCache
+
+	// Identifies the embedder in shared cache keys, e.g. the provider and its
+	// base URL, so that different providers serving the same model name
+	// don't share vectors. Defaults to the Embedder's type.
+	EmbedderName string
+}
+
+// How an index uses the cache files on disk
+type CacheMode int
+
+const (
+	// Load cached embeddings and save new ones
+	CacheReadWrite CacheMode = iota
+	// Load cached embeddings but never write, new embeddings are only kept
+	// in memory, e.g. for a cache on a shared or read-only filesystem
+	CacheReadOnly
+	// Neither load nor save, everything is embedded in memory
+	CacheOff
+)
+
+var cacheModeNames = []string{"readwrite", "readonly", "off"}
+
+func (this CacheMode) String() string {
+	if int(this) < len(cacheModeNames) {
+		return cacheModeNames[this]
+	}
+	return fmt.Sprintf("CacheMode(%d)", int(this))
+}
+
+func ParseCacheMode(name string) (CacheMode, error) {
+	for i, modeName := range cacheModeNames {
+		if strings.EqualFold(name, modeName) {
+			return CacheMode(i), nil
+		}
+	}
+	return CacheReadWrite, fmt.Errorf("Unknown cache mode %q, expected readwrite, readonly, or off", name)
+}
+
+// Files larger than this are skipped by default, they're usually generated
+const DefaultMaxFileSize = 1024 * 1024
+
+// By default files embedded so far are saved after 30 seconds without
+// another file finishing, or once 100 are waiting to be saved
+const DefaultAutoSaveInterval = 30 * time.Second
+const DefaultAutoSaveThreshold = 100
+
+// Directories skipped by default whether or not they're in a .gitignore,
+// they're version control metadata, dependencies, or caches
+var DefaultIgnoreDirs = []string{
+	".git", ".hg", ".svn", "node_modules", "__pycache__", ".venv", ".tox",
+	".mypy_cache", ".pytest_cache", ".next", ".gradle", ".idea",
 }
 
 func NewDiskCachedEmbeddingIndex(embedder Embedder, writer io.Writer) *DiskCachedEmbeddingIndex {
@@ -91,7 +267,7 @@ func NewDiskCachedEmbeddingIndex(embedder Embedder, writer io.Writer) *DiskCache
 		Index:       make(map[string]*pb.DirectoryIndex),
 		Out:         writer,
 		Fs:          afero.NewOsFs(),
-		IgnoreDirs:  []string{".git"},
+		IgnoreDirs:  append([]string{}, DefaultIgnoreDirs...),
 		IgnoreFiles: []string{".gitignore", ".gitmodules", "go.sum", "LICENSE", "LICENSE.md"},
 	}
 
@@ -102,6 +278,12 @@ func NewDiskCachedEmbeddingIndex(embedder Embedder, writer io.Writer) *DiskCache
 func (this *DiskCachedEmbeddingIndex) SetDefaultConfig() {
 	this.DotfileName = ".butterfish_index"
 	this.ChunksPerCall = 32
+	this.Workers = 4
+	this.MaxFileSize = DefaultMaxFileSize
+	this.AutoSaveInterval = DefaultAutoSaveInterval
+	this.AutoSaveThreshold = DefaultAutoSaveThreshold
+	this.UseGitignore = true
+	this.Extractors = DefaultExtractors()
 }
 
 func (this *DiskCachedEmbeddingIndex) SetEmbedder(embedder Embedder) {
@@ -160,51 +342,17 @@ func (this *DiskCachedEmbeddingIndex) Vectorize(ctx context.Context, content str
 // - First we brute force search by iterating over all stored vectors
 //     and calculating cosine distance
 // - Next we sort based on score
+// If ShardSize is set then this is done for each shard of the directories
+// and the best of each are merged, see shard.go. If ANNThreshold is set and
+// the index is large enough then an approximate search is used instead, see
+// ann.go.
 func (this *DiskCachedEmbeddingIndex) SearchWithVector(ctx context.Context,
 	queryVector []float32, numResults int) ([]*VectorSearchResult, error) {
-	// Turn queryVector float array into a govector
-	query, err := govector.AsVector(queryVector)
-	if err != nil {
-		return nil, err
+	results, err := this.searchANN(ctx, queryVector, numResults)
+	if err != nil || results != nil {
+		return results, err
 	}
-
-	results := []*VectorSearchResult{}
-
-	for dirIndexAbsPath, dirIndex := range this.Index {
-		for filename, fileIndex := range dirIndex.Files {
-			if ctx.Err() != nil {
-				return nil, ctx.Err()
-			}
-
-			for _, embedding := range fileIndex.Embeddings {
-				govec, err := govector.AsVector(embedding.Vector)
-
-				distance, err := govector.Cosine(query, govec)
-				if err != nil {
-					return nil, err
-				}
-
-				absPath := filepath.Join(dirIndexAbsPath, filename)
-				result := &VectorSearchResult{
-					Score:    distance,
-					FilePath: absPath,
-					Start:    embedding.Start,
-					End:      embedding.End,
-					Vector:   embedding.Vector,
-				}
-				results = append(results, result)
-			}
-		}
-	}
-
-	sort.Slice(results, func(i, j int) bool {
-		return results[i].Score > results[j].Score
-	})
-
-	// truncate to numResults results
-	results = results[:util.Min(len(results), numResults)]
-
-	return results, nil
+	return this.searchShards(ctx, queryVector, numResults)
 }
 
 // Given an array of VectorSearchResults, fetch the file contents for each
@@ -212,67 +360,125 @@ func (this *DiskCachedEmbeddingIndex) SearchWithVector(ctx context.Context,
 func (this *DiskCachedEmbeddingIndex) PopulateSearchResults(ctx context.Context,
 	results []*VectorSearchResult) error {
 
+	// results often share a file, extract each file once
+	docs := map[string]*Document{}
+
 	for _, result := range results {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
 
-		// read the file
-		f, err := this.Fs.Open(result.FilePath)
+		var content []byte
+		var err error
+		if extractor := this.extractorFor(result.FilePath); extractor != nil {
+			content, err = this.readExtractedRange(extractor, docs, result.FilePath, result.Start, result.End)
+		} else {
+			content, err = this.readRange(result.FilePath, result.Start, result.End)
+		}
 		if err != nil {
 			return err
 		}
-		defer f.Close()
 
-		start := result.Start
-		end := result.End
+		result.Content = string(content)
+	}
+
+	return nil
+}
 
-		// seek to the start byte
-		_, err = f.Seek(int64(start), 0)
+// Extract the text of the file at path and return the bytes between start
+// and end, for files where the stored ranges refer to extracted text. The
+// extracted document is kept in docs for later results from the same file.
+func (this *DiskCachedEmbeddingIndex) readExtractedRange(extractor DocumentExtractor,
+	docs map[string]*Document, path string, start, end uint64) ([]byte, error) {
+	doc, ok := docs[path]
+	if !ok {
+		data, err := afero.ReadFile(this.Fs, path)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		// read the chunk
-		buf := make([]byte, end-start)
-		_, err = f.Read(buf)
+		doc, err = extractor.Extract(data)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		docs[path] = doc
+	}
 
-		result.Content = string(buf)
+	if end < start || end > uint64(len(doc.Text)) {
+		return nil, fmt.Errorf("Invalid byte range %d-%d for %s, the file may have changed since it was indexed", start, end, path)
 	}
 
-	return nil
+	return []byte(doc.Text[start:end]), nil
+}
+
+// Read the bytes between start and end from the file at path, this is used
+// to recover the snippet that a stored vector was calculated from
+func (this *DiskCachedEmbeddingIndex) readRange(path string, start, end uint64) ([]byte, error) {
+	if end < start {
+		return nil, fmt.Errorf("Invalid byte range %d-%d for %s", start, end, path)
+	}
+
+	f, err := this.Fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(int64(start), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, end-start)
+	_, err = io.ReadFull(f, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
 }
 
-// Assumes the path is a valid butterfish index file
+// Assumes the path is a valid butterfish index file. With LazyLoad the file
+// is only registered here and is read when a search reaches it.
 func (this *DiskCachedEmbeddingIndex) LoadDotfile(dotfile string) error {
 	dotfile = filepath.Clean(dotfile)
+	this.invalidateANN()
 
 	if this.Verbosity >= 2 {
 		fmt.Fprintf(this.Out, "DiskCachedEmbeddingIndex.LoadDotfile(%s)\n", dotfile)
 	}
 
-	// Read the entire dotfile into a bytes buffer
-	file, err := this.Fs.Open(dotfile)
-	if err != nil {
+	if this.LazyLoad {
+		absPath, err := filepath.Abs(dotfile)
+		if err != nil {
+			return err
+		}
+		indexName := filepath.Dir(absPath)
+		if _, ok := this.Index[indexName]; !ok {
+			if this.unloaded == nil {
+				this.unloaded = make(map[string]string)
+			}
+			this.unloaded[indexName] = absPath
+		}
 		return nil
 	}
-	defer file.Close()
 
-	// Read the entire file into a buffer
-	buf, err := ioutil.ReadAll(file)
-	if err != nil {
-		return err
-	}
+	return this.loadDotfile(dotfile)
+}
 
-	// Unmarshal the buffer into a DirectoryIndex
-	var dirIndex pb.DirectoryIndex
-	err = proto.Unmarshal(buf, &dirIndex)
+// Read a cache file into the in-memory index
+func (this *DiskCachedEmbeddingIndex) loadDotfile(dotfile string) error {
+	dirIndex, reason, err := this.readDotfile(dotfile, true)
 	if err != nil {
 		return err
 	}
+	if reason != "" {
+		fmt.Fprintf(this.Out, "Ignoring index cache at %s, it %s, files will be embedded again\n", dotfile, reason)
+		return nil
+	}
+	if dirIndex == nil {
+		return nil
+	}
 
 	absPath, err := filepath.Abs(dotfile)
 	if err != nil {
@@ -281,7 +487,8 @@ func (this *DiskCachedEmbeddingIndex) LoadDotfile(dotfile string) error {
 	indexName := filepath.Dir(absPath)
 
 	// put the loaded info in the memory index
-	this.Index[indexName] = &dirIndex
+	this.Index[indexName] = dirIndex
+	delete(this.unloaded, indexName)
 
 	if this.Verbosity >= 1 {
 		fmt.Fprintf(this.Out, "Loaded index cache at %s\n", dotfile)
@@ -299,11 +506,17 @@ func (this *DiskCachedEmbeddingIndex) SavePaths(paths []string) error {
 	return nil
 }
 
+// SavePath writes the index for a directory to its cache file. It does
+// nothing unless CacheMode is CacheReadWrite.
 func (this *DiskCachedEmbeddingIndex) SavePath(path string) error {
 	if this.Verbosity >= 2 {
 		fmt.Fprintf(this.Out, "DiskCachedEmbeddingIndex.SavePath(%s)\n", path)
 	}
 
+	if this.CacheMode != CacheReadWrite {
+		return nil
+	}
+
 	path = filepath.Clean(path)
 
 	// Marshal the index into a buffer, i.e. serialize in-memory protobuf
@@ -322,7 +535,7 @@ func (this *DiskCachedEmbeddingIndex) SavePath(path string) error {
 		panic("DotfileName not set")
 	}
 
-	dotfilePath := filepath.Join(path, this.DotfileName)
+	dotfilePath := filepath.Join(path, this.dotfileName())
 	if this.Verbosity >= 2 {
 		fmt.Fprintf(this.Out, "Writing index cache to %s\n", dotfilePath)
 	}
@@ -333,17 +546,81 @@ func (this *DiskCachedEmbeddingIndex) SavePath(path string) error {
 		return err
 	}
 
+	delete(this.dirty, path)
+
 	if this.Verbosity >= 1 {
 		fmt.Fprintf(this.Out, "Saved index cache to %s\n", dotfilePath)
 	}
 	return nil
 }
 
+// SaveDirty saves directories with embeddings that haven't been written to
+// disk yet, it does nothing if the index is already saved
+func (this *DiskCachedEmbeddingIndex) SaveDirty() error {
+	paths := make([]string, 0, len(this.dirty))
+	for path := range this.dirty {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return this.SavePaths(paths)
+}
+
+// LoadPath loads the cache files in a path and its subdirectories into
+// memory. It does nothing if CacheMode is CacheOff.
 func (this *DiskCachedEmbeddingIndex) LoadPath(ctx context.Context, path string) error {
+	return this.LoadPaths(ctx, []string{path}, nil)
+}
+
+// LoadPaths loads the cache files in each path like LoadPath. If progress is
+// set it's called after each cache file is loaded. If ctx is canceled part
+// way through then the files loaded so far stay in the index.
+func (this *DiskCachedEmbeddingIndex) LoadPaths(ctx context.Context, paths []string, progress ProgressFunc) error {
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
+	if this.CacheMode == CacheOff {
+		return nil
+	}
+
+	dotfiles := []string{}
+	for _, path := range paths {
+		pathDotfiles, err := this.dotfilesForLoad(ctx, path)
+		if err != nil {
+			return err
+		}
+		dotfiles = append(dotfiles, pathDotfiles...)
+	}
+
+	for i, dotfile := range dotfiles {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := this.LoadDotfile(dotfile)
+		if err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(i+1, len(dotfiles))
+		}
+	}
+
+	// build the approximate search graph now rather than on the first
+	// search, unless loading is lazy
+	if !this.LazyLoad {
+		_, err := this.annGraph(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
+// Find the cache files to load for a path, if the path is a file then we
+// load the cache files from its directory
+func (this *DiskCachedEmbeddingIndex) dotfilesForLoad(ctx context.Context, path string) ([]string, error) {
 	if this.Verbosity >= 2 {
 		fmt.Fprintf(this.Out, "DiskCachedEmbeddingIndex.Load(%s)\n", path)
 	}
@@ -352,7 +629,7 @@ func (this *DiskCachedEmbeddingIndex) LoadPath(ctx context.Context, path string)
 	path = filepath.Clean(path)
 	fileInfo, err := this.Fs.Stat(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// If the path is a file then find its parent directory
@@ -361,40 +638,59 @@ func (this *DiskCachedEmbeddingIndex) LoadPath(ctx context.Context, path string)
 		dirPath = filepath.Dir(path)
 	}
 
-	dotfiles, err := this.dotfilesInPath(ctx, dirPath)
+	return this.dotfilesInPath(ctx, dirPath)
+}
+
+// IndexPaths walks each path to find the files that need embedding, embeds
+// them concurrently, then saves the updated directory indexes.
+func (this *DiskCachedEmbeddingIndex) IndexPaths(ctx context.Context, paths []string, forceUpdate bool, chunkSize, maxChunks int) error {
+	// embedding compares against what's already indexed, e.g. to find
+	// unchanged files and duplicate chunks
+	err := this.loadUnloaded()
 	if err != nil {
 		return err
 	}
 
-	for _, dotfile := range dotfiles {
-		err := this.LoadDotfile(dotfile)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
+	work := &indexWork{}
 
-func (this *DiskCachedEmbeddingIndex) LoadPaths(ctx context.Context, paths []string) error {
 	for _, path := range paths {
-		err := this.LoadPath(ctx, path)
+		path, err := filepath.Abs(path)
 		if err != nil {
 			return err
 		}
-	}
 
-	return nil
-}
+		// when indexing a subdirectory of a repository, .gitignore files further
+		// up the tree still apply
+		var ignores gitignoreStack
+		if this.UseGitignore {
+			ignores = ancestorGitignores(this.Fs, path)
+		}
 
-func (this *DiskCachedEmbeddingIndex) IndexPaths(ctx context.Context, paths []string, forceUpdate bool, chunkSize, maxChunks int) error {
-	for _, path := range paths {
-		err := this.IndexPath(ctx, path, forceUpdate, chunkSize, maxChunks)
+		err = this.indexPath(ctx, path, forceUpdate, ignores, work)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	// files embedded again may no longer have the chunks that others were
+	// collapsed into, so those others need embedding again too
+	replaced := map[string]bool{}
+	for _, job := range work.files {
+		if _, ok := job.dirIndex.Files[job.name]; ok {
+			replaced[filepath.Join(job.dirPath, job.name)] = true
+		}
+	}
+
+	err = this.embedFiles(ctx, work, chunkSize, maxChunks)
+	if err != nil {
+		return err
+	}
+
+	orphaned := this.orphanedWork(work, replaced)
+	if len(orphaned.files) == 0 {
+		return nil
+	}
+	return this.embedFiles(ctx, orphaned, chunkSize, maxChunks)
 }
 
 // This is a bit of glue to make afero filesystems work with the vfs interface
@@ -406,45 +702,128 @@ func (this *vfsOpener) Open(path string) (vfs.ReadSeekCloser, error) {
 	return this.fs.Open(path)
 }
 
-// Return true if this is a file we want to index/embed. We use several
-// predicates to determine this.
+// Return true if this is a file we want to index/embed, see skipReason for
+// the predicates we check.
+func (this *DiskCachedEmbeddingIndex) IndexableFile(path string, file os.FileInfo, forceUpdate bool, previousEmbeddings *pb.FileEmbeddings) bool {
+	return this.skipReason(path, file, forceUpdate, previousEmbeddings) == ""
+}
+
+// Return why a file should not be indexed, or an empty string if it should.
+// We use several predicates to determine this.
 // 1. The file must be a non-hidden file (i.e. not starting with a dot)
 // 2. The file must not be a directory (handled separately)
-// 3. The file must be text, not binary, checked by extension/mime-type and
-//    by checking the first few bytes of the file if the extension check passes
-// 4. The file must have been updated since the last indexing, unless forceUpdate is true
-func (this *DiskCachedEmbeddingIndex) IndexableFile(path string, file os.FileInfo, forceUpdate bool, previousEmbeddings *pb.FileEmbeddings) bool {
+// 3. The file must be no larger than MaxFileSize, and have one of the
+//    Extensions, if set
+// 4. The file must be text, not binary, checked by extension/mime-type and
+//    by checking the first few KB of the file if the extension check passes,
+//    unless there's an extractor for the file's extension
+// 5. The file must have been updated since the last indexing, unless forceUpdate is true
+func (this *DiskCachedEmbeddingIndex) skipReason(path string, file os.FileInfo, forceUpdate bool, previousEmbeddings *pb.FileEmbeddings) string {
 	// Ignore dotfiles/hidden files
 	name := file.Name()
 	if name[0] == '.' {
-		return false
+		return "hidden file"
 	}
 
+	// Files we extract text from can be any format, e.g. PDFs
+	extracted := this.extractorFor(name) != nil
+
 	// Ignore files that are not text based on file name
 	mimeType := mime.TypeByExtension(filepath.Ext(name))
-	if mimeType != "" && !strings.HasPrefix(mimeType, "text/") {
-		return false
+	if !extracted && mimeType != "" && !strings.HasPrefix(mimeType, "text/") {
+		return "not a text file type (" + mimeType + ")"
 	}
 
 	// Ignore files in the disallow list
 	if contains(this.IgnoreFiles, name) {
-		return false
+		return "in the ignored files list"
+	}
+
+	// Ignore files without one of the configured extensions
+	if len(this.Extensions) > 0 && !this.hasIndexedExtension(name) {
+		return "not an indexed extension"
+	}
+
+	// Ignore files that are too big, e.g. generated code, minified bundles,
+	// and lockfiles, which waste embedding tokens
+	if this.MaxFileSize > 0 && file.Size() > this.MaxFileSize {
+		return fmt.Sprintf("larger than the max file size (%d > %d bytes)", file.Size(), this.MaxFileSize)
 	}
 
 	// Ignore files that are not text based on a content check
-	opener := &vfsOpener{this.Fs}
-	if !fsutil.IsTextFile(opener, filepath.Join(path, name)) {
-		return false
+	filePath := filepath.Join(path, name)
+	if !extracted {
+		opener := &vfsOpener{this.Fs}
+		if !fsutil.IsTextFile(opener, filePath) {
+			return "binary content"
+		}
+		binary, err := this.looksBinary(filePath)
+		if err != nil {
+			return fmt.Sprintf("could not read file (%s)", err)
+		}
+		if binary {
+			return "binary content"
+		}
 	}
 
 	if !forceUpdate && previousEmbeddings != nil {
-		// Ignore files that have not changed since the last indexing
-		if previousEmbeddings.UpdatedAt.AsTime().Unix() >= file.ModTime().Unix() {
-			return false
+		// Ignore files that have not changed since the last indexing, unless
+		// some of their chunks can no longer be found by searching
+		if previousEmbeddings.UpdatedAt.AsTime().Unix() >= file.ModTime().Unix() &&
+			!this.hasOrphanedAlias(previousEmbeddings) {
+			return "unchanged since last indexed"
 		}
 	}
 
-	return true
+	return ""
+}
+
+func (this *DiskCachedEmbeddingIndex) hasIndexedExtension(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, indexed := range this.Extensions {
+		if !strings.HasPrefix(indexed, ".") {
+			indexed = "." + indexed
+		}
+		if strings.ToLower(indexed) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of bytes at the start of a file we check for binary content
+const binarySniffSize = 8192
+
+// IsTextFile trusts known text extensions and only looks at the first 1KB,
+// so we do a stricter check on more of the file: text files shouldn't
+// contain NUL bytes and should be valid UTF-8.
+func (this *DiskCachedEmbeddingIndex) looksBinary(path string) (bool, error) {
+	file, err := this.Fs.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, binarySniffSize)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	buf = buf[:n]
+
+	if bytes.IndexByte(buf, 0) != -1 {
+		return true, nil
+	}
+
+	// the sniff may have cut a multi-byte character in half, so allow up to
+	// 3 trailing bytes that don't form a complete rune
+	if n == binarySniffSize {
+		for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(buf); i++ {
+			buf = buf[:len(buf)-1]
+		}
+	}
+
+	return !utf8.Valid(buf), nil
 }
 
 // check if a string array contains a string
@@ -474,8 +853,11 @@ func (this *DiskCachedEmbeddingIndex) FilterUnindexablefiles(path string, files
 		}
 
 		previousEmbeddings := dirIndex.Files[file.Name()]
-		if this.IndexableFile(path, file, forceUpdate, previousEmbeddings) {
+		reason := this.skipReason(path, file, forceUpdate, previousEmbeddings)
+		if reason == "" {
 			filteredFiles = append(filteredFiles, file)
+		} else if this.Verbosity >= 2 {
+			fmt.Fprintf(this.Out, "Ignored %s: %s\n", filepath.Join(path, file.Name()), reason)
 		} else {
 			fmt.Fprintf(this.Out, "Ignored %s\n", filepath.Join(path, file.Name()))
 		}
@@ -499,7 +881,7 @@ func (this *DiskCachedEmbeddingIndex) dotfilesInPath(ctx context.Context, path s
 			return err
 		}
 
-		if info.Name() == this.DotfileName {
+		if info.Name() == this.dotfileName() {
 			dotfiles = append(dotfiles, path)
 		}
 		return nil
@@ -520,13 +902,31 @@ func (this *DiskCachedEmbeddingIndex) ClearPaths(ctx context.Context, paths []st
 
 // Clear out embeddings at a given path, both in memory and on disk
 // We do this by first locating all dotfiles in the path, then deleting
-// the in-memory copy, and finally deleting the dotfiles
+// the in-memory copy, and finally deleting the dotfiles. Unless CacheMode is
+// CacheReadWrite only the in-memory copy is cleared.
 func (this *DiskCachedEmbeddingIndex) ClearPath(ctx context.Context, path string) error {
 	path, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
 
+	this.invalidateANN()
+
+	for dirPath := range this.unloaded {
+		if dirPath == path || strings.HasPrefix(dirPath, path+string(filepath.Separator)) {
+			delete(this.unloaded, dirPath)
+		}
+	}
+
+	if this.CacheMode != CacheReadWrite {
+		for dirPath := range this.Index {
+			if dirPath == path || strings.HasPrefix(dirPath, path+string(filepath.Separator)) {
+				delete(this.Index, dirPath)
+			}
+		}
+		return nil
+	}
+
 	dotfiles, err := this.dotfilesInPath(ctx, path)
 	if err != nil {
 		return err
@@ -545,12 +945,15 @@ func (this *DiskCachedEmbeddingIndex) ClearPath(ctx context.Context, path string
 		// Remove the in-memory copy
 		dirPath := filepath.Dir(dotfile)
 		delete(this.Index, dirPath)
+		delete(this.dirty, dirPath)
 	}
 
 	return nil
 }
 
 func (this *DiskCachedEmbeddingIndex) IndexedFiles() []string {
+	this.mustLoadUnloaded()
+
 	var paths []string
 	for path, dirIndex := range this.Index {
 		for name := range dirIndex.Files {
@@ -560,6 +963,51 @@ func (this *DiskCachedEmbeddingIndex) IndexedFiles() []string {
 	return paths
 }
 
+// Explain why a directory index can't be used with this one, e.g. because
+// it was built with a different model, or return an empty string if it can.
+// Indexes that don't record a model or dimensions are assumed compatible.
+// If checkDimensions is set then the directory's vectors must also be the
+// same length as those already in the index.
+func (this *DiskCachedEmbeddingIndex) incompatibleReason(dirIndex *pb.DirectoryIndex, checkDimensions bool) string {
+	if this.EmbeddingModel != "" && dirIndex.EmbeddingModel != "" &&
+		dirIndex.EmbeddingModel != this.EmbeddingModel {
+		return fmt.Sprintf("was built with model %s rather than %s", dirIndex.EmbeddingModel, this.EmbeddingModel)
+	}
+
+	if checkDimensions && dirIndex.Dimensions != 0 {
+		dimensions := this.Dimensions()
+		if dimensions != 0 && int(dirIndex.Dimensions) != dimensions {
+			return fmt.Sprintf("has %d dimensional vectors rather than %d", dirIndex.Dimensions, dimensions)
+		}
+	}
+
+	return ""
+}
+
+// Dimensions returns the length of the vectors currently held in the index,
+// or 0 if the index is empty
+func (this *DiskCachedEmbeddingIndex) Dimensions() int {
+	for _, dirIndex := range this.Index {
+		for _, fileIndex := range dirIndex.Files {
+			for _, embedding := range fileIndex.Embeddings {
+				if !isAlias(embedding) {
+					return embeddingDimensions(embedding)
+				}
+			}
+		}
+	}
+
+	return 0
+}
+
+func (this *DiskCachedEmbeddingIndex) printGitignored(path string) {
+	if this.Verbosity >= 2 {
+		fmt.Fprintf(this.Out, "Ignored %s: matched .gitignore\n", path)
+	} else {
+		fmt.Fprintf(this.Out, "Ignored %s\n", path)
+	}
+}
+
 func NewDirectoryIndex() *pb.DirectoryIndex {
 	return &pb.DirectoryIndex{
 		Files: make(map[string]*pb.FileEmbeddings),
@@ -569,19 +1017,109 @@ func NewDirectoryIndex() *pb.DirectoryIndex {
 // Force means that we will re-index the file even if the target file hasn't
 // changed since the last index
 func (this *DiskCachedEmbeddingIndex) IndexPath(ctx context.Context, path string, forceUpdate bool, chunkSize, maxChunks int) error {
+	return this.IndexPaths(ctx, []string{path}, forceUpdate, chunkSize, maxChunks)
+}
+
+// ListIndexableFiles returns the absolute paths of the files under path that
+// indexing would embed, applying the same directory, .gitignore, size, and
+// binary content filters but ignoring whether a file is already indexed.
+// Paths are sorted.
+func (this *DiskCachedEmbeddingIndex) ListIndexableFiles(ctx context.Context, path string) ([]string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ignores gitignoreStack
+	if this.UseGitignore {
+		ignores = ancestorGitignores(this.Fs, path)
+	}
+
+	files := []string{}
+	err = this.listIndexableFiles(ctx, path, ignores, &files)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+func (this *DiskCachedEmbeddingIndex) listIndexableFiles(ctx context.Context, path string, ignores gitignoreStack, files *[]string) error {
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
 
-	if this.Verbosity >= 2 {
-		fmt.Fprintf(this.Out, "DiskCachedEmbeddingIndex.IndexPath(%s)\n", path)
+	fileInfo, err := this.Fs.Stat(path)
+	if err != nil {
+		return err
 	}
 
-	path, err := filepath.Abs(path)
+	if !fileInfo.IsDir() {
+		if this.skipReason(filepath.Dir(path), fileInfo, true, nil) == "" {
+			*files = append(*files, path)
+		}
+		return nil
+	}
+
+	if this.UseGitignore {
+		ignores = ignores.push(this.Fs, path)
+	}
+
+	entries, err := afero.ReadDir(this.Fs, path)
 	if err != nil {
 		return err
 	}
 
+	for _, entry := range entries {
+		entryPath := filepath.Join(path, entry.Name())
+		if ignores.Ignored(entryPath, entry.IsDir()) {
+			continue
+		}
+
+		if entry.IsDir() {
+			if !this.IndexableDirectory(entryPath) {
+				continue
+			}
+			err := this.listIndexableFiles(ctx, entryPath, ignores, files)
+			if err != nil {
+				return err
+			}
+		} else if this.skipReason(path, entry, true, nil) == "" {
+			*files = append(*files, entryPath)
+		}
+	}
+
+	return nil
+}
+
+// A file found while walking the paths to index which needs to be embedded
+type embedJob struct {
+	dirIndex *pb.DirectoryIndex
+	dirPath  string
+	name     string
+}
+
+// Files to embed and directories to save, collected by indexPath
+type indexWork struct {
+	dirs  []string
+	files []*embedJob
+	// embed every chunk rather than taking vectors from the shared cache,
+	// replacing its entries
+	refreshShared bool
+}
+
+// indexPath walks the path and adds files that need embedding to work, it
+// doesn't call the embedder itself
+func (this *DiskCachedEmbeddingIndex) indexPath(ctx context.Context, path string, forceUpdate bool, ignores gitignoreStack, work *indexWork) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if this.Verbosity >= 2 {
+		fmt.Fprintf(this.Out, "DiskCachedEmbeddingIndex.IndexPath(%s)\n", path)
+	}
+
 	fileInfo, err := this.Fs.Stat(path)
 	if err != nil {
 		return err
@@ -597,15 +1135,22 @@ func (this *DiskCachedEmbeddingIndex) IndexPath(ctx context.Context, path string
 	} else {
 		// if the path is a directory then we add all files to update list
 		dirPath = path
+		if this.UseGitignore {
+			ignores = ignores.push(this.Fs, path)
+		}
 
 		// call UpdatePath recursively for each subdirectory
 		err = util.ForEachSubdir(this.Fs, path, func(path string) error {
-			if this.IndexableDirectory(path) {
-				return this.IndexPath(ctx, path, forceUpdate, chunkSize, maxChunks)
+			if !this.IndexableDirectory(path) {
+				fmt.Fprintf(this.Out, "Ignored %s\n", path)
+				return nil
+			}
+			if ignores.Ignored(path, true) {
+				this.printGitignored(path)
+				return nil
 			}
 
-			fmt.Fprintf(this.Out, "Ignored %s\n", path)
-			return nil
+			return this.indexPath(ctx, path, forceUpdate, ignores, work)
 		})
 
 		// get each non-directory file and stat in the path
@@ -613,49 +1158,228 @@ func (this *DiskCachedEmbeddingIndex) IndexPath(ctx context.Context, path string
 		if err != nil {
 			return nil
 		}
+
+		var notIgnored []os.FileInfo
+		for _, file := range files {
+			filePath := filepath.Join(path, file.Name())
+			if !file.IsDir() && ignores.Ignored(filePath, false) {
+				this.printGitignored(filePath)
+				continue
+			}
+			notIgnored = append(notIgnored, file)
+		}
+		files = notIgnored
 	}
 
-	// Fetch directory index, create a new one if none found
+	// Fetch directory index, create a new one if none found or if the one we
+	// have is from a different model
 	dirIndex, ok := this.Index[dirPath]
+	if ok {
+		if reason := this.incompatibleReason(dirIndex, false); reason != "" {
+			fmt.Fprintf(this.Out, "Index for %s %s, files will be embedded again\n", dirPath, reason)
+			ok = false
+		}
+	}
 	if !ok {
 		dirIndex = NewDirectoryIndex()
 		this.Index[dirPath] = dirIndex
+		this.invalidateANN()
 	}
 
 	files = this.FilterUnindexablefiles(dirPath, files, forceUpdate, dirIndex)
 
-	// Update the index for each file
 	for _, file := range files {
-		name := file.Name()
-		path := filepath.Join(dirPath, file.Name())
-		fileEmbeddings, err := this.EmbedFile(ctx, path, chunkSize, maxChunks)
+		work.files = append(work.files, &embedJob{
+			dirIndex: dirIndex,
+			dirPath:  dirPath,
+			name:     file.Name(),
+		})
+	}
+	work.dirs = append(work.dirs, dirPath)
+
+	return nil
+}
+
+// embedFiles embeds the collected files using a pool of Workers goroutines.
+// The first error cancels the remaining work, though files embedded before
+// then are still stored and saved. Results are stored in the order the files
+// were found rather than the order they finish, except that an auto-save
+// stores the files finished by then, see AutoSaveInterval.
+func (this *DiskCachedEmbeddingIndex) embedFiles(ctx context.Context, work *indexWork, chunkSize, maxChunks int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := this.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]*pb.FileEmbeddings, len(work.files))
+	stored := make([]bool, len(work.files))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex // guards results, stored, firstErr, done, the index, and this.Out
+	var firstErr error
+	done := 0
+
+	saver := this.newAutoSaver(&mutex, func() {
+		err := this.storeEmbedded(work, results, stored)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		err = this.SaveDirty()
 		if err != nil {
-			return err
+			fmt.Fprintf(this.Out, "Auto-saving the index failed: %s\n", err)
+		}
+	})
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				job := work.files[i]
+				path := filepath.Join(job.dirPath, job.name)
+
+				if this.Verbosity >= 1 {
+					mutex.Lock()
+					fmt.Fprintf(this.Out, "Embedding %s\n", path)
+					mutex.Unlock()
+				}
+
+				fileEmbeddings, err := this.embedFile(ctx, path, chunkSize, maxChunks, work.refreshShared)
+
+				mutex.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+				} else {
+					results[i] = fileEmbeddings
+					done++
+					fmt.Fprintf(this.Out, "Indexed %s\n", path)
+					if this.Progress != nil {
+						this.Progress(done, len(work.files))
+					}
+					if saver != nil {
+						saver.finished()
+					}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for i := range work.files {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+			break feed
 		}
+	}
+	close(queue)
+	wg.Wait()
+
+	mutex.Lock()
+	if saver != nil {
+		saver.stop()
+	}
+	mutex.Unlock()
+
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
 
-		dirIndex.Files[name] = fileEmbeddings
-		fmt.Fprintf(this.Out, "Indexed %s\n", path)
+	err := this.storeEmbedded(work, results, stored)
+	if err != nil && firstErr == nil {
+		firstErr = err
 	}
 
 	// TODO remove indexes for files that have been deleted
 
-	if len(dirIndex.Files) > 0 {
-		return this.SavePath(dirPath)
+	if this.CacheMode != CacheReadWrite {
+		return firstErr
 	}
 
-	return nil
+	for _, dirPath := range work.dirs {
+		if len(this.Index[dirPath].Files) == 0 {
+			continue
+		}
+		err := this.SavePath(dirPath)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Add embedded files that aren't stored yet to the index and mark their
+// directories dirty. Files were embedded concurrently so we check here that
+// they all agree with each other as well as with the existing index,
+// returning an error for the first that doesn't.
+func (this *DiskCachedEmbeddingIndex) storeEmbedded(work *indexWork, results []*pb.FileEmbeddings, stored []bool) error {
+	var firstErr error
+	dimensions := this.Dimensions()
+	added := []pathEmbeddings{}
+	for i, fileEmbeddings := range results {
+		if fileEmbeddings == nil || stored[i] {
+			continue
+		}
+		stored[i] = true
+		job := work.files[i]
+
+		if len(fileEmbeddings.Embeddings) > 0 {
+			fileDimensions := embeddingDimensions(fileEmbeddings.Embeddings[0])
+			if dimensions == 0 {
+				dimensions = fileDimensions
+			} else if fileDimensions != dimensions {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("Embedding dimension mismatch for %s: expected %d dimensions, got %d",
+						filepath.Join(job.dirPath, job.name), dimensions, fileDimensions)
+				}
+				continue
+			}
+		}
+
+		job.dirIndex.Files[job.name] = fileEmbeddings
+		this.invalidateANN()
+		added = append(added, pathEmbeddings{filepath.Join(job.dirPath, job.name), fileEmbeddings})
+		job.dirIndex.EmbeddingModel = this.EmbeddingModel
+		job.dirIndex.Dimensions = uint32(dimensions)
+		if this.CacheMode != CacheReadWrite {
+			continue
+		}
+		if this.dirty == nil {
+			this.dirty = make(map[string]bool)
+		}
+		this.dirty[job.dirPath] = true
+	}
+
+	if collapsed := this.dedupFiles(added); collapsed > 0 {
+		fmt.Fprintf(this.Out, "Collapsed %d duplicate chunks\n", collapsed)
+	}
+
+	return firstErr
 }
 
 // EmbedFile takes a path to a file, splits the file into chunks, and calls
 // the embedding API for each chunk
 func (this *DiskCachedEmbeddingIndex) EmbedFile(ctx context.Context, path string, chunkSize, maxChunks int) (*pb.FileEmbeddings, error) {
-	if this.Embedder == nil {
-		return nil, fmt.Errorf("No embedder set")
-	}
 	if this.Verbosity >= 1 {
 		fmt.Fprintf(this.Out, "Embedding %s\n", path)
 	}
 
+	return this.embedFile(ctx, path, chunkSize, maxChunks, false)
+}
+
+func (this *DiskCachedEmbeddingIndex) embedFile(ctx context.Context, path string, chunkSize, maxChunks int, refreshShared bool) (*pb.FileEmbeddings, error) {
+	if this.Embedder == nil {
+		return nil, fmt.Errorf("No embedder set")
+	}
+
 	annotatedVectors := []*pb.AnnotatedEmbedding{}
 
 	absPath, err := filepath.Abs(path)
@@ -669,11 +1393,27 @@ func (this *DiskCachedEmbeddingIndex) EmbedFile(ctx context.Context, path string
 	}
 
 	// first we chunk the file
-	chunks, err := util.GetFileChunks(ctx, this.Fs, absPath, chunkSize, maxChunks)
+	chunks, err := this.fileChunks(ctx, absPath, chunkSize, maxChunks)
 	if err != nil {
 		return nil, err
 	}
-	stringChunks := util.ByteToString(chunks)
+	stringChunks := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		stringChunks[i] = chunk.text
+		if chunk.heading != "" {
+			// the headings give the chunk context that its text may lack
+			stringChunks[i] = chunk.heading + "\n\n" + chunk.text
+		}
+	}
+
+	// vectors from different models can't be compared, so everything we
+	// embed must match what's already in the index
+	dimensions := this.Dimensions()
+
+	language := LanguageFor(absPath)
+	if language == "" && len(chunks) > 0 {
+		language = DetectLanguage(absPath, []byte(chunks[0].text))
+	}
 
 	// then we call the embedding API for each block of chunks
 	for i := 0; i < len(chunks); i += this.ChunksPerCall {
@@ -683,20 +1423,35 @@ func (this *DiskCachedEmbeddingIndex) EmbedFile(ctx context.Context, path string
 		}
 
 		callChunks := stringChunks[i:util.Min(i+this.ChunksPerCall, len(chunks))]
-		newEmbeddings, err := this.Embedder.CalculateEmbeddings(ctx, callChunks)
+		newEmbeddings, err := this.calculateEmbeddings(ctx, callChunks, dimensions, refreshShared)
 		if err != nil {
 			return nil, err
 		}
+		if len(newEmbeddings) != len(callChunks) {
+			return nil, fmt.Errorf("Embedding %s returned %d vectors for %d chunks", path, len(newEmbeddings), len(callChunks))
+		}
 
 		// iterate through response, create an annotation, and create an annotated vector
 		for j, embedding := range newEmbeddings {
-			rangeStart := uint64(i+j) * uint64(chunkSize)
-			rangeEnd := rangeStart + uint64(len(callChunks[j]))
+			if len(embedding) == 0 {
+				return nil, fmt.Errorf("Embedding %s returned an empty vector", path)
+			}
+			if dimensions == 0 {
+				dimensions = len(embedding)
+			} else if len(embedding) != dimensions {
+				return nil, fmt.Errorf("Embedding dimension mismatch for %s: expected %d dimensions, got %d", path, dimensions, len(embedding))
+			}
 
+			chunk := chunks[i+j]
 			av := &pb.AnnotatedEmbedding{
-				Start:  rangeStart,
-				End:    rangeEnd,
-				Vector: embedding,
+				Start:    chunk.start,
+				End:      chunk.end,
+				Vector:   embedding,
+				Heading:  chunk.heading,
+				Language: language,
+			}
+			if this.Quantize {
+				quantizeEmbedding(av)
 			}
 			annotatedVectors = append(annotatedVectors, av)
 		}
@@ -710,3 +1465,57 @@ func (this *DiskCachedEmbeddingIndex) EmbedFile(ctx context.Context, path string
 
 	return fileEmbeddings, nil
 }
+
+// A chunk of a file to embed, start and end are byte offsets into the file,
+// or into the extracted text for files with an extractor
+type fileChunk struct {
+	text    string
+	heading string
+	start   uint64
+	end     uint64
+}
+
+// Split a file into chunks, using the extractor for its extension if there
+// is one and otherwise cutting the raw file into chunkSize pieces
+func (this *DiskCachedEmbeddingIndex) fileChunks(ctx context.Context, path string, chunkSize, maxChunks int) ([]fileChunk, error) {
+	extractor := this.extractorFor(path)
+	if extractor == nil {
+		byteChunks, err := util.GetFileChunks(ctx, this.Fs, path, chunkSize, maxChunks)
+		if err != nil {
+			return nil, err
+		}
+
+		chunks := make([]fileChunk, len(byteChunks))
+		for i, chunk := range byteChunks {
+			start := uint64(i) * uint64(chunkSize)
+			chunks[i] = fileChunk{
+				text:  string(chunk),
+				start: start,
+				end:   start + uint64(len(chunk)),
+			}
+		}
+		return chunks, nil
+	}
+
+	data, err := afero.ReadFile(this.Fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := extractor.Extract(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to extract text from %s: %w", path, err)
+	}
+
+	docChunks := chunkDocument(doc, chunkSize, maxChunks)
+	chunks := make([]fileChunk, len(docChunks))
+	for i, chunk := range docChunks {
+		chunks[i] = fileChunk{
+			text:    doc.Text[chunk.Start:chunk.End],
+			heading: chunk.Heading,
+			start:   uint64(chunk.Start),
+			end:     uint64(chunk.End),
+		}
+	}
+	return chunks, nil
+}
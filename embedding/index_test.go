@@ -2,12 +2,23 @@ package embedding
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	pb "github.com/bakks/butterfish/proto"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
 )
 
 // A basic check to make sure vector comparisons are working
@@ -58,20 +69,29 @@ func TestSearch(t *testing.T) {
 	assert.Equal(t, uint64(0), results[0].Start)
 }
 
-// A mock embedder that implements the Embedder interface
+// A mock embedder that implements the Embedder interface, Vector replaces
+// the default one-hot vectors when set
 type mockEmbedder struct {
-	Calls int
+	Vector func(str string) []float32
+	Calls  int
+	mutex  sync.Mutex
 }
 
 func (this *mockEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
 	embeddings := make([][]float32, len(content))
 	for i, str := range content {
+		if this.Vector != nil {
+			embeddings[i] = this.Vector(str)
+			continue
+		}
 		// create a fake embedding of the ascii values of the first 5 chars
 		embeddings[i] = make([]float32, 128)
 		embeddings[i][int(str[0])] = 1
 	}
 
+	this.mutex.Lock()
 	this.Calls++
+	this.mutex.Unlock()
 
 	return embeddings, nil
 }
@@ -172,3 +192,1614 @@ func TestFileCaching(t *testing.T) {
 
 	// TODO test showindexed
 }
+
+// An embedder that maps text onto a fixed vocabulary, each dimension is the
+// number of times the corresponding keyword appears. This gives deterministic
+// vectors that still rank by topic.
+type keywordEmbedder struct {
+	Keywords []string
+}
+
+func (this *keywordEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(content))
+	for i, str := range content {
+		embeddings[i] = make([]float32, len(this.Keywords))
+		for j, keyword := range this.Keywords {
+			embeddings[i][j] = float32(strings.Count(str, keyword))
+		}
+	}
+
+	return embeddings, nil
+}
+
+// Index a small corpus and make sure search results carry the right
+// snippet, byte range, and score
+func TestSearchFixtureCorpus(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	// each line is exactly 16 bytes so it lines up with the chunk size
+	err := afero.WriteFile(fs, "/corpus/fruit.txt",
+		[]byte("apple apple pie\nbanana bread...\ncherry tart....\n"), 0644)
+	assert.NoError(t, err)
+	err = afero.WriteFile(fs, "/corpus/veg.txt",
+		[]byte("carrot soup....\n"), 0644)
+	assert.NoError(t, err)
+
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.Embedder = &keywordEmbedder{
+		Keywords: []string{"apple", "banana", "cherry", "carrot"},
+	}
+	ctx := context.Background()
+
+	err = index.IndexPath(ctx, "/corpus", false, 16, 8)
+	assert.NoError(t, err)
+
+	results, err := index.Search(ctx, "banana", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, "/corpus/fruit.txt", results[0].FilePath)
+	assert.Equal(t, "banana bread...\n", results[0].Content)
+	assert.Equal(t, uint64(16), results[0].Start)
+	assert.Equal(t, uint64(32), results[0].End)
+	assert.InDelta(t, 1.0, results[0].Score, 0.0001)
+	assert.InDelta(t, 0.0, results[1].Score, 0.0001)
+
+	results, err = index.Search(ctx, "carrot and apple", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(results))
+	assert.InDelta(t, results[0].Score, results[1].Score, 0.0001)
+	assert.Greater(t, results[1].Score, results[2].Score)
+	for _, result := range results[:2] {
+		switch result.FilePath {
+		case "/corpus/fruit.txt":
+			assert.Equal(t, "apple apple pie\n", result.Content)
+			assert.Equal(t, uint64(0), result.Start)
+		case "/corpus/veg.txt":
+			assert.Equal(t, "carrot soup....\n", result.Content)
+			assert.Equal(t, uint64(16), result.End)
+		default:
+			t.Errorf("Unexpected result %s", result.FilePath)
+		}
+	}
+}
+
+// An embedder that returns vectors of a fixed size, simulating a model
+// swap between indexing runs
+type fixedSizeEmbedder struct {
+	Size int
+}
+
+func (this *fixedSizeEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(content))
+	for i := range content {
+		embeddings[i] = make([]float32, this.Size)
+		embeddings[i][i%this.Size] = 1
+	}
+	return embeddings, nil
+}
+
+func TestDimensionMismatch(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	ctx := context.Background()
+
+	index.Embedder = &fixedSizeEmbedder{Size: 8}
+	err := index.IndexPath(ctx, "/a/b/c", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, index.Dimensions())
+
+	results, err := index.Search(ctx, "444", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	// a different model produces vectors we refuse to mix in
+	index.Embedder = &fixedSizeEmbedder{Size: 4}
+	err = index.IndexPath(ctx, "/a/b/nine", false, 512, 8)
+	assert.ErrorContains(t, err, "dimension mismatch")
+
+	_, err = index.Search(ctx, "444", 1)
+	assert.ErrorContains(t, err, "dimension mismatch")
+}
+
+// Read the model and dimensions recorded in a directory's cache file
+func readCacheMetadata(t *testing.T, fs afero.Fs, path string) (string, uint32) {
+	buf, err := afero.ReadFile(fs, path)
+	assert.NoError(t, err)
+	dirIndex := &pb.DirectoryIndex{}
+	assert.NoError(t, proto.Unmarshal(buf, dirIndex))
+	return dirIndex.EmbeddingModel, dirIndex.Dimensions
+}
+
+// Switching the embedding model ignores caches from the old model and embeds
+// every file again rather than mixing vectors
+func TestEmbeddingModelSwitch(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, embedder := newTestDiskCachedEmbeddingIndex(fs)
+	index.EmbeddingModel = "model-a"
+	ctx := context.Background()
+
+	err := index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, embedder.Calls)
+	model, dimensions := readCacheMetadata(t, fs, "/a/b/.butterfish_index")
+	assert.Equal(t, "model-a", model)
+	assert.Equal(t, uint32(128), dimensions)
+
+	// the same model uses the cache
+	same, embedder := newTestDiskCachedEmbeddingIndex(fs)
+	same.EmbeddingModel = "model-a"
+	assert.NoError(t, same.LoadPath(ctx, "/a"))
+	assert.NoError(t, same.IndexPath(ctx, "/a", false, 512, 8))
+	assert.Equal(t, 0, embedder.Calls)
+	assert.Equal(t, 4, len(same.IndexedFiles()))
+
+	// a different model ignores the cache and re-embeds everything
+	out := &strings.Builder{}
+	other, _ := newTestDiskCachedEmbeddingIndex(fs)
+	other.Out = out
+	other.EmbeddingModel = "model-b"
+	other.Embedder = &fixedSizeEmbedder{Size: 4}
+	assert.NoError(t, other.LoadPath(ctx, "/a"))
+	assert.Equal(t, 0, len(other.IndexedFiles()))
+	assert.Contains(t, out.String(), "was built with model model-a rather than model-b")
+
+	assert.NoError(t, other.IndexPath(ctx, "/a", false, 512, 8))
+	assert.Equal(t, 4, len(other.IndexedFiles()))
+	assert.Equal(t, 4, other.Dimensions())
+	model, dimensions = readCacheMetadata(t, fs, "/a/b/.butterfish_index")
+	assert.Equal(t, "model-b", model)
+	assert.Equal(t, uint32(4), dimensions)
+
+	results, err := other.Search(ctx, "444", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+
+	// switching the model of an index in memory re-embeds too
+	same.EmbeddingModel = "model-c"
+	same.Embedder = embedder
+	assert.NoError(t, same.IndexPath(ctx, "/a", false, 512, 8))
+	assert.Equal(t, 4, embedder.Calls)
+}
+
+// An embedder that returns the same vectors regardless of its input
+type cannedEmbedder struct {
+	Vectors [][]float32
+}
+
+func (this *cannedEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
+	return this.Vectors, nil
+}
+
+// Embedders must return one non-empty vector for each chunk
+func TestEmbeddingResultValidation(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/a/one", []byte("111111"), 0644))
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	ctx := context.Background()
+
+	index.Embedder = &cannedEmbedder{Vectors: [][]float32{{1, 0}}}
+	_, err := index.EmbedFile(ctx, "/a/one", 2, 8)
+	assert.ErrorContains(t, err, "returned 1 vectors for 3 chunks")
+
+	index.Embedder = &cannedEmbedder{Vectors: [][]float32{{}}}
+	_, err = index.EmbedFile(ctx, "/a/one", 512, 8)
+	assert.ErrorContains(t, err, "returned an empty vector")
+}
+
+// Save the index to a single file, load it into a fresh index, and make sure
+// search results are identical
+func TestSnapshotRoundTrip(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.EmbeddingModel = "test-model"
+	ctx := context.Background()
+
+	err := index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+	before, err := index.Search(ctx, "222", 4)
+	assert.NoError(t, err)
+
+	err = index.Save("/index.snapshot")
+	assert.NoError(t, err)
+
+	loaded, _ := newTestDiskCachedEmbeddingIndex(fs)
+	loaded.EmbeddingModel = "test-model"
+	err = loaded.Load("/index.snapshot")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, index.IndexedFiles(), loaded.IndexedFiles())
+
+	after, err := loaded.Search(ctx, "222", 4)
+	assert.NoError(t, err)
+	assert.Equal(t, len(before), len(after))
+	assert.Equal(t, "/a/two", after[0].FilePath)
+	// results with equal scores may come back in any order
+	for _, want := range before {
+		found := false
+		for _, got := range after {
+			if got.FilePath == want.FilePath && got.Start == want.Start {
+				assert.Equal(t, want.End, got.End)
+				assert.Equal(t, want.Score, got.Score)
+				assert.Equal(t, want.Content, got.Content)
+				found = true
+			}
+		}
+		assert.True(t, found, want.FilePath)
+	}
+
+	// a snapshot from another model is refused
+	other, _ := newTestDiskCachedEmbeddingIndex(fs)
+	other.EmbeddingModel = "other-model"
+	err = other.Load("/index.snapshot")
+	assert.ErrorContains(t, err, "other-model")
+	assert.Equal(t, 0, len(other.IndexedFiles()))
+
+	// as are vectors of a different size
+	other, _ = newTestDiskCachedEmbeddingIndex(fs)
+	other.Embedder = &fixedSizeEmbedder{Size: 4}
+	err = other.IndexPath(ctx, "/a/b/c", false, 512, 8)
+	assert.NoError(t, err)
+	err = other.Load("/index.snapshot")
+	assert.ErrorContains(t, err, "dimensions")
+}
+
+func TestIndexSkipsLargeAndBinaryFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, fs.MkdirAll("/repo", 0755))
+	writeFile := func(name string, content []byte) {
+		assert.NoError(t, afero.WriteFile(fs, "/repo/"+name, content, 0644))
+	}
+
+	writeFile("small.txt", []byte("a small text file"))
+	writeFile("large.txt", []byte(strings.Repeat("generated ", 500)))
+	// passes the extension and first-KB check but has a NUL byte later on
+	writeFile("payload", append([]byte(strings.Repeat("x", 2000)), 0, 1, 2))
+	writeFile("latin1", append([]byte(strings.Repeat("caf", 500)), 0xe9, '\n'))
+	// a multi-byte character cut in half by the sniff is still text
+	writeFile("unicode", []byte("a"+strings.Repeat("é", binarySniffSize)))
+
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.MaxFileSize = 4096
+	out := &strings.Builder{}
+	index.Out = out
+
+	err := index.IndexPath(context.Background(), "/repo", false, 512, 8)
+	assert.NoError(t, err)
+
+	indexed := []string{}
+	for name := range index.Index["/repo"].Files {
+		indexed = append(indexed, name)
+	}
+	sort.Strings(indexed)
+	assert.Equal(t, []string{"small.txt"}, indexed)
+
+	// the reasons are logged at the highest verbosity
+	assert.Contains(t, out.String(), "Ignored /repo/large.txt: larger than the max file size (5000 > 4096 bytes)")
+	assert.Contains(t, out.String(), "Ignored /repo/payload: binary content")
+	assert.Contains(t, out.String(), "Ignored /repo/latin1: binary content")
+
+	assert.Contains(t, out.String(), "Ignored /repo/unicode: larger than the max file size")
+
+	binary, err := index.looksBinary("/repo/unicode")
+	assert.NoError(t, err)
+	assert.False(t, binary)
+
+	// without a limit the large file is indexed
+	assert.NoError(t, fs.Remove("/repo/unicode"))
+	index.MaxFileSize = 0
+	err = index.IndexPath(context.Background(), "/repo", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Contains(t, index.Index["/repo"].Files, "large.txt")
+	assert.NotContains(t, index.Index["/repo"].Files, "payload")
+}
+
+func TestIndexStats(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.EmbeddingModel = "test-model"
+	ctx := context.Background()
+
+	stats := index.Stats()
+	assert.Equal(t, 0, stats.Files)
+	assert.True(t, stats.OldestModTime.IsZero())
+
+	err := index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+
+	stats = index.Stats()
+	assert.Equal(t, 3, stats.Directories)
+	assert.Equal(t, 4, stats.Files)
+	assert.Equal(t, 4, stats.Chunks)
+	assert.Equal(t, 4, stats.Vectors)
+	assert.Equal(t, 128, stats.Dimensions)
+	assert.Equal(t, "test-model", stats.EmbeddingModel)
+	assert.GreaterOrEqual(t, stats.ApproxBytes, int64(4*128*4))
+	assert.Equal(t, 0, stats.StaleFiles)
+	assert.Equal(t, 0, stats.MissingFiles)
+
+	// edit one file after it was indexed and delete another
+	oldest := time.Now().Add(-time.Hour)
+	err = fs.Chtimes("/a/one", oldest, oldest)
+	assert.NoError(t, err)
+	newest := time.Now().Add(time.Hour)
+	err = fs.Chtimes("/a/two", newest, newest)
+	assert.NoError(t, err)
+	err = fs.Remove("/a/b/nine")
+	assert.NoError(t, err)
+
+	stats = index.Stats()
+	assert.Equal(t, 4, stats.Files)
+	assert.Equal(t, 1, stats.StaleFiles)
+	assert.Equal(t, 1, stats.MissingFiles)
+	assert.True(t, oldest.Equal(stats.OldestModTime))
+	assert.True(t, newest.Equal(stats.NewestModTime))
+}
+
+// Hashes each word into one of size buckets and normalizes the counts, which
+// gives float vectors with a spread of values unlike the one-hot embedders
+func hashedWordVectors(size int) func(string) []float32 {
+	return func(str string) []float32 {
+		vector := make([]float32, size)
+		for _, word := range strings.Fields(str) {
+			h := fnv.New32a()
+			h.Write([]byte(word))
+			sum := h.Sum32()
+			vector[sum%uint32(size)] += 1 + float32(sum%7)/7
+		}
+
+		var norm float64
+		for _, value := range vector {
+			norm += float64(value * value)
+		}
+		for i := range vector {
+			vector[i] /= float32(math.Sqrt(norm))
+		}
+		return vector
+	}
+}
+
+func TestQuantizeVector(t *testing.T) {
+	vector := []float32{0.5, -0.25, 0.1, 0, -0.5, 0.033}
+	quantized, scale := QuantizeVector(vector)
+	assert.Equal(t, len(vector), len(quantized))
+	assert.InDelta(t, 0.5/127, scale, 1e-7)
+
+	dequantized := DequantizeVector(quantized, scale)
+	for i := range vector {
+		assert.InDelta(t, vector[i], dequantized[i], float64(scale)/2+1e-7)
+	}
+
+	quantized, scale = QuantizeVector([]float32{0, 0, 0})
+	assert.Equal(t, float32(0), scale)
+	assert.Equal(t, []float32{0, 0, 0}, DequantizeVector(quantized, scale))
+}
+
+// Quantized search results should closely match full precision results
+func TestQuantizedSearchAccuracy(t *testing.T) {
+	corpus := map[string]string{
+		"/corpus/fruit.txt":   "apple banana cherry orange grape pear plum apricot",
+		"/corpus/veg.txt":     "carrot potato onion garlic leek celery pepper",
+		"/corpus/code.txt":    "func return struct interface channel goroutine defer",
+		"/corpus/shell.txt":   "bash zsh prompt terminal cursor escape sequence pty",
+		"/corpus/index.txt":   "embedding vector search cosine similarity chunk",
+		"/corpus/weather.txt": "rain snow wind cloud storm sunny humid forecast",
+		"/corpus/music.txt":   "guitar piano drums melody rhythm chord tempo",
+		"/corpus/sport.txt":   "soccer tennis golf swim cycling marathon sprint",
+	}
+	queries := []string{
+		"apple pear",
+		"garlic onion soup",
+		"goroutine channel",
+		"terminal escape",
+		"vector search",
+		"storm forecast",
+		"piano chord melody",
+		"tennis sprint",
+	}
+
+	newIndex := func(quantize bool) *DiskCachedEmbeddingIndex {
+		fs := afero.NewMemMapFs()
+		for path, content := range corpus {
+			err := afero.WriteFile(fs, path, []byte(content), 0644)
+			assert.NoError(t, err)
+		}
+
+		index, _ := newTestDiskCachedEmbeddingIndex(fs)
+		index.Embedder = &mockEmbedder{Vector: hashedWordVectors(64)}
+		index.Quantize = quantize
+		err := index.IndexPath(context.Background(), "/corpus", false, 512, 8)
+		assert.NoError(t, err)
+		return index
+	}
+
+	full := newIndex(false)
+	quantized := newIndex(true)
+
+	stats := quantized.Stats()
+	assert.Equal(t, stats.Vectors, stats.QuantizedVectors)
+	assert.Equal(t, 64, quantized.Dimensions())
+	assert.Less(t, stats.ApproxBytes, full.Stats().ApproxBytes)
+
+	// chunks that tie on score can come back in any order, so rather than
+	// comparing paths directly check that each quantized result would also
+	// have made the full precision top k
+	const k = 3
+	const tolerance = 0.02
+	matches, total := 0, 0
+	for _, query := range queries {
+		allResults, err := full.Search(context.Background(), query, len(corpus))
+		assert.NoError(t, err)
+		quantizedResults, err := quantized.Search(context.Background(), query, k)
+		assert.NoError(t, err)
+		assert.Equal(t, k, len(quantizedResults))
+
+		expected := map[string]float64{}
+		for _, result := range allResults {
+			expected[result.FilePath] = result.Score
+		}
+		cutoff := allResults[k-1].Score
+
+		for _, result := range quantizedResults {
+			total++
+			score, ok := expected[result.FilePath]
+			assert.True(t, ok)
+			assert.InDelta(t, score, result.Score, tolerance)
+			if score >= cutoff-tolerance {
+				matches++
+			}
+		}
+
+		assert.InDelta(t, allResults[0].Score, quantizedResults[0].Score, tolerance)
+	}
+
+	recall := float64(matches) / float64(total)
+	assert.GreaterOrEqual(t, recall, 0.9)
+}
+
+// Records the size of each call and how many calls were in flight at once,
+// each chunk's vector marks the chunk's first byte so we can check where it
+// ended up. Vectors have Size dimensions, 128 if it's not set.
+type recordingEmbedder struct {
+	Delay       time.Duration
+	FailOn      string
+	Size        int
+	mutex       sync.Mutex
+	batchSizes  []int
+	inFlight    int
+	maxInFlight int
+}
+
+func (this *recordingEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
+	this.mutex.Lock()
+	this.batchSizes = append(this.batchSizes, len(content))
+	this.inFlight++
+	if this.inFlight > this.maxInFlight {
+		this.maxInFlight = this.inFlight
+	}
+	this.mutex.Unlock()
+
+	defer func() {
+		this.mutex.Lock()
+		this.inFlight--
+		this.mutex.Unlock()
+	}()
+
+	select {
+	case <-time.After(this.Delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	embeddings := make([][]float32, len(content))
+	for i, str := range content {
+		if this.FailOn != "" && strings.Contains(str, this.FailOn) {
+			return nil, errors.New("embedding failed")
+		}
+		size := this.Size
+		if size == 0 {
+			size = 128
+		}
+		embeddings[i] = make([]float32, size)
+		embeddings[i][int(str[0])%size] = 1
+	}
+
+	return embeddings, nil
+}
+
+// Write numFiles files, each made of 5 chunks of 4 bytes with a distinct
+// first byte per chunk
+func makeConcurrentFilesystem(t *testing.T, numFiles int) afero.Fs {
+	fs := afero.NewMemMapFs()
+	for i := 0; i < numFiles; i++ {
+		content := ""
+		for j := 0; j < 5; j++ {
+			content += fmt.Sprintf("%c%03d", 'A'+j, i)
+		}
+		err := afero.WriteFile(fs, fmt.Sprintf("/docs/file%02d", i), []byte(content), 0644)
+		assert.NoError(t, err)
+	}
+	return fs
+}
+
+func TestConcurrentIndexing(t *testing.T) {
+	fs := makeConcurrentFilesystem(t, 12)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	embedder := &recordingEmbedder{Delay: 10 * time.Millisecond}
+	index.Embedder = embedder
+	index.Verbosity = 0
+	index.Workers = 3
+	index.ChunksPerCall = 2
+
+	var progress []int
+	index.Progress = func(done, total int) {
+		assert.Equal(t, 12, total)
+		progress = append(progress, done)
+	}
+
+	err := index.IndexPath(context.Background(), "/docs", false, 4, 8)
+	assert.NoError(t, err)
+
+	// 5 chunks per file batched 2 at a time is 3 calls per file
+	assert.Equal(t, 36, len(embedder.batchSizes))
+	counts := map[int]int{}
+	for _, size := range embedder.batchSizes {
+		counts[size]++
+	}
+	assert.Equal(t, map[int]int{2: 24, 1: 12}, counts)
+
+	assert.LessOrEqual(t, embedder.maxInFlight, 3)
+	assert.Greater(t, embedder.maxInFlight, 1)
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, progress)
+
+	// every chunk's vector belongs to the file and range it was read from
+	files := index.Index["/docs"].Files
+	assert.Equal(t, 12, len(files))
+	for i := 0; i < 12; i++ {
+		fileEmbeddings := files[fmt.Sprintf("file%02d", i)]
+		assert.Equal(t, 5, len(fileEmbeddings.Embeddings))
+		for j, embedding := range fileEmbeddings.Embeddings {
+			assert.Equal(t, uint64(j*4), embedding.Start)
+			assert.Equal(t, float32(1), embedding.Vector['A'+j])
+		}
+	}
+
+	// results were saved to disk
+	exists, err := afero.Exists(fs, "/docs/.butterfish_index")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestConcurrentIndexingError(t *testing.T) {
+	fs := makeConcurrentFilesystem(t, 12)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	embedder := &recordingEmbedder{Delay: 10 * time.Millisecond, FailOn: "C003"}
+	index.Embedder = embedder
+	index.Verbosity = 0
+	index.Workers = 2
+	index.ChunksPerCall = 8
+
+	err := index.IndexPath(context.Background(), "/docs", false, 4, 8)
+	assert.ErrorContains(t, err, "embedding failed")
+
+	// the error cancels the group so we don't go on to embed every file
+	assert.Less(t, len(embedder.batchSizes), 12)
+	_, ok := index.Index["/docs"].Files["file03"]
+	assert.False(t, ok)
+}
+
+// Canceling part way through saves the files embedded so far, and indexing
+// again picks up where it left off
+func TestCanceledIndexing(t *testing.T) {
+	fs := makeConcurrentFilesystem(t, 12)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	embedder := &recordingEmbedder{}
+	index.Embedder = embedder
+	index.Verbosity = 0
+	index.Workers = 1
+	index.ChunksPerCall = 5
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	index.Progress = func(done, total int) {
+		if done == 6 {
+			cancel()
+		}
+	}
+
+	err := index.IndexPath(ctx, "/docs", false, 4, 8)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.LessOrEqual(t, len(embedder.batchSizes), 7)
+
+	// the partial results were flushed to the cache
+	loaded, _ := newTestDiskCachedEmbeddingIndex(fs)
+	loaded.Verbosity = 0
+	var progress []int
+	err = loaded.LoadPaths(context.Background(), []string{"/docs"}, func(done, total int) {
+		assert.Equal(t, 1, total)
+		progress = append(progress, done)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, progress)
+	assert.Equal(t, 6, len(loaded.IndexedFiles()))
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, 5, len(loaded.Index["/docs"].Files[fmt.Sprintf("file%02d", i)].Embeddings))
+	}
+
+	// resuming only embeds the remaining files
+	resumed := &recordingEmbedder{}
+	loaded.Embedder = resumed
+	loaded.Workers = 1
+	loaded.ChunksPerCall = 5
+	err = loaded.IndexPath(context.Background(), "/docs", false, 4, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, len(resumed.batchSizes))
+	assert.Equal(t, 12, len(loaded.IndexedFiles()))
+}
+
+// Canceling a load keeps the cache files loaded before it
+func TestCanceledLoad(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	for _, dir := range []string{"/docs/a", "/docs/b", "/docs/c"} {
+		err := afero.WriteFile(fs, dir+"/file", []byte("A000B000"), 0644)
+		assert.NoError(t, err)
+	}
+
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.Embedder = &recordingEmbedder{}
+	index.Verbosity = 0
+	assert.NoError(t, index.IndexPath(context.Background(), "/docs", false, 4, 8))
+
+	loaded, _ := newTestDiskCachedEmbeddingIndex(fs)
+	loaded.Verbosity = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var progress []int
+	err := loaded.LoadPaths(ctx, []string{"/docs"}, func(done, total int) {
+		assert.Equal(t, 3, total)
+		progress = append(progress, done)
+		if done == 2 {
+			cancel()
+		}
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []int{1, 2}, progress)
+	assert.Equal(t, 2, len(loaded.IndexedFiles()))
+}
+
+// A failed save leaves the directory dirty so that SaveDirty can retry it
+func TestSaveDirty(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.Fs = afero.NewReadOnlyFs(fs)
+
+	err := index.IndexPath(context.Background(), "/a/b/nine", false, 512, 8)
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(index.Index["/a/b"].Files))
+
+	index.Fs = fs
+	err = index.SaveDirty()
+	assert.NoError(t, err)
+	exists, err := afero.Exists(fs, "/a/b/.butterfish_index")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// nothing left to save
+	assert.Equal(t, 0, len(index.dirty))
+	assert.NoError(t, index.SaveDirty())
+}
+
+// A filesystem that records every attempt to modify it, wrapping a read-only
+// filesystem so the attempts also fail
+type writeTrackingFs struct {
+	afero.Fs
+	writes []string
+	mutex  sync.Mutex
+}
+
+func newWriteTrackingFs(fs afero.Fs) *writeTrackingFs {
+	return &writeTrackingFs{Fs: afero.NewReadOnlyFs(fs)}
+}
+
+func (this *writeTrackingFs) record(op, name string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.writes = append(this.writes, op+" "+name)
+}
+
+func (this *writeTrackingFs) Create(name string) (afero.File, error) {
+	this.record("create", name)
+	return this.Fs.Create(name)
+}
+
+func (this *writeTrackingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		this.record("open", name)
+	}
+	return this.Fs.OpenFile(name, flag, perm)
+}
+
+func (this *writeTrackingFs) Remove(name string) error {
+	this.record("remove", name)
+	return this.Fs.Remove(name)
+}
+
+func (this *writeTrackingFs) Rename(oldname, newname string) error {
+	this.record("rename", oldname)
+	return this.Fs.Rename(oldname, newname)
+}
+
+func (this *writeTrackingFs) Mkdir(name string, perm os.FileMode) error {
+	this.record("mkdir", name)
+	return this.Fs.Mkdir(name, perm)
+}
+
+func (this *writeTrackingFs) MkdirAll(name string, perm os.FileMode) error {
+	this.record("mkdir", name)
+	return this.Fs.MkdirAll(name, perm)
+}
+
+// A read-only cache is loaded, and files missing from it are embedded in
+// memory without trying to write the cache
+func TestCacheModeReadOnly(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	ctx := context.Background()
+
+	// cache /a/b/c with a normal index
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	assert.NoError(t, index.IndexPath(ctx, "/a/b/c", false, 512, 8))
+
+	tracking := newWriteTrackingFs(fs)
+	index, embedder := newTestDiskCachedEmbeddingIndex(tracking)
+	index.CacheMode = CacheReadOnly
+
+	assert.NoError(t, index.LoadPath(ctx, "/a"))
+	assert.Equal(t, []string{"/a/b/c/d/four"}, index.IndexedFiles())
+
+	// four is cached, nine is a miss that's embedded in memory
+	assert.NoError(t, index.IndexPath(ctx, "/a/b", false, 512, 8))
+	assert.Equal(t, 1, embedder.Calls)
+	results, err := index.Search(ctx, "999", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/a/b/nine", results[0].FilePath)
+
+	assert.NoError(t, index.SaveDirty())
+	assert.NoError(t, index.SavePath("/a/b"))
+	assert.NoError(t, index.ClearPath(ctx, "/a/b/c"))
+	assert.Empty(t, tracking.writes)
+
+	// clearing only dropped the in-memory copy
+	assert.Equal(t, []string{"/a/b/nine"}, index.IndexedFiles())
+	exists, err := afero.Exists(fs, "/a/b/c/d/.butterfish_index")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+// With the cache off nothing is loaded or written
+func TestCacheModeOff(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	ctx := context.Background()
+
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	assert.NoError(t, index.IndexPath(ctx, "/a/b/c", false, 512, 8))
+
+	tracking := newWriteTrackingFs(fs)
+	index, embedder := newTestDiskCachedEmbeddingIndex(tracking)
+	index.CacheMode = CacheOff
+
+	assert.NoError(t, index.LoadPath(ctx, "/a"))
+	assert.Empty(t, index.IndexedFiles())
+
+	// four is embedded again since the cache wasn't loaded
+	assert.NoError(t, index.IndexPath(ctx, "/a/b", false, 512, 8))
+	assert.Equal(t, 2, embedder.Calls)
+	files := index.IndexedFiles()
+	sort.Strings(files)
+	assert.Equal(t, []string{"/a/b/c/d/four", "/a/b/nine"}, files)
+	assert.Empty(t, tracking.writes)
+}
+
+func TestParseCacheMode(t *testing.T) {
+	for _, mode := range []CacheMode{CacheReadWrite, CacheReadOnly, CacheOff} {
+		parsed, err := ParseCacheMode(mode.String())
+		assert.NoError(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+
+	mode, err := ParseCacheMode("ReadOnly")
+	assert.NoError(t, err)
+	assert.Equal(t, CacheReadOnly, mode)
+
+	_, err = ParseCacheMode("sometimes")
+	assert.ErrorContains(t, err, `Unknown cache mode "sometimes"`)
+}
+
+// Chunks duplicating one already indexed are collapsed into it, kept as
+// aliases that still point at their own file, and embedded again if the
+// chunk they duplicate goes away
+func TestDedupChunks(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	// each line is exactly 16 bytes so it lines up with the chunk size
+	err := afero.WriteFile(fs, "/dup/a.txt",
+		[]byte("license mit....\napple pie......\n"), 0644)
+	assert.NoError(t, err)
+	err = afero.WriteFile(fs, "/dup/b.txt",
+		[]byte("license mit....\nbanana bread...\n"), 0644)
+	assert.NoError(t, err)
+
+	embedder := &keywordEmbedder{Keywords: []string{"license", "apple", "banana", "cherry"}}
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.Embedder = embedder
+	index.DedupThreshold = 0.99
+	ctx := context.Background()
+
+	err = index.IndexPath(ctx, "/dup", false, 16, 8)
+	assert.NoError(t, err)
+
+	stats := index.Stats()
+	assert.Equal(t, 4, stats.Chunks)
+	assert.Equal(t, 3, stats.Vectors)
+	assert.Equal(t, 1, stats.AliasChunks)
+
+	checkAliases := func(index *DiskCachedEmbeddingIndex) {
+		results, err := index.Search(ctx, "license", 3)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(results))
+		assert.Equal(t, "/dup/a.txt", results[0].FilePath)
+		assert.Equal(t, "license mit....\n", results[0].Content)
+		assert.Equal(t, []ChunkLocation{
+			{FilePath: "/dup/b.txt", Start: 0, End: 16},
+		}, results[0].Aliases)
+		for _, result := range results[1:] {
+			assert.NotEqual(t, "license mit....\n", result.Content)
+			assert.Empty(t, result.Aliases)
+		}
+	}
+	checkAliases(index)
+
+	// aliases are saved with the cache
+	loaded, _ := newTestDiskCachedEmbeddingIndex(fs)
+	loaded.Embedder = embedder
+	err = loaded.LoadPath(ctx, "/dup")
+	assert.NoError(t, err)
+	checkAliases(loaded)
+
+	// once a.txt no longer has the chunk, b.txt is embedded again even
+	// though it hasn't changed, so its copy can be found
+	err = afero.WriteFile(fs, "/dup/a.txt",
+		[]byte("cherry tart....\napple pie......\n"), 0644)
+	assert.NoError(t, err)
+	later := time.Now().Add(time.Hour)
+	assert.NoError(t, fs.Chtimes("/dup/a.txt", later, later))
+
+	err = loaded.IndexPath(ctx, "/dup", false, 16, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, loaded.Stats().AliasChunks)
+
+	results, err := loaded.Search(ctx, "license", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "/dup/b.txt", results[0].FilePath)
+	assert.Empty(t, results[0].Aliases)
+}
+
+// Projects indexed in separate namespaces keep separate cache files and
+// aren't loaded or searched from another namespace
+func TestNamespaces(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	ctx := context.Background()
+
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	assert.NoError(t, index.SetNamespace("projecta"))
+	assert.NoError(t, index.IndexPath(ctx, "/a/b/c", false, 512, 8))
+	assert.NoError(t, index.SetNamespace("projectb"))
+	assert.Empty(t, index.IndexedFiles())
+	assert.NoError(t, index.IndexPath(ctx, "/a/b", false, 512, 8))
+
+	// both namespaces embedded four, each in its own cache file
+	for _, name := range []string{".butterfish_index.projecta", ".butterfish_index.projectb"} {
+		exists, err := afero.Exists(fs, filepath.Join("/a/b/c/d", name))
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	}
+	exists, err := afero.Exists(fs, "/a/b/c/d/.butterfish_index")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	// switching back finds the embeddings kept in memory
+	assert.NoError(t, index.SetNamespace("projecta"))
+	assert.Equal(t, []string{"/a/b/c/d/four"}, index.IndexedFiles())
+	assert.Equal(t, []string{"", "projecta", "projectb"}, index.Namespaces())
+
+	// a fresh index only loads the cache files of its namespace
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	assert.NoError(t, index.SetNamespace("projecta"))
+	assert.NoError(t, index.LoadPath(ctx, "/a"))
+	assert.Equal(t, []string{"/a/b/c/d/four"}, index.IndexedFiles())
+	results, err := index.Search(ctx, "999", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/a/b/c/d/four", results[0].FilePath)
+
+	assert.NoError(t, index.SetNamespace("projectb"))
+	assert.NoError(t, index.LoadPath(ctx, "/a"))
+	files := index.IndexedFiles()
+	sort.Strings(files)
+	assert.Equal(t, []string{"/a/b/c/d/four", "/a/b/nine"}, files)
+	results, err = index.Search(ctx, "999", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/a/b/nine", results[0].FilePath)
+
+	// the default namespace has nothing cached
+	assert.NoError(t, index.SetNamespace(""))
+	assert.NoError(t, index.LoadPath(ctx, "/a"))
+	assert.Empty(t, index.IndexedFiles())
+
+	// clearing one namespace leaves the other's cache files alone
+	assert.NoError(t, index.SetNamespace("projectb"))
+	assert.NoError(t, index.ClearPath(ctx, "/a"))
+	exists, err = afero.Exists(fs, "/a/b/c/d/.butterfish_index.projectb")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	exists, err = afero.Exists(fs, "/a/b/c/d/.butterfish_index.projecta")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	assert.ErrorContains(t, index.SetNamespace("../other"), "Invalid namespace")
+	assert.Equal(t, "projectb", index.Namespace())
+}
+
+func TestNamespaceForPath(t *testing.T) {
+	a, err := NamespaceForPath("/home/me/work/api")
+	assert.NoError(t, err)
+	b, err := NamespaceForPath("/home/me/play/api")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(a, "api-"))
+	assert.Equal(t, len("api-")+8, len(a))
+	assert.NotEqual(t, a, b)
+
+	c, err := NamespaceForPath("/home/me/work/api/")
+	assert.NoError(t, err)
+	assert.Equal(t, a, c)
+
+	index, _ := newTestDiskCachedEmbeddingIndex(afero.NewMemMapFs())
+	root, err := NamespaceForPath("/")
+	assert.NoError(t, err)
+	assert.NoError(t, index.SetNamespace(root))
+}
+
+// A Clock whose timers only fire when the test advances it
+type fakeClock struct {
+	mutex  sync.Mutex
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	f       func()
+	stopped bool
+}
+
+func (this *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	timer := &fakeTimer{clock: this, f: f}
+	this.timers = append(this.timers, timer)
+	return timer
+}
+
+func (this *fakeTimer) Stop() bool {
+	this.clock.mutex.Lock()
+	defer this.clock.mutex.Unlock()
+	pending := !this.stopped
+	this.stopped = true
+	return pending
+}
+
+// Fire the timers that haven't been stopped, returning how many there were
+func (this *fakeClock) Advance() int {
+	this.mutex.Lock()
+	pending := []*fakeTimer{}
+	for _, timer := range this.timers {
+		if !timer.stopped {
+			timer.stopped = true
+			pending = append(pending, timer)
+		}
+	}
+	this.timers = nil
+	this.mutex.Unlock()
+
+	for _, timer := range pending {
+		timer.f()
+	}
+	return len(pending)
+}
+
+// An embedder that signals started when called and then waits for release,
+// so that a test can stop indexing between files
+type gatedEmbedder struct {
+	mockEmbedder
+	started chan struct{}
+	release chan struct{}
+}
+
+func newGatedEmbedder() *gatedEmbedder {
+	return &gatedEmbedder{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+}
+
+func (this *gatedEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
+	this.started <- struct{}{}
+	select {
+	case <-this.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return this.mockEmbedder.CalculateEmbeddings(ctx, content)
+}
+
+// Start indexing /a one file at a time with the gated embedder, returning a
+// channel with the result
+func startGatedIndexing(index *DiskCachedEmbeddingIndex, embedder *gatedEmbedder) chan error {
+	index.Embedder = embedder
+	index.Workers = 1
+	result := make(chan error, 1)
+	go func() {
+		result <- index.IndexPath(context.Background(), "/a", false, 512, 8)
+	}()
+	return result
+}
+
+// The files an index loaded from the cache files on disk has, i.e. what
+// would survive the process being killed
+func savedFiles(t *testing.T, fs afero.Fs) []string {
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.Verbosity = 0
+	assert.NoError(t, index.LoadPath(context.Background(), "/a"))
+	files := index.IndexedFiles()
+	sort.Strings(files)
+	return files
+}
+
+func TestAutoSaveOnIdle(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	clock := &fakeClock{}
+	index.Clock = clock
+	index.AutoSaveInterval = time.Minute
+	index.AutoSaveThreshold = 0
+	embedder := newGatedEmbedder()
+	result := startGatedIndexing(index, embedder)
+
+	// nothing has finished so there's nothing to save
+	<-embedder.started
+	assert.Equal(t, 0, clock.Advance())
+
+	// the first file finishes and the second is slow, so the idle timer
+	// saves the first
+	embedder.release <- struct{}{}
+	<-embedder.started
+	assert.Empty(t, savedFiles(t, fs))
+	assert.Equal(t, 1, clock.Advance())
+	assert.Equal(t, 1, len(savedFiles(t, fs)))
+
+	// finishing another file replaces the timer rather than adding one
+	embedder.release <- struct{}{}
+	<-embedder.started
+	embedder.release <- struct{}{}
+	<-embedder.started
+	assert.Equal(t, 1, clock.Advance())
+	assert.Equal(t, 3, len(savedFiles(t, fs)))
+
+	embedder.release <- struct{}{}
+	assert.NoError(t, <-result)
+	assert.Equal(t, 0, clock.Advance())
+	assert.Equal(t, []string{"/a/b/c/d/four", "/a/b/nine", "/a/one", "/a/two"}, savedFiles(t, fs))
+	assert.Empty(t, index.dirty)
+}
+
+func TestAutoSaveOnThreshold(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	clock := &fakeClock{}
+	index.Clock = clock
+	index.AutoSaveInterval = 0
+	index.AutoSaveThreshold = 2
+	embedder := newGatedEmbedder()
+	result := startGatedIndexing(index, embedder)
+
+	<-embedder.started
+	embedder.release <- struct{}{}
+	<-embedder.started
+	assert.Empty(t, savedFiles(t, fs))
+
+	// the second file reaches the threshold
+	embedder.release <- struct{}{}
+	<-embedder.started
+	assert.Equal(t, 2, len(savedFiles(t, fs)))
+
+	embedder.release <- struct{}{}
+	<-embedder.started
+	assert.Equal(t, 2, len(savedFiles(t, fs)))
+
+	embedder.release <- struct{}{}
+	assert.NoError(t, <-result)
+	assert.Equal(t, 4, len(savedFiles(t, fs)))
+	assert.Equal(t, 0, clock.Advance())
+}
+
+// Without a writable cache nothing is auto-saved
+func TestAutoSaveReadOnly(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	tracking := newWriteTrackingFs(fs)
+	index, _ := newTestDiskCachedEmbeddingIndex(tracking)
+	index.CacheMode = CacheReadOnly
+	index.AutoSaveThreshold = 1
+	assert.NoError(t, index.IndexPath(context.Background(), "/a", false, 512, 8))
+	assert.Equal(t, 4, len(index.IndexedFiles()))
+	assert.Empty(t, tracking.writes)
+}
+
+// Write numDirs directories of a few files each, with words drawn from a
+// small vocabulary so that plenty of chunks score close to each other
+func makeShardedFilesystem(t testing.TB, numDirs int) afero.Fs {
+	words := []string{"apple", "pear", "shell", "prompt", "vector", "search",
+		"storm", "cloud", "piano", "chord", "tennis", "golf"}
+	fs := afero.NewMemMapFs()
+	for i := 0; i < numDirs; i++ {
+		for j := 0; j < 3; j++ {
+			content := fmt.Sprintf("%s %s %s", words[(i+j)%len(words)],
+				words[(i*3+j)%len(words)], words[(i*7+j*5)%len(words)])
+			path := fmt.Sprintf("/corpus/dir%02d/file%d.txt", i, j)
+			err := afero.WriteFile(fs, path, []byte(content), 0644)
+			assert.NoError(t, err)
+		}
+	}
+	return fs
+}
+
+func assertSameResults(t *testing.T, expected, actual []*VectorSearchResult) {
+	assert.Equal(t, len(expected), len(actual))
+	for i := range expected {
+		if i >= len(actual) {
+			break
+		}
+		assert.Equal(t, expected[i].FilePath, actual[i].FilePath)
+		assert.Equal(t, expected[i].Start, actual[i].Start)
+		assert.Equal(t, expected[i].Score, actual[i].Score)
+	}
+}
+
+// Merging the best results of each shard should give exactly what searching
+// the whole index at once does, in the same order
+func TestShardedSearch(t *testing.T) {
+	fs := makeShardedFilesystem(t, 10)
+	ctx := context.Background()
+	queries := []string{"apple pear", "shell prompt", "storm", "piano tennis golf"}
+
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.Embedder = &mockEmbedder{Vector: hashedWordVectors(16)}
+	index.Verbosity = 0
+	err := index.IndexPath(ctx, "/corpus", false, 512, 8)
+	assert.NoError(t, err)
+
+	baseline := map[string][]*VectorSearchResult{}
+	for _, query := range queries {
+		baseline[query], err = index.Search(ctx, query, 7)
+		assert.NoError(t, err)
+		assert.Equal(t, 7, len(baseline[query]))
+	}
+
+	for _, shardSize := range []int{1, 3, 4, 10, 20} {
+		for _, workers := range []int{1, 3} {
+			index.ShardSize = shardSize
+			index.ShardWorkers = workers
+			for _, query := range queries {
+				results, err := index.Search(ctx, query, 7)
+				assert.NoError(t, err)
+				assertSameResults(t, baseline[query], results)
+			}
+		}
+	}
+
+	// lazily loaded shards are read for the search and not kept
+	lazy, _ := newTestDiskCachedEmbeddingIndex(fs)
+	lazy.Embedder = &mockEmbedder{Vector: hashedWordVectors(16)}
+	lazy.Verbosity = 0
+	lazy.LazyLoad = true
+	lazy.ShardSize = 3
+	lazy.ShardWorkers = 2
+	err = lazy.LoadPath(ctx, "/corpus")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(lazy.Index))
+
+	for _, query := range queries {
+		results, err := lazy.Search(ctx, query, 7)
+		assert.NoError(t, err)
+		assertSameResults(t, baseline[query], results)
+	}
+	assert.Equal(t, 0, len(lazy.Index))
+
+	// but are loaded for operations that need the whole index
+	assert.Equal(t, index.Stats().Vectors, lazy.Stats().Vectors)
+	assert.ElementsMatch(t, index.IndexedFiles(), lazy.IndexedFiles())
+}
+
+func TestShardDirectories(t *testing.T) {
+	dirs := []string{"/a", "/b", "/c", "/d", "/e"}
+	assert.Equal(t, [][]string{dirs}, shardDirectories(dirs, 0))
+	assert.Equal(t, [][]string{dirs}, shardDirectories(dirs, 5))
+	assert.Equal(t, [][]string{{"/a", "/b"}, {"/c", "/d"}, {"/e"}}, shardDirectories(dirs, 2))
+	assert.Equal(t, [][]string{{}}, shardDirectories([]string{}, 2))
+}
+
+func benchmarkSearch(b *testing.B, shardSize, workers, annThreshold int) {
+	fs := makeShardedFilesystem(b, 200)
+	ctx := context.Background()
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.Embedder = &mockEmbedder{Vector: hashedWordVectors(256)}
+	index.Verbosity = 0
+	err := index.IndexPath(ctx, "/corpus", false, 512, 8)
+	assert.NoError(b, err)
+	index.ShardSize = shardSize
+	index.ShardWorkers = workers
+	index.ANNThreshold = annThreshold
+
+	query, err := index.Vectorize(ctx, "apple shell storm")
+	assert.NoError(b, err)
+	// build the approximate search graph, if any, outside the timing
+	_, err = index.SearchWithVector(ctx, query, 10)
+	assert.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := index.SearchWithVector(ctx, query, 10)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSearch(b *testing.B)              { benchmarkSearch(b, 0, 1, 0) }
+func BenchmarkShardedSearch(b *testing.B)       { benchmarkSearch(b, 20, 1, 0) }
+func BenchmarkParallelShardSearch(b *testing.B) { benchmarkSearch(b, 20, 4, 0) }
+func BenchmarkANNSearch(b *testing.B)           { benchmarkSearch(b, 0, 1, 1) }
+
+// Maps each text to a random vector seeded by its hash, so every distinct
+// chunk gets its own direction and scores rarely tie
+type randomEmbedder struct {
+	Size int
+}
+
+func (this *randomEmbedder) CalculateEmbeddings(ctx context.Context, content []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(content))
+	for i, str := range content {
+		h := fnv.New64a()
+		h.Write([]byte(str))
+		rng := rand.New(rand.NewSource(int64(h.Sum64())))
+		embeddings[i] = make([]float32, this.Size)
+		for j := range embeddings[i] {
+			embeddings[i][j] = float32(rng.NormFloat64())
+		}
+	}
+	return embeddings, nil
+}
+
+// Approximate search should find nearly the same results as the exact
+// search once the index is large enough, and be exact below the threshold
+func TestANNSearch(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	for i := 0; i < 600; i++ {
+		path := fmt.Sprintf("/corpus/dir%02d/file%d.txt", i%20, i)
+		err := afero.WriteFile(fs, path, []byte(fmt.Sprintf("document %d", i)), 0644)
+		assert.NoError(t, err)
+	}
+	ctx := context.Background()
+	embedder := &randomEmbedder{Size: 32}
+
+	exact, _ := newTestDiskCachedEmbeddingIndex(fs)
+	exact.Embedder = embedder
+	exact.Verbosity = 0
+	err := exact.IndexPath(ctx, "/corpus", false, 512, 8)
+	assert.NoError(t, err)
+
+	// the graph is built by LoadPaths
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	index.Embedder = embedder
+	index.Verbosity = 0
+	index.ANNThreshold = 100
+	err = index.LoadPath(ctx, "/corpus")
+	assert.NoError(t, err)
+	assert.NotNil(t, index.ann)
+	assert.NotNil(t, index.ann.graph)
+
+	hits, total := 0, 0
+	for i := 0; i < 30; i++ {
+		query := fmt.Sprintf("query %d", i)
+		expected, err := exact.Search(ctx, query, 10)
+		assert.NoError(t, err)
+		results, err := index.Search(ctx, query, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, len(results))
+
+		found := map[string]bool{}
+		for _, result := range results {
+			found[result.FilePath] = true
+		}
+		for _, result := range expected {
+			total++
+			if found[result.FilePath] {
+				hits++
+			}
+		}
+	}
+	assert.GreaterOrEqual(t, float64(hits)/float64(total), 0.9)
+
+	// changing the index rebuilds the graph so new files are found
+	err = afero.WriteFile(fs, "/corpus/dir00/new.txt", []byte("query 0"), 0644)
+	assert.NoError(t, err)
+	err = index.IndexPath(ctx, "/corpus", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Nil(t, index.ann)
+	results, err := index.Search(ctx, "query 0", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/corpus/dir00/new.txt", results[0].FilePath)
+	assert.InDelta(t, 1.0, results[0].Score, 0.0001)
+
+	// smaller indexes are searched exactly
+	small, _ := newTestDiskCachedEmbeddingIndex(fs)
+	small.Embedder = embedder
+	small.Verbosity = 0
+	small.ANNThreshold = 10000
+	err = small.LoadPath(ctx, "/corpus")
+	assert.NoError(t, err)
+	assert.Nil(t, small.ann.graph)
+	for i := 0; i < 5; i++ {
+		query := fmt.Sprintf("query %d", i)
+		expected, err := index.searchShards(ctx, mustVectorize(t, index, query), 10)
+		assert.NoError(t, err)
+		results, err := small.SearchWithVector(ctx, mustVectorize(t, small, query), 10)
+		assert.NoError(t, err)
+		assertSameResults(t, expected, results)
+	}
+}
+
+func mustVectorize(t testing.TB, index *DiskCachedEmbeddingIndex, query string) []float32 {
+	vector, err := index.Vectorize(context.Background(), query)
+	assert.NoError(t, err)
+	return vector
+}
+
+func chunksEmbedded(embedder *recordingEmbedder) int {
+	total := 0
+	for _, size := range embedder.batchSizes {
+		total += size
+	}
+	return total
+}
+
+// Two projects with an identical file should only embed it once when they
+// share a cache, and each index should still hold the vectors
+func TestSharedEmbeddingCache(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	shared := "package util\n\nfunc Min(a, b int) int {\n\treturn a\n}\n"
+	for path, content := range map[string]string{
+		"/projA/lib/util.go":    shared,
+		"/projA/main.go":        "package main\n",
+		"/projB/vendor/util.go": shared,
+		// only exactly the same content shares an entry
+		"/projB/dep/util.go": strings.ReplaceAll(shared, "\n", "  \n"),
+		"/projB/other.go":    "package other\n",
+	} {
+		err := afero.WriteFile(fs, path, []byte(content), 0644)
+		assert.NoError(t, err)
+	}
+	ctx := context.Background()
+	cache := NewSharedEmbeddingCache(fs, "/cache")
+
+	embedderA := &recordingEmbedder{}
+	indexA, _ := newTestDiskCachedEmbeddingIndex(fs)
+	indexA.Embedder = embedderA
+	indexA.EmbeddingModel = "test-model"
+	indexA.SharedCache = cache
+	err := indexA.IndexPath(ctx, "/projA", false, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, chunksEmbedded(embedderA))
+
+	embedderB := &recordingEmbedder{}
+	indexB, _ := newTestDiskCachedEmbeddingIndex(fs)
+	indexB.Embedder = embedderB
+	indexB.EmbeddingModel = "test-model"
+	indexB.SharedCache = cache
+	err = indexB.IndexPath(ctx, "/projB", false, 512, 8)
+	assert.NoError(t, err)
+	// only the vendored util.go was in the shared cache
+	assert.Equal(t, 2, chunksEmbedded(embedderB))
+
+	vectorA := indexA.Index["/projA/lib"].Files["util.go"].Embeddings[0].Vector
+	assert.Equal(t, vectorA, indexB.Index["/projB/vendor"].Files["util.go"].Embeddings[0].Vector)
+
+	embedder := indexA.embedderName()
+	dimensions, err := cache.Dimensions(embedder, "test-model")
+	assert.NoError(t, err)
+	assert.Equal(t, 128, dimensions)
+	entry, err := cache.Get(embedder, "test-model", 128, shared)
+	assert.NoError(t, err)
+	assert.Equal(t, vectorA, entry)
+
+	// a different model, embedder, or size of vector doesn't share entries
+	entry, err = cache.Get(embedder, "other-model", 128, shared)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+	entry, err = cache.Get("other-embedder", "test-model", 128, shared)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+	entry, err = cache.Get(embedder, "test-model", 64, shared)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+
+	// corrupt entries and entries of the wrong length are embedded again
+	// and replaced
+	key := SharedCacheKey(embedder, "test-model", 128, shared)
+	err = afero.WriteFile(fs, filepath.Join("/cache", key[:2], key), encodeVector(make([]float32, 64)), 0644)
+	assert.NoError(t, err)
+	entry, err = cache.Get(embedder, "test-model", 128, shared)
+	assert.NoError(t, err)
+	assert.Nil(t, entry)
+	key = SharedCacheKey(embedder, "test-model", 128, "package main\n")
+	err = afero.WriteFile(fs, filepath.Join("/cache", key[:2], key), []byte{1, 2, 3}, 0644)
+	assert.NoError(t, err)
+	embedderC := &recordingEmbedder{}
+	indexC, _ := newTestDiskCachedEmbeddingIndex(fs)
+	indexC.Embedder = embedderC
+	indexC.EmbeddingModel = "test-model"
+	indexC.SharedCache = cache
+	indexC.CacheMode = CacheOff
+	err = indexC.IndexPath(ctx, "/projA", false, 512, 8)
+	assert.NoError(t, err)
+	// CacheOff doesn't use the shared cache either
+	assert.Equal(t, 2, chunksEmbedded(embedderC))
+
+	indexC.CacheMode = CacheReadWrite
+	err = indexC.IndexPath(ctx, "/projA", true, 512, 8)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, chunksEmbedded(embedderC))
+	for _, content := range []string{shared, "package main\n"} {
+		entry, err = cache.Get(embedder, "test-model", 128, content)
+		assert.NoError(t, err)
+		assert.Equal(t, 128, len(entry))
+	}
+
+	// an index with vectors of another size doesn't use the cached vectors
+	embedderD := &recordingEmbedder{Size: 64}
+	indexD, _ := newTestDiskCachedEmbeddingIndex(fs)
+	indexD.Embedder = embedderD
+	indexD.EmbeddingModel = "test-model"
+	assert.NoError(t, indexD.IndexPath(ctx, "/projA/lib", false, 512, 8))
+	indexD.SharedCache = cache
+	assert.NoError(t, indexD.IndexPath(ctx, "/projA", false, 512, 8))
+	assert.Equal(t, 64, indexD.Dimensions())
+	assert.Equal(t, 2, chunksEmbedded(embedderD))
+
+	// nor does one whose embedder comes from another provider
+	embedderE := &recordingEmbedder{}
+	indexE, _ := newTestDiskCachedEmbeddingIndex(fs)
+	indexE.Embedder = embedderE
+	indexE.EmbedderName = "other provider"
+	indexE.EmbeddingModel = "test-model"
+	indexE.SharedCache = cache
+	assert.NoError(t, indexE.IndexPath(ctx, "/projA", false, 512, 8))
+	assert.Equal(t, 2, chunksEmbedded(embedderE))
+}
+
+// Corrupt and wrong-dimension cache entries are reported, and rebuilding
+// embeds the indexed files again to replace them
+func TestVerifyAndRebuildCache(t *testing.T) {
+	fs := makeFakeFilesystem(t)
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	ctx := context.Background()
+
+	err := index.IndexPath(ctx, "/a", false, 512, 8)
+	assert.NoError(t, err)
+	problems, err := index.VerifyCache(ctx, []string{"/a"})
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	corruptPath := "/a/b/" + index.DotfileName
+	err = afero.WriteFile(fs, corruptPath, []byte("not a protobuf"), 0644)
+	assert.NoError(t, err)
+
+	shortPath := "/a/b/c/d/" + index.DotfileName
+	buf, err := afero.ReadFile(fs, shortPath)
+	assert.NoError(t, err)
+	dirIndex := &pb.DirectoryIndex{}
+	assert.NoError(t, proto.Unmarshal(buf, dirIndex))
+	dirIndex.Files["four"].Embeddings[0].Vector = []float32{1, 0, 0, 0}
+	buf, err = proto.Marshal(dirIndex)
+	assert.NoError(t, err)
+	assert.NoError(t, afero.WriteFile(fs, shortPath, buf, 0644))
+
+	problems, err = index.VerifyCache(ctx, []string{"/a"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(problems))
+	assert.Equal(t, corruptPath, problems[0].Dotfile)
+	assert.Equal(t, "", problems[0].File)
+	assert.Contains(t, problems[0].Problem, "can't be decoded")
+	assert.Equal(t, shortPath+": four has 4 dimensional vectors rather than 128", problems[1].String())
+
+	// a corrupt cache is skipped when loading rather than failing
+	loaded, loadedEmbedder := newTestDiskCachedEmbeddingIndex(fs)
+	assert.NoError(t, loaded.LoadPath(ctx, "/a"))
+	assert.NotContains(t, loaded.IndexedFiles(), "/a/b/nine")
+
+	// a deleted file is dropped rather than embedded again
+	assert.NoError(t, fs.Remove("/a/two"))
+	err = loaded.RebuildCache(ctx, []string{"/a"}, 512, 8)
+	assert.NoError(t, err)
+	assert.Greater(t, loadedEmbedder.Calls, 0)
+	problems, err = loaded.VerifyCache(ctx, []string{"/a"})
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+	expected := []string{"/a/one", "/a/b/nine", "/a/b/c/d/four"}
+	assert.ElementsMatch(t, expected, loaded.IndexedFiles())
+	assert.Equal(t, 128, len(loaded.Index["/a/b/c/d"].Files["four"].Embeddings[0].Vector))
+
+	reloaded, _ := newTestDiskCachedEmbeddingIndex(fs)
+	assert.NoError(t, reloaded.LoadPath(ctx, "/a"))
+	assert.ElementsMatch(t, expected, reloaded.IndexedFiles())
+}
+
+// Damaged shared cache entries are reported, and rebuilding embeds their
+// chunks again rather than copying the damage back into the index
+func TestVerifyAndRebuildSharedCache(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	files := map[string]string{
+		"/proj/one.go":   "package one\n",
+		"/proj/two.go":   "package two\n",
+		"/proj/three.go": "package three\n",
+	}
+	for path, content := range files {
+		assert.NoError(t, afero.WriteFile(fs, path, []byte(content), 0644))
+	}
+	ctx := context.Background()
+	cache := NewSharedEmbeddingCache(fs, "/cache")
+
+	index, embedder := newTestDiskCachedEmbeddingIndex(fs)
+	index.EmbeddingModel = "test-model"
+	index.SharedCache = cache
+	assert.NoError(t, index.IndexPath(ctx, "/proj", false, 512, 8))
+	problems, err := index.VerifyCache(ctx, []string{"/proj"})
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	entryPath := func(content string) string {
+		key := SharedCacheKey(index.embedderName(), "test-model", 128, content)
+		return filepath.Join("/cache", key[:2], key)
+	}
+	assert.NoError(t, fs.Remove(entryPath(files["/proj/one.go"])))
+	assert.NoError(t, afero.WriteFile(fs, entryPath(files["/proj/two.go"]), []byte{1, 2, 3}, 0644))
+	// a stale vector of the right size can't be told apart, but a rebuild
+	// still replaces it
+	stale := make([]float32, 128)
+	stale[127] = 1
+	assert.NoError(t, afero.WriteFile(fs, entryPath(files["/proj/three.go"]), encodeVector(stale), 0644))
+
+	problems, err = index.VerifyCache(ctx, []string{"/proj"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(problems))
+	dotfile := "/proj/" + index.DotfileName
+	assert.Equal(t, dotfile+": one.go has a chunk at 0-12 whose shared cache entry is missing", problems[0].String())
+	assert.Equal(t, dotfile+": two.go has a chunk at 0-12 whose shared cache entry can't be decoded", problems[1].String())
+
+	calls := embedder.Calls
+	assert.NoError(t, index.RebuildCache(ctx, []string{"/proj"}, 512, 8))
+	// one call for each file's only chunk
+	assert.Equal(t, calls+3, embedder.Calls)
+	problems, err = index.VerifyCache(ctx, []string{"/proj"})
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	vector := index.Index["/proj"].Files["three.go"].Embeddings[0].Vector
+	assert.NotEqual(t, stale, vector)
+	entry, err := cache.Get(index.embedderName(), "test-model", 128, files["/proj/three.go"])
+	assert.NoError(t, err)
+	assert.Equal(t, vector, entry)
+}
@@ -0,0 +1,128 @@
+package embedding
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Languages by lowercase file extension
+var languageExtensions = map[string]string{
+	".go":       "go",
+	".py":       "python",
+	".pyi":      "python",
+	".js":       "javascript",
+	".mjs":      "javascript",
+	".cjs":      "javascript",
+	".jsx":      "javascript",
+	".ts":       "typescript",
+	".tsx":      "typescript",
+	".rb":       "ruby",
+	".rs":       "rust",
+	".java":     "java",
+	".kt":       "kotlin",
+	".kts":      "kotlin",
+	".scala":    "scala",
+	".swift":    "swift",
+	".c":        "c",
+	".h":        "c",
+	".cc":       "cpp",
+	".cpp":      "cpp",
+	".cxx":      "cpp",
+	".hpp":      "cpp",
+	".hh":       "cpp",
+	".cs":       "csharp",
+	".m":        "objectivec",
+	".php":      "php",
+	".pl":       "perl",
+	".pm":       "perl",
+	".lua":      "lua",
+	".r":        "r",
+	".ex":       "elixir",
+	".exs":      "elixir",
+	".erl":      "erlang",
+	".hs":       "haskell",
+	".clj":      "clojure",
+	".dart":     "dart",
+	".sh":       "shell",
+	".bash":     "shell",
+	".zsh":      "shell",
+	".fish":     "shell",
+	".ps1":      "powershell",
+	".sql":      "sql",
+	".html":     "html",
+	".htm":      "html",
+	".css":      "css",
+	".scss":     "css",
+	".vue":      "vue",
+	".svelte":   "svelte",
+	".json":     "json",
+	".yaml":     "yaml",
+	".yml":      "yaml",
+	".toml":     "toml",
+	".xml":      "xml",
+	".proto":    "protobuf",
+	".tf":       "terraform",
+	".md":       "markdown",
+	".markdown": "markdown",
+	".rst":      "restructuredtext",
+	".tex":      "latex",
+	".txt":      "text",
+	".pdf":      "pdf",
+}
+
+// Languages of files that are recognized by name rather than extension
+var languageFilenames = map[string]string{
+	"makefile":    "make",
+	"gnumakefile": "make",
+	"dockerfile":  "dockerfile",
+	"gemfile":     "ruby",
+	"rakefile":    "ruby",
+	"jenkinsfile": "groovy",
+}
+
+// The interpreter named on a shebang line without any version, e.g. python
+// for #!/usr/bin/env python3
+var shebangRegex = regexp.MustCompile(`^#!\s*(?:\S*/)?(?:env\s+(?:-\S+\s+)*)?([A-Za-z]+)`)
+
+var shebangLanguages = map[string]string{
+	"sh":      "shell",
+	"bash":    "shell",
+	"zsh":     "shell",
+	"dash":    "shell",
+	"ksh":     "shell",
+	"fish":    "shell",
+	"python":  "python",
+	"node":    "javascript",
+	"deno":    "typescript",
+	"ruby":    "ruby",
+	"perl":    "perl",
+	"php":     "php",
+	"lua":     "lua",
+	"Rscript": "r",
+}
+
+// Return the language of a file from its name, e.g. "go" for main.go or
+// "make" for Makefile, or an empty string if we don't recognize it
+func LanguageFor(path string) string {
+	name := filepath.Base(path)
+	if language, ok := languageFilenames[strings.ToLower(name)]; ok {
+		return language
+	}
+	return languageExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// Return the language of a file from its name, or if that isn't recognized
+// then from a shebang line at the start of content, e.g. a script without
+// an extension
+func DetectLanguage(path string, content []byte) string {
+	if language := LanguageFor(path); language != "" {
+		return language
+	}
+
+	match := shebangRegex.FindSubmatch(content)
+	if match == nil {
+		return ""
+	}
+	return shebangLanguages[string(match[1])]
+}
@@ -0,0 +1,107 @@
+package embedding
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLanguageFor(t *testing.T) {
+	testCases := map[string]string{
+		"main.go":               "go",
+		"/src/app/models.py":    "python",
+		"index.js":              "javascript",
+		"component.tsx":         "typescript",
+		"lib.rs":                "rust",
+		"Main.java":             "java",
+		"util.h":                "c",
+		"engine.cpp":            "cpp",
+		"install.sh":            "shell",
+		"query.sql":             "sql",
+		"config.yml":            "yaml",
+		"README.md":             "markdown",
+		"docs/GUIDE.MD":         "markdown",
+		"Makefile":              "make",
+		"build/Dockerfile":      "dockerfile",
+		"butterfish.proto":      "protobuf",
+		"notes.txt":             "text",
+		"photo.jpeg":            "",
+		"no_extension":          "",
+		"archive.tar.gz":        "",
+		".github/workflows/x.y": "",
+	}
+
+	for path, expected := range testCases {
+		assert.Equal(t, expected, LanguageFor(path), path)
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	// the extension wins over the content
+	assert.Equal(t, "go", DetectLanguage("main.go", []byte("#!/bin/bash\n")))
+
+	assert.Equal(t, "python", DetectLanguage("deploy", []byte("#!/usr/bin/env python3\nprint('hi')\n")))
+	assert.Equal(t, "shell", DetectLanguage("bin/run", []byte("#!/bin/bash\nset -e\n")))
+	assert.Equal(t, "shell", DetectLanguage("bin/run", []byte("#! /bin/sh\n")))
+	assert.Equal(t, "typescript", DetectLanguage("serve", []byte("#!/usr/bin/env -S deno run\n")))
+	assert.Equal(t, "", DetectLanguage("bin/tool", []byte("#!/usr/local/bin/unknown\n")))
+	assert.Equal(t, "", DetectLanguage("notes", []byte("just some text\n#!/bin/bash\n")))
+}
+
+func TestIndexExtensionsAndLanguages(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, fs.MkdirAll("/repo", 0755))
+	files := map[string]string{
+		"main.go":   "package main",
+		"README.md": "# Readme\n\nSome docs",
+		"notes.txt": "some notes",
+		"deploy":    "#!/usr/bin/env python\nprint('deploy')\n",
+	}
+	for name, content := range files {
+		assert.NoError(t, afero.WriteFile(fs, "/repo/"+name, []byte(content), 0644))
+	}
+	ctx := context.Background()
+
+	index, _ := newTestDiskCachedEmbeddingIndex(fs)
+	assert.NoError(t, index.IndexPath(ctx, "/repo", false, 512, 8))
+
+	languages := map[string]string{}
+	for name, file := range index.Index["/repo"].Files {
+		languages[name] = file.Embeddings[0].Language
+	}
+	assert.Equal(t, map[string]string{
+		"main.go":   "go",
+		"README.md": "markdown",
+		"notes.txt": "text",
+		"deploy":    "python",
+	}, languages)
+
+	// searches can be limited to languages, and results carry theirs
+	index.SearchLanguages = []string{"go", "python"}
+	query := make([]float32, 128)
+	for i := range query {
+		query[i] = 1
+	}
+	results, err := index.SearchWithVector(ctx, query, 10)
+	assert.NoError(t, err)
+	found := map[string]string{}
+	for _, result := range results {
+		found[result.FilePath] = result.Language
+	}
+	assert.Equal(t, map[string]string{"/repo/main.go": "go", "/repo/deploy": "python"}, found)
+
+	// only files with the configured extensions are indexed, with or
+	// without the leading dot
+	index, _ = newTestDiskCachedEmbeddingIndex(fs)
+	index.Extensions = []string{"go", ".MD"}
+	assert.NoError(t, index.IndexPath(ctx, "/repo", false, 512, 8))
+	indexed := []string{}
+	for name := range index.Index["/repo"].Files {
+		indexed = append(indexed, name)
+	}
+	sort.Strings(indexed)
+	assert.Equal(t, []string{"README.md", "main.go"}, indexed)
+}
@@ -0,0 +1,104 @@
+package embedding
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	pb "github.com/bakks/butterfish/proto"
+)
+
+var namespaceRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+var namespaceUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// The embeddings of a namespace that isn't currently active
+type namespaceIndex struct {
+	index    map[string]*pb.DirectoryIndex
+	dirty    map[string]bool
+	unloaded map[string]string
+}
+
+// Namespace returns the name of the active namespace, "" is the default
+// namespace
+func (this *DiskCachedEmbeddingIndex) Namespace() string {
+	return this.namespace
+}
+
+// SetNamespace switches the index to a named namespace. Each namespace has
+// its own embeddings in memory and its own cache files on disk, so projects
+// that are loaded, indexed, or searched in one namespace don't show up in
+// another. Embeddings already loaded in the previous namespace are kept and
+// come back when switching back to it. The empty name is the default
+// namespace, which uses DotfileName unchanged.
+func (this *DiskCachedEmbeddingIndex) SetNamespace(name string) error {
+	if name != "" && !namespaceRegex.MatchString(name) {
+		return fmt.Errorf("Invalid namespace %q, use letters, digits, - and _", name)
+	}
+	if name == this.namespace {
+		return nil
+	}
+
+	if this.namespaces == nil {
+		this.namespaces = make(map[string]*namespaceIndex)
+	}
+	this.namespaces[this.namespace] = &namespaceIndex{
+		index:    this.Index,
+		dirty:    this.dirty,
+		unloaded: this.unloaded,
+	}
+
+	next, ok := this.namespaces[name]
+	if !ok {
+		next = &namespaceIndex{index: make(map[string]*pb.DirectoryIndex)}
+	}
+	delete(this.namespaces, name)
+
+	this.Index = next.index
+	this.dirty = next.dirty
+	this.unloaded = next.unloaded
+	this.namespace = name
+	this.invalidateANN()
+	return nil
+}
+
+// Namespaces returns the sorted names of the namespaces used so far,
+// including the active one
+func (this *DiskCachedEmbeddingIndex) Namespaces() []string {
+	names := []string{this.namespace}
+	for name := range this.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The name of the cache files of the active namespace
+func (this *DiskCachedEmbeddingIndex) dotfileName() string {
+	if this.namespace == "" {
+		return this.DotfileName
+	}
+	return this.DotfileName + "." + this.namespace
+}
+
+// NamespaceForPath returns a namespace name keyed by a project's root path,
+// the directory name followed by a hash of the absolute path so that two
+// projects with the same directory name still get separate namespaces
+func NamespaceForPath(root string) (string, error) {
+	absPath, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	base := namespaceUnsafeChars.ReplaceAllString(filepath.Base(absPath), "-")
+	base = strings.Trim(base, "-")
+	if base == "" {
+		base = "root"
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(absPath))
+	return fmt.Sprintf("%s-%08x", base, hash.Sum32()), nil
+}
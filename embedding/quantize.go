@@ -0,0 +1,69 @@
+package embedding
+
+import (
+	"math"
+
+	pb "github.com/bakks/butterfish/proto"
+)
+
+// Quantize a vector to one signed byte per dimension. The scale maps the
+// largest magnitude in the vector to 127, so each value is stored as
+// round(v / scale) and recovered as q * scale. This uses a quarter of the
+// memory of float32 at the cost of some precision.
+func QuantizeVector(vector []float32) ([]byte, float32) {
+	var maxAbs float32
+	for _, value := range vector {
+		if abs := float32(math.Abs(float64(value))); abs > maxAbs {
+			maxAbs = abs
+		}
+	}
+
+	quantized := make([]byte, len(vector))
+	if maxAbs == 0 {
+		return quantized, 0
+	}
+
+	scale := maxAbs / 127
+	for i, value := range vector {
+		q := math.Round(float64(value / scale))
+		q = math.Max(-127, math.Min(127, q))
+		quantized[i] = byte(int8(q))
+	}
+
+	return quantized, scale
+}
+
+// Reverse QuantizeVector
+func DequantizeVector(quantized []byte, scale float32) []float32 {
+	vector := make([]float32, len(quantized))
+	for i, q := range quantized {
+		vector[i] = float32(int8(q)) * scale
+	}
+	return vector
+}
+
+// Replace the full precision vector of an embedding with a quantized one
+func quantizeEmbedding(embedding *pb.AnnotatedEmbedding) {
+	if len(embedding.Vector) == 0 {
+		return
+	}
+	embedding.Quantized, embedding.Scale = QuantizeVector(embedding.Vector)
+	embedding.Vector = nil
+}
+
+// Return the vector of an embedding whether it's stored at full precision or
+// quantized
+func embeddingVector(embedding *pb.AnnotatedEmbedding) []float32 {
+	if len(embedding.Quantized) > 0 {
+		return DequantizeVector(embedding.Quantized, embedding.Scale)
+	}
+	return embedding.Vector
+}
+
+// Return the number of dimensions of an embedding without dequantizing it
+func embeddingDimensions(embedding *pb.AnnotatedEmbedding) int {
+	if len(embedding.Quantized) > 0 {
+		return len(embedding.Quantized)
+	}
+	return len(embedding.Vector)
+}
@@ -0,0 +1,323 @@
+package embedding
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pb "github.com/bakks/butterfish/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/afero"
+)
+
+// Checking and repairing the cache files: VerifyCache reads the cache files
+// on disk and reports entries that can't be used, and RebuildCache clears
+// the cache for a path and embeds its indexed files again. Corrupt cache
+// files are ignored when loading, so their files aren't searchable until
+// they're rebuilt or indexed again.
+
+// A problem VerifyCache found in a cache file
+type CacheProblem struct {
+	// Path of the cache file
+	Dotfile string
+	// The indexed file the problem is in, relative to the cache file's
+	// directory, empty if it's the whole cache file
+	File    string
+	Problem string
+}
+
+func (this CacheProblem) String() string {
+	if this.File == "" {
+		return fmt.Sprintf("%s: %s", this.Dotfile, this.Problem)
+	}
+	return fmt.Sprintf("%s: %s %s", this.Dotfile, this.File, this.Problem)
+}
+
+// VerifyCache reads the cache files in each path and its subdirectories and
+// reports those that can't be decoded, were built with a different model,
+// or hold vectors that are empty or have different dimensions from the rest
+// of the index. With a shared cache, indexed chunks whose shared entries are
+// missing, can't be decoded, or have the wrong dimensions are reported too.
+// The index and the cache files are left as they are.
+func (this *DiskCachedEmbeddingIndex) VerifyCache(ctx context.Context, paths []string) ([]CacheProblem, error) {
+	dotfiles := []string{}
+	for _, path := range paths {
+		pathDotfiles, err := this.dotfilesForLoad(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		dotfiles = append(dotfiles, pathDotfiles...)
+	}
+
+	problems := []CacheProblem{}
+	dirIndexes := map[string]*pb.DirectoryIndex{}
+	for _, dotfile := range dotfiles {
+		buf, err := afero.ReadFile(this.Fs, dotfile)
+		if err != nil {
+			return nil, err
+		}
+
+		dirIndex := &pb.DirectoryIndex{}
+		err = proto.Unmarshal(buf, dirIndex)
+		if err != nil {
+			problems = append(problems, CacheProblem{
+				Dotfile: dotfile,
+				Problem: fmt.Sprintf("can't be decoded: %s", err),
+			})
+			continue
+		}
+		dirIndexes[dotfile] = dirIndex
+	}
+
+	dimensions := this.Dimensions()
+	if dimensions == 0 {
+		dimensions = commonDimensions(dirIndexes)
+	}
+
+	// extracted documents, in case a file has several chunks to check
+	docs := map[string]*Document{}
+
+	for _, dotfile := range dotfiles {
+		dirIndex, ok := dirIndexes[dotfile]
+		if !ok {
+			continue
+		}
+
+		if reason := this.incompatibleReason(dirIndex, false); reason != "" {
+			problems = append(problems, CacheProblem{Dotfile: dotfile, Problem: reason})
+			continue
+		}
+
+		names := make([]string, 0, len(dirIndex.Files))
+		for name := range dirIndex.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			problem := fileProblem(dirIndex.Files[name], dimensions)
+			if problem == "" {
+				path := filepath.Join(filepath.Dir(dotfile), name)
+				var err error
+				problem, err = this.sharedCacheProblem(docs, path, dirIndex.Files[name], dimensions)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if problem != "" {
+				problems = append(problems, CacheProblem{Dotfile: dotfile, File: name, Problem: problem})
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// Describe what's wrong with the shared cache entries for a file's chunks,
+// or return an empty string if they can be used. The chunks' text is read
+// back from the file, so files that have been deleted aren't checked.
+func (this *DiskCachedEmbeddingIndex) sharedCacheProblem(docs map[string]*Document,
+	path string, fileIndex *pb.FileEmbeddings, dimensions int) (string, error) {
+	if this.SharedCache == nil || this.CacheMode == CacheOff || dimensions == 0 {
+		return "", nil
+	}
+	_, err := this.Fs.Stat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	extractor := this.extractorFor(path)
+	for _, embedding := range fileIndex.Embeddings {
+		if isAlias(embedding) {
+			continue
+		}
+
+		var content []byte
+		if extractor != nil {
+			content, err = this.readExtractedRange(extractor, docs, path, embedding.Start, embedding.End)
+		} else {
+			content, err = this.readRange(path, embedding.Start, embedding.End)
+		}
+		if err != nil {
+			return fmt.Sprintf("has a chunk at %d-%d that can't be read: %s", embedding.Start, embedding.End, err), nil
+		}
+
+		// chunks are embedded with their headings, see embedFile
+		text := string(content)
+		if embedding.Heading != "" {
+			text = embedding.Heading + "\n\n" + text
+		}
+
+		problem, err := this.SharedCache.Check(this.embedderName(), this.EmbeddingModel, dimensions, text)
+		if err != nil {
+			return "", fmt.Errorf("Unable to read shared embedding cache: %s", err)
+		}
+		if problem != "" {
+			return fmt.Sprintf("has a chunk at %d-%d whose shared cache entry %s",
+				embedding.Start, embedding.End, problem), nil
+		}
+	}
+	return "", nil
+}
+
+// The most common vector length in the cache files, ties go to the longer
+func commonDimensions(dirIndexes map[string]*pb.DirectoryIndex) int {
+	counts := map[int]int{}
+	for _, dirIndex := range dirIndexes {
+		for _, fileIndex := range dirIndex.Files {
+			for _, embedding := range fileIndex.Embeddings {
+				if !isAlias(embedding) && embeddingDimensions(embedding) > 0 {
+					counts[embeddingDimensions(embedding)]++
+				}
+			}
+		}
+	}
+
+	best := 0
+	for dimensions, count := range counts {
+		if count > counts[best] || (count == counts[best] && dimensions > best) {
+			best = dimensions
+		}
+	}
+	return best
+}
+
+// Describe what's wrong with a file's cached chunks, or return an empty
+// string if they can be searched
+func fileProblem(fileIndex *pb.FileEmbeddings, dimensions int) string {
+	for _, embedding := range fileIndex.Embeddings {
+		if isAlias(embedding) {
+			continue
+		}
+
+		fileDimensions := embeddingDimensions(embedding)
+		if fileDimensions == 0 {
+			return fmt.Sprintf("has a chunk at %d-%d without a vector", embedding.Start, embedding.End)
+		}
+		if dimensions != 0 && fileDimensions != dimensions {
+			return fmt.Sprintf("has %d dimensional vectors rather than %d", fileDimensions, dimensions)
+		}
+	}
+	return ""
+}
+
+// RebuildCache clears the index and cache files for each path, like
+// ClearPaths, then embeds the files that were indexed there again and saves
+// new cache files. The indexed files are those in memory and those listed
+// in the cache files on disk, files that no longer exist are dropped. A
+// cache file that can't be decoded doesn't say which files it held, so the
+// indexable files in its directory are embedded instead. Every chunk is
+// embedded again rather than taken from the shared cache, whose entries are
+// replaced. As with ClearPath, unless CacheMode is CacheReadWrite only the
+// in-memory index is rebuilt.
+func (this *DiskCachedEmbeddingIndex) RebuildCache(ctx context.Context, paths []string, chunkSize, maxChunks int) error {
+	files := map[string]bool{}
+	rescanDirs := []string{}
+
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+
+		for dirPath, dirIndex := range this.Index {
+			if dirPath != path && !strings.HasPrefix(dirPath, path+string(filepath.Separator)) {
+				continue
+			}
+			for name := range dirIndex.Files {
+				files[filepath.Join(dirPath, name)] = true
+			}
+		}
+
+		dotfiles, err := this.dotfilesForLoad(ctx, path)
+		if err != nil {
+			return err
+		}
+		for _, dotfile := range dotfiles {
+			dirPath := filepath.Dir(dotfile)
+			buf, err := afero.ReadFile(this.Fs, dotfile)
+			if err != nil {
+				return err
+			}
+
+			dirIndex := &pb.DirectoryIndex{}
+			if proto.Unmarshal(buf, dirIndex) != nil {
+				rescanDirs = append(rescanDirs, dirPath)
+				continue
+			}
+			for name := range dirIndex.Files {
+				files[filepath.Join(dirPath, name)] = true
+			}
+		}
+
+		err = this.ClearPath(ctx, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	work := &indexWork{refreshShared: true}
+	queued := map[string]bool{}
+	addJob := func(dirPath, name string) {
+		if queued[filepath.Join(dirPath, name)] {
+			return
+		}
+		queued[filepath.Join(dirPath, name)] = true
+
+		dirIndex, ok := this.Index[dirPath]
+		if !ok {
+			dirIndex = NewDirectoryIndex()
+			this.Index[dirPath] = dirIndex
+			work.dirs = append(work.dirs, dirPath)
+		}
+		work.files = append(work.files, &embedJob{dirIndex: dirIndex, dirPath: dirPath, name: name})
+	}
+
+	sortedFiles := make([]string, 0, len(files))
+	for path := range files {
+		sortedFiles = append(sortedFiles, path)
+	}
+	sort.Strings(sortedFiles)
+
+	for _, path := range sortedFiles {
+		_, err := this.Fs.Stat(path)
+		if os.IsNotExist(err) {
+			fmt.Fprintf(this.Out, "Dropping %s from the index, it no longer exists\n", path)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		addJob(filepath.Dir(path), filepath.Base(path))
+	}
+
+	for _, dirPath := range rescanDirs {
+		fmt.Fprintf(this.Out, "Index cache in %s is corrupt, embedding its indexable files\n", dirPath)
+
+		dirFiles, err := afero.ReadDir(this.Fs, dirPath)
+		if err != nil {
+			return err
+		}
+
+		var ignores gitignoreStack
+		if this.UseGitignore {
+			ignores = ancestorGitignores(this.Fs, dirPath).push(this.Fs, dirPath)
+		}
+		for _, file := range this.FilterUnindexablefiles(dirPath, dirFiles, true, NewDirectoryIndex()) {
+			if !ignores.Ignored(filepath.Join(dirPath, file.Name()), false) {
+				addJob(dirPath, file.Name())
+			}
+		}
+	}
+
+	if this.Verbosity >= 1 {
+		fmt.Fprintf(this.Out, "Rebuilding index cache for %d files\n", len(work.files))
+	}
+	return this.embedFiles(ctx, work, chunkSize, maxChunks)
+}
@@ -0,0 +1,301 @@
+package embedding
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	pb "github.com/bakks/butterfish/proto"
+	"github.com/golang/protobuf/proto"
+)
+
+// Searching in shards: the directory indexes are split into groups of
+// ShardSize, each group is searched on its own for its best results, and
+// those are merged into the overall best. Only one shard's candidates are
+// held per worker rather than every vector in the index, and with LazyLoad
+// the shard's cache files are only read while it's being searched. Shards
+// are contiguous runs of the sorted directories so that merging gives
+// exactly the results, in the same order, as searching a single shard.
+
+// The best results of one shard and the aliases found in it
+type shardResult struct {
+	results []*VectorSearchResult
+	aliases map[chunkKey][]ChunkLocation
+}
+
+// Split sorted directories into runs of size, or a single shard if size is
+// 0. There's always at least one shard, even if it's empty.
+func shardDirectories(dirPaths []string, size int) [][]string {
+	if size <= 0 || len(dirPaths) <= size {
+		return [][]string{dirPaths}
+	}
+
+	shards := [][]string{}
+	for start := 0; start < len(dirPaths); start += size {
+		end := start + size
+		if end > len(dirPaths) {
+			end = len(dirPaths)
+		}
+		shards = append(shards, dirPaths[start:end])
+	}
+	return shards
+}
+
+// The sorted directories a search covers, those loaded into memory and those
+// waiting to be loaded lazily
+func (this *DiskCachedEmbeddingIndex) searchDirectories() []string {
+	dirPaths := make([]string, 0, len(this.Index)+len(this.unloaded))
+	for dirPath := range this.Index {
+		dirPaths = append(dirPaths, dirPath)
+	}
+	for dirPath := range this.unloaded {
+		if _, ok := this.Index[dirPath]; !ok {
+			dirPaths = append(dirPaths, dirPath)
+		}
+	}
+	sort.Strings(dirPaths)
+	return dirPaths
+}
+
+// Search the shards with up to ShardWorkers at once and merge their results
+func (this *DiskCachedEmbeddingIndex) searchShards(ctx context.Context,
+	queryVector []float32, numResults int) ([]*VectorSearchResult, error) {
+	shards := shardDirectories(this.searchDirectories(), this.ShardSize)
+	results := make([]*shardResult, len(shards))
+	errs := make([]error, len(shards))
+
+	workers := this.ShardWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	semaphore := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+
+	for i, shard := range shards {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, shard []string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			results[i], errs[i] = this.searchShard(ctx, queryVector, shard, numResults)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return mergeShardResults(results, numResults), nil
+}
+
+// Merge the results of each shard into the overall best numResults. Equal
+// scores keep shard order, which is the order a single shard would return.
+// A chunk's aliases can be in other shards so they're collected from all of
+// them.
+func mergeShardResults(shards []*shardResult, numResults int) []*VectorSearchResult {
+	merged := []*VectorSearchResult{}
+	aliases := map[chunkKey][]ChunkLocation{}
+	for _, shard := range shards {
+		merged = append(merged, shard.results...)
+		for key, locations := range shard.aliases {
+			aliases[key] = append(aliases[key], locations...)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Score > merged[j].Score
+	})
+	if numResults < len(merged) {
+		merged = merged[:numResults]
+	}
+
+	for _, result := range merged {
+		result.Aliases = aliases[chunkKey{result.FilePath, result.Start}]
+	}
+	return merged
+}
+
+// Score every vector in a shard's directories and return the best
+// numResults, along with the shard's aliases
+func (this *DiskCachedEmbeddingIndex) searchShard(ctx context.Context,
+	queryVector []float32, dirPaths []string, numResults int) (*shardResult, error) {
+	candidates, vectors, aliases, err := this.shardCandidates(ctx, dirPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, candidate := range candidates {
+		if len(vectors[i]) != len(queryVector) {
+			return nil, fmt.Errorf("Embedding dimension mismatch: query has %d dimensions but %s has %d, the index may have been built with a different model",
+				len(queryVector), candidate.FilePath, len(vectors[i]))
+		}
+	}
+
+	ranked, err := TopK(float32To64(queryVector), vectors, numResults)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*VectorSearchResult, len(ranked))
+	for i, scored := range ranked {
+		results[i] = candidates[scored.Index]
+		results[i].Score = scored.Score
+	}
+
+	return &shardResult{results: results, aliases: aliases}, nil
+}
+
+// The searchable vectors in a shard's directories in a stable order, the
+// results they'd be returned as, and the aliases found alongside them.
+// Embeddings not in SearchLanguages are skipped.
+func (this *DiskCachedEmbeddingIndex) shardCandidates(ctx context.Context,
+	dirPaths []string) ([]*VectorSearchResult, [][]float64, map[chunkKey][]ChunkLocation, error) {
+	candidates := []*VectorSearchResult{}
+	vectors := [][]float64{}
+	aliases := map[chunkKey][]ChunkLocation{}
+
+	for _, dirIndexAbsPath := range dirPaths {
+		if ctx.Err() != nil {
+			return nil, nil, nil, ctx.Err()
+		}
+
+		dirIndex, err := this.shardDirectory(dirIndexAbsPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if dirIndex == nil {
+			continue
+		}
+
+		// walk the files in sorted order so that results with equal scores
+		// come back in the same order every time
+		filenames := make([]string, 0, len(dirIndex.Files))
+		for filename := range dirIndex.Files {
+			filenames = append(filenames, filename)
+		}
+		sort.Strings(filenames)
+
+		for _, filename := range filenames {
+			if ctx.Err() != nil {
+				return nil, nil, nil, ctx.Err()
+			}
+
+			fileIndex := dirIndex.Files[filename]
+			absPath := filepath.Join(dirIndexAbsPath, filename)
+			for _, embedding := range fileIndex.Embeddings {
+				language := embedding.Language
+				if language == "" {
+					// embedded before languages were recorded
+					language = LanguageFor(absPath)
+				}
+				if len(this.SearchLanguages) > 0 && !contains(this.SearchLanguages, language) {
+					continue
+				}
+
+				if isAlias(embedding) {
+					key := chunkKey{embedding.AliasPath, embedding.AliasStart}
+					aliases[key] = append(aliases[key], ChunkLocation{
+						FilePath: absPath,
+						Start:    embedding.Start,
+						End:      embedding.End,
+						Heading:  embedding.Heading,
+					})
+					continue
+				}
+
+				vector := embeddingVector(embedding)
+				candidates = append(candidates, &VectorSearchResult{
+					FilePath: absPath,
+					Start:    embedding.Start,
+					End:      embedding.End,
+					Vector:   vector,
+					Heading:  embedding.Heading,
+					Language: language,
+				})
+				vectors = append(vectors, float32To64(vector))
+			}
+		}
+	}
+
+	return candidates, vectors, aliases, nil
+}
+
+// The index of a directory being searched, read from its cache file if it
+// hasn't been loaded. Lazily read directories aren't kept in memory. Returns
+// nil if the cache file is missing or can't be used with this index.
+func (this *DiskCachedEmbeddingIndex) shardDirectory(dirPath string) (*pb.DirectoryIndex, error) {
+	if dirIndex, ok := this.Index[dirPath]; ok {
+		return dirIndex, nil
+	}
+
+	// dimensions can only be compared with what's loaded, the search checks
+	// them against the query instead
+	dirIndex, _, err := this.readDotfile(this.unloaded[dirPath], false)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read index cache for %s: %s", dirPath, err)
+	}
+	return dirIndex, nil
+}
+
+// Read and decode a cache file. If it can't be used with this index then
+// the reason is returned rather than the index, see incompatibleReason. A
+// missing file returns nothing.
+func (this *DiskCachedEmbeddingIndex) readDotfile(dotfile string, checkDimensions bool) (*pb.DirectoryIndex, string, error) {
+	file, err := this.Fs.Open(dotfile)
+	if err != nil {
+		return nil, "", nil
+	}
+	defer file.Close()
+
+	buf, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// a corrupt cache is ignored like an incompatible one so that its files
+	// are embedded again, see VerifyCache
+	dirIndex := &pb.DirectoryIndex{}
+	err = proto.Unmarshal(buf, dirIndex)
+	if err != nil {
+		return nil, fmt.Sprintf("is corrupt (%s)", err), nil
+	}
+
+	if reason := this.incompatibleReason(dirIndex, checkDimensions); reason != "" {
+		return nil, reason, nil
+	}
+	return dirIndex, "", nil
+}
+
+// Load the cache files registered with LazyLoad into memory, for operations
+// that need the whole index rather than one shard at a time
+func (this *DiskCachedEmbeddingIndex) loadUnloaded() error {
+	dirPaths := make([]string, 0, len(this.unloaded))
+	for dirPath := range this.unloaded {
+		dirPaths = append(dirPaths, dirPath)
+	}
+	sort.Strings(dirPaths)
+
+	for _, dirPath := range dirPaths {
+		err := this.loadDotfile(this.unloaded[dirPath])
+		if err != nil {
+			return err
+		}
+		delete(this.unloaded, dirPath)
+	}
+	return nil
+}
+
+// Load the lazily registered cache files for an operation that can't return
+// an error, reporting a failure to Out
+func (this *DiskCachedEmbeddingIndex) mustLoadUnloaded() {
+	err := this.loadUnloaded()
+	if err != nil {
+		fmt.Fprintf(this.Out, "Unable to load index cache: %s\n", err)
+	}
+}
@@ -0,0 +1,252 @@
+package embedding
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// A content-addressed store of embeddings shared by every index, so chunks
+// that are identical across projects, e.g. dependencies vendored into each
+// package of a monorepo, are only embedded once. Each entry is keyed by a
+// hash of the embedder, the embedding model, the vectors' dimensions, and
+// the chunk's exact text, and is a file under Dir holding the vector. The
+// dimensions each embedder and model produce are recorded too, so a new
+// index knows which entries it can use. Indexes look chunks up here before
+// calling the embedder and add the vectors they had to embed, their own
+// cache files keep copies of the vectors so searching doesn't read the
+// store. Entries are written atomically so several processes can share it.
+type SharedEmbeddingCache struct {
+	Fs  afero.Fs
+	Dir string
+}
+
+func NewSharedEmbeddingCache(fs afero.Fs, dir string) *SharedEmbeddingCache {
+	return &SharedEmbeddingCache{Fs: fs, Dir: dir}
+}
+
+// The key of the entry for content embedded by embedder with model into
+// vectors of the given dimensions
+func SharedCacheKey(embedder, model string, dimensions int, content string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00", embedder, model, dimensions)
+	h.Write([]byte(content))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Entries are spread over subdirectories named by the first byte of their
+// key so no single directory gets too large
+func (this *SharedEmbeddingCache) path(key string) string {
+	return filepath.Join(this.Dir, key[:2], key)
+}
+
+// Where the dimensions of embedder and model's vectors are recorded
+func (this *SharedEmbeddingCache) dimensionsPath(embedder, model string) string {
+	sum := sha256.Sum256([]byte(embedder + "\x00" + model))
+	return filepath.Join(this.Dir, "dimensions", hex.EncodeToString(sum[:]))
+}
+
+// The dimensions of the vectors last stored for embedder and model, 0 if
+// there aren't any
+func (this *SharedEmbeddingCache) Dimensions(embedder, model string) (int, error) {
+	buf, err := afero.ReadFile(this.Fs, this.dimensionsPath(embedder, model))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	dimensions, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return 0, nil
+	}
+	return dimensions, nil
+}
+
+// The vector cached for content embedded by embedder with model, or nil if
+// there isn't one of the given dimensions. An entry that can't be decoded
+// or has the wrong length is treated as missing and replaced by the next
+// Put.
+func (this *SharedEmbeddingCache) Get(embedder, model string, dimensions int, content string) ([]float32, error) {
+	buf, err := afero.ReadFile(this.Fs, this.path(SharedCacheKey(embedder, model, dimensions, content)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	vector := decodeVector(buf)
+	if len(vector) != dimensions {
+		return nil, nil
+	}
+	return vector, nil
+}
+
+// Describe what's wrong with the entry for content embedded by embedder with
+// model into vectors of the given dimensions, e.g. "is missing", or return
+// an empty string if it can be used
+func (this *SharedEmbeddingCache) Check(embedder, model string, dimensions int, content string) (string, error) {
+	buf, err := afero.ReadFile(this.Fs, this.path(SharedCacheKey(embedder, model, dimensions, content)))
+	if os.IsNotExist(err) {
+		return "is missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	vector := decodeVector(buf)
+	if vector == nil {
+		return "can't be decoded", nil
+	}
+	if len(vector) != dimensions {
+		return fmt.Sprintf("has %d dimensions rather than %d", len(vector), dimensions), nil
+	}
+	return "", nil
+}
+
+// Store the vector for content embedded by embedder with model
+func (this *SharedEmbeddingCache) Put(embedder, model, content string, vector []float32) error {
+	err := this.writeFile(this.path(SharedCacheKey(embedder, model, len(vector), content)), encodeVector(vector))
+	if err != nil {
+		return err
+	}
+
+	dimensions, err := this.Dimensions(embedder, model)
+	if err != nil || dimensions == len(vector) {
+		return err
+	}
+	return this.writeFile(this.dimensionsPath(embedder, model), []byte(strconv.Itoa(len(vector))))
+}
+
+// Write then rename so readers never see half a file
+func (this *SharedEmbeddingCache) writeFile(path string, data []byte) error {
+	err := this.Fs.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := fmt.Sprintf("%s.%d.tmp", path, time.Now().UnixNano())
+	err = afero.WriteFile(this.Fs, tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return this.Fs.Rename(tmpPath, path)
+}
+
+// Vectors are stored as little-endian float32s
+func encodeVector(vector []float32) []byte {
+	buf := make([]byte, 4*len(vector))
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(value))
+	}
+	return buf
+}
+
+// Decode a stored vector, nil if buf isn't one
+func decodeVector(buf []byte) []float32 {
+	if len(buf) == 0 || len(buf)%4 != 0 {
+		return nil
+	}
+
+	vector := make([]float32, len(buf)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return vector
+}
+
+// Embed content with the embedder, taking the vectors already in the shared
+// cache from there and adding the rest. Cached vectors must have the given
+// dimensions, or if that's 0 the dimensions the shared cache last recorded
+// for the embedder and model. With refresh the cached vectors aren't used
+// and the embedder's replace them, so a rebuild can't copy bad entries back
+// into the index. Without a shared cache, or with CacheOff, this just calls
+// the embedder. With CacheReadOnly the shared cache is read but not written.
+func (this *DiskCachedEmbeddingIndex) calculateEmbeddings(ctx context.Context, content []string, dimensions int, refresh bool) ([][]float32, error) {
+	if this.SharedCache == nil || this.CacheMode == CacheOff {
+		return this.Embedder.CalculateEmbeddings(ctx, content)
+	}
+
+	embedder := this.embedderName()
+	if refresh {
+		dimensions = 0
+	} else if dimensions == 0 {
+		var err error
+		dimensions, err = this.SharedCache.Dimensions(embedder, this.EmbeddingModel)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read shared embedding cache: %s", err)
+		}
+	}
+
+	embeddings := make([][]float32, len(content))
+	missing := []string{}
+	missingIndexes := []int{}
+	for i, str := range content {
+		var vector []float32
+		if dimensions != 0 {
+			var err error
+			vector, err = this.SharedCache.Get(embedder, this.EmbeddingModel, dimensions, str)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read shared embedding cache: %s", err)
+			}
+		}
+		if vector == nil {
+			missing = append(missing, str)
+			missingIndexes = append(missingIndexes, i)
+			continue
+		}
+		embeddings[i] = vector
+	}
+
+	if this.Verbosity >= 2 {
+		fmt.Fprintf(this.Out, "Found %d of %d chunks in the shared embedding cache\n",
+			len(content)-len(missing), len(content))
+	}
+	if len(missing) == 0 {
+		return embeddings, nil
+	}
+
+	newEmbeddings, err := this.Embedder.CalculateEmbeddings(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	if len(newEmbeddings) != len(missing) {
+		return nil, fmt.Errorf("Embedder returned %d vectors for %d chunks", len(newEmbeddings), len(missing))
+	}
+
+	for i, vector := range newEmbeddings {
+		embeddings[missingIndexes[i]] = vector
+		if this.CacheMode != CacheReadWrite || len(vector) == 0 {
+			continue
+		}
+
+		err := this.SharedCache.Put(embedder, this.EmbeddingModel, missing[i], vector)
+		if err != nil {
+			// the index works without the shared cache, it just costs more
+			fmt.Fprintf(this.Out, "Unable to write shared embedding cache: %s\n", err)
+			break
+		}
+	}
+
+	return embeddings, nil
+}
+
+// Identifies the embedder in shared cache keys, along with EmbeddingModel
+func (this *DiskCachedEmbeddingIndex) embedderName() string {
+	if this.EmbedderName != "" {
+		return this.EmbedderName
+	}
+	return fmt.Sprintf("%T", this.Embedder)
+}
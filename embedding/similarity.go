@@ -0,0 +1,75 @@
+package embedding
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The position of a vector in a list passed to TopK and its similarity to
+// the query
+type ScoredIndex struct {
+	Index int
+	Score float64
+}
+
+// Return the cosine similarity of two vectors, from -1 (opposite) to 1 (same
+// direction). Vectors must be non-empty and have the same number of
+// dimensions. If either vector has zero magnitude the similarity is 0.
+func CosineSimilarity(a, b []float64) (float64, error) {
+	if len(a) == 0 || len(b) == 0 {
+		return 0, errors.New("Cannot compare zero-length vectors")
+	}
+	if len(a) != len(b) {
+		return 0, fmt.Errorf("Vector dimension mismatch: %d != %d", len(a), len(b))
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+
+	if normA == 0 || normB == 0 {
+		return 0, nil
+	}
+
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB)), nil
+}
+
+// Rank vectors by cosine similarity to the query and return the k most
+// similar, best first. Ties keep the order of the input. If k is larger than
+// the number of vectors then all of them are returned.
+func TopK(query []float64, vectors [][]float64, k int) ([]ScoredIndex, error) {
+	if k < 0 {
+		return nil, fmt.Errorf("k must not be negative, got %d", k)
+	}
+
+	scored := make([]ScoredIndex, 0, len(vectors))
+	for i, vector := range vectors {
+		score, err := CosineSimilarity(query, vector)
+		if err != nil {
+			return nil, fmt.Errorf("Vector %d: %w", i, err)
+		}
+		scored = append(scored, ScoredIndex{Index: i, Score: score})
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].Score > scored[j].Score
+	})
+
+	if k < len(scored) {
+		scored = scored[:k]
+	}
+	return scored, nil
+}
+
+func float32To64(vector []float32) []float64 {
+	out := make([]float64, len(vector))
+	for i, value := range vector {
+		out[i] = float64(value)
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package embedding
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCosineSimilarity(t *testing.T) {
+	score, err := CosineSimilarity([]float64{1, 0}, []float64{1, 0})
+	assert.NoError(t, err)
+	assert.InDelta(t, 1.0, score, 1e-9)
+
+	score, err = CosineSimilarity([]float64{1, 0}, []float64{0, 1})
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.0, score, 1e-9)
+
+	score, err = CosineSimilarity([]float64{1, 1}, []float64{-2, -2})
+	assert.NoError(t, err)
+	assert.InDelta(t, -1.0, score, 1e-9)
+
+	// magnitude doesn't matter, only direction
+	score, err = CosineSimilarity([]float64{3, 4}, []float64{6, 8})
+	assert.NoError(t, err)
+	assert.InDelta(t, 1.0, score, 1e-9)
+
+	score, err = CosineSimilarity([]float64{1, 1}, []float64{1, 0})
+	assert.NoError(t, err)
+	assert.InDelta(t, 1/math.Sqrt2, score, 1e-9)
+
+	score, err = CosineSimilarity([]float64{0, 0}, []float64{1, 0})
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, score)
+
+	_, err = CosineSimilarity([]float64{}, []float64{})
+	assert.ErrorContains(t, err, "zero-length")
+
+	_, err = CosineSimilarity([]float64{1, 2, 3}, []float64{1, 2})
+	assert.ErrorContains(t, err, "dimension mismatch: 3 != 2")
+}
+
+func TestTopK(t *testing.T) {
+	vectors := [][]float64{
+		{0, 1, 0},
+		{1, 0, 0},
+		{1, 1, 0},
+		{-1, 0, 0},
+		{1, 0.1, 0},
+	}
+
+	ranked, err := TopK([]float64{1, 0, 0}, vectors, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(ranked))
+	assert.Equal(t, []int{1, 4, 2}, []int{ranked[0].Index, ranked[1].Index, ranked[2].Index})
+	assert.InDelta(t, 1.0, ranked[0].Score, 1e-9)
+
+	// k larger than the number of vectors returns everything, worst last
+	ranked, err = TopK([]float64{1, 0, 0}, vectors, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(ranked))
+	assert.Equal(t, 3, ranked[4].Index)
+
+	// ties keep input order
+	ranked, err = TopK([]float64{0, 0, 1}, vectors, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []ScoredIndex{{0, 0}, {1, 0}}, ranked)
+
+	ranked, err = TopK([]float64{1, 0, 0}, nil, 3)
+	assert.NoError(t, err)
+	assert.Empty(t, ranked)
+
+	_, err = TopK([]float64{1, 0}, vectors, 3)
+	assert.ErrorContains(t, err, "Vector 0: Vector dimension mismatch")
+
+	_, err = TopK([]float64{1, 0, 0}, vectors, -1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,131 @@
+package embedding
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"path/filepath"
+
+	pb "github.com/bakks/butterfish/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/afero"
+)
+
+// Version of the snapshot format written by Save, bump this when the layout
+// of indexSnapshot changes
+const snapshotVersion = 1
+
+// A snapshot is the entire in-memory index written to a single file. Each
+// directory index is stored in the same protobuf encoding used by the
+// per-directory dotfiles.
+type indexSnapshot struct {
+	Version        int
+	EmbeddingModel string
+	Dimensions     int
+	// True if the index was built with int8 quantized vectors, older
+	// snapshots decode this as false
+	Quantized   bool
+	Directories map[string][]byte
+}
+
+// Save writes every vector currently held in memory, along with file
+// metadata and the embedding model name, to a single file at path. Unlike
+// the dotfile cache this gives one portable artifact for the whole index.
+func (this *DiskCachedEmbeddingIndex) Save(path string) error {
+	err := this.loadUnloaded()
+	if err != nil {
+		return err
+	}
+
+	snapshot := indexSnapshot{
+		Version:        snapshotVersion,
+		EmbeddingModel: this.EmbeddingModel,
+		Dimensions:     this.Dimensions(),
+		Quantized:      this.Quantize,
+		Directories:    make(map[string][]byte, len(this.Index)),
+	}
+
+	for dirPath, dirIndex := range this.Index {
+		buf, err := proto.Marshal(dirIndex)
+		if err != nil {
+			return err
+		}
+		snapshot.Directories[dirPath] = buf
+	}
+
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(&snapshot)
+	if err != nil {
+		return err
+	}
+
+	err = afero.WriteFile(this.Fs, path, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	if this.Verbosity >= 1 {
+		fmt.Fprintf(this.Out, "Saved index snapshot of %d directories to %s\n", len(snapshot.Directories), path)
+	}
+	return nil
+}
+
+// Load reads a file written by Save and merges its contents into the
+// in-memory index. The snapshot is refused if it was built with a different
+// embedding model or its vectors don't match the dimensions of the vectors
+// already loaded.
+func (this *DiskCachedEmbeddingIndex) Load(path string) error {
+	buf, err := afero.ReadFile(this.Fs, path)
+	if err != nil {
+		return err
+	}
+
+	var snapshot indexSnapshot
+	err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&snapshot)
+	if err != nil {
+		return fmt.Errorf("Unable to decode index snapshot %s: %s", path, err)
+	}
+
+	if snapshot.Version != snapshotVersion {
+		return fmt.Errorf("Unsupported index snapshot version %d in %s, expected %d",
+			snapshot.Version, path, snapshotVersion)
+	}
+
+	if this.EmbeddingModel != "" && snapshot.EmbeddingModel != this.EmbeddingModel {
+		return fmt.Errorf("Index snapshot %s was built with embedding model %s but the current model is %s",
+			path, snapshot.EmbeddingModel, this.EmbeddingModel)
+	}
+
+	dimensions := this.Dimensions()
+	if dimensions != 0 && snapshot.Dimensions != 0 && dimensions != snapshot.Dimensions {
+		return fmt.Errorf("Index snapshot %s has %d dimensions but the loaded index has %d",
+			path, snapshot.Dimensions, dimensions)
+	}
+
+	// decode everything before touching the in-memory index so a bad file
+	// doesn't leave us half loaded
+	loaded := make(map[string]*pb.DirectoryIndex, len(snapshot.Directories))
+	for dirPath, dirBuf := range snapshot.Directories {
+		dirIndex := &pb.DirectoryIndex{}
+		err = proto.Unmarshal(dirBuf, dirIndex)
+		if err != nil {
+			return fmt.Errorf("Unable to decode index for %s in snapshot %s: %s", dirPath, path, err)
+		}
+		loaded[filepath.Clean(dirPath)] = dirIndex
+	}
+
+	for dirPath, dirIndex := range loaded {
+		this.Index[dirPath] = dirIndex
+		delete(this.unloaded, dirPath)
+	}
+	this.invalidateANN()
+
+	if this.Verbosity >= 1 {
+		format := "full precision"
+		if snapshot.Quantized {
+			format = "quantized"
+		}
+		fmt.Fprintf(this.Out, "Loaded index snapshot of %d directories (%s) from %s\n", len(loaded), format, path)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package embedding
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// A summary of what's held in the index, used to check that it's current
+// and sized reasonably
+type IndexStats struct {
+	Directories    int
+	Files          int
+	Chunks         int
+	Vectors        int
+	Dimensions     int
+	EmbeddingModel string
+
+	// The active namespace, see DiskCachedEmbeddingIndex.SetNamespace
+	Namespace string
+
+	// Vectors stored as int8, see DiskCachedEmbeddingIndex.Quantize
+	QuantizedVectors int
+
+	// Chunks collapsed into a near duplicate, they're counted in Chunks but
+	// have no vector, see DiskCachedEmbeddingIndex.DedupThreshold
+	AliasChunks int
+
+	// Rough size of the index in memory: vectors, byte ranges, paths, and
+	// timestamps, ignoring map and protobuf overhead
+	ApproxBytes int64
+
+	// Modification times of the oldest and newest indexed files still on
+	// disk, zero if there are none
+	OldestModTime time.Time
+	NewestModTime time.Time
+
+	// Files modified since they were embedded, re-index to update them
+	StaleFiles int
+	// Indexed files that no longer exist on disk
+	MissingFiles int
+}
+
+// Compute stats over the files currently loaded in the index. Each indexed
+// file is stat'ed to find its modification time.
+func (this *DiskCachedEmbeddingIndex) Stats() IndexStats {
+	this.mustLoadUnloaded()
+
+	stats := IndexStats{
+		EmbeddingModel: this.EmbeddingModel,
+		Namespace:      this.namespace,
+		Dimensions:     this.Dimensions(),
+	}
+
+	for dirPath, dirIndex := range this.Index {
+		// directories are added to the index as they're walked, only count
+		// those with indexed files
+		if len(dirIndex.Files) == 0 {
+			continue
+		}
+		stats.Directories++
+		stats.ApproxBytes += int64(len(dirPath))
+
+		for name, fileIndex := range dirIndex.Files {
+			stats.Files++
+			// name and path, plus the updated_at timestamp
+			stats.ApproxBytes += int64(len(name)+len(fileIndex.Path)) + 12
+
+			for _, embedding := range fileIndex.Embeddings {
+				stats.Chunks++
+				// start and end offsets
+				stats.ApproxBytes += 16
+				if isAlias(embedding) {
+					stats.AliasChunks++
+					// path and start of the chunk it duplicates
+					stats.ApproxBytes += int64(len(embedding.AliasPath)) + 8
+				} else if len(embedding.Quantized) > 0 {
+					stats.Vectors++
+					stats.QuantizedVectors++
+					// one byte per dimension plus the scale
+					stats.ApproxBytes += int64(len(embedding.Quantized)) + 4
+				} else if len(embedding.Vector) > 0 {
+					stats.Vectors++
+					stats.ApproxBytes += int64(len(embedding.Vector)) * 4
+				}
+			}
+
+			info, err := this.Fs.Stat(filepath.Join(dirPath, name))
+			if err != nil {
+				stats.MissingFiles++
+				continue
+			}
+
+			modTime := info.ModTime()
+			if stats.OldestModTime.IsZero() || modTime.Before(stats.OldestModTime) {
+				stats.OldestModTime = modTime
+			}
+			if modTime.After(stats.NewestModTime) {
+				stats.NewestModTime = modTime
+			}
+			if fileIndex.UpdatedAt != nil && modTime.After(fileIndex.UpdatedAt.AsTime()) {
+				stats.StaleFiles++
+			}
+		}
+	}
+
+	return stats
+}
@@ -3,7 +3,6 @@ package prompt
 const (
 	PromptFixCommand           = "fix_command"
 	PromptSummarize            = "summarize"
-	PromptSummarizeFacts       = "summarize_facts"
 	PromptSummarizeListOfFacts = "summarize_list_of_facts"
 	PromptGenerateCommand      = "generate_command"
 	PromptQuestion             = "question"
@@ -13,6 +12,8 @@ const (
 	ShellAutosuggestPrompt     = "shell_autocomplete_prompt"
 	ShellSystemMessage         = "shell_system_message"
 	GoalModeSystemMessage      = "goal_mode_system_message"
+	GoalModeCommandResult      = "goal_mode_command_result"
+	PromptEdit                 = "edit"
 )
 
 // These are the default prompts used for Butterfish, they will be written
@@ -39,6 +40,20 @@ var DefaultPrompts []Prompt = []Prompt{
 		OkToReplace: true,
 	},
 
+	// GoalModeCommandResult is how the result of a command goal mode ran is
+	// given back to the model
+	{
+		Name:        GoalModeCommandResult,
+		OkToReplace: true,
+		Prompt: `Command: {command}
+Exit code: {status} ({result})
+Duration: {duration}
+Output (stdout and stderr combined):
+'''
+{output}
+'''`,
+	},
+
 	{
 		Name:        ShellAutosuggestCommand,
 		OkToReplace: true,
@@ -119,18 +134,6 @@ predicted question:
 {content}
 '''
 
-Summary:`,
-	},
-
-	// PromptSummarizeFacts is a prompt for summarizing facts
-	{
-		Name:        PromptSummarizeFacts,
-		OkToReplace: true,
-		Prompt: `The following is a raw text file, write a bullet-point list of facts from the document starting with the most important.
-'''
-{content}
-'''
-
 Summary:`,
 	},
 
@@ -168,4 +171,16 @@ Shell command:`,
 '''
 {question}:`,
 	},
+	// PromptEdit wraps the user's instruction and the file being edited, with
+	// line numbers, for the edit command
+	{
+		Name:        PromptEdit,
+		OkToReplace: true,
+		Prompt: `Edit the file below as follows: {instruction}
+
+Here is the file, each line is prefixed with its line number:
+'''
+{content}
+'''`,
+	},
 }
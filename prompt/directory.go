@@ -0,0 +1,191 @@
+package prompt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A prompt library can also be a directory with one file per prompt, which
+// gives cleaner diffs when a team keeps its prompts in version control:
+//
+//	prompts/
+//	  fix_command.txt
+//	  question.md
+//	  question.meta.yaml
+//
+// Each <name>.txt or <name>.md file holds the text of the prompt called
+// name. The optional <name>.meta.yaml sidecar holds its other settings,
+// e.g. "oktoreplace: true", and without one OkToReplace is false so that
+// edited files aren't overwritten by the defaults.
+
+// Extensions of prompt files, new prompts are written as .txt, and the
+// suffix of their sidecar files
+const (
+	promptFileExtension     = ".txt"
+	promptMarkdownExtension = ".md"
+	promptSidecarSuffix     = ".meta.yaml"
+)
+
+// Settings of a prompt kept in its sidecar file, the keys match the yaml
+// library file
+type promptSidecar struct {
+	OkToReplace bool `yaml:"oktoreplace"`
+}
+
+// Whether path is a directory layout library, it's either an existing
+// directory or a path ending in a separator for one that will be created
+func isDirectoryLibrary(path string) bool {
+	if strings.HasSuffix(path, "/") || strings.HasSuffix(path, string(filepath.Separator)) {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// The name of the prompt in a directory entry and whether it's a prompt
+// file, hidden files, sidecars, and other files are skipped
+func promptFileName(filename string) (string, bool) {
+	if strings.HasPrefix(filename, ".") {
+		return "", false
+	}
+	ext := filepath.Ext(filename)
+	if ext != promptFileExtension && ext != promptMarkdownExtension {
+		return "", false
+	}
+	return strings.TrimSuffix(filename, ext), true
+}
+
+// Read the prompts in a directory library, sorted by name
+func readPromptDirectory(dir string) ([]Prompt, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.New("Unable to access prompt directory, please check read permissions and try again.")
+	}
+
+	prompts := []Prompt{}
+	for _, entry := range entries {
+		name, ok := promptFileName(entry.Name())
+		if entry.IsDir() || !ok {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read prompt file %s: %w", entry.Name(), err)
+		}
+
+		sidecar := promptSidecar{}
+		data, err := os.ReadFile(filepath.Join(dir, name+promptSidecarSuffix))
+		if err == nil {
+			err = yaml.UnmarshalStrict(data, &sidecar)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid prompt settings %s: %s", name+promptSidecarSuffix, err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		prompts = append(prompts, Prompt{
+			Name: name,
+			// editors usually add a newline at the end of the file
+			Prompt:      strings.TrimSuffix(string(content), "\n"),
+			OkToReplace: sidecar.OkToReplace,
+		})
+	}
+
+	sort.SliceStable(prompts, func(i, j int) bool {
+		return prompts[i].Name < prompts[j].Name
+	})
+	return prompts, nil
+}
+
+// Write each prompt to its file in a directory library. A prompt already
+// kept in a .md file is written back to it, otherwise to a .txt file. Files
+// of prompts that aren't in the library are left alone.
+func writePromptDirectory(dir string, prompts []Prompt) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.New("Unable to access directory, please check write permissions and try again.")
+	}
+
+	for _, prompt := range prompts {
+		if prompt.Name == "" || strings.ContainsAny(prompt.Name, `/\`) || strings.HasPrefix(prompt.Name, ".") {
+			return fmt.Errorf("Prompt name %q can't be used as a file name", prompt.Name)
+		}
+
+		path := filepath.Join(dir, prompt.Name+promptMarkdownExtension)
+		if _, err := os.Stat(path); err != nil {
+			path = filepath.Join(dir, prompt.Name+promptFileExtension)
+		}
+
+		err := os.WriteFile(path, []byte(prompt.Prompt+"\n"), 0644)
+		if err != nil {
+			return errors.New("Unable to write file, please check write permissions and try again.")
+		}
+
+		sidecarPath := filepath.Join(dir, prompt.Name+promptSidecarSuffix)
+		if !prompt.OkToReplace {
+			err = os.Remove(sidecarPath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return errors.New("Unable to write file, please check write permissions and try again.")
+			}
+			continue
+		}
+
+		data, err := yaml.Marshal(promptSidecar{OkToReplace: prompt.OkToReplace})
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(sidecarPath, data, 0644)
+		if err != nil {
+			return errors.New("Unable to write file, please check write permissions and try again.")
+		}
+	}
+
+	return nil
+}
+
+// A summary of a directory library for Watch, changing when any file in it
+// is added, removed, or modified
+type directoryInfo struct {
+	os.FileInfo
+	modTime time.Time
+	size    int64
+}
+
+func (this *directoryInfo) ModTime() time.Time { return this.modTime }
+func (this *directoryInfo) Size() int64        { return this.size }
+
+// Stat a library, for a directory the latest modification time of it and
+// its files and a size that changes when files are added or removed
+func statLibrary(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return info, err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &directoryInfo{FileInfo: info, modTime: info.ModTime()}
+	for _, entry := range entries {
+		entryInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if entryInfo.ModTime().After(summary.modTime) {
+			summary.modTime = entryInfo.ModTime()
+		}
+		summary.size += entryInfo.Size() + 1
+	}
+	return summary, nil
+}
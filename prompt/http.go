@@ -0,0 +1,264 @@
+package prompt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bakks/butterfish/util"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// This file contains the HTTPPromptLibrary, which implements the
+// PromptLibrary interface with prompts served from a URL, e.g. a team's
+// central prompt service, so that prompt updates roll out without anyone
+// editing their library. The URL serves prompts in the same yaml format as
+// the library file and Export.
+
+// How long fetched prompts are used before checking the URL for changes
+const DefaultHTTPPromptTTL = 5 * time.Minute
+
+// Fetches give up after this long and use the prompts we already have
+const httpPromptTimeout = 5 * time.Second
+
+// Larger responses are refused rather than read into memory
+const maxHTTPPromptBytes = 4 * 1024 * 1024
+
+// HTTPPromptLibrary serves prompts fetched from URL, falling back to a disk
+// library for prompts the URL doesn't serve and whenever it can't be
+// fetched. The first prompt asked for waits for the first fetch. After that
+// fetched prompts are cached for TTL, after which the next prompt asked for
+// starts a fetch in the background and is served the cached prompts. Fetches
+// send the ETag of the last response in If-None-Match so an unchanged
+// library costs a 304 rather than a download. If a fetch fails, or serves
+// prompts that don't validate, the last good prompts are kept.
+type HTTPPromptLibrary struct {
+	URL    string
+	Client *http.Client
+	TTL    time.Duration
+	// Used for prompts the URL doesn't serve, and for every prompt until the
+	// URL has been fetched successfully
+	Fallback *DiskPromptLibrary
+	Verbose  bool
+
+	mutex sync.Mutex
+	// the last prompts fetched, and those merged with the fallback's, nil
+	// until a fetch succeeds
+	served     []Prompt
+	current    *DiskPromptLibrary
+	etag       string
+	checked    time.Time
+	firstFetch sync.Once
+	// whether a background fetch is in flight, tracked by refreshes
+	refreshing bool
+	refreshes  sync.WaitGroup
+	// replaced by tests
+	now func() time.Time
+}
+
+func NewHTTPPromptLibrary(url string, fallback *DiskPromptLibrary) *HTTPPromptLibrary {
+	return &HTTPPromptLibrary{
+		URL:      url,
+		Client:   &http.Client{Timeout: httpPromptTimeout},
+		TTL:      DefaultHTTPPromptTTL,
+		Fallback: fallback,
+		now:      time.Now,
+	}
+}
+
+// Fetch the prompts now rather than waiting for the TTL to pass, returning
+// any error rather than only logging it
+func (this *HTTPPromptLibrary) Refresh() error {
+	return this.refresh()
+}
+
+// Fetch the prompts and replace ours if they've changed. The lock is only
+// held before and after the request so prompts can be served meanwhile.
+func (this *HTTPPromptLibrary) refresh() error {
+	this.mutex.Lock()
+	// checked even if the fetch fails so a down server isn't retried for
+	// every prompt
+	this.checked = this.now()
+	etag := ""
+	if this.current != nil {
+		etag = this.etag
+	}
+	this.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpPromptTimeout)
+	defer cancel()
+	prompts, etag, err := this.fetch(ctx, etag)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if prompts == nil {
+		// not modified, but the fallback may have been reloaded
+		this.current = this.merge(this.served)
+		return nil
+	}
+
+	err = validatePrompts(this.URL, prompts)
+	if err != nil {
+		return err
+	}
+
+	this.served = prompts
+	this.current = this.merge(prompts)
+	this.etag = etag
+	if this.Verbose {
+		util.DefaultLogger().Infof("Loaded %d prompts from %s", len(prompts), this.URL)
+	}
+	return nil
+}
+
+// Request the prompts, returning nil prompts if they haven't changed since
+// the response with the given ETag, if set
+func (this *HTTPPromptLibrary) fetch(ctx context.Context, etag string) ([]Prompt, string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, this.URL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+
+	response, err := this.Client.Do(request)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		if etag == "" {
+			return nil, "", errors.New("Server said prompts were not modified but none have been fetched")
+		}
+		return nil, "", nil
+	case http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("Unexpected response %s", response.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxHTTPPromptBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxHTTPPromptBytes {
+		return nil, "", fmt.Errorf("Prompt library is larger than %d bytes", maxHTTPPromptBytes)
+	}
+
+	prompts := []Prompt{}
+	err = yaml.Unmarshal(data, &prompts)
+	if err != nil {
+		return nil, "", fmt.Errorf("Prompt library is not formatted correctly: %w", err)
+	}
+
+	return prompts, response.Header.Get("ETag"), nil
+}
+
+// A library of the fetched prompts plus the fallback's prompts that weren't
+// fetched, wrapped in the fallback's global prefix and suffix and linted
+// with its token budget
+func (this *HTTPPromptLibrary) merge(prompts []Prompt) *DiskPromptLibrary {
+	library := &DiskPromptLibrary{Path: this.URL, Prompts: append([]Prompt{}, prompts...)}
+	if this.Fallback == nil {
+		return library
+	}
+
+	library.GlobalPromptPrefix = this.Fallback.GlobalPromptPrefix
+	library.GlobalPromptSuffix = this.Fallback.GlobalPromptSuffix
+	library.LintTokenBudget = this.Fallback.LintTokenBudget
+	this.Fallback.mutex.RLock()
+	defer this.Fallback.mutex.RUnlock()
+	for _, prompt := range this.Fallback.Prompts {
+		if !containsPromptNamed(prompts, prompt.Name) {
+			library.Prompts = append(library.Prompts, prompt)
+		}
+	}
+	return library
+}
+
+// The library to serve prompts from. The first call waits for the first
+// fetch, later calls start a fetch in the background once the TTL has
+// passed. Fetch errors are logged since prompts are fetched on the way to
+// calling the LLM, where there's no one to report them to.
+func (this *HTTPPromptLibrary) library() *DiskPromptLibrary {
+	this.mutex.Lock()
+	fetched := !this.checked.IsZero()
+	this.mutex.Unlock()
+	if !fetched {
+		this.firstFetch.Do(func() { this.logRefreshError(this.refresh()) })
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !this.refreshing && this.now().Sub(this.checked) >= this.TTL {
+		this.refreshing = true
+		this.refreshes.Add(1)
+		go func() {
+			defer this.refreshes.Done()
+			this.logRefreshError(this.refresh())
+			this.mutex.Lock()
+			this.refreshing = false
+			this.mutex.Unlock()
+		}()
+	}
+
+	if this.current != nil {
+		return this.current
+	}
+	if this.Fallback != nil {
+		return this.Fallback
+	}
+	return &DiskPromptLibrary{Path: this.URL}
+}
+
+func (this *HTTPPromptLibrary) logRefreshError(err error) {
+	if err != nil {
+		util.DefaultLogger().Warnf("Unable to fetch prompts from %s, using previous prompts: %s", this.URL, err)
+	}
+}
+
+func (this *HTTPPromptLibrary) GetPrompt(name string, args ...string) (string, error) {
+	return this.library().GetPrompt(name, args...)
+}
+
+func (this *HTTPPromptLibrary) GetPromptWrapped(name, prefix, suffix string, args ...string) (string, error) {
+	return this.library().GetPromptWrapped(name, prefix, suffix, args...)
+}
+
+func (this *HTTPPromptLibrary) GetPromptFields(name string, fields map[string]string) (string, error) {
+	return this.library().GetPromptFields(name, fields)
+}
+
+func (this *HTTPPromptLibrary) GetPromptFieldsWrapped(name, prefix, suffix string, fields map[string]string) (string, error) {
+	return this.library().GetPromptFieldsWrapped(name, prefix, suffix, fields)
+}
+
+func (this *HTTPPromptLibrary) GetUninterpolatedPrompt(name string) (string, error) {
+	return this.library().GetUninterpolatedPrompt(name)
+}
+
+func (this *HTTPPromptLibrary) InterpolatePrompt(prompt string, args ...string) (string, error) {
+	return this.library().InterpolatePrompt(prompt, args...)
+}
+
+// Names of the prompts being served, sorted
+func (this *HTTPPromptLibrary) PromptNames() []string {
+	return this.library().PromptNames()
+}
+
+// Check the prompts being served, fetched and from the fallback, see
+// DiskPromptLibrary.Lint
+func (this *HTTPPromptLibrary) Lint() []LintIssue {
+	return this.library().Lint()
+}
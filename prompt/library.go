@@ -1,16 +1,20 @@
 package prompt
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/bakks/butterfish/util"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -30,26 +34,62 @@ type Prompt struct {
 // DiskPromptLibrary struct which includes a Path string and a Prompts instance
 // This implements the PromptLibrary interface.
 type DiskPromptLibrary struct {
-	Path          string
+	Path string
+	// If set then Path is a directory with a file per prompt rather than a
+	// yaml file, see directory.go
+	Directory     bool
 	Prompts       []Prompt
 	Verbose       bool
 	VerboseWriter io.Writer
+
+	// Text added before and after every user prompt fetched with GetPrompt,
+	// GetPromptFields, or InterpolatePrompt, after fields are interpolated,
+	// e.g. to add standing instructions to every LLM call. System messages
+	// and function output (see unwrappedPrompts) are left as they are.
+	GlobalPromptPrefix string
+	GlobalPromptSuffix string
+
+	// Prompts estimated to be longer than this many tokens are reported by
+	// Lint, 0 means DefaultLintTokenBudget
+	LintTokenBudget int
+
+	// guards Prompts, which may be swapped out by Watch while prompts are
+	// being fetched
+	mutex sync.RWMutex
 }
 
-// NewPromptLibrary function to make a NewPromptLibrary which takes a path argument
+// NewPromptLibrary function to make a NewPromptLibrary which takes a path argument.
+// If the path is a directory, or ends with a separator, then the library is
+// kept as a file per prompt in that directory.
 func NewPromptLibrary(path string, verbose bool, verboseWriter io.Writer) *DiskPromptLibrary {
 	return &DiskPromptLibrary{
 		Path:          path,
+		Directory:     isDirectoryLibrary(path),
 		Verbose:       verbose,
 		VerboseWriter: verboseWriter,
 	}
 }
 
-// Returns a list of fields to interpolate (strings wrapped in { and })
+// Matches escaped braces ({{ and }}) and fields to interpolate (a name
+// wrapped in { and })
+var fieldRegex = regexp.MustCompile(`\{\{|\}\}|\{[a-zA-Z0-9_]+\}`)
+
+// Returns a list of unique fields to interpolate (strings wrapped in { and }),
+// in the order they first appear. Escaped braces are skipped, so {{name}}
+// is not a field.
 func getFields(prompt string) []string {
-	// regex to find all fields in a string
-	regex := regexp.MustCompile(`\{[a-zA-Z0-9_]+\}`)
-	return regex.FindAllString(prompt, -1)
+	fields := []string{}
+	seen := map[string]bool{}
+
+	for _, match := range fieldRegex.FindAllString(prompt, -1) {
+		if match == "{{" || match == "}}" || seen[match] {
+			continue
+		}
+		seen[match] = true
+		fields = append(fields, match)
+	}
+
+	return fields
 }
 
 // Fetch a prompt with a given name, interpolating the fields into the prompt string.
@@ -57,73 +97,266 @@ func getFields(prompt string) []string {
 // The argument pattern is first the field name, then the value, for example:
 //
 //	GetPrompt("my_prompt", "name", "John", "age", "30")
+//
+// The result is wrapped in GlobalPromptPrefix and GlobalPromptSuffix unless
+// it's a system message or function output.
 func (this *DiskPromptLibrary) GetPrompt(name string, args ...string) (string, error) {
+	prefix, suffix := this.globalWrapping(name)
+	return this.GetPromptWrapped(name, prefix, suffix, args...)
+}
+
+// Like GetPrompt, but wrapped in the given prefix and suffix rather than
+// the library's GlobalPromptPrefix and GlobalPromptSuffix. Pass empty
+// strings to get the prompt unwrapped.
+func (this *DiskPromptLibrary) GetPromptWrapped(name, prefix, suffix string, args ...string) (string, error) {
 
 	// first find the prompt given the name
-	index := this.ContainsPromptNamed(name)
-	if index == -1 {
+	prompt, ok := this.findPrompt(name)
+	if !ok {
 		return "", errors.New("Prompt not found")
 	}
-	prompt := this.Prompts[index]
 
 	// interpolate the prompt string
 	promptString, err := Interpolate(prompt.Prompt, args...)
+	if err != nil {
+		return "", err
+	}
+
+	return wrapPrompt(promptString, prefix, suffix), nil
+}
+
+// Fetch a prompt with a given name, filling fields by name from the map
+// rather than positional arguments, for example:
+//
+//	GetPromptFields("my_prompt", map[string]string{"name": "John", "age": "30"})
+//
+// As with GetPrompt, missing or unknown fields are an error and user prompts
+// are wrapped in GlobalPromptPrefix and GlobalPromptSuffix.
+func (this *DiskPromptLibrary) GetPromptFields(name string, fields map[string]string) (string, error) {
+	prefix, suffix := this.globalWrapping(name)
+	return this.GetPromptFieldsWrapped(name, prefix, suffix, fields)
+}
+
+// Like GetPromptFields, but wrapped in the given prefix and suffix rather
+// than the library's globals
+func (this *DiskPromptLibrary) GetPromptFieldsWrapped(name, prefix, suffix string, fields map[string]string) (string, error) {
+	prompt, ok := this.findPrompt(name)
+	if !ok {
+		return "", errors.New("Prompt not found")
+	}
+
+	promptString, err := InterpolateFields(prompt.Prompt, fields)
+	if err != nil {
+		return "", err
+	}
+
+	return wrapPrompt(promptString, prefix, suffix), nil
+}
+
+// Prompts that aren't sent as the user prompt, so GetPrompt and
+// GetPromptFields don't wrap them in the global prefix and suffix
+var unwrappedPrompts = map[string]bool{
+	PromptSystemMessage:   true,
+	ShellSystemMessage:    true,
+	GoalModeSystemMessage: true,
+	GoalModeCommandResult: true,
+}
+
+// The global prefix and suffix to wrap the named prompt in, empty for
+// system messages and function output
+func (this *DiskPromptLibrary) globalWrapping(name string) (string, string) {
+	if unwrappedPrompts[name] {
+		return "", ""
+	}
+	return this.GlobalPromptPrefix, this.GlobalPromptSuffix
+}
 
-	return promptString, err
+// Add prefix and suffix around an interpolated prompt. They're added as
+// is, so any separating whitespace should be part of them. Text in them is
+// never interpolated, so braces needn't be escaped.
+func wrapPrompt(promptString, prefix, suffix string) string {
+	return prefix + promptString + suffix
 }
 
 // Fetch a prompt with a given name, interpolating later
 func (this *DiskPromptLibrary) GetUninterpolatedPrompt(name string) (string, error) {
 
 	// first find the prompt given the name
-	index := this.ContainsPromptNamed(name)
-	if index == -1 {
+	prompt, ok := this.findPrompt(name)
+	if !ok {
 		return "", errors.New("Prompt not found")
 	}
-	prompt := this.Prompts[index]
 
 	return prompt.Prompt, nil
 }
 
+// Find a prompt by name, safe to call while the library is being reloaded
+func (this *DiskPromptLibrary) findPrompt(name string) (Prompt, bool) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	index := this.indexOf(name)
+	if index == -1 {
+		return Prompt{}, false
+	}
+	return this.Prompts[index], true
+}
+
+// Interpolate a prompt from GetUninterpolatedPrompt, wrapping the result in
+// GlobalPromptPrefix and GlobalPromptSuffix as GetPrompt would
 func (this *DiskPromptLibrary) InterpolatePrompt(prompt string, args ...string) (string, error) {
-	return Interpolate(prompt, args...)
+	promptString, err := Interpolate(prompt, args...)
+	if err != nil {
+		return "", err
+	}
+
+	return wrapPrompt(promptString, this.GlobalPromptPrefix, this.GlobalPromptSuffix), nil
 }
 
+// Interpolate fields in the prompt p, args are pairs of field name and value.
+// Every field in the prompt must be given a value and every argument must
+// match a field in the prompt, otherwise an error is returned. Literal braces
+// can be written as {{ and }}.
 func Interpolate(p string, args ...string) (string, error) {
+	if len(args)%2 != 0 {
+		return "", fmt.Errorf("Arguments must be pairs of field name and value, got %d arguments", len(args))
+	}
+
 	// turn args into a map
 	argMap := make(map[string]string)
 	for i := 0; i < len(args); i += 2 {
+		if _, ok := argMap[args[i]]; ok {
+			return "", fmt.Errorf("Field %s provided more than once", args[i])
+		}
 		argMap[args[i]] = args[i+1]
 	}
 
 	fields := getFields(p)
-	promptString := p
-
-	// check that the number of fields matches the number of arguments
-	if len(fields)*2 != len(args) {
-		fieldNames := strings.Join(fields, ", ")
-		return "", fmt.Errorf("Incorrect number of fields provided, prompt requires fields (%s)", fieldNames)
-	}
+	fieldNames := strings.Join(fields, ", ")
+	required := make(map[string]bool)
 
-	// interpolate fields using the argMap
+	// check that every field has a value
 	for _, field := range fields {
 		fieldName := field[1 : len(field)-1] // trim { and } from field
-		value, ok := argMap[fieldName]
-		if !ok {
-			fieldNames := strings.Join(fields, ", ")
+		if _, ok := argMap[fieldName]; !ok {
 			return "", fmt.Errorf("Missing field %s, prompt requires fields (%s)", field, fieldNames)
 		}
-		promptString = strings.Replace(promptString, field, value, -1)
+		required[fieldName] = true
 	}
 
+	// check that every value has a field
+	for i := 0; i < len(args); i += 2 {
+		if !required[args[i]] {
+			return "", fmt.Errorf("Unused field %s, prompt requires fields (%s)", args[i], fieldNames)
+		}
+	}
+
+	// interpolate fields using the argMap, we only scan the template so any
+	// braces in the values are left alone
+	promptString := fieldRegex.ReplaceAllStringFunc(p, func(match string) string {
+		switch match {
+		case "{{":
+			return "{"
+		case "}}":
+			return "}"
+		default:
+			return argMap[match[1:len(match)-1]]
+		}
+	})
+
 	return promptString, nil
 }
 
-// Write a yaml file at the path with the contents marshalled from Prompts
+// Interpolate fields in the prompt p using values looked up by field name,
+// with the same checks as Interpolate
+func InterpolateFields(p string, fields map[string]string) (string, error) {
+	// sort the names so that errors are deterministic
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := make([]string, 0, len(fields)*2)
+	for _, name := range names {
+		args = append(args, name, fields[name])
+	}
+
+	return Interpolate(p, args...)
+}
+
+// Check that the prompts in the library are well formed: names must be
+// unique, and a prompt replacing one of the defaults must use exactly the
+// same fields as the default since callers fill in those fields.
+func (this *DiskPromptLibrary) Validate() error {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	return validatePrompts(this.Path, this.Prompts)
+}
+
+func validatePrompts(path string, prompts []Prompt) error {
+	defaultFields := make(map[string][]string)
+	for _, prompt := range DefaultPrompts {
+		defaultFields[prompt.Name] = getFields(prompt.Prompt)
+	}
+
+	problems := []string{}
+	seen := make(map[string]bool)
+
+	for _, prompt := range prompts {
+		if seen[prompt.Name] {
+			problems = append(problems, fmt.Sprintf("prompt %s is defined more than once", prompt.Name))
+		}
+		seen[prompt.Name] = true
+
+		expected, ok := defaultFields[prompt.Name]
+		if !ok {
+			continue
+		}
+
+		fields := getFields(prompt.Prompt)
+		for _, field := range expected {
+			if !contains(fields, field) {
+				problems = append(problems, fmt.Sprintf("prompt %s is missing field %s", prompt.Name, field))
+			}
+		}
+		for _, field := range fields {
+			if !contains(expected, field) {
+				problems = append(problems, fmt.Sprintf("prompt %s has unknown field %s, expected fields (%s)",
+					prompt.Name, field, strings.Join(expected, ", ")))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid prompt library %s: %s", path, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// Write a yaml file at the path with the contents marshalled from Prompts,
+// or a file per prompt for a Directory library
 func (this *DiskPromptLibrary) Save() error {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
 	if this.Prompts == nil || len(this.Prompts) == 0 {
 		return errors.New("No prompts to write, please initialize the prompt library")
 	}
+	if this.Directory {
+		return writePromptDirectory(this.Path, this.Prompts)
+	}
 	bytes, err := yaml.Marshal(this.Prompts)
 	if err != nil {
 		return errors.New("There was a problem marshalling prompt library, please ensure you are passing in a vaild PromptLibrary struct.")
@@ -146,6 +379,14 @@ func (this *DiskPromptLibrary) Save() error {
 // prompt array of the DiskPromptLibrary, returns the index of the prompt if
 // found, otherwise returns -1
 func (this *DiskPromptLibrary) ContainsPromptNamed(name string) int {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	return this.indexOf(name)
+}
+
+// ContainsPromptNamed without locking, the caller must hold the mutex
+func (this *DiskPromptLibrary) indexOf(name string) int {
 	for i, prompt := range this.Prompts {
 		if prompt.Name == name {
 			return i
@@ -156,16 +397,142 @@ func (this *DiskPromptLibrary) ContainsPromptNamed(name string) int {
 
 // Given an array of Prompt objects, replace prompts in the prompt library based on name, only if OkToReplace is true on the Prompt already in the library
 func (this *DiskPromptLibrary) ReplacePrompts(newPrompts []Prompt) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	for _, newPrompt := range newPrompts {
-		index := this.ContainsPromptNamed(newPrompt.Name)
+		index := this.indexOf(newPrompt.Name)
 		if index == -1 {
 			this.Prompts = append(this.Prompts, newPrompt)
-		} else {
+		} else if this.Prompts[index].OkToReplace {
 			this.Prompts[index] = newPrompt
 		}
 	}
 }
 
+// Names of the prompts in the library, sorted
+func (this *DiskPromptLibrary) PromptNames() []string {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	names := make([]string, len(this.Prompts))
+	for i, prompt := range this.Prompts {
+		names[i] = prompt.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Set the text of the named prompt. The prompt must already exist and a
+// replacement for a default prompt must use the same fields, as in Validate.
+// OkToReplace is cleared so the defaults don't overwrite the new text.
+func (this *DiskPromptLibrary) SetPrompt(name, text string) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	index := this.indexOf(name)
+	if index == -1 {
+		names := make([]string, len(this.Prompts))
+		for i, prompt := range this.Prompts {
+			names[i] = prompt.Name
+		}
+		sort.Strings(names)
+		return fmt.Errorf("No prompt named %s, prompts are: %s", name, strings.Join(names, ", "))
+	}
+
+	prompts := make([]Prompt, len(this.Prompts))
+	copy(prompts, this.Prompts)
+	prompts[index].Prompt = text
+	prompts[index].OkToReplace = false
+
+	err := validatePrompts(this.Path, prompts)
+	if err != nil {
+		return err
+	}
+
+	this.Prompts = prompts
+	return nil
+}
+
+// The outcome of an Import, listing prompt names by what happened to them
+type ImportReport struct {
+	Added    []string
+	Replaced []string
+	Skipped  []string
+}
+
+// Write the prompts in the library to w as yaml, in the same format as the
+// library file, so a set of prompts can be shared and merged with Import.
+func (this *DiskPromptLibrary) Export(w io.Writer) error {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	bytes, err := yaml.Marshal(this.Prompts)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal prompts: %w", err)
+	}
+
+	_, err = w.Write(bytes)
+	return err
+}
+
+// Merge prompts exported with Export into the library. Prompts with new names
+// are added. A prompt that already exists is replaced only if OkToReplace is
+// set on the existing prompt, meaning the user hasn't customized it, or if
+// overwrite is true, otherwise it's skipped. Nothing is imported if any
+// prompt is unnamed, defined twice, or replaces a default prompt with
+// different fields. The library is not saved, call Save() to persist the
+// result.
+func (this *DiskPromptLibrary) Import(r io.Reader, overwrite bool) (*ImportReport, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := []Prompt{}
+	err = yaml.Unmarshal(data, &imported)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse imported prompts: %w", err)
+	}
+
+	// check every prompt before changing anything so a bad import leaves
+	// the library as it was
+	for _, prompt := range imported {
+		if prompt.Name == "" {
+			return nil, errors.New("Imported prompt is missing a name")
+		}
+	}
+	err = validatePrompts("import", imported)
+	if err != nil {
+		return nil, err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	report := &ImportReport{}
+	for _, prompt := range imported {
+		index := this.indexOf(prompt.Name)
+		switch {
+		case index == -1:
+			this.Prompts = append(this.Prompts, prompt)
+			report.Added = append(report.Added, prompt.Name)
+		case overwrite || this.Prompts[index].OkToReplace:
+			this.Prompts[index] = prompt
+			report.Replaced = append(report.Replaced, prompt.Name)
+		default:
+			report.Skipped = append(report.Skipped, prompt.Name)
+		}
+	}
+
+	if this.Verbose && this.VerboseWriter != nil {
+		fmt.Fprintf(this.VerboseWriter, "Imported prompts: %d added, %d replaced, %d skipped\n",
+			len(report.Added), len(report.Replaced), len(report.Skipped))
+	}
+
+	return report, nil
+}
+
 // Check if the library file exists, should be called before Load()
 func (this *DiskPromptLibrary) LibraryFileExists() bool {
 	if _, err := os.Stat(this.Path); os.IsNotExist(err) {
@@ -174,19 +541,117 @@ func (this *DiskPromptLibrary) LibraryFileExists() bool {
 	return true
 }
 
-// Load a yaml file at the path with a contents marshalled into Prompts
+// Load a yaml file at the path with a contents marshalled into Prompts, or
+// the prompt files of a Directory library
 func (this *DiskPromptLibrary) Load() error {
+	prompts, err := this.readFile()
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	this.Prompts = prompts
+	this.mutex.Unlock()
+
+	if this.Verbose {
+		util.DefaultLogger().Infof("Loaded %v prompts from %v", len(prompts), this.Path)
+	}
+	return nil
+}
+
+func (this *DiskPromptLibrary) readFile() ([]Prompt, error) {
+	if this.Directory {
+		return readPromptDirectory(this.Path)
+	}
+
 	data, err := os.ReadFile(this.Path)
 	if err != nil {
-		return errors.New("Unable to access prompt file, please check write permissions and try again.")
+		return nil, errors.New("Unable to access prompt file, please check write permissions and try again.")
 	}
-	err = yaml.Unmarshal(data, &this.Prompts)
+
+	prompts := []Prompt{}
+	err = yaml.Unmarshal(data, &prompts)
 	if err != nil {
-		return errors.New("File is not formatted correctly. Please ensure you are passing in a valid YAML file and try again.")
+		return nil, errors.New("File is not formatted correctly. Please ensure you are passing in a valid YAML file and try again.")
 	}
 
-	if this.Verbose {
-		log.Printf("Loaded %v prompts from %v\n\r", len(this.Prompts), this.Path)
+	return prompts, nil
+}
+
+// Reload the library file, replacing the prompts only if the file loads and
+// validates. Default prompts missing from the file are kept so that callers
+// can still find them.
+func (this *DiskPromptLibrary) Reload() error {
+	prompts, err := this.readFile()
+	if err != nil {
+		return err
 	}
+
+	err = validatePrompts(this.Path, prompts)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, prompt := range this.Prompts {
+		if !containsPromptNamed(prompts, prompt.Name) {
+			prompts = append(prompts, prompt)
+		}
+	}
+	this.Prompts = prompts
+
 	return nil
 }
+
+func containsPromptNamed(prompts []Prompt, name string) bool {
+	for _, prompt := range prompts {
+		if prompt.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch the library file, reloading it when its modification time or size
+// changes, until ctx is done. We poll every interval rather than using
+// filesystem notifications, which also copes with editors that replace the
+// file rather than writing to it. If the changed file doesn't load or
+// validate we log the error and keep serving the last good prompts.
+func (this *DiskPromptLibrary) Watch(ctx context.Context, interval time.Duration) {
+	lastInfo, _ := statLibrary(this.Path)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			info, err := statLibrary(this.Path)
+			if err != nil || !fileChanged(lastInfo, info) {
+				continue
+			}
+			lastInfo = info
+
+			err = this.Reload()
+			if err != nil {
+				util.DefaultLogger().Warnf("Unable to reload prompt library, keeping previous prompts: %s", err)
+			} else if this.Verbose {
+				util.DefaultLogger().Infof("Reloaded prompts from %s", this.Path)
+			}
+		}
+	}()
+}
+
+func fileChanged(before, after os.FileInfo) bool {
+	if before == nil {
+		return true
+	}
+	return !before.ModTime().Equal(after.ModTime()) || before.Size() != after.Size()
+}
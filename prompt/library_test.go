@@ -0,0 +1,533 @@
+package prompt
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterpolate(t *testing.T) {
+	result, err := Interpolate("Hello {name}, you are {age}", "name", "John", "age", "30")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello John, you are 30", result)
+
+	// a field used twice only needs one value
+	result, err = Interpolate("{cmd} failed, rerun {cmd}", "cmd", "ls")
+	assert.NoError(t, err)
+	assert.Equal(t, "ls failed, rerun ls", result)
+
+	// braces in values are left alone
+	result, err = Interpolate("Output: {output}", "output", "{status}")
+	assert.NoError(t, err)
+	assert.Equal(t, "Output: {status}", result)
+}
+
+func TestInterpolateMissingField(t *testing.T) {
+	_, err := Interpolate("Hello {name}, you are {age}", "name", "John")
+	assert.ErrorContains(t, err, "Missing field {age}")
+}
+
+func TestInterpolateUnusedField(t *testing.T) {
+	_, err := Interpolate("Hello {name}", "name", "John", "age", "30")
+	assert.ErrorContains(t, err, "Unused field age")
+
+	_, err = Interpolate("Hello {name}", "name")
+	assert.ErrorContains(t, err, "pairs")
+
+	_, err = Interpolate("Hello {name}", "name", "John", "name", "Jane")
+	assert.ErrorContains(t, err, "more than once")
+}
+
+func TestInterpolateEscapedBraces(t *testing.T) {
+	result, err := Interpolate(`Reply with JSON like {{"cmd": "{{cmd}}"}} for {goal}`, "goal", "x")
+	assert.NoError(t, err)
+	assert.Equal(t, `Reply with JSON like {"cmd": "{cmd}"} for x`, result)
+
+	fields := getFields("{{escaped}} {real} {real}")
+	assert.Equal(t, []string{"{real}"}, fields)
+}
+
+func TestValidate(t *testing.T) {
+	library := NewPromptLibrary("", false, nil)
+	library.ReplacePrompts(DefaultPrompts)
+	assert.NoError(t, library.Validate())
+
+	// a replacement for a default prompt that drops a field callers rely on
+	index := library.ContainsPromptNamed(PromptFixCommand)
+	library.Prompts[index].Prompt = "Fix {command} with status {status}"
+	err := library.Validate()
+	assert.ErrorContains(t, err, "missing field {output}")
+
+	// or adds one they'll never fill in
+	library.Prompts[index].Prompt = "Fix {command} {status} {output} {extra}"
+	err = library.Validate()
+	assert.ErrorContains(t, err, "unknown field {extra}")
+
+	// custom prompts can use any fields, but names must be unique
+	library.ReplacePrompts(DefaultPrompts)
+	library.Prompts = append(library.Prompts,
+		Prompt{Name: "custom", Prompt: "{anything}"},
+		Prompt{Name: "custom", Prompt: "again"})
+	err = library.Validate()
+	assert.ErrorContains(t, err, "custom is defined more than once")
+}
+
+func TestLint(t *testing.T) {
+	library := NewPromptLibrary("", false, nil)
+	library.ReplacePrompts(DefaultPrompts)
+	assert.Empty(t, library.Lint())
+
+	index := library.ContainsPromptNamed(PromptFixCommand)
+	library.Prompts[index].Prompt = "Fix {command} {status} {output} {extra}"
+	library.Prompts = append(library.Prompts,
+		Prompt{Name: "long", Prompt: strings.Repeat("word ", 400)},
+		Prompt{Name: "json", Prompt: `Reply with {"answer": {answer}}`},
+		Prompt{Name: "escaped", Prompt: `Reply with {{"answer": {answer}}}`},
+		Prompt{Name: "spaced", Prompt: "Hello {user name}"},
+		Prompt{Name: "custom", Prompt: "{anything}"},
+		Prompt{Name: "custom", Prompt: "again"})
+	// above the longest default prompt
+	library.LintTokenBudget = 300
+
+	issues := library.Lint()
+	kinds := map[string]string{}
+	for _, issue := range issues {
+		kinds[issue.Prompt] = issue.Kind
+	}
+	assert.Equal(t, map[string]string{
+		PromptFixCommand: LintUnusedPlaceholder,
+		"long":           LintTooLong,
+		"json":           LintUnmatchedBrace,
+		"spaced":         LintUnmatchedBrace,
+		"custom":         LintDuplicateName,
+	}, kinds)
+	assert.Equal(t, 5, len(issues))
+
+	assert.Equal(t, "fix_command: field {extra} is never filled in, callers provide ({command}, {status}, {output})",
+		issues[0].String())
+	assert.Contains(t, issues[1].Message, "about 500 tokens, over the budget of 300")
+	assert.Contains(t, issues[2].Message, `'{' at byte 11`)
+	assert.Contains(t, issues[3].Message, `'{' at byte 6`)
+
+	// within the default budget
+	library.LintTokenBudget = 0
+	for _, issue := range library.Lint() {
+		assert.NotEqual(t, LintTooLong, issue.Kind)
+	}
+}
+
+func TestGetPromptFields(t *testing.T) {
+	library := NewPromptLibrary("", false, nil)
+	library.ReplacePrompts(DefaultPrompts)
+
+	result, err := library.GetPromptFields(PromptFixCommand, map[string]string{
+		"output":  "no such file",
+		"command": "cat foo",
+		"status":  "1",
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, result, `The user ran the command "cat foo", which failed with exit code 1.`)
+	assert.Contains(t, result, "no such file")
+
+	_, err = library.GetPromptFields(PromptFixCommand, map[string]string{
+		"command": "cat foo",
+		"status":  "1",
+	})
+	assert.ErrorContains(t, err, "Missing field {output}")
+
+	_, err = library.GetPromptFields(PromptFixCommand, map[string]string{
+		"command": "cat foo",
+		"status":  "1",
+		"output":  "",
+		"stderr":  "",
+	})
+	assert.ErrorContains(t, err, "Unused field stderr")
+
+	_, err = library.GetPromptFields("not_a_prompt", nil)
+	assert.Error(t, err)
+}
+
+func TestGlobalPromptPrefixSuffix(t *testing.T) {
+	library := NewPromptLibrary("", false, nil)
+	library.ReplacePrompts([]Prompt{
+		{Name: "greeting", Prompt: "Hello, {name}"},
+	})
+	library.GlobalPromptPrefix = "Be brief. {name}\n"
+	library.GlobalPromptSuffix = "\nThanks."
+
+	// wrapped after interpolation, so fields in the prefix aren't filled in
+	result, err := library.GetPrompt("greeting", "name", "Peter")
+	assert.NoError(t, err)
+	assert.Equal(t, "Be brief. {name}\nHello, Peter\nThanks.", result)
+
+	result, err = library.GetPromptFields("greeting", map[string]string{"name": "Peter"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Be brief. {name}\nHello, Peter\nThanks.", result)
+
+	uninterpolated, err := library.GetUninterpolatedPrompt("greeting")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello, {name}", uninterpolated)
+	result, err = library.InterpolatePrompt(uninterpolated, "name", "Peter")
+	assert.NoError(t, err)
+	assert.Equal(t, "Be brief. {name}\nHello, Peter\nThanks.", result)
+
+	// per-call overrides replace the globals
+	result, err = library.GetPromptWrapped("greeting", "[", "]", "name", "Peter")
+	assert.NoError(t, err)
+	assert.Equal(t, "[Hello, Peter]", result)
+
+	result, err = library.GetPromptFieldsWrapped("greeting", "", "", map[string]string{"name": "Peter"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello, Peter", result)
+
+	_, err = library.GetPrompt("greeting")
+	assert.ErrorContains(t, err, "Missing field {name}")
+
+	// system messages and function output are never wrapped
+	library.ReplacePrompts([]Prompt{
+		{Name: ShellSystemMessage, Prompt: "You are a shell assistant"},
+		{Name: GoalModeCommandResult, Prompt: "Exit code {status}"},
+	})
+	result, err = library.GetPrompt(ShellSystemMessage)
+	assert.NoError(t, err)
+	assert.Equal(t, "You are a shell assistant", result)
+
+	result, err = library.GetPromptFields(GoalModeCommandResult, map[string]string{"status": "0"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Exit code 0", result)
+}
+
+func TestSetPrompt(t *testing.T) {
+	library := NewPromptLibrary("", false, nil)
+	library.ReplacePrompts(DefaultPrompts)
+
+	err := library.SetPrompt("not_a_prompt", "text")
+	assert.ErrorContains(t, err, "No prompt named not_a_prompt")
+	assert.ErrorContains(t, err, PromptFixCommand+", "+PromptGenerateCommand)
+
+	// the fields of a default prompt must stay the same
+	err = library.SetPrompt(PromptFixCommand, "Fix {command}")
+	assert.ErrorContains(t, err, "missing field {output}")
+	original, err := library.GetUninterpolatedPrompt(PromptFixCommand)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "Fix {command}", original)
+
+	edited := "Fix {command}, it exited {status}: {output}"
+	assert.NoError(t, library.SetPrompt(PromptFixCommand, edited))
+	index := library.ContainsPromptNamed(PromptFixCommand)
+	assert.False(t, library.Prompts[index].OkToReplace)
+
+	// the edit survives the defaults being applied again
+	library.ReplacePrompts(DefaultPrompts)
+	prompt, err := library.GetUninterpolatedPrompt(PromptFixCommand)
+	assert.NoError(t, err)
+	assert.Equal(t, edited, prompt)
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	library := NewPromptLibrary("", false, nil)
+	library.Prompts = []Prompt{
+		{Name: "a", Prompt: "Prompt a {x}", OkToReplace: true},
+		{Name: "b", Prompt: "Prompt b\nwith two lines", OkToReplace: false},
+	}
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, library.Export(buf))
+
+	other := NewPromptLibrary("", false, nil)
+	report, err := other.Import(buf, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, report.Added)
+	assert.Empty(t, report.Replaced)
+	assert.Empty(t, report.Skipped)
+	assert.Equal(t, library.Prompts, other.Prompts)
+}
+
+func TestImportConflicts(t *testing.T) {
+	shared := NewPromptLibrary("", false, nil)
+	shared.Prompts = []Prompt{
+		{Name: "default", Prompt: "shared default", OkToReplace: true},
+		{Name: "custom", Prompt: "shared custom", OkToReplace: true},
+		{Name: "new", Prompt: "shared new", OkToReplace: false},
+	}
+	exported := new(bytes.Buffer)
+	assert.NoError(t, shared.Export(exported))
+
+	local := func() *DiskPromptLibrary {
+		library := NewPromptLibrary("", false, nil)
+		library.Prompts = []Prompt{
+			{Name: "default", Prompt: "local default", OkToReplace: true},
+			// the user edited this prompt so it shouldn't be replaced
+			{Name: "custom", Prompt: "local custom", OkToReplace: false},
+		}
+		return library
+	}
+
+	// merge, keeping customized prompts
+	library := local()
+	report, err := library.Import(bytes.NewReader(exported.Bytes()), false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"new"}, report.Added)
+	assert.Equal(t, []string{"default"}, report.Replaced)
+	assert.Equal(t, []string{"custom"}, report.Skipped)
+	assert.Equal(t, []Prompt{
+		{Name: "default", Prompt: "shared default", OkToReplace: true},
+		{Name: "custom", Prompt: "local custom", OkToReplace: false},
+		{Name: "new", Prompt: "shared new", OkToReplace: false},
+	}, library.Prompts)
+
+	// overwrite everything
+	library = local()
+	report, err = library.Import(bytes.NewReader(exported.Bytes()), true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"new"}, report.Added)
+	assert.Equal(t, []string{"default", "custom"}, report.Replaced)
+	assert.Empty(t, report.Skipped)
+	assert.Equal(t, shared.Prompts, library.Prompts)
+
+	_, err = library.Import(strings.NewReader("not: [a list"), false)
+	assert.Error(t, err)
+
+	// an invalid prompt anywhere in the import leaves the library unchanged
+	library = local()
+	_, err = library.Import(strings.NewReader(
+		"- name: new\n  prompt: shared new\n- prompt: no name\n"), true)
+	assert.ErrorContains(t, err, "missing a name")
+	_, err = library.Import(strings.NewReader(
+		"- name: new\n  prompt: shared new\n- name: "+PromptSummarize+"\n  prompt: Summarize {text}\n"), true)
+	assert.ErrorContains(t, err, "unknown field {text}")
+	assert.Equal(t, local().Prompts, library.Prompts)
+}
+
+// Wait until the named prompt has the expected text, or fail after a second
+func waitForPrompt(t *testing.T, library *DiskPromptLibrary, name, expected string) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		text, err := library.GetUninterpolatedPrompt(name)
+		if err == nil && text == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("prompt %s was %q (err %v), expected %q", name, text, err, expected)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatchReloadsChangedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.yaml")
+	write := func(content string) {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+
+	write("- name: greeting\n  prompt: Hello {name}\n")
+	library := NewPromptLibrary(path, false, nil)
+	assert.NoError(t, library.Load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	library.Watch(ctx, 10*time.Millisecond)
+
+	// an edited prompt and a new one are both picked up
+	write("- name: greeting\n  prompt: Goodbye {name}, see you soon\n- name: farewell\n  prompt: Bye\n")
+	waitForPrompt(t, library, "greeting", "Goodbye {name}, see you soon")
+	waitForPrompt(t, library, "farewell", "Bye")
+
+	result, err := library.GetPrompt("greeting", "name", "Ada")
+	assert.NoError(t, err)
+	assert.Equal(t, "Goodbye Ada, see you soon", result)
+
+	// a broken file is ignored and the last good prompts are still served
+	write("- name: greeting\n  prompt: [unterminated\n")
+	time.Sleep(50 * time.Millisecond)
+	waitForPrompt(t, library, "greeting", "Goodbye {name}, see you soon")
+
+	// and fixing it is picked up again
+	write("- name: greeting\n  prompt: Hi\n")
+	waitForPrompt(t, library, "greeting", "Hi")
+}
+
+func TestDirectoryLibrary(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	read := func(name string) string {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		return string(content)
+	}
+
+	write("greeting.txt", "Hello, {name}\n")
+	write("notes.md", "# Notes\n{topic}\n")
+	write("notes.meta.yaml", "oktoreplace: true\n")
+	// hidden files, other files, and directories aren't prompts
+	write(".hidden.txt", "hidden")
+	write("README", "readme")
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "sub.txt"), 0755))
+
+	library := NewPromptLibrary(dir, false, nil)
+	assert.True(t, library.Directory)
+	assert.True(t, library.LibraryFileExists())
+	assert.NoError(t, library.Load())
+	assert.Equal(t, []string{"greeting", "notes"}, library.PromptNames())
+
+	result, err := library.GetPrompt("greeting", "name", "Peter")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello, Peter", result)
+	assert.Equal(t, []Prompt{
+		{Name: "greeting", Prompt: "Hello, {name}", OkToReplace: false},
+		{Name: "notes", Prompt: "# Notes\n{topic}", OkToReplace: true},
+	}, library.Prompts)
+
+	// only prompts with a sidecar allowing it are replaced
+	library.ReplacePrompts([]Prompt{
+		{Name: "greeting", Prompt: "Hi", OkToReplace: true},
+		{Name: "notes", Prompt: "Notes on {topic}"},
+		{Name: "added", Prompt: "New prompt", OkToReplace: true},
+	})
+	assert.NoError(t, library.Save())
+
+	assert.Equal(t, "Hello, {name}\n", read("greeting.txt"))
+	assert.Equal(t, "Notes on {topic}\n", read("notes.md"))
+	assert.NoFileExists(t, filepath.Join(dir, "notes.meta.yaml"))
+	assert.NoFileExists(t, filepath.Join(dir, "notes.txt"))
+	assert.Equal(t, "New prompt\n", read("added.txt"))
+	assert.Equal(t, "oktoreplace: true\n", read("added.meta.yaml"))
+
+	reloaded := NewPromptLibrary(dir, false, nil)
+	assert.NoError(t, reloaded.Load())
+	assert.ElementsMatch(t, library.Prompts, reloaded.Prompts)
+
+	// a path ending in a separator is created as a directory
+	newDir := filepath.Join(t.TempDir(), "prompts") + string(filepath.Separator)
+	created := NewPromptLibrary(newDir, false, nil)
+	assert.True(t, created.Directory)
+	assert.False(t, created.LibraryFileExists())
+	created.ReplacePrompts(DefaultPrompts)
+	assert.NoError(t, created.Save())
+
+	loaded := NewPromptLibrary(newDir, false, nil)
+	assert.NoError(t, loaded.Load())
+	assert.ElementsMatch(t, DefaultPrompts, loaded.Prompts)
+	assert.NoError(t, loaded.Validate())
+}
+
+func TestHTTPPromptLibrary(t *testing.T) {
+	served := "- name: greeting\n  prompt: Hello from the server, {name}\n"
+	etag := `"v1"`
+	status := 0
+	var block chan struct{}
+	requests := []*http.Request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if block != nil {
+			<-block
+		}
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(served))
+	}))
+	defer server.Close()
+
+	fallback := NewPromptLibrary("", false, nil)
+	fallback.ReplacePrompts([]Prompt{
+		{Name: "greeting", Prompt: "Hello from disk, {name}"},
+		{Name: "farewell", Prompt: "Bye"},
+	})
+	fallback.GlobalPromptSuffix = "!"
+	fallback.LintTokenBudget = 2
+
+	now := time.Now()
+	library := NewHTTPPromptLibrary(server.URL, fallback)
+	library.TTL = time.Minute
+	library.now = func() time.Time { return now }
+
+	// served prompts replace the fallback's, the rest come from disk
+	result, err := library.GetPrompt("greeting", "name", "Ada")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello from the server, Ada!", result)
+	result, err = library.GetPromptFields("farewell", map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, "Bye!", result)
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, "", requests[0].Header.Get("If-None-Match"))
+
+	// served and fallback prompts are linted together, with the fallback's
+	// token budget
+	assert.Equal(t, []string{"farewell", "greeting"}, library.PromptNames())
+	issues := library.Lint()
+	assert.Equal(t, 1, len(issues))
+	assert.Equal(t, "greeting", issues[0].Prompt)
+	assert.Equal(t, LintTooLong, issues[0].Kind)
+
+	// after the TTL we ask again in the background with the ETag and keep
+	// our copy on a 304
+	now = now.Add(time.Minute)
+	result, err = library.GetPrompt("greeting", "name", "Ada")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello from the server, Ada!", result)
+	library.refreshes.Wait()
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, etag, requests[1].Header.Get("If-None-Match"))
+
+	// a changed library is downloaded, and the old prompts are served until
+	// it arrives
+	served = "- name: greeting\n  prompt: Hi again, {name}\n"
+	etag = `"v2"`
+	block = make(chan struct{})
+	now = now.Add(time.Minute)
+	result, err = library.GetPrompt("greeting", "name", "Ada")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello from the server, Ada!", result)
+	result, err = library.GetPrompt("greeting", "name", "Ada")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello from the server, Ada!", result)
+	close(block)
+	library.refreshes.Wait()
+	block = nil
+	result, err = library.GetPrompt("greeting", "name", "Ada")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi again, Ada!", result)
+	assert.Equal(t, 3, len(requests))
+
+	// prompts that don't validate are ignored
+	served = "- name: greeting\n  prompt: Hi\n- name: greeting\n  prompt: Hi twice\n"
+	etag = `"v3"`
+	err = library.Refresh()
+	assert.ErrorContains(t, err, "prompt greeting is defined more than once")
+
+	// if the server fails we keep serving the last good prompts
+	status = http.StatusInternalServerError
+	now = now.Add(time.Minute)
+	result, err = library.GetPrompt("greeting", "name", "Ada")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi again, Ada!", result)
+	library.refreshes.Wait()
+	result, err = library.GetPrompt("greeting", "name", "Ada")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi again, Ada!", result)
+	assert.Equal(t, 5, len(requests))
+
+	// and before the first successful fetch we use the disk library
+	unreachable := NewHTTPPromptLibrary(server.URL, fallback)
+	result, err = unreachable.GetPrompt("greeting", "name", "Ada")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello from disk, Ada!", result)
+	assert.ErrorContains(t, unreachable.Refresh(), "500 Internal Server Error")
+}
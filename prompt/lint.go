@@ -0,0 +1,120 @@
+package prompt
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Kinds of problem reported by Lint
+const (
+	// The prompt is longer than the library's LintTokenBudget
+	LintTooLong = "too_long"
+	// A { or } that isn't part of a field or an escaped brace, which is sent
+	// to the model as is and was probably meant to be a field
+	LintUnmatchedBrace = "unmatched_brace"
+	// More than one prompt has the same name, only the first is used
+	LintDuplicateName = "duplicate_name"
+	// A field that no caller fills in, so fetching the prompt fails
+	LintUnusedPlaceholder = "unused_placeholder"
+)
+
+// Prompts longer than this many tokens are reported by Lint if the library
+// doesn't set LintTokenBudget
+const DefaultLintTokenBudget = 1024
+
+// A problem found in a prompt by Lint
+type LintIssue struct {
+	Prompt  string
+	Kind    string
+	Message string
+}
+
+func (this LintIssue) String() string {
+	return fmt.Sprintf("%s: %s", this.Prompt, this.Message)
+}
+
+// Check the prompts in the library for likely mistakes without calling the
+// LLM: prompts longer than the token budget, braces that aren't part of a
+// field, names defined more than once, and fields that callers never fill
+// in. Unlike Validate these are reported rather than refused, and issues
+// are returned in the order of the prompts in the library.
+//
+// Callers fill in the fields of the default prompts, so a field is unused
+// if a prompt replacing a default has one the default doesn't. Fields of
+// other prompts are left to whoever uses them.
+func (this *DiskPromptLibrary) Lint() []LintIssue {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	budget := this.LintTokenBudget
+	if budget <= 0 {
+		budget = DefaultLintTokenBudget
+	}
+
+	defaultFields := make(map[string][]string)
+	for _, prompt := range DefaultPrompts {
+		defaultFields[prompt.Name] = getFields(prompt.Prompt)
+	}
+
+	issues := []LintIssue{}
+	seen := make(map[string]bool)
+
+	for _, prompt := range this.Prompts {
+		add := func(kind, format string, a ...interface{}) {
+			issues = append(issues, LintIssue{
+				Prompt:  prompt.Name,
+				Kind:    kind,
+				Message: fmt.Sprintf(format, a...),
+			})
+		}
+
+		if seen[prompt.Name] {
+			add(LintDuplicateName, "defined more than once, only the first definition is used")
+		}
+		seen[prompt.Name] = true
+
+		if tokens := estimateTokens(prompt.Prompt); tokens > budget {
+			add(LintTooLong, "about %d tokens, over the budget of %d", tokens, budget)
+		}
+
+		if offset := unmatchedBrace(prompt.Prompt); offset != -1 {
+			add(LintUnmatchedBrace, "%q at byte %d isn't part of a field, write {{ or }} for a literal brace",
+				prompt.Prompt[offset], offset)
+		}
+
+		if expected, ok := defaultFields[prompt.Name]; ok {
+			for _, field := range getFields(prompt.Prompt) {
+				if !contains(expected, field) {
+					add(LintUnusedPlaceholder, "field %s is never filled in, callers provide (%s)",
+						field, strings.Join(expected, ", "))
+				}
+			}
+		}
+	}
+
+	return issues
+}
+
+// A rough token count for English text, about 4 characters per token,
+// which is close enough to flag prompts that are far too long
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// The byte offset of the first brace in the prompt that isn't part of a
+// field or an escaped brace, or -1 if there isn't one
+func unmatchedBrace(prompt string) int {
+	last := 0
+	for _, match := range fieldRegex.FindAllStringIndex(prompt, -1) {
+		if offset := strings.IndexAny(prompt[last:match[0]], "{}"); offset != -1 {
+			return last + offset
+		}
+		last = match[1]
+	}
+
+	if offset := strings.IndexAny(prompt[last:], "{}"); offset != -1 {
+		return last + offset
+	}
+	return -1
+}
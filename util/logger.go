@@ -0,0 +1,117 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (this LogLevel) String() string {
+	if this < LogLevelDebug || this > LogLevelError {
+		return fmt.Sprintf("LogLevel(%d)", int(this))
+	}
+	return logLevelNames[this]
+}
+
+// Parse a level name like "debug" or "WARN" into a LogLevel
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return LogLevel(i), nil
+		}
+	}
+
+	if strings.EqualFold(name, "warning") {
+		return LogLevelWarn, nil
+	}
+
+	return LogLevelInfo, fmt.Errorf("Unknown log level %q, expected one of debug, info, warn, error", name)
+}
+
+// A leveled logger, messages below Level are dropped. If no writer is given
+// then messages go to the standard logger, which InitLogging points at a log
+// file so that logging doesn't corrupt a raw-mode terminal. A nil *Logger is
+// valid and logs through the default logger, or everything to the standard
+// logger if no default is set.
+type Logger struct {
+	Level  LogLevel
+	logger *log.Logger
+}
+
+var defaultLogger atomic.Pointer[Logger]
+
+// Set the logger used by code that isn't handed one, e.g. package-level
+// helpers and the prompt library, so that they respect the configured level
+func SetDefaultLogger(logger *Logger) {
+	defaultLogger.Store(logger)
+}
+
+// The logger set by SetDefaultLogger, nil if there isn't one, which is still
+// valid to log to
+func DefaultLogger() *Logger {
+	return defaultLogger.Load()
+}
+
+func NewLogger(level LogLevel, writer io.Writer) *Logger {
+	logger := &Logger{
+		Level: level,
+	}
+
+	if writer != nil {
+		logger.logger = log.New(writer, "", log.LstdFlags)
+	}
+
+	return logger
+}
+
+func (this *Logger) Enabled(level LogLevel) bool {
+	if this == nil {
+		this = DefaultLogger()
+	}
+	return this == nil || level >= this.Level
+}
+
+func (this *Logger) logf(level LogLevel, format string, args ...any) {
+	if this == nil {
+		this = DefaultLogger()
+	}
+	if !this.Enabled(level) {
+		return
+	}
+
+	msg := level.String() + " " + fmt.Sprintf(format, args...)
+	if this == nil || this.logger == nil {
+		log.Output(3, msg)
+	} else {
+		this.logger.Output(3, msg)
+	}
+}
+
+func (this *Logger) Debugf(format string, args ...any) {
+	this.logf(LogLevelDebug, format, args...)
+}
+
+func (this *Logger) Infof(format string, args ...any) {
+	this.logf(LogLevelInfo, format, args...)
+}
+
+func (this *Logger) Warnf(format string, args ...any) {
+	this.logf(LogLevelWarn, format, args...)
+}
+
+func (this *Logger) Errorf(format string, args ...any) {
+	this.logf(LogLevelError, format, args...)
+}
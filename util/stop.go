@@ -0,0 +1,95 @@
+package util
+
+import (
+	"strings"
+)
+
+// StopSequenceFilter applies stop sequences to streamed text locally, for
+// backends that don't support them server side or to cut a stream that
+// overshoots. Text arrives in arbitrary chunks so a stop sequence may be
+// split across them, we hold back any trailing text that could be the start
+// of a stop sequence until the next chunk tells us whether it is. Once a stop
+// sequence is seen everything from it onward is dropped. Call Flush at the
+// end of the stream to get any held back text.
+type StopSequenceFilter struct {
+	Stops []string
+
+	pending string
+	stopped bool
+}
+
+func NewStopSequenceFilter(stops []string) *StopSequenceFilter {
+	return &StopSequenceFilter{Stops: stops}
+}
+
+// Add a chunk of text, returns the text that's safe to output and whether
+// a stop sequence has been reached
+func (this *StopSequenceFilter) Filter(text string) (string, bool) {
+	if this.stopped {
+		return "", true
+	}
+
+	text = this.pending + text
+	this.pending = ""
+
+	if index := indexOfStop(text, this.Stops); index != -1 {
+		this.stopped = true
+		return text[:index], true
+	}
+
+	hold := longestStopPrefixSuffix(text, this.Stops)
+	this.pending = text[len(text)-hold:]
+	return text[:len(text)-hold], false
+}
+
+// Return any text held back at the end of the stream
+func (this *StopSequenceFilter) Flush() string {
+	pending := this.pending
+	this.pending = ""
+	return pending
+}
+
+// Whether a stop sequence has been reached
+func (this *StopSequenceFilter) Stopped() bool {
+	return this.stopped
+}
+
+// Cut text at the first stop sequence, returns the text before it and
+// whether a stop sequence was found
+func TruncateAtStop(text string, stops []string) (string, bool) {
+	index := indexOfStop(text, stops)
+	if index == -1 {
+		return text, false
+	}
+	return text[:index], true
+}
+
+// Index of the earliest stop sequence in text, or -1
+func indexOfStop(text string, stops []string) int {
+	first := -1
+	for _, stop := range stops {
+		if stop == "" {
+			continue
+		}
+		index := strings.Index(text, stop)
+		if index != -1 && (first == -1 || index < first) {
+			first = index
+		}
+	}
+	return first
+}
+
+// Length of the longest suffix of text that's a proper prefix of one of the
+// stop sequences
+func longestStopPrefixSuffix(text string, stops []string) int {
+	longest := 0
+	for _, stop := range stops {
+		for n := len(stop) - 1; n > longest; n-- {
+			if strings.HasSuffix(text, stop[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
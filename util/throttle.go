@@ -0,0 +1,110 @@
+package util
+
+import (
+	"context"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// Output is paced in chunks of about this long rather than a character at a
+// time, about one chunk per frame the terminal draws
+const throttleTick = 16 * time.Millisecond
+
+// ThrottledWriter paces streamed text to at most CharsPerSecond characters
+// per second, so that a very fast stream is displayed smoothly rather than
+// flooding the terminal. Time spent waiting for the stream isn't saved up,
+// so a slow stream is written as it arrives. If Ctx is cancelled then the
+// rest of the text is written at once. A CharsPerSecond of 0 or less
+// disables pacing. Flush and WriteFunctionCall are passed through to Writer.
+type ThrottledWriter struct {
+	Writer         io.Writer
+	CharsPerSecond int
+	Ctx            context.Context
+
+	// when the next chunk may be written
+	next time.Time
+	// replaced by tests to control time
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func NewThrottledWriter(ctx context.Context, writer io.Writer, charsPerSecond int) *ThrottledWriter {
+	return &ThrottledWriter{
+		Writer:         writer,
+		CharsPerSecond: charsPerSecond,
+		Ctx:            ctx,
+		now:            time.Now,
+		sleep:          sleepContext,
+	}
+}
+
+func (this *ThrottledWriter) Write(p []byte) (int, error) {
+	ctx := this.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if this.CharsPerSecond <= 0 || ctx.Err() != nil {
+		return this.Writer.Write(p)
+	}
+
+	chunkChars := this.CharsPerSecond * int(throttleTick) / int(time.Second)
+	if chunkChars < 1 {
+		chunkChars = 1
+	}
+	chunkTime := time.Duration(chunkChars) * time.Second / time.Duration(this.CharsPerSecond)
+
+	written := 0
+	for written < len(p) {
+		now := this.now()
+		if this.next.Before(now) {
+			this.next = now
+		}
+		if wait := this.next.Sub(now); wait > 0 {
+			if this.sleep(ctx, wait) != nil {
+				// cancelled, finish without pacing
+				n, err := this.Writer.Write(p[written:])
+				return written + n, err
+			}
+		}
+
+		end := written
+		for i := 0; i < chunkChars && end < len(p); i++ {
+			_, size := utf8.DecodeRune(p[end:])
+			end += size
+		}
+
+		n, err := this.Writer.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		this.next = this.next.Add(chunkTime)
+	}
+
+	return written, nil
+}
+
+func (this *ThrottledWriter) WriteFunctionCall(p []byte) (int, error) {
+	return WriteFunctionCall(this.Writer, p)
+}
+
+func (this *ThrottledWriter) Flush() error {
+	if flusher, ok := this.Writer.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Sleep for d, returning early with the context's error if it's cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
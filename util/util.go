@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -23,17 +24,33 @@ import (
 // We define types for calling LLM APIs here because I don't want the internal
 // interfaces to depend on OpenAI-specific types.
 type CompletionRequest struct {
-	Ctx           context.Context
-	Prompt        string
-	Model         string
-	MaxTokens     int
-	Temperature   float32
+	Ctx         context.Context
+	Prompt      string
+	Model       string
+	MaxTokens   int
+	Temperature float32
+	// Nucleus sampling, only tokens in the top TopP of probability mass are
+	// considered, 0 means use the API default
+	TopP float32
+	// Sequences at which generation stops, the stop sequence itself isn't
+	// included in the completion
+	Stop          []string
 	HistoryBlocks []HistoryBlock
+	// Instructions sent in the system role, ahead of the history and prompt.
+	// Required by chat models, ignored by instruct completion models.
 	SystemMessage string
 	Functions     []FunctionDefinition
 	Tools         []ToolDefinition
 	Verbose       bool
 	TokenTimeout  time.Duration
+	// Deadline for the whole request, 0 means no deadline beyond Ctx
+	Timeout time.Duration
+	// Name of the feature making the request, e.g. summarize, reported with
+	// its token usage
+	Feature string
+	// Number of candidate completions to generate, used by CompletionN. 0 or
+	// 1 means one.
+	N int
 }
 
 type FunctionCall struct {
@@ -52,6 +69,64 @@ type CompletionResponse struct {
 	FunctionName       string
 	FunctionParameters string
 	ToolCalls          []*ToolCall
+
+	// Every candidate completion when more than one was requested with N,
+	// Completion is the first of them
+	Choices []string
+
+	// Tokens used by the request as reported by the API, or estimated if
+	// UsageEstimated is set, e.g. for streamed responses
+	PromptTokens     int
+	CompletionTokens int
+	UsageEstimated   bool
+
+	// Why the model stopped, e.g. FinishReasonStop or FinishReasonLength,
+	// empty if the backend didn't say
+	FinishReason string
+}
+
+// Reasons a completion finished, as reported by the API
+const (
+	FinishReasonStop          = "stop"
+	FinishReasonLength        = "length"
+	FinishReasonFunctionCall  = "function_call"
+	FinishReasonToolCalls     = "tool_calls"
+	FinishReasonContentFilter = "content_filter"
+)
+
+// Return the function the model called, either through the function calling
+// API or as the first function tool call, or nil if it didn't call one
+func (this *CompletionResponse) CalledFunction() *FunctionCall {
+	if this.FunctionName != "" {
+		return &FunctionCall{
+			Name:       this.FunctionName,
+			Parameters: this.FunctionParameters,
+		}
+	}
+
+	for _, toolCall := range this.ToolCalls {
+		if (toolCall.Type == "" || toolCall.Type == "function") && toolCall.Function.Name != "" {
+			return &toolCall.Function
+		}
+	}
+
+	return nil
+}
+
+// A writer that shows a streamed function call differently from the text of
+// a completion, e.g. in another color. LLM clients stream function names and
+// arguments through WriteFunctionCall when the writer implements it.
+type FunctionCallWriter interface {
+	WriteFunctionCall(p []byte) (int, error)
+}
+
+// Write part of a streamed function call, using WriteFunctionCall if the
+// writer distinguishes function calls and Write otherwise
+func WriteFunctionCall(writer io.Writer, p []byte) (int, error) {
+	if callWriter, ok := writer.(FunctionCallWriter); ok {
+		return callWriter.WriteFunctionCall(p)
+	}
+	return writer.Write(p)
 }
 
 type FunctionDefinition struct {
@@ -116,11 +191,12 @@ func ChunkFromReader(
 	maxChunks int,
 	callback func(int, []byte) error) error {
 
-	buf := make([]byte, chunkSize)
-
 	for i := 0; i < maxChunks || maxChunks == -1; i++ {
-		n, err := reader.Read(buf)
-		if err != nil && err != io.EOF {
+		// each chunk gets its own buffer since callers may keep them, and we
+		// read a full chunk so that chunk i always starts at i*chunkSize
+		buf := make([]byte, chunkSize)
+		n, err := io.ReadFull(reader, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			return err
 		}
 		if n == 0 {
@@ -240,6 +316,52 @@ func (this *CacheWriter) GetLastN(n int) []byte {
 	return this.cache[len(this.cache)-n:]
 }
 
+// A writer that copies a stream to Tee as it's written to Writer, e.g. to
+// log a streamed answer to a file while Writer styles it for the terminal.
+// Unlike io.MultiWriter, Tee gets the raw text before any styling or
+// filtering, streamed function calls reach both writers through
+// WriteFunctionCall, and Flush flushes Writer. An error from Tee doesn't stop
+// Writer from getting the rest of the stream, the first one is returned by
+// Flush.
+type TeeWriter struct {
+	Writer io.Writer
+	Tee    io.Writer
+	teeErr error
+}
+
+func NewTeeWriter(writer, tee io.Writer) *TeeWriter {
+	return &TeeWriter{Writer: writer, Tee: tee}
+}
+
+func (this *TeeWriter) Write(p []byte) (int, error) {
+	this.tee(this.Tee.Write, p)
+	return this.Writer.Write(p)
+}
+
+func (this *TeeWriter) WriteFunctionCall(p []byte) (int, error) {
+	this.tee(func(p []byte) (int, error) { return WriteFunctionCall(this.Tee, p) }, p)
+	return WriteFunctionCall(this.Writer, p)
+}
+
+func (this *TeeWriter) tee(write func([]byte) (int, error), p []byte) {
+	if this.teeErr != nil {
+		return
+	}
+	_, this.teeErr = write(p)
+}
+
+// Flush Writer if it holds back output, e.g. a StyledWriter or
+// WordWrapWriter, and return any error from writing to Tee
+func (this *TeeWriter) Flush() error {
+	if flusher, ok := this.Writer.(interface{ Flush() error }); ok {
+		err := flusher.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return this.teeErr
+}
+
 const (
 	STATE_NORMAL = iota
 	STATE_NEWLINE
@@ -475,7 +597,7 @@ func (this *StyleCodeblocksWriter) EndOfCodeLine(w io.Writer) error {
 	err := quick.Highlight(temp, blockBufferString,
 		this.langSuffix.String(), "terminal256", "monokai")
 	if err != nil {
-		log.Printf("error highlighting code block: %s", err)
+		DefaultLogger().Warnf("Error highlighting code block: %s", err)
 	}
 
 	last := lastLine(temp, 0)
@@ -506,7 +628,7 @@ func (this *StyleCodeblocksWriter) EndOfCodeBlock(w io.Writer) error {
 	// render block
 	err := quick.Highlight(w, this.blockBuffer.String(), this.langSuffix.String(), "terminal256", "monokai")
 	if err != nil {
-		log.Printf("error highlighting code block: %s", err)
+		DefaultLogger().Warnf("Error highlighting code block: %s", err)
 	}
 	return err
 }
@@ -602,17 +724,28 @@ func (this *ColorWriter) Write(p []byte) (n int, err error) {
 // An implementation of io.Writer that renders output with a lipgloss style
 // and filters out the special token "NOOP". This is specially handled -
 // we seem to get "NO" as a separate token from GPT.
+// Carriage returns and CSI escape sequences (cursor movement, line erases,
+// colors) are written through unstyled so progress bars render correctly.
+// Call Flush to write an escape sequence still held back at the end.
 type StyledWriter struct {
-	Writer    io.Writer
-	Style     lipgloss.Style
-	cache     []byte
-	seenInput bool
+	Writer        io.Writer
+	Style         lipgloss.Style
+	cache         []byte
+	seenInput     bool
+	partialEscape []byte
 }
 
+// Carriage returns and CSI escape sequences, which we don't style
+var terminalControlRegexp = regexp.MustCompile("\r|\x1b\\[[\x30-\x3f]*[\x20-\x2f]*[\x40-\x7e]")
+
+// A CSI escape sequence that was cut off at the end of a write
+var partialEscapeRegexp = regexp.MustCompile("\x1b(\\[[\x30-\x3f]*[\x20-\x2f]*)?$")
+
 // Lipgloss is a little tricky - if you render a string with newlines it
 // turns it into a "block", i.e. each line will be padding to be the same
 // length. This is not what we want, so we split on newlines and render
-// each line separately.
+// each line separately. Carriage returns and escape sequences are written
+// between the styled runs of text rather than being rendered by lipgloss.
 func MultilineLipglossRender(style lipgloss.Style, str string) string {
 	strBuilder := strings.Builder{}
 	for i, line := range strings.Split(str, "\n") {
@@ -620,9 +753,17 @@ func MultilineLipglossRender(style lipgloss.Style, str string) string {
 			strBuilder.WriteString("\n")
 		}
 
-		if len(line) > 0 {
-			rendered := style.Render(line)
-			strBuilder.WriteString(rendered)
+		last := 0
+		for _, loc := range terminalControlRegexp.FindAllStringIndex(line, -1) {
+			if loc[0] > last {
+				strBuilder.WriteString(style.Render(line[last:loc[0]]))
+			}
+			strBuilder.WriteString(line[loc[0]:loc[1]])
+			last = loc[1]
+		}
+
+		if last < len(line) {
+			strBuilder.WriteString(style.Render(line[last:]))
 		}
 	}
 
@@ -633,25 +774,30 @@ func MultilineLipglossRender(style lipgloss.Style, str string) string {
 // This is a bit insane but it's a dumb way to filter out NOOP split into
 // two tokens, should probably be rewritten
 func (this *StyledWriter) Write(input []byte) (int, error) {
+	if len(input) == 0 {
+		return 0, nil
+	}
+	inputLen := len(input)
+
 	if !this.seenInput && unicode.IsSpace(rune(input[0])) {
-		return len(input), nil
+		return inputLen, nil
 	}
 	this.seenInput = true
 
 	if string(input) == "NOOP" {
 		// This doesn't seem to actually happen since it gets split into two
 		// tokens? but let's code defensively
-		return len(input), nil
+		return inputLen, nil
 	}
 
 	if string(input) == "NO" {
 		this.cache = input
-		return len(input), nil
+		return inputLen, nil
 	}
 	if string(input) == "OP" && this.cache != nil {
 		// We have a NOOP, discard it
 		this.cache = nil
-		return len(input), nil
+		return inputLen, nil
 	}
 
 	if this.cache != nil {
@@ -659,18 +805,42 @@ func (this *StyledWriter) Write(input []byte) (int, error) {
 		this.cache = nil
 	}
 
-	str := string(input)
-	rendered := MultilineLipglossRender(this.Style, str)
-	renderedBytes := []byte(rendered)
+	// hold back an escape sequence split across writes so that its pieces
+	// aren't styled as text
+	if this.partialEscape != nil {
+		input = append(this.partialEscape, input...)
+		this.partialEscape = nil
+	}
+	if loc := partialEscapeRegexp.FindIndex(input); loc != nil {
+		this.partialEscape = append([]byte{}, input[loc[0]:]...)
+		input = input[:loc[0]]
+	}
 
-	_, err := this.Writer.Write(renderedBytes)
+	err := this.render(string(input))
 	if err != nil {
 		return 0, err
 	}
-	// use len(input) rather than len(renderedBytes) because it would be unexpected to get
-	// a different number of bytes written than were passed in, (lipgloss
-	// render adds ANSI codes)
-	return len(input), nil
+	// use the input length rather than len(renderedBytes) because it would be
+	// unexpected to get a different number of bytes written than were passed
+	// in, (lipgloss render adds ANSI codes)
+	return inputLen, nil
+}
+
+func (this *StyledWriter) render(str string) error {
+	if str == "" {
+		return nil
+	}
+
+	rendered := MultilineLipglossRender(this.Style, str)
+	_, err := this.Writer.Write([]byte(rendered))
+	return err
+}
+
+// Write any partial escape sequence still being held by the writer
+func (this *StyledWriter) Flush() error {
+	str := string(this.partialEscape)
+	this.partialEscape = nil
+	return this.render(str)
 }
 
 func NewStyledWriter(writer io.Writer, style lipgloss.Style) *StyledWriter {
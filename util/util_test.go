@@ -2,10 +2,15 @@ package util
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/charmbracelet/lipgloss"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -132,3 +137,320 @@ Foo`
 	// assert buffer equals expected
 	assert.Equal(t, expected, buffer.String())
 }
+
+func TestLoggerLevels(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	logger := NewLogger(LogLevelWarn, buffer)
+
+	logger.Debugf("debug %d", 1)
+	logger.Infof("info %d", 2)
+	logger.Warnf("warn %d", 3)
+	logger.Errorf("error %d", 4)
+
+	output := buffer.String()
+	assert.NotContains(t, output, "debug 1")
+	assert.NotContains(t, output, "info 2")
+	assert.Contains(t, output, "WARN warn 3")
+	assert.Contains(t, output, "ERROR error 4")
+
+	buffer.Reset()
+	logger.Level = LogLevelDebug
+	logger.Debugf("now visible")
+	assert.Contains(t, buffer.String(), "DEBUG now visible")
+
+	// a nil logger logs through the default
+	buffer.Reset()
+	SetDefaultLogger(NewLogger(LogLevelInfo, buffer))
+	defer SetDefaultLogger(nil)
+	var nilLogger *Logger
+	nilLogger.Debugf("dropped")
+	nilLogger.Infof("through the default")
+	assert.NotContains(t, buffer.String(), "dropped")
+	assert.Contains(t, buffer.String(), "INFO through the default")
+}
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := ParseLogLevel("debug")
+	assert.NoError(t, err)
+	assert.Equal(t, LogLevelDebug, level)
+
+	level, err = ParseLogLevel("WARNING")
+	assert.NoError(t, err)
+	assert.Equal(t, LogLevelWarn, level)
+
+	_, err = ParseLogLevel("loud")
+	assert.Error(t, err)
+}
+
+func wrapChunks(width int, chunks ...string) string {
+	buffer := new(bytes.Buffer)
+	writer := NewWordWrapWriter(buffer, width)
+	for _, chunk := range chunks {
+		writer.Write([]byte(chunk))
+	}
+	writer.Flush()
+	return buffer.String()
+}
+
+func TestWordWrapWriter(t *testing.T) {
+	// words split across chunks are wrapped as a whole
+	assert.Equal(t, "The quick\nbrown fox\njumps over\nthe lazy\ndog",
+		wrapChunks(10, "The qu", "ick brown f", "ox jumps over the lazy dog"))
+
+	// newlines and indentation from the model are preserved
+	assert.Equal(t, "short\n\nlines\n  indented\ntext here",
+		wrapChunks(10, "short\n\nlines\n  indented text here"))
+
+	// ANSI codes don't count toward the width
+	assert.Equal(t, "\x1b[38;5;221mcolored\x1b[0m\nwords wrap\nnicely",
+		wrapChunks(10, "\x1b[38;5;221mcolored\x1b[0m words ", "wrap nicely"))
+
+	// long words get their own line, runes count as one column
+	assert.Equal(t, "supercalifragilistic\nis\nlong",
+		wrapChunks(5, "supercalifragilistic is long"))
+	assert.Equal(t, "héllo\nwörld", wrapChunks(6, "hé", "llo wö", "rld"))
+
+	// wide characters count as two columns, even when a chunk splits a rune
+	assert.Equal(t, "日本 語\n中文", wrapChunks(7, "日本 語 中\xe6", "\x96\x87"))
+	assert.Equal(t, "ok 🎉🎉\nparty", wrapChunks(8, "ok 🎉🎉 party"))
+
+	// a width of 0 disables wrapping
+	assert.Equal(t, "no wrapping at all here", wrapChunks(0, "no wrapping at all here"))
+}
+
+func TestStopSequenceFilter(t *testing.T) {
+	filter := NewStopSequenceFilter([]string{"\n", "END"})
+
+	// "E" could be the start of END so it's held back
+	text, stopped := filter.Filter("hello E")
+	assert.Equal(t, "hello ", text)
+	assert.False(t, stopped)
+
+	// which completes END, so we stop before it
+	text, stopped = filter.Filter("ND")
+	assert.Equal(t, "", text)
+	assert.True(t, stopped)
+	assert.True(t, filter.Stopped())
+
+	// nothing more comes through once stopped
+	text, stopped = filter.Filter("more")
+	assert.Equal(t, "", text)
+	assert.True(t, stopped)
+
+	filter = NewStopSequenceFilter([]string{"END"})
+	text, _ = filter.Filter("the EN")
+	assert.Equal(t, "the ", text)
+	text, _ = filter.Filter("TRY")
+	assert.Equal(t, "ENTRY", text)
+	text, _ = filter.Filter(" E")
+	assert.Equal(t, " ", text)
+	assert.Equal(t, "E", filter.Flush())
+	assert.False(t, filter.Stopped())
+
+	// the earliest stop sequence wins
+	truncated, found := TruncateAtStop("a END b\nc", []string{"\n", "END"})
+	assert.Equal(t, "a ", truncated)
+	assert.True(t, found)
+
+	truncated, found = TruncateAtStop("abc", []string{"\n"})
+	assert.Equal(t, "abc", truncated)
+	assert.False(t, found)
+}
+
+// Write each chunk to a StyledWriter that upper cases text, so we can see
+// what was styled, and return the output
+func styleChunks(chunks ...string) string {
+	out := &bytes.Buffer{}
+	style := lipgloss.NewStyle().Transform(strings.ToUpper)
+	writer := NewStyledWriter(out, style)
+
+	for _, chunk := range chunks {
+		writer.Write([]byte(chunk))
+	}
+	writer.Flush()
+
+	return out.String()
+}
+
+func TestStyledWriterCarriageReturns(t *testing.T) {
+	// carriage returns and escapes are written through around styled text
+	assert.Equal(t, "10%\r50%\r\x1b[KDONE\n",
+		styleChunks("10%\r50%\r\x1b[Kdone\n"))
+	assert.Equal(t, "DL 10%\r\x1b[2KDL 50%\x1b[1A",
+		styleChunks("dl 10%\r\x1b[2Kdl 50%\x1b[1A"))
+
+	// an escape split across writes isn't styled as text
+	assert.Equal(t, "A\x1b[32mB\x1b[0m",
+		styleChunks("a\x1b[3", "2mb\x1b", "[0m"))
+
+	// empty writes are ignored
+	assert.Equal(t, "", styleChunks("", ""))
+}
+
+type failingWriter struct{}
+
+func (this failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// A writer that marks function calls so we can tell them apart
+type functionMarkingWriter struct {
+	bytes.Buffer
+}
+
+func (this *functionMarkingWriter) WriteFunctionCall(p []byte) (int, error) {
+	return this.WriteString("<" + string(p) + ">")
+}
+
+func TestTeeWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	tee := &functionMarkingWriter{}
+	styled := NewStyledWriter(out, lipgloss.NewStyle().Transform(strings.ToUpper))
+	writer := NewTeeWriter(styled, tee)
+
+	chunks := []string{"Hello", " wor", "ld\nsecond", " line"}
+	for _, chunk := range chunks {
+		n, err := writer.Write([]byte(chunk))
+		assert.NoError(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+	WriteFunctionCall(writer, []byte("run()"))
+
+	assert.NoError(t, writer.Flush())
+	assert.Equal(t, "HELLO WORLD\nSECOND LINERUN()", out.String())
+	assert.Equal(t, "Hello world\nsecond line<run()>", tee.String())
+
+	// a failing tee doesn't interrupt the display
+	out.Reset()
+	writer = NewTeeWriter(out, failingWriter{})
+	_, err := writer.Write([]byte("one "))
+	assert.NoError(t, err)
+	_, err = writer.Write([]byte("two"))
+	assert.NoError(t, err)
+	assert.Equal(t, "one two", out.String())
+	assert.ErrorContains(t, writer.Flush(), "disk full")
+}
+
+// A clock for ThrottledWriter where sleeping advances time immediately
+type fakeThrottleClock struct {
+	now    time.Time
+	sleeps []time.Duration
+	// called on each sleep, e.g. to cancel the context part way through
+	onSleep func()
+}
+
+func (this *fakeThrottleClock) Now() time.Time {
+	return this.now
+}
+
+func (this *fakeThrottleClock) Sleep(ctx context.Context, d time.Duration) error {
+	if this.onSleep != nil {
+		this.onSleep()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	this.sleeps = append(this.sleeps, d)
+	this.now = this.now.Add(d)
+	return nil
+}
+
+// Records each write separately
+type chunkWriter struct {
+	chunks []string
+}
+
+func (this *chunkWriter) Write(p []byte) (int, error) {
+	this.chunks = append(this.chunks, string(p))
+	return len(p), nil
+}
+
+func newFakeThrottledWriter(ctx context.Context, writer io.Writer, charsPerSecond int) (*ThrottledWriter, *fakeThrottleClock) {
+	clock := &fakeThrottleClock{now: time.Unix(1700000000, 0)}
+	throttled := NewThrottledWriter(ctx, writer, charsPerSecond)
+	throttled.now = clock.Now
+	throttled.sleep = clock.Sleep
+	return throttled, clock
+}
+
+func TestThrottledWriter(t *testing.T) {
+	// 1000 characters per second is written in chunks of 16 every 16ms
+	out := &chunkWriter{}
+	writer, clock := newFakeThrottledWriter(context.Background(), out, 1000)
+	text := strings.Repeat("abcdefgh", 20)
+	n, err := writer.Write([]byte(text))
+	assert.NoError(t, err)
+	assert.Equal(t, len(text), n)
+	assert.Equal(t, text, strings.Join(out.chunks, ""))
+	assert.Equal(t, 10, len(out.chunks))
+	assert.Equal(t, 16, len(out.chunks[0]))
+
+	// the first chunk is written immediately and nothing waits after the
+	// last, so 160 characters take 144ms
+	assert.Equal(t, 9, len(clock.sleeps))
+	for _, sleep := range clock.sleeps {
+		assert.Equal(t, 16*time.Millisecond, sleep)
+	}
+
+	// the pace carries on across writes
+	_, err = writer.Write([]byte("x"))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, len(clock.sleeps))
+
+	// time waiting for the stream isn't saved up for a burst
+	clock.now = clock.now.Add(time.Second)
+	_, err = writer.Write([]byte(strings.Repeat("y", 32)))
+	assert.NoError(t, err)
+	assert.Equal(t, 11, len(clock.sleeps))
+	assert.Equal(t, text+"x"+strings.Repeat("y", 32), strings.Join(out.chunks, ""))
+
+	// characters aren't split
+	out = &chunkWriter{}
+	writer, _ = newFakeThrottledWriter(context.Background(), out, 62)
+	_, err = writer.Write([]byte("héllo"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"h", "é", "l", "l", "o"}, out.chunks)
+
+	// 0 disables pacing
+	out = &chunkWriter{}
+	writer, clock = newFakeThrottledWriter(context.Background(), out, 0)
+	_, err = writer.Write([]byte(text))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{text}, out.chunks)
+	assert.Empty(t, clock.sleeps)
+}
+
+// Cancelling the context writes the rest of the text without waiting
+func TestThrottledWriterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	out := &chunkWriter{}
+	writer, clock := newFakeThrottledWriter(ctx, out, 1000)
+	clock.onSleep = func() {
+		if len(clock.sleeps) == 2 {
+			cancel()
+		}
+	}
+
+	text := strings.Repeat("abcdefgh", 20)
+	n, err := writer.Write([]byte(text))
+	assert.NoError(t, err)
+	assert.Equal(t, len(text), n)
+	assert.Equal(t, text, strings.Join(out.chunks, ""))
+	assert.Equal(t, 4, len(out.chunks))
+	assert.Equal(t, 2, len(clock.sleeps))
+
+	// later writes aren't paced
+	_, err = writer.Write([]byte(text))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(out.chunks))
+	assert.Equal(t, 2, len(clock.sleeps))
+
+	// flushes reach the wrapped writer
+	buffer := new(bytes.Buffer)
+	wrapped := NewWordWrapWriter(buffer, 80)
+	writer, _ = newFakeThrottledWriter(context.Background(), wrapped, 1000)
+	writer.Write([]byte("hello world"))
+	assert.Equal(t, "hello", buffer.String())
+	assert.NoError(t, writer.Flush())
+	assert.Equal(t, "hello world", buffer.String())
+}
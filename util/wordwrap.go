@@ -0,0 +1,153 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/mattn/go-runewidth"
+)
+
+const (
+	escapeNone = iota
+	escapeStart
+	escapeCSI
+)
+
+// WordWrapWriter wraps streamed text at word boundaries so lines fit in Width
+// columns. The current word is buffered until we know whether it fits, so
+// call Flush at the end of the stream. Escape sequences take no columns, wide
+// characters take two, and overlong words get a line to themselves.
+type WordWrapWriter struct {
+	Writer io.Writer
+	Width  int
+
+	space      bytes.Buffer
+	spaceWidth int
+	word       bytes.Buffer
+	// the word without escape sequences, measured once the word is complete
+	// since a chunk can end partway through a rune
+	wordText    bytes.Buffer
+	column      int
+	escapeState int
+	lock        sync.Mutex
+}
+
+// Create a writer that wraps at width columns, a width of 0 or less disables
+// wrapping
+func NewWordWrapWriter(writer io.Writer, width int) *WordWrapWriter {
+	return &WordWrapWriter{
+		Writer: writer,
+		Width:  width,
+	}
+}
+
+func (this *WordWrapWriter) SetWidth(width int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.Width = width
+}
+
+func (this *WordWrapWriter) Write(p []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.Width <= 0 {
+		return this.Writer.Write(p)
+	}
+
+	out := new(bytes.Buffer)
+
+	for _, char := range p {
+		switch {
+		case this.escapeState == escapeStart:
+			this.word.WriteByte(char)
+			if char == '[' {
+				this.escapeState = escapeCSI
+			} else {
+				this.escapeState = escapeNone
+			}
+
+		case this.escapeState == escapeCSI:
+			// CSI sequences end with a byte in the range @ to ~
+			this.word.WriteByte(char)
+			if char >= 0x40 && char <= 0x7E {
+				this.escapeState = escapeNone
+			}
+
+		case char == 0x1b:
+			this.word.WriteByte(char)
+			this.escapeState = escapeStart
+
+		case char == '\n':
+			this.flushWord(out)
+			// trailing whitespace is dropped
+			this.space.Reset()
+			this.spaceWidth = 0
+			out.WriteByte(char)
+			this.column = 0
+
+		case char == ' ' || char == '\t':
+			this.flushWord(out)
+			width := 1
+			if char == '\t' {
+				width = 8 - (this.column+this.spaceWidth)%8
+			}
+			this.space.WriteByte(char)
+			this.spaceWidth += width
+
+		default:
+			this.word.WriteByte(char)
+			this.wordText.WriteByte(char)
+		}
+	}
+
+	_, err := this.Writer.Write(out.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Write any buffered partial word, e.g. at the end of a stream
+func (this *WordWrapWriter) Flush() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	out := new(bytes.Buffer)
+	this.flushWord(out)
+	if this.column+this.spaceWidth <= this.Width {
+		out.Write(this.space.Bytes())
+		this.column += this.spaceWidth
+	}
+	this.space.Reset()
+	this.spaceWidth = 0
+
+	_, err := this.Writer.Write(out.Bytes())
+	return err
+}
+
+// Write the buffered whitespace and word, or break the line and drop the
+// whitespace if the word won't fit
+func (this *WordWrapWriter) flushWord(out *bytes.Buffer) {
+	if this.word.Len() == 0 {
+		return
+	}
+
+	wordWidth := runewidth.StringWidth(this.wordText.String())
+	if wordWidth > 0 && this.column > 0 &&
+		this.column+this.spaceWidth+wordWidth > this.Width {
+		out.WriteByte('\n')
+		this.column = 0
+	} else {
+		out.Write(this.space.Bytes())
+		this.column += this.spaceWidth
+	}
+	this.space.Reset()
+	this.spaceWidth = 0
+
+	out.Write(this.word.Bytes())
+	this.column += wordWidth
+	this.word.Reset()
+	this.wordText.Reset()
+}